@@ -0,0 +1,400 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+const (
+	DefaultSize = 10000
+
+	// how long any answer is kept at most, whatever its TTL
+	DefaultMaxTtl = 24 * time.Hour
+
+	// how long a negative answer is kept at most (RFC 2308, section 5)
+	DefaultMaxNegativeTtl = 3 * time.Hour
+
+	// the TTL of the records of expired answers (RFC 8767, section 4)
+	StaleTtl = 30
+
+	/*
+	   An answer is prefetched once it was served prefetchHits
+	   times and less than a tenth of its TTL remains.
+	*/
+	prefetchHits     = 3
+	prefetchFraction = 10
+
+	// the number of independently locked parts of the cache
+	shardCount = 16
+)
+
+/*
+Cache keeps the results of the queries resolved by other servers, keyed
+by the name, type and class of their question, until their records
+expire.
+*/
+type Cache interface {
+	/*
+	   Returns the cached result of the question, the TTLs of
+	   its records lowered by the time it spent in the cache,
+	   and false if there is none.
+	*/
+	Get(question *zonefiles.QueryQuestion) (*zonefiles.QueryResult, bool)
+
+	/*
+	   Returns the result of the question that expired less
+	   than the stale window ago, the TTLs of its records set
+	   to StaleTtl, to be served when the servers having the
+	   answer can't be reached (RFC 8767).
+	*/
+	GetStale(question *zonefiles.QueryQuestion) (*zonefiles.QueryResult, bool)
+
+	/*
+	   Reports whether the result of the question is popular
+	   and about to expire, in which case it should be resolved
+	   again and put back before it does. It is reported once
+	   per result, and never if prefetching is disabled.
+	*/
+	NeedsPrefetch(question *zonefiles.QueryQuestion) bool
+
+	/*
+	   Caches the result of the question for as long as the
+	   TTLs of its records allow. Results that must not be
+	   cached, such as server failures, are ignored.
+	*/
+	Put(question *zonefiles.QueryQuestion, result *zonefiles.QueryResult)
+
+	Stats() Stats
+}
+
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+
+	// the results dropped to make room for new ones
+	Evictions uint64
+
+	// the expired results served and the results reported for prefetch
+	StaleHits  uint64
+	Prefetches uint64
+
+	// the number of cached results
+	Entries int
+}
+
+type entry struct {
+	key    string
+	result *zonefiles.QueryResult
+	stored time.Time
+
+	// when the first record of the result expires
+	expires time.Time
+
+	// the times the result was served and whether a prefetch was reported
+	hits        int
+	prefetching bool
+}
+
+/*
+shard holds a part of the entries in a map for lookups and in a list
+ordered from the most to the least recently used for eviction.
+*/
+type shard struct {
+	lock     sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	capacity int
+}
+
+type responseCache struct {
+	shards [shardCount]shard
+
+	maxTtl         time.Duration
+	maxNegativeTtl time.Duration
+
+	// how long expired results are kept to be served stale
+	staleWindow time.Duration
+	prefetch    bool
+
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	evictions  atomic.Uint64
+	staleHits  atomic.Uint64
+	prefetches atomic.Uint64
+}
+
+/*
+NewCache returns a cache holding up to size results, spread over shards
+that are locked on their own so that concurrent queries seldom wait for
+each other. A zero size or maximum TTL stands for its default value.
+Expired results are kept for staleWindow, no stale results are served
+if it is zero.
+*/
+func NewCache(size int, maxTtl time.Duration, maxNegativeTtl time.Duration, staleWindow time.Duration, prefetch bool) Cache {
+	if size == 0 {
+		size = DefaultSize
+	}
+	if maxTtl == 0 {
+		maxTtl = DefaultMaxTtl
+	}
+	if maxNegativeTtl == 0 {
+		maxNegativeTtl = DefaultMaxNegativeTtl
+	}
+
+	c := &responseCache{maxTtl: maxTtl, maxNegativeTtl: maxNegativeTtl, staleWindow: staleWindow, prefetch: prefetch}
+	capacity := (size + shardCount - 1) / shardCount
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]*list.Element)
+		c.shards[i].lru = list.New()
+		c.shards[i].capacity = capacity
+	}
+	return c
+}
+
+// names differing only in case are the same name (RFC 4343)
+func cacheKey(question *zonefiles.QueryQuestion) string {
+	name := strings.ToLower(question.QName)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return fmt.Sprintf("%s/%d/%d", name, question.Qtype, question.Qclass)
+}
+
+func (c *responseCache) shard(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.shards[h.Sum32()%shardCount]
+}
+
+/*
+lookup returns the entry of the key, removing it if it expired longer
+than the stale window ago. The shard must be locked.
+*/
+func (c *responseCache) lookup(s *shard, key string, now time.Time) *entry {
+	elem, found := s.entries[key]
+	if !found {
+		return nil
+	}
+	e := elem.Value.(*entry)
+	if !now.Before(e.expires.Add(c.staleWindow)) {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return e
+}
+
+func (c *responseCache) Get(question *zonefiles.QueryQuestion) (*zonefiles.QueryResult, bool) {
+	key := cacheKey(question)
+	s := c.shard(key)
+	now := time.Now()
+
+	s.lock.Lock()
+	e := c.lookup(s, key, now)
+	if e == nil || !now.Before(e.expires) {
+		s.lock.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	e.hits++
+	s.lock.Unlock()
+
+	c.hits.Add(1)
+	return e.served(now, false), true
+}
+
+func (c *responseCache) GetStale(question *zonefiles.QueryQuestion) (*zonefiles.QueryResult, bool) {
+	key := cacheKey(question)
+	s := c.shard(key)
+
+	s.lock.Lock()
+	e := c.lookup(s, key, time.Now())
+	s.lock.Unlock()
+	if e == nil {
+		return nil, false
+	}
+	c.staleHits.Add(1)
+	return e.served(time.Now(), true), true
+}
+
+func (c *responseCache) NeedsPrefetch(question *zonefiles.QueryQuestion) bool {
+	if !c.prefetch {
+		return false
+	}
+	key := cacheKey(question)
+	s := c.shard(key)
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e := c.lookup(s, key, now)
+	if e == nil || e.prefetching || e.hits < prefetchHits {
+		return false
+	}
+	remaining, ttl := e.expires.Sub(now), e.expires.Sub(e.stored)
+	if remaining <= 0 || remaining > ttl/prefetchFraction {
+		return false
+	}
+	e.prefetching = true
+	c.prefetches.Add(1)
+	return true
+}
+
+/*
+served returns a copy of the result with the TTLs of its records lowered
+by the time it spent in the cache, or set to StaleTtl if it is served
+stale.
+*/
+func (e *entry) served(now time.Time, stale bool) *zonefiles.QueryResult {
+	elapsed := uint(now.Sub(e.stored) / time.Second)
+	age := func(records []*zonefiles.ResourceRecord) []*zonefiles.ResourceRecord {
+		aged := make([]*zonefiles.ResourceRecord, 0, len(records))
+		for _, rrPtr := range records {
+			ttl := uint(0)
+			if stale {
+				ttl = StaleTtl
+			} else if (*rrPtr).GetTtl() > elapsed {
+				ttl = (*rrPtr).GetTtl() - elapsed
+			}
+			rr := zonefiles.WithTtl(*rrPtr, ttl)
+			aged = append(aged, &rr)
+		}
+		return aged
+	}
+	result := *e.result
+	result.Answers = age(e.result.Answers)
+	result.Authority = age(e.result.Authority)
+	result.Additional = age(e.result.Additional)
+	return &result
+}
+
+/*
+cacheTtl returns how long the result may be cached, 0 if it must not be.
+Positive answers expire with their first record. Negative answers, for
+names or records that don't exist, are cached for the TTL of the SOA
+record of their zone bounded by its MINIMUM field, and not at all
+without it (RFC 2308, section 5).
+*/
+func (c *responseCache) cacheTtl(result *zonefiles.QueryResult) time.Duration {
+	var ttl uint
+	switch {
+	case result.RCode == zonefiles.NoError && len(result.Answers) > 0:
+		ttl = minTtl(result.Answers)
+		if len(result.Authority) > 0 {
+			ttl = minOf(ttl, minTtl(result.Authority))
+		}
+		if len(result.Additional) > 0 {
+			ttl = minOf(ttl, minTtl(result.Additional))
+		}
+		return boundTtl(ttl, c.maxTtl)
+	case result.RCode == zonefiles.NoError || result.RCode == zonefiles.NameError:
+		soa := negativeSoa(result)
+		if soa == nil {
+			return 0
+		}
+		ttl = soa.GetTtl()
+		if soa.Minimum >= 0 {
+			ttl = minOf(ttl, uint(soa.Minimum))
+		}
+		return boundTtl(ttl, c.maxNegativeTtl)
+	}
+	return 0
+}
+
+func minOf(a, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func minTtl(records []*zonefiles.ResourceRecord) uint {
+	ttl := (*records[0]).GetTtl()
+	for _, rrPtr := range records[1:] {
+		ttl = minOf(ttl, (*rrPtr).GetTtl())
+	}
+	return ttl
+}
+
+func boundTtl(ttl uint, max time.Duration) time.Duration {
+	if time.Duration(ttl)*time.Second > max {
+		return max
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// returns the SOA record of the authority section of a negative answer
+func negativeSoa(result *zonefiles.QueryResult) *zonefiles.SoaRecord {
+	for _, rrPtr := range result.Authority {
+		if soa, ok := (*rrPtr).(*zonefiles.SoaRecord); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// returns copies of the records whose TTL is at most ttl seconds
+func capTtls(records []*zonefiles.ResourceRecord, ttl uint) []*zonefiles.ResourceRecord {
+	capped := make([]*zonefiles.ResourceRecord, 0, len(records))
+	for _, rrPtr := range records {
+		rr := *rrPtr
+		if rr.GetTtl() > ttl {
+			rr = zonefiles.WithTtl(rr, ttl)
+		}
+		capped = append(capped, &rr)
+	}
+	return capped
+}
+
+func (c *responseCache) Put(question *zonefiles.QueryQuestion, result *zonefiles.QueryResult) {
+	ttl := c.cacheTtl(result)
+	if ttl < time.Second {
+		return
+	}
+
+	// the records served from the cache never outlive the entry
+	seconds := uint(ttl / time.Second)
+	cached := *result
+	cached.Authoritative = false
+	cached.Answers = capTtls(result.Answers, seconds)
+	cached.Authority = capTtls(result.Authority, seconds)
+	cached.Additional = capTtls(result.Additional, seconds)
+
+	now := time.Now()
+	e := &entry{key: cacheKey(question), result: &cached, stored: now, expires: now.Add(ttl)}
+	s := c.shard(e.key)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, found := s.entries[e.key]; found {
+		elem.Value = e
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.entries[e.key] = s.lru.PushFront(e)
+	for s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*entry).key)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *responseCache) Stats() Stats {
+	stats := Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Evictions: c.evictions.Load(),
+		StaleHits: c.staleHits.Load(), Prefetches: c.prefetches.Load()}
+	for i := range c.shards {
+		c.shards[i].lock.Lock()
+		stats.Entries += c.shards[i].lru.Len()
+		c.shards[i].lock.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+func question(name string) *zonefiles.QueryQuestion {
+	return &zonefiles.QueryQuestion{QName: name, Qtype: int(zonefiles.A), Qclass: int(zonefiles.IN)}
+}
+
+// a positive answer holding an A record of the name with the TTL
+func answer(name string, ttl uint) *zonefiles.QueryResult {
+	record := &zonefiles.ARecord{}
+	record.Name, record.Type, record.Class, record.TTL, record.Value = name, zonefiles.A, zonefiles.IN, ttl, "192.0.2.1"
+	var rr zonefiles.ResourceRecord = record
+	return &zonefiles.QueryResult{Authoritative: true, Answers: []*zonefiles.ResourceRecord{&rr}}
+}
+
+// a negative answer with the rcode and the SOA of example.test. in the authority section
+func negative(rCode int, soaTtl uint, minimum int) *zonefiles.QueryResult {
+	var rr zonefiles.ResourceRecord = zonefiles.NewSoaRecord("example.test.", zonefiles.IN, soaTtl,
+		zonefiles.Soa{MName: "ns.example.test.", RName: "hostmaster.example.test.", Serial: 1, Minimum: minimum})
+	return &zonefiles.QueryResult{RCode: rCode, Authority: []*zonefiles.ResourceRecord{&rr}}
+}
+
+// returns the TTL of the only record of the section
+func ttlOf(t *testing.T, records []*zonefiles.ResourceRecord) uint {
+	t.Helper()
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	return (*records[0]).GetTtl()
+}
+
+func TestGetLowersTtl(t *testing.T) {
+	c := NewCache(100, 0, 0, 0, false)
+	c.Put(question("www.example.test."), answer("www.example.test.", 10))
+
+	// names differing in case are the same name
+	result, found := c.Get(question("WWW.Example.Test"))
+	if !found {
+		t.Fatal("the answer isn't cached")
+	}
+	if result.Authoritative {
+		t.Error("a cached answer is authoritative")
+	}
+	if ttl := ttlOf(t, result.Answers); ttl != 10 {
+		t.Errorf("got TTL %d right after caching, want 10", ttl)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	result, found = c.Get(question("www.example.test."))
+	if !found {
+		t.Fatal("the answer expired before its TTL")
+	}
+	if ttl := ttlOf(t, result.Answers); ttl != 9 {
+		t.Errorf("got TTL %d a second after caching, want 9", ttl)
+	}
+	if stats := c.Stats(); stats.Hits != 2 || stats.Misses != 0 || stats.Entries != 1 {
+		t.Errorf("got %+v, want 2 hits, no miss and 1 entry", stats)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := NewCache(100, 0, 0, time.Minute, false)
+	c.Put(question("short.example.test."), answer("short.example.test.", 1))
+	if _, found := c.Get(question("short.example.test.")); !found {
+		t.Fatal("the answer isn't cached")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, found := c.Get(question("short.example.test.")); found {
+		t.Error("got the answer once expired")
+	}
+	result, found := c.GetStale(question("short.example.test."))
+	if !found {
+		t.Fatal("the expired answer isn't kept for the stale window")
+	}
+	if ttl := ttlOf(t, result.Answers); ttl != StaleTtl {
+		t.Errorf("got TTL %d for a stale answer, want %d", ttl, StaleTtl)
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.StaleHits != 1 {
+		t.Errorf("got %+v, want 1 hit, 1 miss and 1 stale hit", stats)
+	}
+
+	// without stale window expired answers are dropped
+	c = NewCache(100, 0, 0, 0, false)
+	c.Put(question("short.example.test."), answer("short.example.test.", 1))
+	time.Sleep(1100 * time.Millisecond)
+	if _, found := c.GetStale(question("short.example.test.")); found {
+		t.Error("got a stale answer without stale window")
+	}
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Errorf("got %d entries, want the expired answer removed", stats.Entries)
+	}
+}
+
+func TestCacheTtl(t *testing.T) {
+	c := NewCache(100, time.Hour, 10*time.Minute, 0, false).(*responseCache)
+	tests := []struct {
+		name   string
+		result *zonefiles.QueryResult
+		ttl    time.Duration
+	}{
+		{"positive", answer("www.example.test.", 300), 300 * time.Second},
+		{"positive above the maximum", answer("www.example.test.", 86400), time.Hour},
+		{"NXDOMAIN bounded by MINIMUM", negative(zonefiles.NameError, 3600, 60), time.Minute},
+		{"NODATA bounded by the SOA TTL", negative(zonefiles.NoError, 30, 60), 30 * time.Second},
+		{"negative above the maximum", negative(zonefiles.NameError, 86400, 86400), 10 * time.Minute},
+		{"negative without SOA", &zonefiles.QueryResult{RCode: zonefiles.NameError}, 0},
+		{"server failure", negative(zonefiles.ServerFailure, 3600, 60), 0},
+	}
+	for _, test := range tests {
+		if ttl := c.cacheTtl(test.result); ttl != test.ttl {
+			t.Errorf("%s: got %v, want %v", test.name, ttl, test.ttl)
+		}
+	}
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	c := NewCache(100, 0, 0, 0, false)
+	c.Put(question("missing.example.test."), negative(zonefiles.NameError, 3600, 60))
+	result, found := c.Get(question("missing.example.test."))
+	if !found {
+		t.Fatal("the NXDOMAIN answer isn't cached")
+	}
+	if result.RCode != zonefiles.NameError {
+		t.Errorf("got rcode %d, want NXDOMAIN", result.RCode)
+	}
+	// the SOA is served with the TTL the answer is cached for
+	if ttl := ttlOf(t, result.Authority); ttl != 60 {
+		t.Errorf("got SOA TTL %d, want the MINIMUM 60", ttl)
+	}
+
+	c.Put(question("failing.example.test."), negative(zonefiles.ServerFailure, 3600, 60))
+	c.Put(question("nosoa.example.test."), &zonefiles.QueryResult{RCode: zonefiles.NameError})
+	for _, name := range []string{"failing.example.test.", "nosoa.example.test."} {
+		if _, found := c.Get(question(name)); found {
+			t.Errorf("%s: got an answer that must not be cached", name)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	// two entries per shard
+	c := NewCache(2*shardCount, 0, 0, 0, false).(*responseCache)
+
+	// names falling in the same shard, in the order they are cached
+	var names []string
+	for i := 0; len(names) < 3; i++ {
+		name := fmt.Sprintf("host%d.example.test.", i)
+		if c.shard(cacheKey(question(name))) == c.shard(cacheKey(question("host0.example.test."))) {
+			names = append(names, name)
+		}
+	}
+	c.Put(question(names[0]), answer(names[0], 300))
+	c.Put(question(names[1]), answer(names[1], 300))
+
+	// the first name is now the most recently used one, the second is evicted
+	if _, found := c.Get(question(names[0])); !found {
+		t.Fatalf("%s isn't cached", names[0])
+	}
+	c.Put(question(names[2]), answer(names[2], 300))
+	for i, want := range []bool{true, false, true} {
+		if _, found := c.Get(question(names[i])); found != want {
+			t.Errorf("%s: got cached %v, want %v", names[i], found, want)
+		}
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("got %+v, want 1 eviction, 2 entries, 3 hits and 1 miss", stats)
+	}
+
+	// replacing a cached answer evicts nothing
+	c.Put(question(names[0]), answer(names[0], 600))
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("got %+v after replacing an answer, want 1 eviction and 2 entries", stats)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,7 +16,185 @@ type ConfigFile struct {
 	Zones []struct {
 		ZoneName         string   `yaml:"name"`
 		ZonefileLocation []string `yaml:"filePath"`
+
+		/*
+		   Where to keep a binary snapshot of the zone, which is
+		   loaded instead of the zone files as long as they don't
+		   change. No snapshot is used if empty.
+		*/
+		SnapshotPath string `yaml:"snapshotPath"`
+
+		// signs the records of the zone, which is left unsigned if no KSK is given
+		Dnssec struct {
+			/*
+			   PEM files of the ECDSA P-256 or Ed25519 private
+			   keys of the zone. The key signing key signs the
+			   DNSKEY records and the zone signing key the
+			   others, or the KSK signs them all if there is
+			   no ZSK.
+			*/
+			KskFile string `yaml:"kskFile"`
+			ZskFile string `yaml:"zskFile"`
+
+			/*
+			   How long the signatures are valid, 14 days if
+			   not set. They are made again every quarter of
+			   this time.
+			*/
+			SignatureValidity time.Duration `yaml:"signatureValidity"`
+
+			/*
+			   Proves that names don't exist with an NSEC3
+			   chain (RFC 5155) rather than an NSEC one, which
+			   lets the names of the zone be listed by walking
+			   it.
+			*/
+			Nsec3 struct {
+				Enabled bool `yaml:"enabled"`
+
+				// the salt in hexadecimal, none if empty
+				Salt       string `yaml:"salt"`
+				Iterations int    `yaml:"iterations"`
+
+				// leaves the delegations to unsigned zones out of the chain
+				OptOut bool `yaml:"optOut"`
+			} `yaml:"nsec3"`
+		} `yaml:"dnssec"`
 	} `yaml:"zones"`
+
+	/*
+	   Where queries for names outside of our zones are sent.
+	   They are refused if no upstream server is given.
+	*/
+	Forwarder struct {
+		// host:port of the upstream servers, the port defaults to 53
+		Upstreams []string `yaml:"upstreams"`
+
+		/*
+		   How the upstream server of a query is chosen:
+		   "round-robin" (the default) spreads the queries
+		   over the healthy servers, "fastest" prefers the
+		   healthy server with the lowest response time.
+		*/
+		Policy string `yaml:"policy"`
+
+		/*
+		   "udp" (the default) retries over TCP the queries
+		   whose answer is truncated, "tcp" only uses TCP and
+		   "tls" DNS over TLS, on port 853 by default.
+		*/
+		Transport string `yaml:"transport"`
+
+		/*
+		   The name the certificates of the servers must be
+		   valid for over TLS, the host of their address if
+		   not set.
+		*/
+		TlsServerName string `yaml:"tlsServerName"`
+
+		// how long to wait for an upstream server, 2s if not set
+		Timeout time.Duration `yaml:"timeout"`
+
+		// how often the upstream servers are checked, 30s if not set
+		HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+	} `yaml:"forwarder"`
+
+	/*
+	   Domains whose queries go to servers of their own instead
+	   of the forwarder or the recursion. A query goes to the
+	   most specific domain enclosing its name; the fields are
+	   the ones of the forwarder.
+	*/
+	ForwardZones []struct {
+		Name                string        `yaml:"name"`
+		Upstreams           []string      `yaml:"upstreams"`
+		Policy              string        `yaml:"policy"`
+		Transport           string        `yaml:"transport"`
+		TlsServerName       string        `yaml:"tlsServerName"`
+		Timeout             time.Duration `yaml:"timeout"`
+		HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+	} `yaml:"forwardZones"`
+
+	/*
+	   Resolves the queries for names outside of our zones
+	   iteratively from the root servers, when no forwarder
+	   is configured. No recursion is done if no root hints
+	   file is given.
+	*/
+	Recursion struct {
+		// a zone file holding the NS records of the root and their addresses
+		RootHints string `yaml:"rootHints"`
+
+		/*
+		   The port the name servers are queried on, 53 if not
+		   set. Only useful to test against servers on
+		   loopback.
+		*/
+		Port int `yaml:"port"`
+
+		// how long to wait for a name server, 2s if not set
+		Timeout time.Duration `yaml:"timeout"`
+
+		// how many times the servers of a zone are tried in turn, 2 if not set
+		Retries int `yaml:"retries"`
+
+		// the most referrals followed to answer a query, 16 if not set
+		MaxReferrals int `yaml:"maxReferrals"`
+
+		/*
+		   How deeply the lookups of the addresses of name
+		   servers without glue may nest, 4 if not set.
+		*/
+		MaxDepth int `yaml:"maxDepth"`
+
+		/*
+		   How much of the query name the name servers see
+		   (RFC 9156): "relaxed" (the default) only sends them
+		   the labels they need, falling back to the whole name
+		   for servers failing on part of it, "strict" never
+		   falls back and "off" always sends the whole name.
+		*/
+		QnameMinimisation string `yaml:"qnameMinimisation"`
+	} `yaml:"recursion"`
+
+	// keeps the answers of the forwarder or of the recursion
+	Cache struct {
+		Disabled bool `yaml:"disabled"`
+
+		// the most answers kept, 10000 if not set
+		Size int `yaml:"size"`
+
+		// how long an answer is kept at most, 24h if not set
+		MaxTtl time.Duration `yaml:"maxTtl"`
+
+		/*
+		   How long an answer saying a name or its records
+		   don't exist is kept at most, 3h if not set.
+		*/
+		MaxNegativeTtl time.Duration `yaml:"maxNegativeTtl"`
+
+		/*
+		   How long expired answers are kept, to be served
+		   when the servers having the answer can't be reached
+		   (RFC 8767). Expired answers are never served if not
+		   set; RFC 8767 suggests 1 to 3 days.
+		*/
+		ServeStale time.Duration `yaml:"serveStale"`
+
+		// refreshes popular answers shortly before they expire
+		Prefetch bool `yaml:"prefetch"`
+	} `yaml:"cache"`
+
+	// checks the DNSSEC signatures of the answers of the forwarder or of the recursion
+	Dnssec struct {
+		/*
+		   A file of DS or DNSKEY records, in the master file
+		   format with fully qualified names, of the keys
+		   trusted without proof (RFC 4035, section 4.4). No
+		   answer is validated if not set.
+		*/
+		TrustAnchors string `yaml:"trustAnchors"`
+	} `yaml:"dnssec"`
 	// Some configurations
 }
 
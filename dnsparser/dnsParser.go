@@ -3,6 +3,7 @@ package dnsparser
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/abhra303/qDNS/zonefiles"
@@ -11,6 +12,13 @@ import (
 var headerSize int = 96         // message header size
 var MessageByteLimit uint = 512 // overall message size
 
+// the largest UDP payload we advertise and accept to send with EDNS(0)
+var EdnsBufferSize uint = 1232
+
+// the type code of the OPT pseudo record and its size with empty RDATA
+const optType = 41
+const optRecordSize = 11
+
 type MessageHeader struct {
 
 	/*
@@ -72,7 +80,23 @@ type MessageHeader struct {
 	*/
 	RA bool
 
-	Z       int  // for future use
+	Z int // for future use
+
+	/*
+	   Authentic Data - set in a response whose records were
+	   all validated with DNSSEC (RFC 4035, section 3.2.3). In
+	   a query, it tells that the client understands the bit
+	   (RFC 6840, section 5.7).
+	*/
+	AD bool
+
+	/*
+	   Checking Disabled - set in a query by a client that
+	   validates the records itself and wants them even if
+	   they fail validation. It is copied into the response.
+	*/
+	CD bool
+
 	Rcode   int  // 4 bit response code
 	Qdcount uint // no of entries in question section
 	Ancount uint // no of RR in answer section
@@ -80,9 +104,32 @@ type MessageHeader struct {
 	Arcount uint // no of RR in the additional records section
 }
 
+/*
+EdnsOpt holds the content of the OPT pseudo record of a message
+(RFC 6891, section 6.1.3).
+*/
+type EdnsOpt struct {
+	// the largest UDP payload the sender of the message can receive
+	UDPSize uint
+
+	// upper 8 bits of the 12 bit extended RCODE
+	ExtendedRcode int
+
+	Version int
+
+	/*
+	   DNSSEC OK - the sender is able to accept DNSSEC
+	   security records (RFC 3225).
+	*/
+	DO bool
+}
+
 type DnsQuery struct {
 	Header *MessageHeader
 
+	// the EDNS(0) options of the query, nil if it has no OPT record
+	Opt *EdnsOpt
+
 	/*
 		One of the below two fields must be nil. Normal
 		queries contain a Question section, but Inverse
@@ -100,37 +147,51 @@ type DnsMessage struct {
 	Answer     []*zonefiles.ResourceRecord
 	Authority  []*zonefiles.ResourceRecord
 	Additional []*zonefiles.ResourceRecord
+
+	// if not nil, an OPT record is added to the additional section
+	Opt *EdnsOpt
+
+	/*
+	   The size the serialized message must fit in, usually the
+	   payload size negotiated with the client. MessageByteLimit
+	   is used if it is zero.
+	*/
+	SizeLimit uint
 }
 
 func parseQueryHeader(inputBytes []byte, length int, bytesOffset *int) *MessageHeader {
 	header := MessageHeader{}
 
-	if length < headerSize {
+	// headerSize is in bits
+	if length < headerSize/8 {
 		return nil
 	}
 
 	header.ID = (int(inputBytes[*bytesOffset]) << 8) ^ int(inputBytes[*bytesOffset+1])
 	*bytesOffset += 2
 
-	header.QR = (int(inputBytes[*bytesOffset]) >> 8) == 1
-	header.Opcode = int((int8(inputBytes[*bytesOffset]) << 1) >> 4)
-	header.AA = (inputBytes[*bytesOffset] & 0b00000100) == 1
-	header.TC = (inputBytes[*bytesOffset] & 0b00000010) == 1
-	header.RD = (inputBytes[*bytesOffset] & 0b00000001) == 1
+	header.QR = (inputBytes[*bytesOffset] >> 7) == 1
+	header.Opcode = int((inputBytes[*bytesOffset] >> 3) & 0b00001111)
+	header.AA = (inputBytes[*bytesOffset] & 0b00000100) != 0
+	header.TC = (inputBytes[*bytesOffset] & 0b00000010) != 0
+	header.RD = (inputBytes[*bytesOffset] & 0b00000001) != 0
 
 	*bytesOffset++
-	header.RA = (inputBytes[*bytesOffset] & 0b10000000) == 1
-	header.Z = int(inputBytes[*bytesOffset] & 0b01110000)
+	header.RA = (inputBytes[*bytesOffset] & 0b10000000) != 0
+	header.Z = int((inputBytes[*bytesOffset] & 0b01000000) >> 6)
+	header.AD = (inputBytes[*bytesOffset] & 0b00100000) != 0
+	header.CD = (inputBytes[*bytesOffset] & 0b00010000) != 0
 	header.Rcode = int(inputBytes[*bytesOffset] & 0b00001111)
 
 	*bytesOffset++
 	header.Qdcount = (uint(inputBytes[*bytesOffset]) << 8) ^ uint(inputBytes[*bytesOffset+1])
-	*bytesOffset++
+	*bytesOffset += 2
 	header.Ancount = (uint(inputBytes[*bytesOffset]) << 8) ^ uint(inputBytes[*bytesOffset+1])
-	*bytesOffset++
+	*bytesOffset += 2
 	header.Nscount = (uint(inputBytes[*bytesOffset]) << 8) ^ uint(inputBytes[*bytesOffset+1])
-	*bytesOffset++
+	*bytesOffset += 2
 	header.Arcount = (uint(inputBytes[*bytesOffset]) << 8) ^ uint(inputBytes[*bytesOffset+1])
+	*bytesOffset += 2
 	return &header
 }
 
@@ -143,24 +204,23 @@ func parseQueryQuestion(inputBytes []byte, bytesOffset *int) (*zonefiles.QueryQu
 		return nil, fmt.Errorf("corrupt question: question size to small")
 	}
 
-	// though it seems O(n^2) but actually it is O(n); n is the no. of bytes in Qname
-	for i, length := 0, int(inputBytes[*bytesOffset]); length != 0; i++ {
-		qName := ""
-		if *bytesOffset+length+fixedQSize > bufLen {
-			return nil, fmt.Errorf("corrupt question: question size too small")
+	for length := int(inputBytes[*bytesOffset]); length != 0; length = int(inputBytes[*bytesOffset]) {
+		if length > 63 {
+			return nil, fmt.Errorf("corrupt question: label too long")
 		}
-
-		for ; length > 0; length-- {
-			*bytesOffset++
-			qName += string(inputBytes[*bytesOffset])
+		if *bytesOffset+length+1+fixedQSize > bufLen {
+			return nil, fmt.Errorf("corrupt question: question size too small")
 		}
 
-		if qName == "" {
-			return nil, fmt.Errorf("corrupt question: question is empty")
-		}
-		question.QName += qName + "."
 		*bytesOffset++
+		question.QName += string(inputBytes[*bytesOffset:*bytesOffset+length]) + "."
+		*bytesOffset += length
 	}
+	if question.QName == "" {
+		question.QName = "."
+	}
+	// skip the null byte ending the name
+	*bytesOffset++
 
 	question.Qtype = (int(inputBytes[*bytesOffset]) << 8) ^ int(inputBytes[*bytesOffset+1])
 	*bytesOffset += 2
@@ -184,11 +244,137 @@ func parseQueryQuestions(inputBytes []byte, qdCount uint, bytesOffset *int) ([]*
 	return messageQuestions, nil
 }
 
+// moves the offset past the (possibly compressed) domain name at offset
+func skipDomainName(inputBytes []byte, bytesOffset *int) error {
+	for *bytesOffset < len(inputBytes) {
+		length := int(inputBytes[*bytesOffset])
+		if length == 0 {
+			*bytesOffset++
+			return nil
+		}
+		if length&0xC0 == 0xC0 {
+			*bytesOffset += 2
+			return nil
+		}
+		*bytesOffset += length + 1
+	}
+	return fmt.Errorf("corrupt message: domain name out of bounds")
+}
+
+// returns the offset right after the question section of a raw message
+func questionSectionEnd(rawMessage []byte) (int, error) {
+	offset := headerSize / 8
+	if len(rawMessage) < offset {
+		return 0, fmt.Errorf("corrupt message: header too small")
+	}
+	qdCount := int(binary.BigEndian.Uint16(rawMessage[4:]))
+	for i := 0; i < qdCount; i++ {
+		err := skipDomainName(rawMessage, &offset)
+		if err != nil {
+			return 0, err
+		}
+		offset += 4
+		if offset > len(rawMessage) {
+			return 0, fmt.Errorf("corrupt message: question out of bounds")
+		}
+	}
+	return offset, nil
+}
+
+/*
+SameQuestion reports whether a raw response answers a raw query: both
+have the same ID and question section and the response has its QR bit
+set.
+*/
+func SameQuestion(query, response []byte) bool {
+	queryEnd, err := questionSectionEnd(query)
+	if err != nil {
+		return false
+	}
+	responseEnd, err := questionSectionEnd(response)
+	if err != nil || queryEnd != responseEnd {
+		return false
+	}
+	return query[0] == response[0] && query[1] == response[1] && response[2]&0x80 != 0 &&
+		string(query[4:6]) == string(response[4:6]) &&
+		string(query[headerSize/8:queryEnd]) == string(response[headerSize/8:responseEnd])
+}
+
+/*
+TruncateMessage cuts a raw response that doesn't fit in the payload
+size of the client down to its header and question section and sets its
+TC bit, so that the client retries over TCP.
+*/
+func TruncateMessage(rawMessage []byte) ([]byte, error) {
+	end, err := questionSectionEnd(rawMessage)
+	if err != nil {
+		return nil, err
+	}
+	truncated := append([]byte(nil), rawMessage[:end]...)
+	truncated[2] |= 0x02
+	for i := 6; i < headerSize/8; i++ {
+		truncated[i] = 0
+	}
+	return truncated, nil
+}
+
+/*
+parseQueryOpt looks for the OPT record in the sections following the
+questions. The records of the other sections are skipped, queries have
+no use for them.
+*/
+func parseQueryOpt(inputBytes []byte, header *MessageHeader, bytesOffset *int) (*EdnsOpt, error) {
+	rrCount := header.Ancount + header.Nscount + header.Arcount
+	for i := uint(0); i < rrCount; i++ {
+		err := skipDomainName(inputBytes, bytesOffset)
+		if err != nil {
+			return nil, err
+		}
+		if *bytesOffset+10 > len(inputBytes) {
+			return nil, fmt.Errorf("corrupt message: resource record too small")
+		}
+		rrType := binary.BigEndian.Uint16(inputBytes[*bytesOffset:])
+		class := binary.BigEndian.Uint16(inputBytes[*bytesOffset+2:])
+		ttl := binary.BigEndian.Uint32(inputBytes[*bytesOffset+4:])
+		rdLength := int(binary.BigEndian.Uint16(inputBytes[*bytesOffset+8:]))
+		*bytesOffset += 10 + rdLength
+		if *bytesOffset > len(inputBytes) {
+			return nil, fmt.Errorf("corrupt message: rdata out of bounds")
+		}
+
+		if rrType == optType && i >= header.Ancount+header.Nscount {
+			return &EdnsOpt{
+				UDPSize:       uint(class),
+				ExtendedRcode: int(ttl >> 24),
+				Version:       int((ttl >> 16) & 0xFF),
+				DO:            ttl&0x8000 != 0,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+PayloadSize returns the size a response to the query may have: the
+payload size advertised by the client, bounded by EdnsBufferSize and
+never less than the 512 octets every client accepts.
+*/
+func (q *DnsQuery) PayloadSize() uint {
+	if q.Opt == nil || q.Opt.UDPSize <= MessageByteLimit {
+		return MessageByteLimit
+	}
+	if q.Opt.UDPSize > EdnsBufferSize {
+		return EdnsBufferSize
+	}
+	return q.Opt.UDPSize
+}
+
 func ParseDnsQuery(inputBytes []byte, length int) (*DnsQuery, error) {
 	var err error
 	bytesOffset := 0
 	query := DnsQuery{}
 
+	inputBytes = inputBytes[:length]
 	query.Header = parseQueryHeader(inputBytes, length, &bytesOffset)
 	if query.Header == nil {
 		err = fmt.Errorf("error parsing dns request header")
@@ -205,6 +391,11 @@ func ParseDnsQuery(inputBytes []byte, length int) (*DnsQuery, error) {
 		return nil, err
 	}
 
+	query.Opt, err = parseQueryOpt(inputBytes, query.Header, &bytesOffset)
+	if err != nil {
+		return nil, err
+	}
+
 	return &query, nil
 }
 
@@ -222,6 +413,9 @@ func serializeMessageHeader(header *MessageHeader, rawMessage []byte, offset *ui
 	}
 
 	tcPos := *offset
+	if header.TC {
+		rawMessage[*offset] |= 0x2
+	}
 	if header.RD {
 		rawMessage[*offset] |= 0x1
 	}
@@ -229,7 +423,13 @@ func serializeMessageHeader(header *MessageHeader, rawMessage []byte, offset *ui
 	if header.RA {
 		rawMessage[*offset] = 1 << 7
 	}
-	rawMessage[*offset] |= (byte(header.Z) << 4) & 0b01110000
+	rawMessage[*offset] |= (byte(header.Z) << 6) & 0b01000000
+	if header.AD {
+		rawMessage[*offset] |= 0b00100000
+	}
+	if header.CD {
+		rawMessage[*offset] |= 0b00010000
+	}
 	rawMessage[*offset] |= byte(header.Rcode) & 0b00001111
 	*offset++
 
@@ -240,29 +440,69 @@ func serializeMessageHeader(header *MessageHeader, rawMessage []byte, offset *ui
 	binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(header.Nscount))
 	*offset += 2
 	binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(header.Arcount))
+	*offset += 2
 
 	return tcPos, nil
 }
 
-func serializeMessageQuestion(questions *[]*zonefiles.QueryQuestion, rawMessage []byte, offset *uint) (bool, error) {
-	for _, question := range *questions {
-		labels := strings.Split(question.QName, ".")
-		for _, label := range labels {
-			len := len(label)
+/*
+serializeDomainName writes the given fully qualified name as a
+sequence of labels. Suffixes that were already written are replaced
+by a pointer to their first occurrence (RFC 1035, section 4.1.4),
+unless compression is nil. Returns true if the name doesn't fit in the
+message.
+*/
+func serializeDomainName(name string, rawMessage []byte, offset *uint, compression map[string]uint) bool {
+	limit := uint(len(rawMessage))
+	name = strings.TrimSuffix(name, ".")
+	var labels []string
+	if name != "" {
+		labels = strings.Split(name, ".")
+	}
 
-			rawMessage[*offset] = byte(len)
-			*offset++
-			if *offset+3 >= MessageByteLimit {
-				return true, nil
+	for i, label := range labels {
+		suffix := strings.ToLower(strings.Join(labels[i:], "."))
+		if pos, ok := compression[suffix]; ok {
+			if *offset+2 > limit {
+				return true
 			}
+			binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(0xC000|pos))
+			*offset += 2
+			return false
+		}
 
-			for i := range label {
-				rawMessage[*offset] = byte(label[i])
-				*offset++
-			}
+		if len(label) == 0 || len(label) > 63 || *offset+uint(len(label))+1 > limit {
+			return true
+		}
+		// pointers can only address the first 14 bits of the message
+		if compression != nil && *offset < 0x4000 {
+			compression[suffix] = *offset
 		}
-		// a null byte to denote the end of query domain
+		rawMessage[*offset] = byte(len(label))
 		*offset++
+		*offset += uint(copy(rawMessage[*offset:], label))
+	}
+
+	if *offset+1 > limit {
+		return true
+	}
+	// a null byte to denote the end of the domain
+	rawMessage[*offset] = 0
+	*offset++
+	return false
+}
+
+func serializeMessageQuestion(questions *[]*zonefiles.QueryQuestion, rawMessage []byte, offset *uint, compression map[string]uint) (bool, error) {
+	if questions == nil {
+		return false, nil
+	}
+	for _, question := range *questions {
+		if serializeDomainName(question.QName, rawMessage, offset, compression) {
+			return true, nil
+		}
+		if *offset+4 > uint(len(rawMessage)) {
+			return true, nil
+		}
 
 		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(question.Qtype))
 		*offset += 2
@@ -270,48 +510,355 @@ func serializeMessageQuestion(questions *[]*zonefiles.QueryQuestion, rawMessage
 		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(question.Qclass))
 		*offset += 2
 	}
-	return (*offset >= MessageByteLimit), nil
+	return false, nil
 }
 
-func serializeResourceRecords(RRs []*zonefiles.ResourceRecord, rawMessage []byte, offset *uint) (bool, error) {
+// writes the RDATA of a record, returns true if it doesn't fit
+func serializeRData(rr zonefiles.ResourceRecord, rawMessage []byte, offset *uint, compression map[string]uint) (bool, error) {
+	limit := uint(len(rawMessage))
+
+	switch record := rr.(type) {
+	case *zonefiles.ARecord:
+		ip := net.ParseIP(record.GetValue()).To4()
+		if ip == nil {
+			return false, fmt.Errorf("invalid ipv4 address %v", record.GetValue())
+		}
+		if *offset+net.IPv4len > limit {
+			return true, nil
+		}
+		*offset += uint(copy(rawMessage[*offset:], ip))
+	case *zonefiles.AaaaRecord:
+		ip := net.ParseIP(record.GetValue()).To16()
+		if ip == nil {
+			return false, fmt.Errorf("invalid ipv6 address %v", record.GetValue())
+		}
+		if *offset+net.IPv6len > limit {
+			return true, nil
+		}
+		*offset += uint(copy(rawMessage[*offset:], ip))
+	case *zonefiles.NSRecord, *zonefiles.CnameRecord:
+		return serializeDomainName(record.GetValue(), rawMessage, offset, compression), nil
+	case *zonefiles.MxRecord:
+		if *offset+2 > limit {
+			return true, nil
+		}
+		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(record.GetPreference()))
+		*offset += 2
+		return serializeDomainName(record.GetValue(), rawMessage, offset, compression), nil
+	case *zonefiles.SoaRecord:
+		if serializeDomainName(record.MName, rawMessage, offset, compression) ||
+			serializeDomainName(record.RName, rawMessage, offset, compression) ||
+			*offset+20 > limit {
+			return true, nil
+		}
+		for _, val := range []int{record.Serial, record.Refresh, record.Retry, record.Expire, record.Minimum} {
+			binary.BigEndian.PutUint32(rawMessage[*offset:], uint32(val))
+			*offset += 4
+		}
+	case *zonefiles.SrvRecord:
+		if *offset+6 > limit {
+			return true, nil
+		}
+		for _, val := range []int{record.GetPriority(), record.GetWeight(), record.GetPort()} {
+			binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(val))
+			*offset += 2
+		}
+		// the target of SRV records must not be compressed (RFC 2782)
+		return serializeDomainName(record.GetValue(), rawMessage, offset, nil), nil
+	case *zonefiles.SvcbRecord:
+		if *offset+2 > limit {
+			return true, nil
+		}
+		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(record.GetPriority()))
+		*offset += 2
+		if serializeDomainName(record.GetValue(), rawMessage, offset, nil) {
+			return true, nil
+		}
+		for _, param := range record.Params {
+			if *offset+4+uint(len(param.Value)) > limit {
+				return true, nil
+			}
+			binary.BigEndian.PutUint16(rawMessage[*offset:], param.Key)
+			binary.BigEndian.PutUint16(rawMessage[*offset+2:], uint16(len(param.Value)))
+			*offset += 4
+			*offset += uint(copy(rawMessage[*offset:], param.Value))
+		}
+	case *zonefiles.TxtRecord:
+		for _, str := range record.GetCharacterStrings() {
+			if *offset+uint(len(str))+1 > limit {
+				return true, nil
+			}
+			rawMessage[*offset] = byte(len(str))
+			*offset++
+			*offset += uint(copy(rawMessage[*offset:], str))
+		}
+	case *zonefiles.DnskeyRecord:
+		if *offset+4+uint(len(record.PublicKey)) > limit {
+			return true, nil
+		}
+		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(record.Flags))
+		rawMessage[*offset+2] = byte(record.Protocol)
+		rawMessage[*offset+3] = byte(record.Algorithm)
+		*offset += 4
+		*offset += uint(copy(rawMessage[*offset:], record.PublicKey))
+	case *zonefiles.DsRecord:
+		if *offset+4+uint(len(record.Digest)) > limit {
+			return true, nil
+		}
+		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(record.KeyTag))
+		rawMessage[*offset+2] = byte(record.Algorithm)
+		rawMessage[*offset+3] = byte(record.DigestType)
+		*offset += 4
+		*offset += uint(copy(rawMessage[*offset:], record.Digest))
+	case *zonefiles.RrsigRecord:
+		if *offset+18 > limit {
+			return true, nil
+		}
+		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(record.TypeCovered))
+		rawMessage[*offset+2] = byte(record.Algorithm)
+		rawMessage[*offset+3] = byte(record.Labels)
+		binary.BigEndian.PutUint32(rawMessage[*offset+4:], uint32(record.OriginalTtl))
+		binary.BigEndian.PutUint32(rawMessage[*offset+8:], record.Expiration)
+		binary.BigEndian.PutUint32(rawMessage[*offset+12:], record.Inception)
+		binary.BigEndian.PutUint16(rawMessage[*offset+16:], uint16(record.KeyTag))
+		*offset += 18
+		// the names of DNSSEC records must not be compressed (RFC 4034, section 3.1.7)
+		if serializeDomainName(record.SignerName, rawMessage, offset, nil) ||
+			*offset+uint(len(record.Signature)) > limit {
+			return true, nil
+		}
+		*offset += uint(copy(rawMessage[*offset:], record.Signature))
+	case *zonefiles.NsecRecord:
+		if serializeDomainName(record.NextName, rawMessage, offset, nil) {
+			return true, nil
+		}
+		return serializeTypeBitmap(record.Types, rawMessage, offset), nil
+	case *zonefiles.Nsec3Record:
+		if *offset+6+uint(len(record.Salt))+uint(len(record.NextHashed)) > limit {
+			return true, nil
+		}
+		rawMessage[*offset] = byte(record.HashAlgorithm)
+		rawMessage[*offset+1] = byte(record.Flags)
+		binary.BigEndian.PutUint16(rawMessage[*offset+2:], uint16(record.Iterations))
+		rawMessage[*offset+4] = byte(len(record.Salt))
+		*offset += 5
+		*offset += uint(copy(rawMessage[*offset:], record.Salt))
+		rawMessage[*offset] = byte(len(record.NextHashed))
+		*offset++
+		*offset += uint(copy(rawMessage[*offset:], record.NextHashed))
+		return serializeTypeBitmap(record.Types, rawMessage, offset), nil
+	case *zonefiles.Nsec3paramRecord:
+		if *offset+5+uint(len(record.Salt)) > limit {
+			return true, nil
+		}
+		rawMessage[*offset] = byte(record.HashAlgorithm)
+		rawMessage[*offset+1] = byte(record.Flags)
+		binary.BigEndian.PutUint16(rawMessage[*offset+2:], uint16(record.Iterations))
+		rawMessage[*offset+4] = byte(len(record.Salt))
+		*offset += 5
+		*offset += uint(copy(rawMessage[*offset:], record.Salt))
+	case *zonefiles.UnknownRecord:
+		if *offset+uint(len(record.Data)) > limit {
+			return true, nil
+		}
+		*offset += uint(copy(rawMessage[*offset:], record.Data))
+	default:
+		return false, fmt.Errorf("can't serialize record of type %v", rr.GetRType())
+	}
 	return false, nil
 }
 
+/*
+serializeTypeBitmap writes the types of an NSEC or NSEC3 record as the
+bitmaps of the windows of 256 types holding them (RFC 4034, section
+4.1.2). Returns true if they don't fit.
+*/
+func serializeTypeBitmap(types []zonefiles.RType, rawMessage []byte, offset *uint) bool {
+	var windows [256][32]byte
+	var lengths [256]int
+	for _, t := range types {
+		window, bit := t>>8, t&0xFF
+		windows[window][bit/8] |= 0x80 >> (bit % 8)
+		if int(bit/8)+1 > lengths[window] {
+			lengths[window] = int(bit/8) + 1
+		}
+	}
+	for window, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		if *offset+2+uint(length) > uint(len(rawMessage)) {
+			return true
+		}
+		rawMessage[*offset] = byte(window)
+		rawMessage[*offset+1] = byte(length)
+		*offset += 2
+		*offset += uint(copy(rawMessage[*offset:], windows[window][:length]))
+	}
+	return false
+}
+
+/*
+SerializeRData returns the RDATA of the record in its wire format, its
+names left uncompressed, as it is hashed and signed by DNSSEC.
+*/
+func SerializeRData(rr zonefiles.ResourceRecord) ([]byte, error) {
+	for size := 512; ; size *= 2 {
+		if size > 0xFFFF {
+			size = 0xFFFF
+		}
+		rdata := make([]byte, size)
+		var offset uint
+		isTruncated, err := serializeRData(rr, rdata, &offset, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !isTruncated {
+			return rdata[:offset], nil
+		}
+		if size == 0xFFFF {
+			return nil, fmt.Errorf("the data of the %v record of %s is too long", rr.GetRType(), rr.GetName())
+		}
+	}
+}
+
+// SerializeName returns the wire format of the fully qualified name, uncompressed
+func SerializeName(name string) ([]byte, error) {
+	encoded := make([]byte, maxNameLength)
+	var length uint
+	if serializeDomainName(name, encoded, &length, nil) {
+		return nil, fmt.Errorf("invalid domain name %s", name)
+	}
+	return encoded[:length], nil
+}
+
+// drops the names written at or after start so that they can't be pointed to
+func forgetNames(compression map[string]uint, start uint) {
+	for suffix, pos := range compression {
+		if pos >= start {
+			delete(compression, suffix)
+		}
+	}
+}
+
+/*
+serializeResourceRecords writes as many of the given records as fit in
+the message. Returns the number of records written and whether the
+section had to be truncated.
+*/
+func serializeResourceRecords(RRs []*zonefiles.ResourceRecord, rawMessage []byte, offset *uint, compression map[string]uint) (uint, bool, error) {
+	var count uint
+	limit := uint(len(rawMessage))
+
+	for _, rrPtr := range RRs {
+		rr := *rrPtr
+		start := *offset
+
+		if serializeDomainName(rr.GetName(), rawMessage, offset, compression) || *offset+10 > limit {
+			forgetNames(compression, start)
+			*offset = start
+			return count, true, nil
+		}
+		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(rr.GetRType()))
+		*offset += 2
+		binary.BigEndian.PutUint16(rawMessage[*offset:], uint16(rr.GetRClass()))
+		*offset += 2
+		binary.BigEndian.PutUint32(rawMessage[*offset:], uint32(rr.GetTtl()))
+		*offset += 4
+		rdLengthPos := *offset
+		*offset += 2
+
+		isTruncated, err := serializeRData(rr, rawMessage, offset, compression)
+		if err != nil {
+			return count, false, err
+		}
+		if isTruncated {
+			forgetNames(compression, start)
+			*offset = start
+			return count, true, nil
+		}
+		binary.BigEndian.PutUint16(rawMessage[rdLengthPos:], uint16(*offset-rdLengthPos-2))
+		count++
+	}
+	return count, false, nil
+}
+
+/*
+SerializeMessage converts the message to its wire format, within the
+size limit of the message. Records of the additional section that
+don't fit are dropped silently as they are not required by the client
+(RFC 2181, section 9); if the answer or authority sections don't fit,
+the message is cut and the TC bit gets set.
+*/
 func SerializeMessage(message *DnsMessage) ([]byte, error) {
-	var offset uint
-	var tcPos uint
 	var isTruncated bool
-	rawMessage := make([]byte, 512)
-
-	tcPos, err := serializeMessageHeader(message.Header, rawMessage, &offset)
-	if err != nil {
-		return nil, err
+	var err error
+	headerOffset := uint(0)
+	offset := uint(headerSize / 8)
+	compression := make(map[string]uint)
+	header := *message.Header
+
+	sizeLimit := message.SizeLimit
+	if sizeLimit == 0 {
+		sizeLimit = MessageByteLimit
+	}
+	rawMessage := make([]byte, sizeLimit)
+	// keep room for the OPT record at the end of the message
+	sections := rawMessage
+	if message.Opt != nil {
+		sections = rawMessage[:sizeLimit-optRecordSize]
 	}
 
-	isTruncated, err = serializeMessageQuestion(message.Question, rawMessage, &offset)
+	isTruncated, err = serializeMessageQuestion(message.Question, sections, &offset, compression)
 	if err != nil {
 		return nil, err
 	} else if isTruncated {
-		goto truncated
+		return nil, fmt.Errorf("the question section doesn't fit in the message")
 	}
 
-	isTruncated, err = serializeResourceRecords(message.Answer, rawMessage, &offset)
+	header.Ancount, isTruncated, err = serializeResourceRecords(message.Answer, sections, &offset, compression)
 	if err != nil {
 		return nil, err
-	} else if isTruncated {
-		goto truncated
+	}
+	header.Nscount, header.Arcount = 0, 0
+	if !isTruncated {
+		header.Nscount, isTruncated, err = serializeResourceRecords(message.Authority, sections, &offset, compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !isTruncated {
+		header.Arcount, _, err = serializeResourceRecords(message.Additional, sections, &offset, compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header.TC = isTruncated
+
+	if message.Opt != nil {
+		serializeOpt(message.Opt, rawMessage, &offset)
+		header.Arcount++
 	}
 
-	isTruncated, err = serializeResourceRecords(message.Answer, rawMessage, &offset)
+	_, err = serializeMessageHeader(&header, rawMessage, &headerOffset)
 	if err != nil {
 		return nil, err
-	} else if isTruncated {
-		goto truncated
 	}
+	return rawMessage[:offset], nil
+}
 
-	return rawMessage, err
-
-truncated:
-	rawMessage[tcPos] &= ^byte(0x2)
-	return rawMessage, err
+// writes an OPT record without options, the caller keeps room for it
+func serializeOpt(opt *EdnsOpt, rawMessage []byte, offset *uint) {
+	// the owner of the OPT record is the root
+	rawMessage[*offset] = 0
+	*offset++
+	binary.BigEndian.PutUint16(rawMessage[*offset:], optType)
+	binary.BigEndian.PutUint16(rawMessage[*offset+2:], uint16(opt.UDPSize))
+	ttl := uint32(opt.ExtendedRcode)<<24 | uint32(opt.Version)<<16
+	if opt.DO {
+		ttl |= 0x8000
+	}
+	binary.BigEndian.PutUint32(rawMessage[*offset+4:], ttl)
+	binary.BigEndian.PutUint16(rawMessage[*offset+8:], 0)
+	*offset += optRecordSize - 1
 }
@@ -0,0 +1,104 @@
+package dnsparser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+// serializes the message and parses it back
+func roundTrip(t *testing.T, message *DnsMessage) *DnsMessage {
+	t.Helper()
+	raw, err := SerializeMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseDnsMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestSerializeTxtChunks(t *testing.T) {
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", 20)
+	txt := &zonefiles.TxtRecord{Strings: []string{dkim, "say \"hi\"", ""}}
+	txt.Name, txt.Type, txt.Class, txt.TTL = "dkim._domainkey.example.com.", zonefiles.TXT, zonefiles.IN, 300
+	var rr zonefiles.ResourceRecord = txt
+	question := []*zonefiles.QueryQuestion{{QName: "dkim._domainkey.example.com.", Qtype: 16, Qclass: 1}}
+
+	parsed := roundTrip(t, &DnsMessage{
+		Header:    &MessageHeader{ID: 7, QR: true, Qdcount: 1},
+		Question:  &question,
+		Answer:    []*zonefiles.ResourceRecord{&rr},
+		SizeLimit: EdnsBufferSize,
+	})
+	if parsed.Header.TC || len(parsed.Answer) != 1 {
+		t.Fatalf("got %d answers and TC %v, want 1 answer", len(parsed.Answer), parsed.Header.TC)
+	}
+	got := (*parsed.Answer[0]).(*zonefiles.TxtRecord).Strings
+	want := []string{dkim[:255], dkim[255:510], dkim[510:], "say \"hi\"", ""}
+	if len(got) != len(want) {
+		t.Fatalf("got %d character-strings, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("character-string %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSerializeTxtTruncated(t *testing.T) {
+	txt := &zonefiles.TxtRecord{Strings: []string{strings.Repeat("x", 600)}}
+	txt.Name, txt.Type, txt.Class, txt.TTL = "big.example.com.", zonefiles.TXT, zonefiles.IN, 300
+	var rr zonefiles.ResourceRecord = txt
+
+	// a record that doesn't fit is left out whole and the TC bit set
+	parsed := roundTrip(t, &DnsMessage{
+		Header: &MessageHeader{ID: 8, QR: true},
+		Answer: []*zonefiles.ResourceRecord{&rr},
+	})
+	if !parsed.Header.TC || len(parsed.Answer) != 0 {
+		t.Fatalf("got %d answers and TC %v, want none and TC", len(parsed.Answer), parsed.Header.TC)
+	}
+}
+
+func TestSerializeDropsAdditionalFirst(t *testing.T) {
+	var answers, additional []*zonefiles.ResourceRecord
+	for i := 0; i < 10; i++ {
+		mx := &zonefiles.MxRecord{Preference: i}
+		mx.Name, mx.Type, mx.Class, mx.TTL = "example.com.", zonefiles.MX, zonefiles.IN, 300
+		mx.Value = strings.Repeat("m", 20) + string(rune('a'+i)) + ".example.com."
+		var rr zonefiles.ResourceRecord = mx
+		answers = append(answers, &rr)
+
+		aaaa := &zonefiles.AaaaRecord{}
+		aaaa.Name, aaaa.Type, aaaa.Class, aaaa.TTL = mx.Value, zonefiles.Aaaa, zonefiles.IN, 300
+		aaaa.Value = "2001:db8::1"
+		var glue zonefiles.ResourceRecord = aaaa
+		additional = append(additional, &glue)
+	}
+	message := &DnsMessage{
+		Header:     &MessageHeader{ID: 9, QR: true},
+		Answer:     answers,
+		Additional: additional,
+	}
+
+	// the answers fit in 512 octets, not all of their addresses
+	parsed := roundTrip(t, message)
+	if parsed.Header.TC || len(parsed.Answer) != len(answers) {
+		t.Fatalf("got %d answers and TC %v, want %d answers", len(parsed.Answer), parsed.Header.TC, len(answers))
+	}
+	if len(parsed.Additional) == 0 || len(parsed.Additional) == len(additional) {
+		t.Fatalf("got %d additional records, want some of %d", len(parsed.Additional), len(additional))
+	}
+
+	// all of them fit in the EDNS payload size
+	message.SizeLimit = EdnsBufferSize
+	parsed = roundTrip(t, message)
+	if parsed.Header.TC || len(parsed.Answer) != len(answers) || len(parsed.Additional) != len(additional) {
+		t.Fatalf("got %d answers, %d additional records and TC %v, want all of them",
+			len(parsed.Answer), len(parsed.Additional), parsed.Header.TC)
+	}
+}
@@ -0,0 +1,454 @@
+package dnsparser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+// the longest domain name on the wire, in octets (RFC 1035, section 2.3.4)
+const maxNameLength = 255
+
+// type codes of RFC 1035 whose RDATA is a single, possibly compressed, name
+const (
+	mbType  = 7
+	mgType  = 8
+	mrType  = 9
+	ptrType = 12
+)
+
+/*
+parseDomainName reads the domain name at offset, following compression
+pointers (RFC 1035, section 4.1.4), and moves the offset past it.
+Pointers must point backwards, so that a message can't make us loop.
+*/
+func parseDomainName(inputBytes []byte, bytesOffset *int) (string, error) {
+	var name strings.Builder
+	pos := *bytesOffset
+	jumped := false
+	length := 0
+
+	for {
+		if pos >= len(inputBytes) {
+			return "", fmt.Errorf("corrupt message: domain name out of bounds")
+		}
+		labelLength := int(inputBytes[pos])
+		switch {
+		case labelLength == 0:
+			if !jumped {
+				*bytesOffset = pos + 1
+			}
+			if name.Len() == 0 {
+				return ".", nil
+			}
+			return name.String(), nil
+		case labelLength&0xC0 == 0xC0:
+			if pos+2 > len(inputBytes) {
+				return "", fmt.Errorf("corrupt message: compression pointer out of bounds")
+			}
+			target := int(binary.BigEndian.Uint16(inputBytes[pos:]) & 0x3FFF)
+			if target >= pos {
+				return "", fmt.Errorf("corrupt message: compression pointer doesn't point backwards")
+			}
+			if !jumped {
+				*bytesOffset = pos + 2
+				jumped = true
+			}
+			pos = target
+		case labelLength > 63:
+			return "", fmt.Errorf("corrupt message: unknown label type")
+		default:
+			if pos+1+labelLength > len(inputBytes) {
+				return "", fmt.Errorf("corrupt message: label out of bounds")
+			}
+			length += labelLength + 1
+			if length+1 > maxNameLength {
+				return "", fmt.Errorf("corrupt message: domain name too long")
+			}
+			name.Write(inputBytes[pos+1 : pos+1+labelLength])
+			name.WriteByte('.')
+			pos += 1 + labelLength
+		}
+	}
+}
+
+// parses a question whose name may be compressed
+func parseMessageQuestion(inputBytes []byte, bytesOffset *int) (*zonefiles.QueryQuestion, error) {
+	name, err := parseDomainName(inputBytes, bytesOffset)
+	if err != nil {
+		return nil, err
+	}
+	if *bytesOffset+4 > len(inputBytes) {
+		return nil, fmt.Errorf("corrupt message: question out of bounds")
+	}
+	question := zonefiles.QueryQuestion{QName: name}
+	question.Qtype = int(binary.BigEndian.Uint16(inputBytes[*bytesOffset:]))
+	question.Qclass = int(binary.BigEndian.Uint16(inputBytes[*bytesOffset+2:]))
+	*bytesOffset += 4
+	return &question, nil
+}
+
+/*
+parseResourceRecord reads the record at offset. Records of the types we
+have a structure for are returned as such, with the names of their RDATA
+decompressed; the others are returned as UnknownRecord. The OPT pseudo
+record is returned as an EdnsOpt instead.
+*/
+func parseResourceRecord(inputBytes []byte, bytesOffset *int) (zonefiles.ResourceRecord, *EdnsOpt, error) {
+	name, err := parseDomainName(inputBytes, bytesOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *bytesOffset+10 > len(inputBytes) {
+		return nil, nil, fmt.Errorf("corrupt message: resource record too small")
+	}
+	rrType := binary.BigEndian.Uint16(inputBytes[*bytesOffset:])
+	class := binary.BigEndian.Uint16(inputBytes[*bytesOffset+2:])
+	ttl := binary.BigEndian.Uint32(inputBytes[*bytesOffset+4:])
+	rdLength := int(binary.BigEndian.Uint16(inputBytes[*bytesOffset+8:]))
+	*bytesOffset += 10
+	end := *bytesOffset + rdLength
+	if end > len(inputBytes) {
+		return nil, nil, fmt.Errorf("corrupt message: rdata out of bounds")
+	}
+
+	if rrType == optType {
+		*bytesOffset = end
+		return nil, &EdnsOpt{
+			UDPSize:       uint(class),
+			ExtendedRcode: int(ttl >> 24),
+			Version:       int((ttl >> 16) & 0xFF),
+			DO:            ttl&0x8000 != 0,
+		}, nil
+	}
+
+	// the RDATA is parsed on its own slice so that it can't overflow
+	// into the next record, names can still point anywhere before it
+	rdata := inputBytes[:end]
+	rr, err := parseRData(zonefiles.RType(rrType), rdata, *bytesOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	*bytesOffset = end
+
+	switch record := rr.(type) {
+	case *zonefiles.ARecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.AaaaRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.NSRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.CnameRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.MxRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.TxtRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.SoaRecord:
+		rr = zonefiles.NewSoaRecord(name, zonefiles.RClass(class), uint(ttl), record.Soa)
+	case *zonefiles.SrvRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.SvcbRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.DnskeyRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.DsRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.RrsigRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.NsecRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.Nsec3Record:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.Nsec3paramRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+	case *zonefiles.UnknownRecord:
+		record.Name, record.Class, record.TTL = name, zonefiles.RClass(class), uint(ttl)
+		record.Type = zonefiles.RType(rrType)
+	}
+	return rr, nil, nil
+}
+
+// parses the RDATA starting at offset and ending with the given slice
+func parseRData(rrType zonefiles.RType, rdata []byte, offset int) (zonefiles.ResourceRecord, error) {
+	data := rdata[offset:]
+
+	switch rrType {
+	case zonefiles.A:
+		if len(data) != net.IPv4len {
+			return nil, fmt.Errorf("corrupt message: bad A record length")
+		}
+		record := &zonefiles.ARecord{}
+		record.Value = net.IP(data).String()
+		return record, nil
+	case zonefiles.Aaaa:
+		if len(data) != net.IPv6len {
+			return nil, fmt.Errorf("corrupt message: bad AAAA record length")
+		}
+		record := &zonefiles.AaaaRecord{}
+		record.Value = net.IP(data).String()
+		return record, nil
+	case zonefiles.NS, zonefiles.Cname:
+		target, err := parseDomainName(rdata, &offset)
+		if err != nil {
+			return nil, err
+		}
+		if rrType == zonefiles.NS {
+			record := &zonefiles.NSRecord{}
+			record.Value = target
+			return record, nil
+		}
+		record := &zonefiles.CnameRecord{}
+		record.Value = target
+		return record, nil
+	case zonefiles.MX:
+		if len(data) < 3 {
+			return nil, fmt.Errorf("corrupt message: MX record too small")
+		}
+		record := &zonefiles.MxRecord{Preference: int(binary.BigEndian.Uint16(data))}
+		offset += 2
+		exchange, err := parseDomainName(rdata, &offset)
+		if err != nil {
+			return nil, err
+		}
+		record.Value = exchange
+		return record, nil
+	case zonefiles.TXT:
+		record := &zonefiles.TxtRecord{}
+		for len(data) > 0 {
+			length := int(data[0])
+			if 1+length > len(data) {
+				return nil, fmt.Errorf("corrupt message: character string out of bounds")
+			}
+			record.Strings = append(record.Strings, string(data[1:1+length]))
+			data = data[1+length:]
+		}
+		record.Value = zonefiles.FormatCharacterStrings(record.Strings)
+		return record, nil
+	case zonefiles.SOA:
+		// the owner is only known by the caller, which makes the record again
+		record := &zonefiles.SoaRecord{}
+		var err error
+		if record.MName, err = parseDomainName(rdata, &offset); err != nil {
+			return nil, err
+		}
+		if record.RName, err = parseDomainName(rdata, &offset); err != nil {
+			return nil, err
+		}
+		if offset+20 != len(rdata) {
+			return nil, fmt.Errorf("corrupt message: bad SOA record length")
+		}
+		values := make([]int, 5)
+		for i := range values {
+			values[i] = int(binary.BigEndian.Uint32(rdata[offset+4*i:]))
+		}
+		record.Serial, record.Refresh, record.Retry, record.Expire, record.Minimum = values[0], values[1], values[2], values[3], values[4]
+		return record, nil
+	case zonefiles.SRV:
+		if len(data) < 7 {
+			return nil, fmt.Errorf("corrupt message: SRV record too small")
+		}
+		record := &zonefiles.SrvRecord{}
+		record.Priority = int(binary.BigEndian.Uint16(data))
+		record.Weight = int(binary.BigEndian.Uint16(data[2:]))
+		record.Port = int(binary.BigEndian.Uint16(data[4:]))
+		offset += 6
+		target, err := parseDomainName(rdata, &offset)
+		if err != nil {
+			return nil, err
+		}
+		record.Value = target
+		return record, nil
+	case zonefiles.SVCB:
+		if len(data) < 3 {
+			return nil, fmt.Errorf("corrupt message: SVCB record too small")
+		}
+		record := &zonefiles.SvcbRecord{Priority: int(binary.BigEndian.Uint16(data))}
+		offset += 2
+		target, err := parseDomainName(rdata, &offset)
+		if err != nil {
+			return nil, err
+		}
+		record.Value = target
+		for params := rdata[offset:]; len(params) > 0; {
+			if len(params) < 4 {
+				return nil, fmt.Errorf("corrupt message: SVCB parameter too small")
+			}
+			length := int(binary.BigEndian.Uint16(params[2:]))
+			if 4+length > len(params) {
+				return nil, fmt.Errorf("corrupt message: SVCB parameter out of bounds")
+			}
+			param := zonefiles.SvcParam{Key: binary.BigEndian.Uint16(params), Value: append([]byte(nil), params[4:4+length]...)}
+			record.Params = append(record.Params, param)
+			params = params[4+length:]
+		}
+		return record, nil
+	case zonefiles.DNSKEY:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("corrupt message: DNSKEY record too small")
+		}
+		record := &zonefiles.DnskeyRecord{Flags: int(binary.BigEndian.Uint16(data)), Protocol: int(data[2]), Algorithm: int(data[3])}
+		record.PublicKey = append([]byte(nil), data[4:]...)
+		return record, nil
+	case zonefiles.DS:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("corrupt message: DS record too small")
+		}
+		record := &zonefiles.DsRecord{KeyTag: int(binary.BigEndian.Uint16(data)), Algorithm: int(data[2]), DigestType: int(data[3])}
+		record.Digest = append([]byte(nil), data[4:]...)
+		return record, nil
+	case zonefiles.RRSIG:
+		if len(data) < 19 {
+			return nil, fmt.Errorf("corrupt message: RRSIG record too small")
+		}
+		record := &zonefiles.RrsigRecord{
+			TypeCovered: zonefiles.RType(binary.BigEndian.Uint16(data)),
+			Algorithm:   int(data[2]),
+			Labels:      int(data[3]),
+			OriginalTtl: uint(binary.BigEndian.Uint32(data[4:])),
+			Expiration:  binary.BigEndian.Uint32(data[8:]),
+			Inception:   binary.BigEndian.Uint32(data[12:]),
+			KeyTag:      int(binary.BigEndian.Uint16(data[16:])),
+		}
+		offset += 18
+		signer, err := parseDomainName(rdata, &offset)
+		if err != nil {
+			return nil, err
+		}
+		record.SignerName = signer
+		record.Signature = append([]byte(nil), rdata[offset:]...)
+		return record, nil
+	case zonefiles.NSEC:
+		next, err := parseDomainName(rdata, &offset)
+		if err != nil {
+			return nil, err
+		}
+		types, err := parseTypeBitmap(rdata[offset:])
+		if err != nil {
+			return nil, err
+		}
+		return &zonefiles.NsecRecord{NextName: next, Types: types}, nil
+	case zonefiles.NSEC3:
+		if len(data) < 5 || len(data) < 6+int(data[4]) {
+			return nil, fmt.Errorf("corrupt message: NSEC3 record too small")
+		}
+		record := &zonefiles.Nsec3Record{HashAlgorithm: int(data[0]), Flags: int(data[1]), Iterations: int(binary.BigEndian.Uint16(data[2:]))}
+		saltEnd := 5 + int(data[4])
+		record.Salt = append([]byte(nil), data[5:saltEnd]...)
+		hashEnd := saltEnd + 1 + int(data[saltEnd])
+		if hashEnd > len(data) {
+			return nil, fmt.Errorf("corrupt message: NSEC3 hash out of bounds")
+		}
+		record.NextHashed = append([]byte(nil), data[saltEnd+1:hashEnd]...)
+		types, err := parseTypeBitmap(data[hashEnd:])
+		if err != nil {
+			return nil, err
+		}
+		record.Types = types
+		return record, nil
+	case zonefiles.NSEC3PARAM:
+		if len(data) < 5 || len(data) != 5+int(data[4]) {
+			return nil, fmt.Errorf("corrupt message: bad NSEC3PARAM record length")
+		}
+		return &zonefiles.Nsec3paramRecord{HashAlgorithm: int(data[0]), Flags: int(data[1]),
+			Iterations: int(binary.BigEndian.Uint16(data[2:])), Salt: append([]byte(nil), data[5:]...)}, nil
+	case mbType, mgType, mrType, ptrType:
+		// these names may be compressed, they are stored uncompressed
+		target, err := parseDomainName(rdata, &offset)
+		if err != nil {
+			return nil, err
+		}
+		encoded := make([]byte, maxNameLength)
+		var length uint
+		if serializeDomainName(target, encoded, &length, nil) {
+			return nil, fmt.Errorf("corrupt message: domain name too long")
+		}
+		return &zonefiles.UnknownRecord{Data: encoded[:length]}, nil
+	}
+	return &zonefiles.UnknownRecord{Data: append([]byte(nil), data...)}, nil
+}
+
+// parses the type bitmaps ending the RDATA of NSEC and NSEC3 records (RFC 4034, section 4.1.2)
+func parseTypeBitmap(data []byte) ([]zonefiles.RType, error) {
+	var types []zonefiles.RType
+	lastWindow := -1
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("corrupt message: type bitmap too small")
+		}
+		window, length := int(data[0]), int(data[1])
+		if window <= lastWindow || length == 0 || length > 32 || 2+length > len(data) {
+			return nil, fmt.Errorf("corrupt message: bad type bitmap")
+		}
+		for i, octet := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, zonefiles.RType(window<<8|i*8+bit))
+				}
+			}
+		}
+		lastWindow = window
+		data = data[2+length:]
+	}
+	return types, nil
+}
+
+func parseResourceRecords(inputBytes []byte, count uint, bytesOffset *int, message *DnsMessage) ([]*zonefiles.ResourceRecord, error) {
+	var records []*zonefiles.ResourceRecord
+	for i := uint(0); i < count; i++ {
+		rr, opt, err := parseResourceRecord(inputBytes, bytesOffset)
+		if err != nil {
+			return nil, err
+		}
+		if opt != nil {
+			message.Opt = opt
+			continue
+		}
+		records = append(records, &rr)
+	}
+	return records, nil
+}
+
+/*
+ParseDnsMessage parses a whole message, usually a response from another
+server, with the records of all of its sections. The OPT record, if
+any, is returned as the Opt of the message rather than as a record of
+the additional section.
+*/
+func ParseDnsMessage(inputBytes []byte) (*DnsMessage, error) {
+	bytesOffset := 0
+	message := DnsMessage{}
+
+	message.Header = parseQueryHeader(inputBytes, len(inputBytes), &bytesOffset)
+	if message.Header == nil {
+		return nil, fmt.Errorf("error parsing dns message header")
+	}
+
+	questions := make([]*zonefiles.QueryQuestion, 0, message.Header.Qdcount)
+	for i := uint(0); i < message.Header.Qdcount; i++ {
+		question, err := parseMessageQuestion(inputBytes, &bytesOffset)
+		if err != nil {
+			return nil, err
+		}
+		questions = append(questions, question)
+	}
+	message.Question = &questions
+
+	var err error
+	message.Answer, err = parseResourceRecords(inputBytes, message.Header.Ancount, &bytesOffset, &message)
+	if err != nil {
+		return nil, err
+	}
+	message.Authority, err = parseResourceRecords(inputBytes, message.Header.Nscount, &bytesOffset, &message)
+	if err != nil {
+		return nil, err
+	}
+	message.Additional, err = parseResourceRecords(inputBytes, message.Header.Arcount, &bytesOffset, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
@@ -0,0 +1,306 @@
+package dnssec
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/abhra303/qDNS/ds/trie"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+/*
+MaxNsec3Iterations is the most additional hash iterations of the NSEC3
+records we hash names for; answers proven with more are only treated as
+insecure, as hashing is costly (RFC 9276, section 3.2).
+*/
+const MaxNsec3Iterations = 150
+
+// returns true if name is zone or below it
+func isSubdomain(name, zone string) bool {
+	name, zone = CanonicalName(name), CanonicalName(zone)
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// returns the name without its first label, "." for the root
+func parentName(name string) string {
+	_, parent, _ := strings.Cut(CanonicalName(name), ".")
+	if parent == "" {
+		return "."
+	}
+	return parent
+}
+
+// returns the ancestor of the name having one label more than the ancestor
+func childOf(name, ancestor string) string {
+	for name = CanonicalName(name); parentName(name) != CanonicalName(ancestor) && name != "."; {
+		name = parentName(name)
+	}
+	return name
+}
+
+// returns the deepest common ancestor of two names
+func commonAncestor(a, b string) string {
+	a, b = CanonicalName(a), CanonicalName(b)
+	for !isSubdomain(b, a) {
+		a = parentName(a)
+	}
+	return a
+}
+
+// returns the wildcard name at the ancestor
+func wildcardOf(ancestor string) string {
+	if ancestor = CanonicalName(ancestor); ancestor == "." {
+		return "*."
+	}
+	return "*." + ancestor
+}
+
+/*
+NsecCovers reports whether the name falls strictly between the owner
+and the next name of the NSEC record in canonical order, the last
+record of a zone pointing back to its apex (RFC 4034, section 4.1.1).
+*/
+func NsecCovers(nsec *zonefiles.NsecRecord, name string) bool {
+	owner, next := nsec.GetName(), nsec.NextName
+	if trie.CompareNames(owner, next) < 0 {
+		return trie.CompareNames(owner, name) < 0 && trie.CompareNames(name, next) < 0
+	}
+	return trie.CompareNames(owner, name) < 0 || trie.CompareNames(name, next) < 0
+}
+
+// the same as NsecCovers, for the hashes of NSEC3 records
+func nsec3Covers(record *zonefiles.Nsec3Record, hash []byte) bool {
+	owner, next := record.OwnerHash(), record.NextHashed
+	if owner == nil {
+		return false
+	}
+	if bytes.Compare(owner, next) < 0 {
+		return bytes.Compare(owner, hash) < 0 && bytes.Compare(hash, next) < 0
+	}
+	return bytes.Compare(owner, hash) < 0 || bytes.Compare(hash, next) < 0
+}
+
+/*
+Denial holds the NSEC or NSEC3 records of a zone found in a response,
+whose signatures were verified, and tells what they prove about the
+names of the zone. NSEC3 records whose hash algorithm or parameters
+differ from the ones of the first NSEC3 record are ignored.
+*/
+type Denial struct {
+	Zone   string
+	Nsecs  []*zonefiles.NsecRecord
+	Nsec3s []*zonefiles.Nsec3Record
+}
+
+// the NSEC record whose owner is the name, and an NSEC record covering it
+func (d *Denial) nsecFor(name string) (*zonefiles.NsecRecord, *zonefiles.NsecRecord) {
+	var match, cover *zonefiles.NsecRecord
+	for _, nsec := range d.Nsecs {
+		if !isSubdomain(nsec.GetName(), d.Zone) {
+			continue
+		}
+		if trie.CompareNames(nsec.GetName(), name) == 0 {
+			match = nsec
+		} else if NsecCovers(nsec, name) {
+			cover = nsec
+		}
+	}
+	return match, cover
+}
+
+// the NSEC3 record of the hash of the name, and an NSEC3 record covering it
+func (d *Denial) nsec3For(name string) (*zonefiles.Nsec3Record, *zonefiles.Nsec3Record) {
+	if len(d.Nsec3s) == 0 {
+		return nil, nil
+	}
+	params := d.Nsec3s[0]
+	hash, err := zonefiles.Nsec3Hash(name, params.Iterations, params.Salt)
+	if err != nil {
+		return nil, nil
+	}
+	var match, cover *zonefiles.Nsec3Record
+	for _, record := range d.Nsec3s {
+		if record.HashAlgorithm != zonefiles.Nsec3Sha1 || record.Iterations != params.Iterations ||
+			!bytes.Equal(record.Salt, params.Salt) || parentName(record.GetName()) != CanonicalName(d.Zone) {
+			continue
+		}
+		if bytes.Equal(record.OwnerHash(), hash) {
+			match = record
+		} else if nsec3Covers(record, hash) {
+			cover = record
+		}
+	}
+	return match, cover
+}
+
+/*
+closestEncloser looks for the closest provable encloser of the name
+(RFC 5155, section 7.2.1): its deepest ancestor owning an NSEC3 record,
+whose child towards the name, the next closer name, is covered by
+another one. Returns the encloser and the record covering the next
+closer name, nil if there is no such proof.
+*/
+func (d *Denial) closestEncloser(name string) (string, *zonefiles.Nsec3Record) {
+	for candidate := parentName(name); isSubdomain(candidate, d.Zone); candidate = parentName(candidate) {
+		if match, _ := d.nsec3For(candidate); match != nil {
+			if _, cover := d.nsec3For(childOf(name, candidate)); cover != nil {
+				return candidate, cover
+			}
+			return "", nil
+		}
+		if candidate == "." {
+			break
+		}
+	}
+	return "", nil
+}
+
+/*
+NameError reports whether the records prove that the name doesn't exist
+and that no wildcard could have answered for it (RFC 4035, section
+5.4 and RFC 5155, section 8.4). The proof is reported as opted out if
+the name could be an unsigned delegation of an NSEC3 opt-out zone, in
+which case its answer can't be trusted as secure (RFC 5155, section 9.2).
+*/
+func (d *Denial) NameError(name string) (proven bool, optOut bool) {
+	if !isSubdomain(name, d.Zone) {
+		return false, false
+	}
+	if len(d.Nsecs) > 0 {
+		match, cover := d.nsecFor(name)
+		if match != nil || cover == nil {
+			return false, false
+		}
+		encloser := commonAncestor(name, cover.GetName())
+		if next := commonAncestor(name, cover.NextName); len(next) > len(encloser) {
+			encloser = next
+		}
+		wildcardMatch, wildcardCover := d.nsecFor(wildcardOf(encloser))
+		return wildcardMatch == nil && wildcardCover != nil, false
+	}
+
+	encloser, cover := d.closestEncloser(name)
+	if cover == nil {
+		return false, false
+	}
+	wildcardMatch, wildcardCover := d.nsec3For(wildcardOf(encloser))
+	return wildcardMatch == nil && wildcardCover != nil, cover.IsOptOut()
+}
+
+/*
+NoData reports whether the records prove that the name exists but has
+no records of the type, nor an alias, directly or through a wildcard
+(RFC 4035, section 5.4 and RFC 5155, sections 8.5 to 8.7). The NSEC or
+NSEC3 record of the parent side of a zone cut only proves the absence
+of DS records, the other types belonging to the child zone.
+*/
+func (d *Denial) NoData(name string, qtype zonefiles.RType) (proven bool, optOut bool) {
+	if !isSubdomain(name, d.Zone) {
+		return false, false
+	}
+	denies := func(types []zonefiles.RType) bool {
+		if zonefiles.HasType(types, qtype) || zonefiles.HasType(types, zonefiles.Cname) {
+			return false
+		}
+		delegation := zonefiles.HasType(types, zonefiles.NS) && !zonefiles.HasType(types, zonefiles.SOA)
+		return !delegation || qtype == zonefiles.DS
+	}
+
+	if len(d.Nsecs) > 0 {
+		match, cover := d.nsecFor(name)
+		if match != nil {
+			return denies(match.Types), false
+		}
+		if cover == nil {
+			return false, false
+		}
+		// an empty non-terminal: the names following it are below it
+		if next := CanonicalName(cover.NextName); next != CanonicalName(name) && isSubdomain(next, name) {
+			return true, false
+		}
+		encloser := commonAncestor(name, cover.GetName())
+		if next := commonAncestor(name, cover.NextName); len(next) > len(encloser) {
+			encloser = next
+		}
+		wildcard, _ := d.nsecFor(wildcardOf(encloser))
+		return wildcard != nil && denies(wildcard.Types), false
+	}
+
+	if match, _ := d.nsec3For(name); match != nil {
+		return denies(match.Types), false
+	}
+	encloser, cover := d.closestEncloser(name)
+	if cover == nil {
+		return false, false
+	}
+	if qtype == zonefiles.DS && cover.IsOptOut() {
+		// an unsigned delegation in an opt-out span
+		return true, true
+	}
+	wildcard, _ := d.nsec3For(wildcardOf(encloser))
+	return wildcard != nil && denies(wildcard.Types), cover.IsOptOut()
+}
+
+/*
+InsecureDelegation tells, given the records of a response denying the
+DS records of the name, whether the name is a delegation to an unsigned
+zone: a zone cut without DS records, or a name in the opt-out span of
+an NSEC3 record. Proven is false if the records don't prove that the
+name has no DS records.
+*/
+func (d *Denial) InsecureDelegation(name string) (insecure bool, proven bool) {
+	if !isSubdomain(name, d.Zone) {
+		return false, false
+	}
+	var types []zonefiles.RType
+	if len(d.Nsecs) > 0 {
+		match, cover := d.nsecFor(name)
+		if match == nil {
+			// the name doesn't exist or is an empty non-terminal
+			return false, cover != nil
+		}
+		types = match.Types
+	} else if match, _ := d.nsec3For(name); match != nil {
+		types = match.Types
+	} else {
+		_, cover := d.closestEncloser(name)
+		if cover == nil {
+			return false, false
+		}
+		return cover.IsOptOut(), true
+	}
+
+	if zonefiles.HasType(types, zonefiles.DS) || zonefiles.HasType(types, zonefiles.SOA) {
+		return false, false
+	}
+	return zonefiles.HasType(types, zonefiles.NS), true
+}
+
+/*
+WildcardAnswer reports whether the records prove that an answer
+synthesized from a wildcard having the given number of labels is the
+right one: the name it was synthesized for doesn't exist, nor any name
+closer to it than the wildcard (RFC 4035, section 5.3.4 and RFC 5155,
+section 8.8).
+*/
+func (d *Denial) WildcardAnswer(name string, labels int) (proven bool, optOut bool) {
+	if !isSubdomain(name, d.Zone) {
+		return false, false
+	}
+	if len(d.Nsecs) > 0 {
+		_, cover := d.nsecFor(name)
+		return cover != nil, false
+	}
+
+	// the next closer name has one label more than the wildcard's parent
+	parts := strings.Split(strings.TrimSuffix(CanonicalName(name), "."), ".")
+	if labels >= len(parts) {
+		return false, false
+	}
+	nextCloser := strings.Join(parts[len(parts)-labels-1:], ".") + "."
+	_, cover := d.nsec3For(nextCloser)
+	if cover == nil {
+		return false, false
+	}
+	return true, cover.IsOptOut()
+}
@@ -0,0 +1,166 @@
+package dnssec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+var denialZone = []string{
+	"$TTL=300",
+	"@ IN SOA ns1.example.test. admin.example.test. 1 7200 3600 1209600 60",
+	"@ IN NS ns1.example.test.",
+	"ns1 IN A 192.0.2.1",
+	"www IN A 192.0.2.2",
+	"host.ent IN A 192.0.2.3",
+	"*.wild IN A 192.0.2.4",
+	"secure IN NS ns.secure.example.test.",
+	"secure IN DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	"ns.secure IN A 192.0.2.5",
+	"insecure IN NS ns.insecure.example.test.",
+	"ns.insecure IN A 192.0.2.6",
+}
+
+// signs denialZone with the chain and puts it in the Catalog until the test ends
+func serveDenialZone(t *testing.T, nsec3 *zonefiles.Nsec3Params) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zone")
+	if err := os.WriteFile(path, []byte(strings.Join(denialZone, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zone, err := zonefiles.ParseZonefile("example.test.", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewZoneSigner(zone, writeKey(t, newKey(t, false)), "", 0, nsec3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signer.Sign(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	zonefiles.Catalog.Put(zone.Origin, zone)
+	t.Cleanup(func() { zonefiles.Catalog.Delete(zone.Origin) })
+}
+
+// returns the denial records of the answer to the question
+func denialOf(t *testing.T, qname string, qtype zonefiles.RType) *Denial {
+	t.Helper()
+	result, err := zonefiles.SearchResourceRecord(&zonefiles.QueryQuestion{QName: qname, Qtype: int(qtype), Qclass: int(zonefiles.IN)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denial := &Denial{Zone: "example.test."}
+	for _, rr := range result.Authority {
+		switch record := (*rr).(type) {
+		case *zonefiles.NsecRecord:
+			denial.Nsecs = append(denial.Nsecs, record)
+		case *zonefiles.Nsec3Record:
+			denial.Nsec3s = append(denial.Nsec3s, record)
+		}
+	}
+	return denial
+}
+
+func TestDenial(t *testing.T) {
+	// what a check reports with the NSEC, the NSEC3 and the opt-out NSEC3 chain
+	type outcome [3][2]bool
+	proven, provenOptOut, none := [2]bool{true, false}, [2]bool{true, true}, [2]bool{false, false}
+	// the opt-out flag only matters for proofs
+	proof := func(proven bool, optOut bool) (bool, bool) {
+		return proven, proven && optOut
+	}
+	nameError := func(name string) func(d *Denial) (bool, bool) {
+		return func(d *Denial) (bool, bool) { return proof(d.NameError(name)) }
+	}
+	noData := func(name string, qtype zonefiles.RType) func(d *Denial) (bool, bool) {
+		return func(d *Denial) (bool, bool) { return proof(d.NoData(name, qtype)) }
+	}
+	tests := []struct {
+		name string
+		// the question whose answer holds the denial records
+		qname string
+		qtype zonefiles.RType
+		check func(d *Denial) (bool, bool)
+		want  outcome
+	}{
+		{"name error", "nope.example.test.", zonefiles.A, nameError("nope.example.test."),
+			outcome{proven, proven, provenOptOut}},
+		{"name error below an empty non-terminal", "x.ent.example.test.", zonefiles.A, nameError("x.ent.example.test."),
+			outcome{proven, proven, provenOptOut}},
+		{"name error of an existing name", "www.example.test.", zonefiles.MX, nameError("www.example.test."),
+			outcome{none, none, none}},
+		{"name error out of the zone", "nope.example.test.", zonefiles.A, nameError("nope.example.org."),
+			outcome{none, none, none}},
+		{"no data", "www.example.test.", zonefiles.MX, noData("www.example.test.", zonefiles.MX),
+			outcome{proven, proven, proven}},
+		{"no data of a type the name has", "www.example.test.", zonefiles.MX, noData("www.example.test.", zonefiles.A),
+			outcome{none, none, none}},
+		{"no data at an empty non-terminal", "ent.example.test.", zonefiles.A, noData("ent.example.test.", zonefiles.A),
+			outcome{proven, proven, proven}},
+		{"no data from a wildcard", "a.wild.example.test.", zonefiles.MX, noData("a.wild.example.test.", zonefiles.MX),
+			outcome{proven, proven, provenOptOut}},
+		{"no data of a type the wildcard has", "a.wild.example.test.", zonefiles.MX, noData("a.wild.example.test.", zonefiles.A),
+			outcome{none, none, none}},
+		{"no DS at an unsigned delegation", "insecure.example.test.", zonefiles.DS, noData("insecure.example.test.", zonefiles.DS),
+			outcome{proven, proven, provenOptOut}},
+		{"no A at a delegation", "insecure.example.test.", zonefiles.DS, noData("insecure.example.test.", zonefiles.A),
+			outcome{none, none, none}},
+		{"wildcard answer", "a.wild.example.test.", zonefiles.A,
+			func(d *Denial) (bool, bool) { return proof(d.WildcardAnswer("a.wild.example.test.", 3)) },
+			outcome{proven, proven, provenOptOut}},
+		{"wildcard answer of an existing name", "a.wild.example.test.", zonefiles.A,
+			func(d *Denial) (bool, bool) { return proof(d.WildcardAnswer("www.example.test.", 2)) },
+			outcome{none, none, none}},
+		{"unsigned delegation", "insecure.example.test.", zonefiles.DS,
+			func(d *Denial) (bool, bool) { return d.InsecureDelegation("insecure.example.test.") },
+			outcome{{true, true}, {true, true}, {true, true}}},
+		{"name that is no delegation", "www.example.test.", zonefiles.MX,
+			func(d *Denial) (bool, bool) { return d.InsecureDelegation("www.example.test.") },
+			outcome{{false, true}, {false, true}, {false, true}}},
+	}
+
+	chains := []struct {
+		name   string
+		params *zonefiles.Nsec3Params
+	}{
+		{"NSEC", nil},
+		{"NSEC3", &zonefiles.Nsec3Params{Salt: []byte{0xAB}}},
+		{"NSEC3 opt-out", &zonefiles.Nsec3Params{Salt: []byte{0xAB}, OptOut: true}},
+	}
+	for i, chain := range chains {
+		t.Run(chain.name, func(t *testing.T) {
+			serveDenialZone(t, chain.params)
+			for _, test := range tests {
+				denial := denialOf(t, test.qname, test.qtype)
+				first, second := test.check(denial)
+				if want := test.want[i]; first != want[0] || second != want[1] {
+					t.Errorf("%s: got %v %v, want %v %v", test.name, first, second, want[0], want[1])
+				}
+			}
+
+			// a name error needs the record covering the wildcard too
+			denial := denialOf(t, "nope.example.test.", zonefiles.A)
+			var nsecs []*zonefiles.NsecRecord
+			for _, nsec := range denial.Nsecs {
+				if !NsecCovers(nsec, "*.example.test.") {
+					nsecs = append(nsecs, nsec)
+				}
+			}
+			var nsec3s []*zonefiles.Nsec3Record
+			for _, record := range denial.Nsec3s {
+				if hash, _ := zonefiles.Nsec3Hash("*.example.test.", record.Iterations, record.Salt); !nsec3Covers(record, hash) {
+					nsec3s = append(nsec3s, record)
+				}
+			}
+			denial.Nsecs, denial.Nsec3s = nsecs, nsec3s
+			if proven, _ := denial.NameError("nope.example.test."); proven {
+				t.Error("a name error is proven without the wildcard")
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+// the numbers of the signing algorithms (RFC 8624, section 3.1)
+const (
+	RsaSha1          = 5
+	RsaSha1Nsec3Sha1 = 7
+	RsaSha256        = 8
+	RsaSha512        = 10
+	EcdsaP256Sha256  = 13
+	EcdsaP384Sha384  = 14
+	Ed25519          = 15
+)
+
+// the digest types of DS records (RFC 8624, section 3.3)
+const (
+	Sha1Digest   = 1
+	Sha256Digest = 2
+	Sha384Digest = 4
+)
+
+// SupportedAlgorithm reports whether signatures of the algorithm can be verified
+func SupportedAlgorithm(algorithm int) bool {
+	switch algorithm {
+	case RsaSha1, RsaSha1Nsec3Sha1, RsaSha256, RsaSha512, EcdsaP256Sha256, EcdsaP384Sha384, Ed25519:
+		return true
+	}
+	return false
+}
+
+// SupportedDigest reports whether DS records of the digest type can be checked
+func SupportedDigest(digestType int) bool {
+	return digestType == Sha1Digest || digestType == Sha256Digest || digestType == Sha384Digest
+}
+
+// CanonicalName returns the lower case, fully qualified form of the name (RFC 4034, section 6.2)
+func CanonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+/*
+CountLabels returns the number of labels of the name as counted by the
+Labels field of RRSIG records: the root and a leading wildcard label
+are not counted (RFC 4034, section 3.1.3).
+*/
+func CountLabels(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 0
+	}
+	labels := strings.Split(name, ".")
+	if labels[0] == "*" {
+		return len(labels) - 1
+	}
+	return len(labels)
+}
+
+/*
+KeyTag returns the tag identifying the key in the RRSIG and DS records
+pointing to it (RFC 4034, appendix B).
+*/
+func KeyTag(key *zonefiles.DnskeyRecord) int {
+	rdata := make([]byte, 4, 4+len(key.PublicKey))
+	binary.BigEndian.PutUint16(rdata, uint16(key.Flags))
+	rdata[2], rdata[3] = byte(key.Protocol), byte(key.Algorithm)
+	rdata = append(rdata, key.PublicKey...)
+
+	var sum uint32
+	for i, octet := range rdata {
+		if i&1 == 0 {
+			sum += uint32(octet) << 8
+		} else {
+			sum += uint32(octet)
+		}
+	}
+	sum += sum >> 16
+	return int(sum & 0xFFFF)
+}
+
+/*
+Digest returns the digest of the key a DS record of the given digest
+type holds: the hash of the owner name of the key followed by its RDATA
+(RFC 4034, section 5.1.4).
+*/
+func Digest(key *zonefiles.DnskeyRecord, digestType int) ([]byte, error) {
+	owner, err := dnsparser.SerializeName(CanonicalName(key.GetName()))
+	if err != nil {
+		return nil, err
+	}
+	rdata, err := dnsparser.SerializeRData(key)
+	if err != nil {
+		return nil, err
+	}
+	data := append(owner, rdata...)
+
+	switch digestType {
+	case Sha1Digest:
+		digest := sha1.Sum(data)
+		return digest[:], nil
+	case Sha256Digest:
+		digest := sha256.Sum256(data)
+		return digest[:], nil
+	case Sha384Digest:
+		digest := sha512.Sum384(data)
+		return digest[:], nil
+	}
+	return nil, fmt.Errorf("dnssec: unsupported digest type %d", digestType)
+}
+
+// MatchesDs reports whether the DS record points to the key
+func MatchesDs(ds *zonefiles.DsRecord, key *zonefiles.DnskeyRecord) bool {
+	if ds.Algorithm != key.Algorithm || ds.KeyTag != KeyTag(key) || CanonicalName(ds.GetName()) != CanonicalName(key.GetName()) {
+		return false
+	}
+	digest, err := Digest(key, ds.DigestType)
+	return err == nil && bytes.Equal(digest, ds.Digest)
+}
+
+/*
+ValidAt reports whether the time is within the validity period of the
+signature. The times of signatures wrap around every 136 years, they
+are compared with serial number arithmetic (RFC 4034, section 3.1.5).
+*/
+func ValidAt(sig *zonefiles.RrsigRecord, t time.Time) bool {
+	now := uint32(t.Unix())
+	return int32(now-sig.Inception) >= 0 && int32(sig.Expiration-now) >= 0
+}
+
+/*
+canonicalRecord returns a copy of the record whose RDATA names are in
+lower case, for the types whose names are (RFC 4034, section 6.2 as
+updated by RFC 6840, section 5.1: the next name of NSEC records keeps
+its case).
+*/
+func canonicalRecord(rr zonefiles.ResourceRecord) zonefiles.ResourceRecord {
+	switch record := rr.(type) {
+	case *zonefiles.NSRecord:
+		c := *record
+		c.Value = strings.ToLower(c.Value)
+		return &c
+	case *zonefiles.CnameRecord:
+		c := *record
+		c.Value = strings.ToLower(c.Value)
+		return &c
+	case *zonefiles.MxRecord:
+		c := *record
+		c.Value = strings.ToLower(c.Value)
+		return &c
+	case *zonefiles.SrvRecord:
+		c := *record
+		c.Value = strings.ToLower(c.Value)
+		return &c
+	case *zonefiles.SoaRecord:
+		c := *record
+		c.MName, c.RName = strings.ToLower(c.MName), strings.ToLower(c.RName)
+		return &c
+	case *zonefiles.RrsigRecord:
+		c := *record
+		c.SignerName = strings.ToLower(c.SignerName)
+		return &c
+	case *zonefiles.UnknownRecord:
+		// the RDATA of these types is a single uncompressed name,
+		// whose length octets are never upper case letters
+		switch c := *record; c.Type {
+		case 7, 8, 9, 12:
+			c.Data = bytes.ToLower(c.Data)
+			return &c
+		}
+	}
+	return rr
+}
+
+/*
+SignedData returns the data the signature covers: its RDATA without the
+signature, followed by the records of the RRset in canonical form and
+order (RFC 4034, section 3.1.8.1). Records synthesized from a wildcard
+are signed with the owner name of the wildcard.
+*/
+func SignedData(sig *zonefiles.RrsigRecord, rrset []zonefiles.ResourceRecord) ([]byte, error) {
+	unsigned := *sig
+	unsigned.SignerName = CanonicalName(sig.SignerName)
+	unsigned.Signature = nil
+	data, err := dnsparser.SerializeRData(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("dnssec: no record to sign")
+	}
+
+	owner := CanonicalName(rrset[0].GetName())
+	if CountLabels(owner) > sig.Labels {
+		labels := strings.Split(strings.TrimSuffix(owner, "."), ".")
+		owner = "*." + strings.Join(labels[len(labels)-sig.Labels:], ".") + "."
+	}
+	wireOwner, err := dnsparser.SerializeName(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdata, err := dnsparser.SerializeRData(canonicalRecord(rr))
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[:], uint16(rrset[0].GetRType()))
+	binary.BigEndian.PutUint16(fixed[2:], uint16(rrset[0].GetRClass()))
+	binary.BigEndian.PutUint32(fixed[4:], uint32(sig.OriginalTtl))
+	for i, rdata := range rdatas {
+		// an RRset holds no duplicate records (RFC 2181, section 5)
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+		data = append(data, wireOwner...)
+		data = append(data, fixed[:]...)
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+// returns the hash function of the algorithm, 0 for the ones that don't prehash
+func algorithmHash(algorithm int) (crypto.Hash, error) {
+	switch algorithm {
+	case RsaSha1, RsaSha1Nsec3Sha1:
+		return crypto.SHA1, nil
+	case RsaSha256, EcdsaP256Sha256:
+		return crypto.SHA256, nil
+	case RsaSha512:
+		return crypto.SHA512, nil
+	case EcdsaP384Sha384:
+		return crypto.SHA384, nil
+	case Ed25519:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("dnssec: unsupported algorithm %d", algorithm)
+}
+
+/*
+parses an RSA public key: the length of the exponent on one octet, or
+on three starting with a zero, the exponent and the modulus (RFC 3110,
+section 2)
+*/
+func parseRsaKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 1 {
+		return nil, fmt.Errorf("dnssec: empty RSA key")
+	}
+	length, start := int(key[0]), 1
+	if length == 0 {
+		if len(key) < 3 {
+			return nil, fmt.Errorf("dnssec: RSA key too short")
+		}
+		length, start = int(binary.BigEndian.Uint16(key[1:])), 3
+	}
+	if length == 0 || start+length >= len(key) || length > 4 {
+		return nil, fmt.Errorf("dnssec: bad RSA key exponent")
+	}
+	exponent := new(big.Int).SetBytes(key[start : start+length])
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("dnssec: RSA key exponent too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(key[start+length:]), E: int(exponent.Int64())}, nil
+}
+
+// verifies the signature of the data with the public key of the algorithm
+func verifySignature(algorithm int, publicKey []byte, data []byte, signature []byte) error {
+	hash, err := algorithmHash(algorithm)
+	if err != nil {
+		return err
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		digest = h.Sum(nil)
+	}
+
+	switch algorithm {
+	case RsaSha1, RsaSha1Nsec3Sha1, RsaSha256, RsaSha512:
+		key, err := parseRsaKey(publicKey)
+		if err != nil {
+			return err
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case EcdsaP256Sha256, EcdsaP384Sha384:
+		// the key is the point Q and the signature r and s (RFC 6605, section 4)
+		curve := elliptic.P256()
+		if algorithm == EcdsaP384Sha384 {
+			curve = elliptic.P384()
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(publicKey) != 2*size || len(signature) != 2*size {
+			return fmt.Errorf("dnssec: bad ECDSA key or signature length")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(publicKey[:size]), Y: new(big.Int).SetBytes(publicKey[size:])}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("dnssec: ECDSA verification failed")
+		}
+		return nil
+	case Ed25519:
+		if len(publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("dnssec: bad Ed25519 key length")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(publicKey), data, signature) {
+			return fmt.Errorf("dnssec: Ed25519 verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("dnssec: unsupported algorithm %d", algorithm)
+}
+
+/*
+Verify checks that the signature of the RRset was made with the key.
+The key must be a zone key of the zone named by the signer of the
+signature, and match its algorithm and key tag. The validity period of
+the signature is not checked.
+*/
+func Verify(sig *zonefiles.RrsigRecord, key *zonefiles.DnskeyRecord, rrset []zonefiles.ResourceRecord) error {
+	if !key.IsZoneKey() || key.Protocol != zonefiles.DnskeyProtocol {
+		return fmt.Errorf("dnssec: the key of %s is not a zone key", key.GetName())
+	}
+	if key.Algorithm != sig.Algorithm || KeyTag(key) != sig.KeyTag || CanonicalName(key.GetName()) != CanonicalName(sig.SignerName) {
+		return fmt.Errorf("dnssec: the signature was not made with the key %d of %s", KeyTag(key), key.GetName())
+	}
+	data, err := SignedData(sig, rrset)
+	if err != nil {
+		return err
+	}
+	return verifySignature(sig.Algorithm, key.PublicKey, data, sig.Signature)
+}
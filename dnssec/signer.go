@@ -0,0 +1,305 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+const (
+	// how long signatures are valid if no validity is configured
+	DefaultSignatureValidity = 14 * 24 * time.Hour
+
+	/*
+	   Signatures are valid from a while before they are made, so
+	   that validators whose clock is late accept them.
+	*/
+	inceptionOffset = time.Hour
+
+	// the TTL of the DNSKEY records of zones without SOA record
+	defaultDnskeyTtl = 3600
+)
+
+// the flags of the DNSKEY records of key signing and zone signing keys
+const (
+	KskFlags = zonefiles.DnskeyZoneKey | zonefiles.DnskeySep
+	ZskFlags = zonefiles.DnskeyZoneKey
+)
+
+/*
+SigningKey is a private key of a zone along with the DNSKEY record
+publishing its public key. Only ECDSA P-256 and Ed25519 keys are
+supported, the algorithms recommended for signing (RFC 8624, section
+3.1).
+*/
+type SigningKey struct {
+	Dnskey  *zonefiles.DnskeyRecord
+	private crypto.PrivateKey
+}
+
+/*
+LoadSigningKey reads the PEM encoded private key of the file, in the
+PKCS #8 format or, for ECDSA keys, the SEC 1 one, as written by
+"openssl genpkey -algorithm ed25519" or "openssl ecparam -name
+prime256v1 -genkey". The DNSKEY record of the key is owned by the zone.
+*/
+func LoadSigningKey(path string, zone string, flags int, ttl uint) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("dnssec: no PEM encoded key in %s", path)
+	}
+	var private crypto.PrivateKey
+	if block.Type == "EC PRIVATE KEY" {
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dnssec: %s: %v", path, err)
+	}
+	return NewSigningKey(private, zone, flags, ttl)
+}
+
+// NewSigningKey returns the signing key of the zone having the private key
+func NewSigningKey(private crypto.PrivateKey, zone string, flags int, ttl uint) (*SigningKey, error) {
+	dnskey := &zonefiles.DnskeyRecord{Flags: flags, Protocol: zonefiles.DnskeyProtocol}
+	switch key := private.(type) {
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("dnssec: only the P-256 curve is supported for ECDSA keys")
+		}
+		// the point Q, its coordinates padded to the size of the curve (RFC 6605, section 4)
+		dnskey.Algorithm = EcdsaP256Sha256
+		dnskey.PublicKey = append(key.X.FillBytes(make([]byte, 32)), key.Y.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		dnskey.Algorithm = Ed25519
+		dnskey.PublicKey = append([]byte(nil), key.Public().(ed25519.PublicKey)...)
+	default:
+		return nil, fmt.Errorf("dnssec: unsupported key type %T, only ECDSA P-256 and Ed25519 keys are", private)
+	}
+	dnskey.Name, dnskey.Type, dnskey.Class, dnskey.TTL = CanonicalName(zone), zonefiles.DNSKEY, zonefiles.IN, ttl
+	dnskey.Value = dnskey.GetValue()
+	return &SigningKey{Dnskey: dnskey, private: private}, nil
+}
+
+/*
+Sign returns the signature of the RRset, valid from inception to
+expiration. The RRset is signed with the TTL of its first record as its
+original TTL.
+*/
+func (k *SigningKey) Sign(rrset []zonefiles.ResourceRecord, inception time.Time, expiration time.Time) (*zonefiles.RrsigRecord, error) {
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("dnssec: no record to sign")
+	}
+	first := rrset[0]
+	sig := &zonefiles.RrsigRecord{
+		TypeCovered: first.GetRType(),
+		Algorithm:   k.Dnskey.Algorithm,
+		Labels:      CountLabels(first.GetName()),
+		OriginalTtl: first.GetTtl(),
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      KeyTag(k.Dnskey),
+		SignerName:  k.Dnskey.GetName(),
+	}
+	sig.Name, sig.Type, sig.Class, sig.TTL = first.GetName(), zonefiles.RRSIG, first.GetRClass(), first.GetTtl()
+	data, err := SignedData(sig, rrset)
+	if err != nil {
+		return nil, err
+	}
+
+	switch private := k.private.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		r, s := signEcdsa(private, digest[:])
+		sig.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig.Signature = ed25519.Sign(private, data)
+	}
+	sig.Value = sig.GetValue()
+	return sig, nil
+}
+
+/*
+signEcdsa signs the SHA-256 digest with the P-256 key, the nonce being
+derived from the key and the digest (RFC 6979, section 3.2) rather than
+drawn at random, so that the same data always gets the same signature
+and signed zone files can be reproduced.
+*/
+func signEcdsa(private *ecdsa.PrivateKey, digest []byte) (*big.Int, *big.Int) {
+	curve := private.Curve
+	n := curve.Params().N
+	x := private.D.FillBytes(make([]byte, 32))
+	// the digest is as long as the order, it only has to be reduced
+	e := new(big.Int).SetBytes(digest)
+	h := new(big.Int).Mod(e, n).FillBytes(make([]byte, 32))
+
+	mac := func(key []byte, data ...[]byte) []byte {
+		m := hmac.New(sha256.New, key)
+		for _, d := range data {
+			m.Write(d)
+		}
+		return m.Sum(nil)
+	}
+	v := bytes.Repeat([]byte{0x01}, 32)
+	key := make([]byte, 32)
+	key = mac(key, v, []byte{0x00}, x, h)
+	v = mac(key, v)
+	key = mac(key, v, []byte{0x01}, x, h)
+	v = mac(key, v)
+	for {
+		v = mac(key, v)
+		k := new(big.Int).SetBytes(v)
+		if k.Sign() > 0 && k.Cmp(n) < 0 {
+			rx, _ := curve.ScalarBaseMult(v)
+			r := rx.Mod(rx, n)
+			if r.Sign() != 0 {
+				// s = k^-1 (e + x r) mod n
+				s := new(big.Int).Mul(r, private.D)
+				s.Add(s, e)
+				s.Mul(s, new(big.Int).ModInverse(k, n))
+				s.Mod(s, n)
+				if s.Sign() != 0 {
+					return r, s
+				}
+			}
+		}
+		key = mac(key, v, []byte{0x00})
+		v = mac(key, v)
+	}
+}
+
+/*
+ZoneSigner keeps a zone signed. The key signing key (KSK), the one the
+DS records of the parent zone point to, signs the DNSKEY RRset and the
+zone signing key (ZSK) every other RRset. Zones without a ZSK have all
+of their RRsets signed by their KSK.
+*/
+type ZoneSigner struct {
+	zone     *zonefiles.Zone
+	ksk      *SigningKey
+	zsk      *SigningKey
+	validity time.Duration
+
+	// the parameters of the NSEC3 chain of the zone, which has an NSEC one if nil
+	nsec3 *zonefiles.Nsec3Params
+}
+
+/*
+NewZoneSigner returns the signer of the zone with the keys of the files,
+the ZSK one being optional, whose signatures are valid for the given
+time, DefaultSignatureValidity if it is zero. The zone gets an NSEC3
+chain with the given parameters, or an NSEC chain if there are none.
+*/
+func NewZoneSigner(zone *zonefiles.Zone, kskFile string, zskFile string, validity time.Duration,
+	nsec3 *zonefiles.Nsec3Params) (*ZoneSigner, error) {
+	if validity == 0 {
+		validity = DefaultSignatureValidity
+	}
+	if nsec3 != nil && (nsec3.Iterations < 0 || nsec3.Iterations > MaxNsec3Iterations) {
+		return nil, fmt.Errorf("dnssec: NSEC3 iterations must be between 0 and %d, validators reject more", MaxNsec3Iterations)
+	}
+	if nsec3 != nil && len(nsec3.Salt) > 255 {
+		return nil, fmt.Errorf("dnssec: NSEC3 salts are at most 255 bytes long")
+	}
+	if validity < 4*inceptionOffset {
+		return nil, fmt.Errorf("dnssec: signatures must be valid for at least %v", 4*inceptionOffset)
+	}
+	ttl := dnskeyTtl(zone)
+	signer := &ZoneSigner{zone: zone, validity: validity, nsec3: nsec3}
+	var err error
+	if signer.ksk, err = LoadSigningKey(kskFile, zone.Origin, KskFlags, ttl); err != nil {
+		return nil, err
+	}
+	if zskFile != "" {
+		if signer.zsk, err = LoadSigningKey(zskFile, zone.Origin, ZskFlags, ttl); err != nil {
+			return nil, err
+		}
+	}
+	return signer, nil
+}
+
+// the DNSKEY records of a zone get the TTL of its SOA record
+func dnskeyTtl(zone *zonefiles.Zone) uint {
+	apex, _ := zone.Search(zone.Origin)
+	for _, rr := range apex {
+		if rr.GetRType() == zonefiles.SOA {
+			return rr.GetTtl()
+		}
+	}
+	return defaultDnskeyTtl
+}
+
+// Keys returns the DNSKEY records of the keys of the zone
+func (s *ZoneSigner) Keys() []*zonefiles.DnskeyRecord {
+	if s.zsk == nil {
+		return []*zonefiles.DnskeyRecord{s.ksk.Dnskey}
+	}
+	return []*zonefiles.DnskeyRecord{s.ksk.Dnskey, s.zsk.Dnskey}
+}
+
+/*
+Sign publishes the keys of the zone at its apex, builds its NSEC or
+NSEC3 chain and signs its RRsets again, the signatures being valid from
+a little before now.
+*/
+func (s *ZoneSigner) Sign(now time.Time) error {
+	return s.sign(now.Add(-inceptionOffset), now.Add(s.validity))
+}
+
+/*
+SignFrom signs the zone like Sign, with signatures valid from inception
+for the validity of the signer. The signed zone only depends on its
+records, its keys and the inception time.
+*/
+func (s *ZoneSigner) SignFrom(inception time.Time) error {
+	return s.sign(inception, inception.Add(s.validity))
+}
+
+func (s *ZoneSigner) sign(inception time.Time, expiration time.Time) error {
+	for _, key := range s.Keys() {
+		if err := s.zone.Put(s.zone.Origin, key); err != nil {
+			return err
+		}
+	}
+	return s.zone.Sign(s.nsec3, func(rrset []zonefiles.ResourceRecord) ([]*zonefiles.RrsigRecord, error) {
+		key := s.zsk
+		if key == nil || rrset[0].GetRType() == zonefiles.DNSKEY {
+			key = s.ksk
+		}
+		sig, err := key.Sign(rrset, inception, expiration)
+		if err != nil {
+			return nil, err
+		}
+		return []*zonefiles.RrsigRecord{sig}, nil
+	})
+}
+
+/*
+KeepSigned signs the zone again every quarter of the validity of the
+signatures, long before they expire, until the program ends.
+*/
+func (s *ZoneSigner) KeepSigned() {
+	for range time.Tick(s.validity / 4) {
+		if err := s.Sign(time.Now()); err != nil {
+			log.Printf("dnssec: can't sign %s again: %v\n", s.zone.Origin, err)
+		}
+	}
+}
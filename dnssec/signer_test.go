@@ -0,0 +1,159 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+func newKey(t *testing.T, useEcdsa bool) crypto.PrivateKey {
+	t.Helper()
+	if useEcdsa {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return private
+	}
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+// writes the private key in a PEM file
+func writeKey(t *testing.T, private crypto.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// signs the zone file from the inception and returns the signed zone file
+func signFrom(t *testing.T, path string, kskFile string, zskFile string, inception time.Time, nsec3 *zonefiles.Nsec3Params) []byte {
+	t.Helper()
+	zone, err := zonefiles.ParseZonefile("example.test.", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewZoneSigner(zone, kskFile, zskFile, 0, nsec3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signer.SignFrom(inception); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = zone.WriteZonefile(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestSignFromReproducible(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone")
+	lines := []string{"$TTL=300", "@ IN SOA ns.example.test. hostmaster.example.test. 1 7200 3600 1209600 60",
+		"@ IN NS ns.example.test.", "ns IN A 192.0.2.1", "www IN A 192.0.2.2", "www IN AAAA 2001:db8::2",
+		"mail IN MX 10 www.example.test."}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inception := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, useEcdsa := range []bool{false, true} {
+		ksk, zsk := writeKey(t, newKey(t, useEcdsa)), writeKey(t, newKey(t, useEcdsa))
+		for _, nsec3 := range []*zonefiles.Nsec3Params{nil, {Salt: []byte{0xAB, 0x12}}} {
+			first := signFrom(t, path, ksk, zsk, inception, nsec3)
+			second := signFrom(t, path, ksk, zsk, inception, nsec3)
+			if !bytes.Equal(first, second) {
+				t.Errorf("ECDSA %v, NSEC3 %v: signing twice gave different zone files:\n%s\n%s", useEcdsa, nsec3 != nil, first, second)
+			}
+			if !bytes.Contains(first, []byte("RRSIG")) {
+				t.Errorf("ECDSA %v, NSEC3 %v: the zone file has no signature:\n%s", useEcdsa, nsec3 != nil, first)
+			}
+			if later := signFrom(t, path, ksk, zsk, inception.Add(time.Second), nsec3); bytes.Equal(first, later) {
+				t.Errorf("ECDSA %v, NSEC3 %v: signing from another inception gave the same zone file", useEcdsa, nsec3 != nil)
+			}
+		}
+	}
+}
+
+func TestSignEcdsa(t *testing.T) {
+	key, err := NewSigningKey(newKey(t, true), "example.test.", ZskFlags, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &zonefiles.ARecord{}
+	record.Name, record.Type, record.Class, record.TTL, record.Value = "www.example.test.", zonefiles.A, zonefiles.IN, 300, "192.0.2.2"
+	rrset := []zonefiles.ResourceRecord{record}
+	inception := time.Now()
+
+	// the same RRset signed twice gets the same valid signature
+	var signatures [][]byte
+	for i := 0; i < 2; i++ {
+		sig, err := key.Sign(rrset, inception, inception.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sig.Signature) != 64 {
+			t.Errorf("got a signature of %d octets, want 64", len(sig.Signature))
+		}
+		if err = Verify(sig, key.Dnskey, rrset); err != nil {
+			t.Errorf("the signature doesn't verify: %v", err)
+		}
+		signatures = append(signatures, sig.Signature)
+	}
+	if !bytes.Equal(signatures[0], signatures[1]) {
+		t.Error("got different ECDSA signatures of the same RRset, want deterministic signatures")
+	}
+}
+
+// the P-256 and SHA-256 test vectors of RFC 6979, appendix A.2.5
+func TestSignEcdsaRfc6979(t *testing.T) {
+	fromHex := func(str string) *big.Int {
+		n, _ := new(big.Int).SetString(str, 16)
+		return n
+	}
+	private := &ecdsa.PrivateKey{D: fromHex("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")}
+	private.Curve = elliptic.P256()
+	private.X, private.Y = private.Curve.ScalarBaseMult(private.D.Bytes())
+
+	tests := []struct {
+		message string
+		r, s    string
+	}{
+		{"sample", "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716", "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+		{"test", "F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367", "019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083"},
+	}
+	for _, test := range tests {
+		digest := sha256.Sum256([]byte(test.message))
+		r, s := signEcdsa(private, digest[:])
+		if r.Cmp(fromHex(test.r)) != 0 || s.Cmp(fromHex(test.s)) != 0 {
+			t.Errorf("%s: got r %X and s %X, want %s and %s", test.message, r, s, test.r, test.s)
+		}
+		if !ecdsa.Verify(&private.PublicKey, digest[:], r, s) {
+			t.Errorf("%s: the signature doesn't verify", test.message)
+		}
+	}
+}
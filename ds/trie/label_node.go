@@ -0,0 +1,204 @@
+package trie
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+/*
+labelNode is a node of a NameTrie, one per label. Unlike trieNode it
+doesn't merge chains of nodes having a single child and no data: a
+label is already a single edge, and such chains are rare in zones, as
+names sit side by side below a few common ancestors.
+*/
+type labelNode[T any] struct {
+	label    string // case folded label, empty for the root
+	data     []T
+	children []*labelNode[T] // sorted in canonical order of their labels
+
+	// the change that created the node, see trieNode
+	gen uint64
+}
+
+/*
+foldCase lowers the ASCII letters of a label. Other octets are left as
+they are, DNS names are only case insensitive for ASCII (RFC 4343).
+*/
+func foldCase(label string) string {
+	for i := 0; i < len(label); i++ {
+		if label[i] >= 'A' && label[i] <= 'Z' {
+			b := []byte(label)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return label
+}
+
+/*
+find returns the position of the child having the given label, or the
+position it should be inserted at together with false. Labels are
+ordered as unsigned octet strings, a label sorting before every label
+it is a prefix of, which is the canonical order of RFC 4034, section
+6.1 once the labels are case folded.
+*/
+func (ln *labelNode[T]) find(label string) (int, bool) {
+	i := sort.Search(len(ln.children), func(i int) bool {
+		return ln.children[i].label >= label
+	})
+	return i, i < len(ln.children) && ln.children[i].label == label
+}
+
+func (ln *labelNode[T]) child(label string) *labelNode[T] {
+	i, found := ln.find(label)
+	if !found {
+		return nil
+	}
+	return ln.children[i]
+}
+
+// returns ln if it belongs to the generation gen, a copy belonging to it otherwise
+func (ln *labelNode[T]) mutable(gen uint64) *labelNode[T] {
+	if ln.gen == gen {
+		return ln
+	}
+	node := *ln
+	node.children = append([]*labelNode[T](nil), ln.children...)
+	node.gen = gen
+	return &node
+}
+
+// sets node as the child of its label, replacing the existing one
+func (ln *labelNode[T]) setChild(node *labelNode[T]) {
+	i, found := ln.find(node.label)
+	if found {
+		ln.children[i] = node
+		return
+	}
+	ln.children = append(ln.children, nil)
+	copy(ln.children[i+1:], ln.children[i:])
+	ln.children[i] = node
+}
+
+func (ln *labelNode[T]) removeChild(label string) {
+	i, found := ln.find(label)
+	if !found {
+		return
+	}
+	copy(ln.children[i:], ln.children[i+1:])
+	ln.children[len(ln.children)-1] = nil
+	ln.children = ln.children[:len(ln.children)-1]
+}
+
+/*
+childName returns the fully qualified name of the child having the
+given label of the node named parent. Names aren't stored in the nodes,
+they are built while going down the trie.
+*/
+func childName(parent, label string) string {
+	label = escapeLabel(label)
+	if parent == "." {
+		return label + "."
+	}
+	return label + "." + parent
+}
+
+/*
+escapeLabel returns the presentation format of a label: dots and
+backslashes are escaped with a backslash, octets that aren't printable
+ASCII with their "\DDD" decimal value.
+*/
+func escapeLabel(label string) string {
+	clean := true
+	for i := 0; i < len(label); i++ {
+		if c := label[i]; c == '.' || c == '\\' || c <= ' ' || c > '~' {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return label
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		switch c := label[i]; {
+		case c == '.' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c <= ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// returns the fully qualified name of the node at the end of the path of labels
+func pathName(labels []string) string {
+	name := "."
+	for _, label := range labels {
+		name = childName(name, label)
+	}
+	return name
+}
+
+// the first node of the subtree holding data in canonical order and its name, name is the name of ln
+func (ln *labelNode[T]) firstData(name string) (*labelNode[T], string) {
+	if len(ln.data) > 0 {
+		return ln, name
+	}
+	for _, child := range ln.children {
+		if node, nodeName := child.firstData(childName(name, child.label)); node != nil {
+			return node, nodeName
+		}
+	}
+	return nil, ""
+}
+
+// the last node of the subtree holding data in canonical order and its name, name is the name of ln
+func (ln *labelNode[T]) lastData(name string) (*labelNode[T], string) {
+	for i := len(ln.children) - 1; i >= 0; i-- {
+		child := ln.children[i]
+		if node, nodeName := child.lastData(childName(name, child.label)); node != nil {
+			return node, nodeName
+		}
+	}
+	if len(ln.data) > 0 {
+		return ln, name
+	}
+	return nil, ""
+}
+
+// visits the nodes of the subtree holding data in canonical order, name is the name of ln
+func (ln *labelNode[T]) walk(name string, fn func(key string, data []T) bool) bool {
+	if len(ln.data) > 0 && !fn(name, ln.data) {
+		return false
+	}
+	for _, child := range ln.children {
+		if !child.walk(childName(name, child.label), fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// adds the nodes of the subtree and the memory they use to stats
+func (ln *labelNode[T]) account(stats *TrieStats) {
+	var value T
+	stats.Nodes++
+	stats.Edges += len(ln.children)
+	stats.Values += len(ln.data)
+	stats.Bytes += int(unsafe.Sizeof(*ln)) + len(ln.label) +
+		cap(ln.children)*int(unsafe.Sizeof(ln)) + cap(ln.data)*int(unsafe.Sizeof(value))
+	for _, child := range ln.children {
+		child.account(stats)
+	}
+}
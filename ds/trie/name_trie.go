@@ -0,0 +1,511 @@
+package trie
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+NameTrie is a Trie keyed on domain names. Instead of indexing the keys
+character by character it has a node per label, starting from the
+rightmost one, so the node of a name is below the nodes of all of its
+ancestors. Names are case insensitive and "www.example.com" and
+"www.example.com." are the same key. Labels may hold any octet written
+with the escapes of the presentation format, the names given back by
+the trie are escaped the same way.
+
+A name exists in the trie if it holds data or if any name below it
+does (an empty non-terminal). Search returns no error for such names.
+*/
+type NameTrie[T any] interface {
+	Trie[T]
+
+	/*
+	   Returns the longest existing ancestor of the given name,
+	   the name itself if it exists.
+	*/
+	ClosestEncloser(name string) (string, error)
+
+	/*
+	   Returns the longest ancestor of the given name holding
+	   data, the name itself included, along with its data.
+	*/
+	LongestMatch(name string) (string, []T, error)
+
+	/*
+	   Return the name holding data that comes right before
+	   (after) the given name in the canonical order of RFC
+	   4034, section 6.1. The given name doesn't need to exist.
+	   false is returned if there is no such name.
+	*/
+	Predecessor(name string) (string, []T, bool)
+	Successor(name string) (string, []T, bool)
+
+	/*
+	   Calls fn for the given name and every name below it
+	   holding data, in canonical order, until fn returns
+	   false.
+	*/
+	Walk(name string, fn func(key string, data []T) bool) error
+}
+
+// a published version of a name trie
+type nameTrieVersion[T any] struct {
+	root *labelNode[T]
+	size int
+}
+
+// like trie, nameTrie is shared by the name trie and the views of its batches
+type nameTrie[T any] struct {
+	*versions[nameTrieVersion[T]]
+	config  trieConfig
+	inBatch bool
+}
+
+/*
+splitName returns the case folded labels of the name from the
+rightmost one to the leftmost one. The root is "." or "". Labels may
+hold any octet using the escapes of RFC 1035, section 5.1: "\X" for
+the character X (an escaped dot doesn't end the label) and "\DDD" for
+the octet whose decimal value is DDD.
+*/
+func splitName(name string) ([]string, error) {
+	if name == "" || name == "." {
+		return nil, nil
+	}
+
+	/*
+	   The labels are unescaped and case folded into a single
+	   buffer and sliced out of it once it is a string, so that
+	   splitting a name costs two allocations whatever its
+	   number of labels. Nodes keep copies of the labels they
+	   are created with (see modify), not the whole name.
+	*/
+	buf := make([]byte, 0, len(name))
+	ends := make([]int, 0, 8)
+	start := 0
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '.':
+			if len(buf) == start {
+				return nil, fmt.Errorf("the given name %s has an empty label", name)
+			}
+			ends = append(ends, len(buf))
+			start = len(buf)
+			continue
+		case c != '\\':
+			buf = append(buf, c)
+		case i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]):
+			value := int(name[i+1]-'0')*100 + int(name[i+2]-'0')*10 + int(name[i+3]-'0')
+			if value > 255 {
+				return nil, fmt.Errorf("the given name %s has a bad escape", name)
+			}
+			buf = append(buf, byte(value))
+			i += 3
+		case i+1 < len(name):
+			buf = append(buf, name[i+1])
+			i++
+		default:
+			return nil, fmt.Errorf("the given name %s ends with a backslash", name)
+		}
+		if len(buf)-start > 63 {
+			return nil, fmt.Errorf("the given name %s has a label longer than 63 octets", name)
+		}
+	}
+	if len(buf) > start {
+		ends = append(ends, len(buf))
+	}
+
+	// DNS names are only case insensitive for ASCII (RFC 4343)
+	for i, c := range buf {
+		if c >= 'A' && c <= 'Z' {
+			buf[i] = c + 'a' - 'A'
+		}
+	}
+	folded := string(buf)
+	labels := make([]string, len(ends))
+	start = 0
+	for i, end := range ends {
+		labels[len(ends)-1-i] = folded[start:end]
+		start = end
+	}
+	return labels, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// returns the length of the name made of the labels on the wire
+func wireLength(labels []string) int {
+	length := 1
+	for _, label := range labels {
+		length += len(label) + 1
+	}
+	return length
+}
+
+// tells if the name is longer on the wire than the key limit
+func (t *nameTrie[T]) IsExceedingKeyLimit(key string) bool {
+	labels, err := splitName(key)
+	if err != nil {
+		return t.config.isExceedingKeyLimit(key)
+	}
+	return wireLength(labels) > int(t.config.keyLimit)
+}
+
+func (t *nameTrie[T]) Put(key string, data T) error {
+	return t.modify(key, true, func(old []T, _ bool) ([]T, error) {
+		return addValue(t.config, old, data)
+	})
+}
+
+func (t *nameTrie[T]) Update(key string, data T) error {
+	return t.modify(key, false, func(old []T, exists bool) ([]T, error) {
+		if !exists {
+			return nil, fmt.Errorf("the given key doesn't exist")
+		}
+		return addValue(t.config, old, data)
+	})
+}
+
+func (t *nameTrie[T]) Delete(key string) ([]T, error) {
+	return t.DeleteValues(key, func(T) bool { return true })
+}
+
+func (t *nameTrie[T]) DeleteValues(key string, match func(T) bool) ([]T, error) {
+	var removed []T
+	err := t.modify(key, false, func(old []T, _ bool) ([]T, error) {
+		if len(old) == 0 {
+			return nil, fmt.Errorf("the given key doesn't hold data")
+		}
+		var kept []T
+		kept, removed = splitValues(old, match)
+		return kept, nil
+	})
+	return removed, err
+}
+
+func (t *nameTrie[T]) Modify(key string, fn func(data []T) ([]T, error)) error {
+	return t.modify(key, true, func(old []T, _ bool) ([]T, error) {
+		return fn(old)
+	})
+}
+
+/*
+modify replaces the values of the name with the ones returned by fn and
+publishes the new version of the trie. The nodes on the path to the
+name are copied, missing ones are only created if create is set, for
+names within the key limit. Nodes left without data and children are
+removed, so that names which only existed because of this one go away
+too.
+*/
+func (t *nameTrie[T]) modify(key string, create bool, fn func(old []T, exists bool) ([]T, error)) error {
+	labels, err := splitName(key)
+	if err != nil {
+		if create && t.config.isExceedingKeyLimit(key) {
+			return fmt.Errorf("error: the given key exceeds the key length limit")
+		}
+		return err
+	}
+	if create {
+		if wireLength(labels) > int(t.config.keyLimit) {
+			return fmt.Errorf("error: the given key exceeds the key length limit")
+		}
+		for _, label := range labels {
+			if err = t.config.checkBytes(label); err != nil {
+				return err
+			}
+		}
+	}
+
+	version, gen := t.lock(t.inBatch)
+	defer t.unlock(t.inBatch)
+
+	path := make([]*labelNode[T], len(labels)+1)
+	path[0] = version.root
+	for i, label := range labels {
+		if path[i] == nil {
+			break
+		}
+		path[i+1] = path[i].child(label)
+	}
+
+	node := path[len(labels)]
+	var old []T
+	exists := node != nil
+	if exists {
+		old = node.data
+	} else if !create {
+		return fmt.Errorf("the given key doesn't exist")
+	}
+	data, err := fn(old, exists)
+	if err != nil {
+		return err
+	}
+	if !exists && len(data) == 0 {
+		return nil
+	}
+
+	// copy the existing nodes on the path and create the missing ones, in place of the path
+	newPath := path
+	for i, node := range path {
+		if node != nil {
+			newPath[i] = node.mutable(gen)
+		} else {
+			// a copy, the label shares its memory with the whole name
+			newPath[i] = &labelNode[T]{label: strings.Clone(labels[i-1]), gen: gen}
+		}
+	}
+	newPath[len(labels)].data = data
+	for i := len(labels); i > 0; i-- {
+		node := newPath[i]
+		if len(node.data) == 0 && len(node.children) == 0 {
+			newPath[i-1].removeChild(node.label)
+		} else {
+			newPath[i-1].setChild(node)
+		}
+	}
+
+	size := version.size
+	if len(old) == 0 && len(data) > 0 {
+		size++
+	} else if len(old) > 0 && len(data) == 0 {
+		size--
+	}
+	t.publish(&nameTrieVersion[T]{root: newPath[0], size: size}, t.inBatch)
+	return nil
+}
+
+func (t *nameTrie[T]) Search(key string) ([]T, error) {
+	node, err := t.search(key)
+	if err != nil {
+		return nil, err
+	}
+	return node.data, nil
+}
+
+func (t *nameTrie[T]) IsEmpty() bool {
+	root := t.current.Load().root
+	return len(root.data) == 0 && len(root.children) == 0
+}
+
+func (t *nameTrie[T]) ClosestEncloser(name string) (string, error) {
+	path, labels, _, err := t.closest(name)
+	if err != nil {
+		return "", err
+	}
+	return pathName(labels[:len(path)-1]), nil
+}
+
+func (t *nameTrie[T]) LongestMatch(name string) (string, []T, error) {
+	path, labels, _, err := t.closest(name)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if len(path[i].data) > 0 {
+			return pathName(labels[:i]), path[i].data, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no ancestor of %s holds data", name)
+}
+
+func (t *nameTrie[T]) Predecessor(name string) (string, []T, bool) {
+	labels, err := splitName(name)
+	if err != nil {
+		return "", nil, false
+	}
+
+	var best *labelNode[T]
+	var bestName string
+	node, nodeName := t.current.Load().root, "."
+	for _, label := range labels {
+		// every node on the path comes before the name
+		if len(node.data) > 0 {
+			best, bestName = node, nodeName
+		}
+		// and so do the subtrees of the siblings on its left,
+		// which all come after the node itself
+		i, found := node.find(label)
+		for j := i - 1; j >= 0; j-- {
+			sibling := node.children[j]
+			if last, lastName := sibling.lastData(childName(nodeName, sibling.label)); last != nil {
+				best, bestName = last, lastName
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		node, nodeName = node.children[i], childName(nodeName, label)
+	}
+
+	if best == nil {
+		return "", nil, false
+	}
+	return bestName, best.data, true
+}
+
+func (t *nameTrie[T]) Successor(name string) (string, []T, bool) {
+	labels, err := splitName(name)
+	if err != nil {
+		return "", nil, false
+	}
+
+	// the subtrees on the right of the path to the name, the
+	// deepest one first
+	var right [][]*labelNode[T]
+	var rightParents []string
+	node, nodeName := t.current.Load().root, "."
+	exists := true
+	for _, label := range labels {
+		i, found := node.find(label)
+		rightParents = append(rightParents, nodeName)
+		if !found {
+			right = append(right, node.children[i:])
+			exists = false
+			break
+		}
+		right = append(right, node.children[i+1:])
+		node, nodeName = node.children[i], childName(nodeName, label)
+	}
+
+	if exists {
+		// the names below the given one come right after it
+		for _, child := range node.children {
+			if first, firstName := child.firstData(childName(nodeName, child.label)); first != nil {
+				return firstName, first.data, true
+			}
+		}
+	}
+	for i := len(right) - 1; i >= 0; i-- {
+		for _, sibling := range right[i] {
+			if first, firstName := sibling.firstData(childName(rightParents[i], sibling.label)); first != nil {
+				return firstName, first.data, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func (t *nameTrie[T]) Walk(name string, fn func(key string, data []T) bool) error {
+	node, err := t.search(name)
+	if err != nil {
+		return err
+	}
+	node.walk(canonicalKey(name), fn)
+	return nil
+}
+
+/*
+Range visits the names in [from, to) in canonical order. The first name
+is found with a lookup and the following ones with Successor.
+*/
+func (t *nameTrie[T]) Range(from, to string, fn func(key string, data []T) bool) {
+	var name string
+	var data []T
+	var ok bool
+	if node, err := t.search(from); err == nil && len(node.data) > 0 {
+		name, data, ok = canonicalKey(from), node.data, true
+	} else {
+		name, data, ok = t.Successor(from)
+	}
+	for ok && (to == "" || CompareNames(name, to) < 0) {
+		if !fn(name, data) {
+			return
+		}
+		name, data, ok = t.Successor(name)
+	}
+}
+
+func (t *nameTrie[T]) Len() int {
+	return t.current.Load().size
+}
+
+func (t *nameTrie[T]) Stats() TrieStats {
+	version := t.current.Load()
+	stats := TrieStats{Keys: version.size}
+	version.root.account(&stats)
+	return stats
+}
+
+/*
+CompareNames compares two domain names in the canonical order of RFC
+4034, section 6.1 and returns -1, 0 or +1 if a is before, equal to or
+after b. Names that can't be split into labels are compared as strings.
+*/
+func CompareNames(a, b string) int {
+	aLabels, aErr := splitName(a)
+	bLabels, bErr := splitName(b)
+	if aErr != nil || bErr != nil {
+		return strings.Compare(a, b)
+	}
+	for i := 0; i < len(aLabels) && i < len(bLabels); i++ {
+		if c := strings.Compare(aLabels[i], bLabels[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aLabels) < len(bLabels):
+		return -1
+	case len(aLabels) > len(bLabels):
+		return 1
+	}
+	return 0
+}
+
+// returns the name as it is stored in the trie: case folded and fully qualified
+func canonicalKey(name string) string {
+	labels, _ := splitName(name)
+	return pathName(labels)
+}
+
+/*
+closest returns the existing nodes on the path to the name, from the
+root to the deepest one, the labels of the name and whether the last
+node is the name itself. The node at path[i] is named by labels[:i].
+*/
+func (t *nameTrie[T]) closest(name string) ([]*labelNode[T], []string, bool, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	node := t.current.Load().root
+	path := []*labelNode[T]{node}
+	for _, label := range labels {
+		node = node.child(label)
+		if node == nil {
+			return path, labels, false, nil
+		}
+		path = append(path, node)
+	}
+	return path, labels, true, nil
+}
+
+func (t *nameTrie[T]) search(key string) (*labelNode[T], error) {
+	path, _, exact, err := t.closest(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exact {
+		return nil, fmt.Errorf("the given key doesn't exist")
+	}
+	return path[len(path)-1], nil
+}
+
+func (t *nameTrie[T]) Batch(fn func(batch Trie[T]) error) error {
+	if t.inBatch {
+		return fn(t)
+	}
+	return t.runBatch(func() error {
+		return fn(&nameTrie[T]{versions: t.versions, config: t.config, inBatch: true})
+	})
+}
+
+func NewNameTrie[T any](context *TrieContext) NameTrie[T] {
+	config := CreateNewTrieConfig(context)
+	t := &nameTrie[T]{versions: &versions[nameTrieVersion[T]]{}, config: config}
+	t.current.Store(&nameTrieVersion[T]{root: &labelNode[T]{}})
+	return t
+}
@@ -0,0 +1,216 @@
+package trie
+
+import (
+	"sort"
+	"testing"
+)
+
+// a name trie model: the names holding data sorted in canonical order
+type nameModel struct {
+	names []string
+	data  map[string][]int
+}
+
+func newNameModel(names []string) *nameModel {
+	m := &nameModel{data: make(map[string][]int)}
+	for i, name := range names {
+		key := canonicalKey(name)
+		if _, exists := m.data[key]; !exists {
+			m.names = append(m.names, key)
+		}
+		m.data[key] = append(m.data[key], i)
+	}
+	sort.Slice(m.names, func(i, j int) bool {
+		return CompareNames(m.names[i], m.names[j]) < 0
+	})
+	return m
+}
+
+// tells if the labels of the ancestor, root first, start the labels of the name
+func isAncestor(ancestor, name []string) bool {
+	if len(ancestor) > len(name) {
+		return false
+	}
+	for i := range ancestor {
+		if ancestor[i] != name[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// the last name before the given one, and the first one after it
+func (m *nameModel) neighbours(name string) (string, string) {
+	var before, after string
+	for _, n := range m.names {
+		if CompareNames(n, name) < 0 {
+			before = n
+		} else if CompareNames(n, name) > 0 && after == "" {
+			after = n
+		}
+	}
+	return before, after
+}
+
+// the longest ancestor of the name holding data, and the longest existing one
+func (m *nameModel) ancestors(name string) (string, string) {
+	labels, _ := splitName(name)
+	match, encloser := "", "."
+	for i := 0; i <= len(labels); i++ {
+		ancestor := labels[:i]
+		for _, n := range m.names {
+			nLabels, _ := splitName(n)
+			if isAncestor(ancestor, nLabels) {
+				encloser = pathName(ancestor)
+				if len(nLabels) == len(ancestor) {
+					match = n
+				}
+			}
+		}
+	}
+	return match, encloser
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNameTrieQueries(t *testing.T) {
+	names := []string{
+		"example.",
+		"www.example.",
+		"WWW.Example.",
+		"a.b.c.example.",
+		"z.example.",
+		"*.z.example.",
+		`a\.b.example.`,
+		`\065bc.example.`,
+		`\200x.example.`,
+		`a\\b.example.`,
+		"mail.Other.TEST.",
+		"x.y.other.test.",
+		"org.",
+	}
+	nt := NewNameTrie[int](nil)
+	for i, name := range names {
+		if err := nt.Put(name, i); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+	}
+	m := newNameModel(names)
+
+	queries := append([]string{
+		".",
+		"EXAMPLE",
+		"c.example.",
+		"b.c.example.",
+		"q.b.c.example.",
+		"A.B.C.Example.",
+		"deep.below.www.example.",
+		"abc.example.",
+		`a.b.example.`,
+		`\097\.B.example.`,
+		`\199.example.`,
+		`\201.example.`,
+		"aa.example.",
+		"zz.example.",
+		"y.other.test.",
+		"test.",
+		"com.",
+		"a.",
+		"zzz.",
+		"a.org.",
+	}, names...)
+	for _, q := range queries {
+		wantBefore, wantAfter := m.neighbours(q)
+		name, data, ok := nt.Predecessor(q)
+		if ok != (wantBefore != "") || name != wantBefore || !equalInts(data, m.data[wantBefore]) {
+			t.Errorf("predecessor of %s: got %q %v %v, want %q %v", q, name, data, ok, wantBefore, m.data[wantBefore])
+		}
+		name, data, ok = nt.Successor(q)
+		if ok != (wantAfter != "") || name != wantAfter || !equalInts(data, m.data[wantAfter]) {
+			t.Errorf("successor of %s: got %q %v %v, want %q %v", q, name, data, ok, wantAfter, m.data[wantAfter])
+		}
+
+		wantMatch, wantEncloser := m.ancestors(q)
+		name, data, err := nt.LongestMatch(q)
+		if (err == nil) != (wantMatch != "") || name != wantMatch || !equalInts(data, m.data[wantMatch]) {
+			t.Errorf("longest match of %s: got %q %v %v, want %q %v", q, name, data, err, wantMatch, m.data[wantMatch])
+		}
+		if name, err := nt.ClosestEncloser(q); err != nil || name != wantEncloser {
+			t.Errorf("closest encloser of %s: got %q %v, want %q", q, name, err, wantEncloser)
+		}
+	}
+
+	// names that can't be split are in no order
+	for _, q := range []string{"a..example.", `bad\`, `\256.example.`} {
+		if _, _, ok := nt.Predecessor(q); ok {
+			t.Errorf("predecessor of %s: got a name", q)
+		}
+		if _, _, ok := nt.Successor(q); ok {
+			t.Errorf("successor of %s: got a name", q)
+		}
+		if _, err := nt.ClosestEncloser(q); err == nil {
+			t.Errorf("closest encloser of %s: got no error", q)
+		}
+	}
+}
+
+func TestNameTrieRange(t *testing.T) {
+	nt := NewNameTrie[int](nil)
+	for i, name := range []string{"example.", "a.example.", "b.a.example.", "c.example.", "mail.c.example.", "host.x.example.", "z.example.", "other."} {
+		if err := nt.Put(name, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		from, to string
+		limit    int
+		want     []string
+	}{
+		{"whole trie", ".", "", 0,
+			[]string{"example.", "a.example.", "b.a.example.", "c.example.", "mail.c.example.", "host.x.example.", "z.example.", "other."}},
+		{"existing from is included, existing to excluded", "a.example.", "c.example.", 0,
+			[]string{"a.example.", "b.a.example."}},
+		{"missing bounds", "aa.example.", "d.example.", 0,
+			[]string{"c.example.", "mail.c.example."}},
+		{"bounds in mixed case", "A.Example.", "C.EXAMPLE", 0,
+			[]string{"a.example.", "b.a.example."}},
+		{"empty non-terminal from", "x.example.", "z.example.", 0,
+			[]string{"host.x.example."}},
+		{"no upper bound", "mail.c.example.", "", 0,
+			[]string{"mail.c.example.", "host.x.example.", "z.example.", "other."}},
+		{"empty range", "c.example.", "c.example.", 0, nil},
+		{"reversed bounds", "z.example.", "a.example.", 0, nil},
+		{"from after every name", "zz.", "", 0, nil},
+		{"early stop", "example.", "", 3,
+			[]string{"example.", "a.example.", "b.a.example."}},
+	}
+	for _, test := range tests {
+		var got []string
+		nt.Range(test.from, test.to, func(key string, data []int) bool {
+			got = append(got, key)
+			return test.limit == 0 || len(got) < test.limit
+		})
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
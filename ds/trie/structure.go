@@ -2,130 +2,357 @@ package trie
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 )
 
-type TrieContext struct {
-	KeyLimit uint16
-}
+/*
+Trie maps string keys to any number of values of type T. Values are
+kept in the order they were put. The trie returned by NewTrie orders
+its keys as octet strings, the one returned by NewNameTrie in the
+canonical order of domain names.
+
+Tries are safe for concurrent use. Reads never lock: they work on the
+version of the trie that was current when they started. Writes are
+serialized, they copy the nodes on the path to the key they change and
+publish the new version with an atomic swap of the root, so readers
+never see a partial change.
+*/
+type Trie[T any] interface {
+	Put(key string, data T) error
+	Update(key string, data T) error
+
+	/*
+	   Removes the key with all of its values and returns the
+	   removed values.
+	*/
+	Delete(key string) ([]T, error)
+
+	/*
+	   Removes the values of the key for which match returns
+	   true and returns them, the key goes away with its last
+	   value.
+	*/
+	DeleteValues(key string, match func(T) bool) ([]T, error)
+
+	/*
+	   Replaces the values of the key with the ones returned by
+	   fn, which gets the current values, as a single change. No
+	   change is made if fn returns an error.
+	*/
+	Modify(key string, fn func(data []T) ([]T, error)) error
+
+	Search(key string) ([]T, error)
+
+	/*
+	   Calls fn for every key starting with prefix that holds
+	   data, in order, until fn returns false.
+	*/
+	Walk(prefix string, fn func(key string, data []T) bool) error
+
+	/*
+	   Calls fn, in order, for every key holding data that is
+	   not before from and before to, until fn returns false.
+	   An empty to means there is no upper bound.
+	*/
+	Range(from, to string, fn func(key string, data []T) bool)
+
+	// returns the number of keys holding data
+	Len() int
 
-type Trie interface {
-	Put(key string, data interface{}) error
-	Update(key string, data interface{}) error
-	Delete(key string) (interface{}, error)
-	Search(key string) ([]interface{}, error)
 	IsEmpty() bool
+
+	// returns the size of the trie and an estimate of the memory it uses
+	Stats() TrieStats
+
+	/*
+	   Calls fn with a view of the trie and publishes all the
+	   changes made through the view at once when fn returns,
+	   or drops them if it returns an error. Readers keep
+	   seeing the trie as it was before the batch until then.
+	   The nodes created by the batch are changed in place,
+	   which makes loading many keys in a batch much faster
+	   than one by one. Writes made to the trie itself while
+	   the batch runs wait for it to end, and so do other
+	   batches. A batch started on the view joins the batch in
+	   progress.
+	*/
+	Batch(fn func(batch Trie[T]) error) error
+}
+
+type TrieStats struct {
+	// the number of keys holding data
+	Keys int
+
+	// the number of nodes, including the root
+	Nodes int
+
+	// the number of links from a node to one of its children
+	Edges int
+
+	// the number of values held by all the keys
+	Values int
+
+	/*
+	   An estimate of the memory used by the nodes, their keys
+	   and the slices holding the values, in bytes. Memory the
+	   values point to isn't counted.
+	*/
+	Bytes int
 }
 
-type trie struct {
-	root   *trieNode
-	config trieConfig
+// a published version of a trie
+type trieVersion[T any] struct {
+	root *trieNode[T]
+	size int
 }
 
-func (t *trie) IsExceedingKeyLimit(key string) bool {
-	return t.config.isExceedingKeyLimit(key)
+/*
+trie is shared by the trie and the views given to its batches, which
+only differ by inBatch.
+*/
+type trie[T any] struct {
+	*versions[trieVersion[T]]
+	config  trieConfig
+	inBatch bool
 }
 
-func (t *trie) Put(key string, data interface{}) error {
-	var err error
-	if key == "" {
-		t.root.put(data)
-		return nil
+/*
+versions holds the published version of a trie. Writers are serialized
+and every change gets a new generation, except inside a batch where all
+the changes share one and are published together when it ends.
+*/
+type versions[V any] struct {
+	current atomic.Pointer[V]
+	writer  sync.Mutex
+	gen     uint64
+
+	// held by the batch in progress, other writers wait for it to end
+	batching sync.Mutex
+
+	// the version built by the batch in progress, nil if there is none
+	batch *V
+}
+
+/*
+lock locks the writers and returns the version to change and the
+generation of the change, the ones of the batch in progress for the
+writes of the batch.
+*/
+func (v *versions[V]) lock(inBatch bool) (*V, uint64) {
+	if !inBatch {
+		v.batching.Lock()
 	}
-	if t.IsExceedingKeyLimit(key) {
-		return fmt.Errorf("error: the given key exceeds the key length limit")
+	v.writer.Lock()
+	if inBatch {
+		return v.batch, v.gen
+	}
+	v.gen++
+	return v.current.Load(), v.gen
+}
+
+// makes the version the current one, or the one of the batch in progress
+func (v *versions[V]) publish(version *V, inBatch bool) {
+	if inBatch {
+		v.batch = version
+	} else {
+		v.current.Store(version)
 	}
+}
 
-	var node *trieNode = t.root
-	var exist bool
-	for i, char := range key {
-		charByte := byte(char)
-		if i == len(key)-1 {
-			node, _, exist = iterateNode(node, charByte)
-			if exist {
-				node.put(data)
-			} else {
-				err = node.append(charByte, data)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		}
-		node, _, exist = iterateNode(node, charByte)
-		if !exist {
-			err = node.append(charByte, nil)
-			if err != nil {
-				return err
-			}
-			node, _, _ = iterateNode(node, charByte)
+func (v *versions[V]) unlock(inBatch bool) {
+	v.writer.Unlock()
+	if !inBatch {
+		v.batching.Unlock()
+	}
+}
+
+/*
+runBatch calls fn, the writes of the batch it makes publishing at once
+when it returns or being dropped if it returns an error.
+*/
+func (v *versions[V]) runBatch(fn func() error) error {
+	v.batching.Lock()
+	defer v.batching.Unlock()
+
+	v.writer.Lock()
+	v.gen++
+	v.batch = v.current.Load()
+	v.writer.Unlock()
+
+	err := fn()
+
+	v.writer.Lock()
+	defer v.writer.Unlock()
+	if err == nil {
+		v.current.Store(v.batch)
+	}
+	v.batch = nil
+	return err
+}
+
+/*
+splitValues returns the values for which match returns false and the
+ones for which it returns true, in new slices so that the values of a
+published node are never changed.
+*/
+func splitValues[T any](data []T, match func(T) bool) ([]T, []T) {
+	var kept, removed []T
+	for _, d := range data {
+		if match(d) {
+			removed = append(removed, d)
+		} else {
+			kept = append(kept, d)
 		}
 	}
-	return nil
+	return kept, removed
 }
 
-func (t *trie) Update(key string, data interface{}) error {
-	tn, err := t.search(key)
-	if err != nil {
-		return err
+func (t *trie[T]) IsExceedingKeyLimit(key string) bool {
+	return t.config.isExceedingKeyLimit(key)
+}
+
+func (t *trie[T]) Put(key string, data T) error {
+	if t.IsExceedingKeyLimit(key) {
+		return fmt.Errorf("error: the given key exceeds the key length limit")
 	}
-	tn.put(data)
-	return nil
+	return t.modify(key, true, func(old []T, _ bool) ([]T, error) {
+		return addValue(t.config, old, data)
+	})
 }
 
-func (t *trie) Delete(key string) (interface{}, error) {
-	var node *trieNode = t.root
-	var ci int = -1
-	var exist bool
-	for i, char := range key {
-		charByte := byte(char)
-		prevNode := node
-		node, ci, exist = iterateNode(node, charByte)
-		if !exist {
+func (t *trie[T]) Update(key string, data T) error {
+	return t.modify(key, false, func(old []T, exists bool) ([]T, error) {
+		if !exists {
 			return nil, fmt.Errorf("the given key doesn't exist")
 		}
+		return addValue(t.config, old, data)
+	})
+}
+
+func (t *trie[T]) Delete(key string) ([]T, error) {
+	return t.DeleteValues(key, func(T) bool { return true })
+}
 
-		if i == len(key)-1 {
-			copy(prevNode.children[ci:], prevNode.children[ci+1:])
-			prevNode.children[len(prevNode.children)-1] = nil // or the zero value of T
-			prevNode.children = prevNode.children[:len(prevNode.children)-1]
+func (t *trie[T]) DeleteValues(key string, match func(T) bool) ([]T, error) {
+	var removed []T
+	err := t.modify(key, false, func(old []T, _ bool) ([]T, error) {
+		if len(old) == 0 {
+			return nil, fmt.Errorf("the given key doesn't exist")
 		}
+		var kept []T
+		kept, removed = splitValues(old, match)
+		return kept, nil
+	})
+	return removed, err
+}
+
+func (t *trie[T]) Modify(key string, fn func(data []T) ([]T, error)) error {
+	if t.IsExceedingKeyLimit(key) {
+		return fmt.Errorf("error: the given key exceeds the key length limit")
 	}
-	return node.data, nil
+	return t.modify(key, true, func(old []T, _ bool) ([]T, error) {
+		return fn(old)
+	})
 }
 
-func (t *trie) Search(key string) ([]interface{}, error) {
-	tn, err := t.search(key)
-	if err != nil {
-		return nil, err
+/*
+modify replaces the values of the key with the ones returned by fn and
+publishes the new version of the trie. The nodes on the path to the key
+are copied, missing ones are only created if create is set, and the
+nodes left without data and children are pruned.
+*/
+func (t *trie[T]) modify(key string, create bool, fn func(old []T, exists bool) ([]T, error)) error {
+	key = t.config.normalize(key)
+	if create {
+		if err := t.config.checkBytes(key); err != nil {
+			return err
+		}
+	}
+
+	version, gen := t.lock(t.inBatch)
+	defer t.unlock(t.inBatch)
+
+	var old, data []T
+	root, changed, err := version.root.with(key, create, gen, func(o []T, exists bool) ([]T, error) {
+		var err error
+		old = o
+		data, err = fn(o, exists)
+		return data, err
+	})
+	if err != nil || !changed {
+		return err
 	}
 
+	size := version.size
+	if len(old) == 0 && len(data) > 0 {
+		size++
+	} else if len(old) > 0 && len(data) == 0 {
+		size--
+	}
+	t.publish(&trieVersion[T]{root: root, size: size}, t.inBatch)
+	return nil
+}
+
+func (t *trie[T]) Search(key string) ([]T, error) {
+	key = t.config.normalize(key)
+	tn, nodeKey, exists := t.current.Load().root.locate(key)
+	if !exists {
+		return nil, fmt.Errorf("the given key doesn't exist")
+	}
+	if nodeKey != key {
+		// the key only exists as the start of longer ones
+		return nil, nil
+	}
 	return tn.data, nil
 }
 
-func (t *trie) IsEmpty() bool {
-	if len(t.root.data) == 0 && t.root.children == nil {
+func (t *trie[T]) Walk(prefix string, fn func(key string, data []T) bool) error {
+	prefix = t.config.normalize(prefix)
+	tn, nodeKey, exists := t.current.Load().root.locate(prefix)
+	if !exists {
+		return fmt.Errorf("the given key doesn't exist")
+	}
+	tn.walk([]byte(nodeKey), fn)
+	return nil
+}
+
+func (t *trie[T]) Range(from, to string, fn func(key string, data []T) bool) {
+	from, to = t.config.normalize(from), t.config.normalize(to)
+	t.current.Load().root.walkRange(nil, from, to, fn)
+}
+
+func (t *trie[T]) Len() int {
+	return t.current.Load().size
+}
+
+func (t *trie[T]) IsEmpty() bool {
+	root := t.current.Load().root
+	if len(root.data) == 0 && len(root.children) == 0 {
 		return true
 	}
 	return false
 }
 
-func (t *trie) search(key string) (*trieNode, error) {
-	var node *trieNode = t.root
-	if key == "" {
-		return node, nil
-	}
-	var exist bool
-	for _, char := range key {
-		charByte := byte(char)
-		node, _, exist = iterateNode(node, charByte)
-		if !exist {
-			return nil, fmt.Errorf("the given key doesn't exist")
-		}
+func (t *trie[T]) Stats() TrieStats {
+	version := t.current.Load()
+	stats := TrieStats{Keys: version.size}
+	version.root.account(&stats)
+	return stats
+}
+
+func (t *trie[T]) Batch(fn func(batch Trie[T]) error) error {
+	if t.inBatch {
+		return fn(t)
 	}
-	return node, nil
+	return t.runBatch(func() error {
+		return fn(&trie[T]{versions: t.versions, config: t.config, inBatch: true})
+	})
 }
 
-func NewTrie(context *TrieContext) Trie {
+func NewTrie[T any](context *TrieContext) Trie[T] {
 	config := CreateNewTrieConfig(context)
-	return &trie{root: &trieNode{}, config: config}
+	t := &trie[T]{versions: &versions[trieVersion[T]]{}, config: config}
+	t.current.Store(&trieVersion[T]{root: &trieNode[T]{}})
+	return t
 }
@@ -1,25 +1,105 @@
 package trie
 
+import (
+	"fmt"
+	"reflect"
+)
+
+// the longest domain name in octets, the default key limit
+const DefaultKeyLimit = 255
+
+/*
+TrieContext holds the options of a trie. The zero value is a valid
+context: keys up to DefaultKeyLimit octets made of any octet, case
+sensitive, and values put as many times as asked.
+*/
+type TrieContext struct {
+	/*
+	   The longest key accepted, in octets, 0 standing for
+	   DefaultKeyLimit. Name tries count the octets of the
+	   name on the wire: every label with its length octet
+	   and the root label.
+	*/
+	KeyLimit uint16
+
+	/*
+	   Makes keys differing only in the case of ASCII letters
+	   the same key, keys are stored and returned in lower
+	   case. Name tries always ignore the case (RFC 4343).
+	*/
+	CaseInsensitive bool
+
+	/*
+	   The octets keys may be made of, every octet if empty.
+	   Name tries check the octets of their labels, escapes
+	   like "\." or "\000" being decoded first, so that binary
+	   labels can be allowed or refused like any other.
+	*/
+	AllowedBytes []ByteRange
+
+	// what putting a value the key already holds does
+	Duplicates DuplicatePolicy
+}
+
+// the octets from Low to High, both included
+type ByteRange struct {
+	Low, High byte
+}
+
+type DuplicatePolicy int
+
+/*
+Values are compared with reflect.DeepEqual, so two pointers are
+duplicates if they point to equal values.
+*/
+const (
+	// the value is added again
+	AllowDuplicates DuplicatePolicy = iota
+
+	// the value is not added again, without error
+	IgnoreDuplicates
+
+	// the value is not added again and an error is returned
+	RejectDuplicates
+)
+
 type trieConfig struct {
 	// for boolean configurations
 	flags int16
 
 	// for value configurations
-	// TODO: set default value
-	keyLimit uint16
+	keyLimit   uint16
+	allowed    [32]byte // bitmap of the allowed octets
+	duplicates DuplicatePolicy
 }
 
-// var configFlagAllowEmpty int16 = (1 << 0)
+var configFlagCaseInsensitive int16 = (1 << 0)
 
-func (c trieConfig) setFlags(ctx *TrieContext) {
-	// Ex:
-	// if ctx.AllowEmpty == true {
-	// 	c.flags |= configFlagAllowEmpty
-	// }
+func (c *trieConfig) setFlags(ctx *TrieContext) {
+	if ctx.CaseInsensitive {
+		c.flags |= configFlagCaseInsensitive
+	}
 }
 
 func CreateNewTrieConfig(ctx *TrieContext) trieConfig {
-	config := trieConfig{keyLimit: ctx.KeyLimit}
+	if ctx == nil {
+		ctx = &TrieContext{}
+	}
+	config := trieConfig{keyLimit: ctx.KeyLimit, duplicates: ctx.Duplicates}
+	if config.keyLimit == 0 {
+		config.keyLimit = DefaultKeyLimit
+	}
+
+	if len(ctx.AllowedBytes) == 0 {
+		for i := range config.allowed {
+			config.allowed[i] = 0xFF
+		}
+	}
+	for _, r := range ctx.AllowedBytes {
+		for b := int(r.Low); b <= int(r.High); b++ {
+			config.allowed[b/8] |= 1 << (b % 8)
+		}
+	}
 
 	config.setFlags(ctx)
 	return config
@@ -29,3 +109,47 @@ func (c trieConfig) isExceedingKeyLimit(key string) bool {
 	len := len(key)
 	return len > int(c.keyLimit)
 }
+
+func (c trieConfig) isCaseInsensitive() bool {
+	return c.flags&configFlagCaseInsensitive != 0
+}
+
+// returns the key as it is stored in the trie
+func (c trieConfig) normalize(key string) string {
+	if c.isCaseInsensitive() {
+		return foldCase(key)
+	}
+	return key
+}
+
+// checks that every octet of the key is allowed
+func (c trieConfig) checkBytes(key string) error {
+	for i := 0; i < len(key); i++ {
+		if c.allowed[key[i]/8]&(1<<(key[i]%8)) == 0 {
+			return fmt.Errorf("the octet %d is not allowed in keys", key[i])
+		}
+	}
+	return nil
+}
+
+/*
+addValue returns the values of a key once the given value is put,
+following the duplicate policy, in a new slice so that the values of a
+published node are never changed.
+*/
+func addValue[T any](c trieConfig, data []T, value T) ([]T, error) {
+	if c.duplicates != AllowDuplicates {
+		for _, d := range data {
+			if !reflect.DeepEqual(d, value) {
+				continue
+			}
+			if c.duplicates == RejectDuplicates {
+				return nil, fmt.Errorf("the key already holds the given value")
+			}
+			return data, nil
+		}
+	}
+	values := make([]T, len(data), len(data)+1)
+	copy(values, data)
+	return append(values, value), nil
+}
@@ -0,0 +1,202 @@
+package trie
+
+import (
+	"strings"
+	"testing"
+)
+
+// a value put in the tries, pointers to equal items being duplicates
+type item struct {
+	name string
+}
+
+type configStep struct {
+	key, value string
+	rejected   bool
+}
+
+func TestTrieContext(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	lowerCase := []ByteRange{{'a', 'z'}}
+	hostname := []ByteRange{{'a', 'z'}, {'0', '9'}, {'-', '-'}}
+
+	cases := []struct {
+		name  string
+		ctx   *TrieContext
+		names bool
+		steps []configStep
+
+		// the values of the keys after the steps, nil if absent
+		want map[string][]string
+	}{
+		{
+			name: "default key limit",
+			steps: []configStep{
+				{key: strings.Repeat("k", 255), value: "fits"},
+				{key: strings.Repeat("k", 256), value: "too long", rejected: true},
+			},
+			want: map[string][]string{strings.Repeat("k", 255): {"fits"}, strings.Repeat("k", 256): nil},
+		},
+		{
+			name: "key limit",
+			ctx:  &TrieContext{KeyLimit: 4},
+			steps: []configStep{
+				{key: "abcd", value: "fits"},
+				{key: "abcde", value: "too long", rejected: true},
+			},
+			want: map[string][]string{"abcd": {"fits"}, "abcde": nil},
+		},
+		{
+			name:  "default key limit of names",
+			names: true,
+			steps: []configStep{
+				{key: strings.Repeat(label63+".", 3) + strings.Repeat("b", 61) + ".", value: "255 octets"},
+				{key: strings.Repeat(label63+".", 4), value: "257 octets", rejected: true},
+			},
+			want: map[string][]string{
+				strings.Repeat(label63+".", 3) + strings.Repeat("b", 61) + ".": {"255 octets"},
+				strings.Repeat(label63+".", 4):                                 nil,
+			},
+		},
+		{
+			name:  "key limit of names on the wire",
+			ctx:   &TrieContext{KeyLimit: 12},
+			names: true,
+			steps: []configStep{
+				{key: "ab.example.", value: "12 octets"},
+				{key: "www.example.", value: "13 octets", rejected: true},
+			},
+			want: map[string][]string{"ab.example.": {"12 octets"}, "www.example.": nil},
+		},
+		{
+			name: "case sensitive",
+			steps: []configStep{
+				{key: "Key", value: "1"},
+				{key: "KEY", value: "2"},
+			},
+			want: map[string][]string{"Key": {"1"}, "KEY": {"2"}, "key": nil},
+		},
+		{
+			name: "case insensitive",
+			ctx:  &TrieContext{CaseInsensitive: true},
+			steps: []configStep{
+				{key: "Key", value: "1"},
+				{key: "KEY", value: "2"},
+			},
+			want: map[string][]string{"key": {"1", "2"}, "kEY": {"1", "2"}},
+		},
+		{
+			name: "allowed bytes",
+			ctx:  &TrieContext{AllowedBytes: lowerCase},
+			steps: []configStep{
+				{key: "abc", value: "letters"},
+				{key: "ab1", value: "digit", rejected: true},
+				{key: "AB", value: "upper case", rejected: true},
+			},
+			want: map[string][]string{"abc": {"letters"}, "ab1": nil, "AB": nil},
+		},
+		{
+			name: "allowed bytes after case folding",
+			ctx:  &TrieContext{AllowedBytes: lowerCase, CaseInsensitive: true},
+			steps: []configStep{
+				{key: "AB", value: "upper case"},
+			},
+			want: map[string][]string{"ab": {"upper case"}},
+		},
+		{
+			name:  "allowed bytes of names",
+			ctx:   &TrieContext{AllowedBytes: hostname},
+			names: true,
+			steps: []configStep{
+				{key: "host-1.example.", value: "hostname"},
+				{key: "_sip._udp.example.", value: "underscore", rejected: true},
+				{key: `a\.b.example.`, value: "escaped dot", rejected: true},
+				{key: `\000.example.`, value: "binary label", rejected: true},
+			},
+			want: map[string][]string{
+				"host-1.example.": {"hostname"}, "_sip._udp.example.": nil,
+				`a\.b.example.`: nil, `\000.example.`: nil,
+			},
+		},
+		{
+			name:  "binary labels allowed",
+			ctx:   &TrieContext{AllowedBytes: append([]ByteRange{{0, 0}, {'.', '.'}}, hostname...)},
+			names: true,
+			steps: []configStep{
+				{key: `\000.example.`, value: "binary label"},
+				{key: `a\.b.example.`, value: "escaped dot"},
+				{key: `\001.example.`, value: "other binary label", rejected: true},
+			},
+			want: map[string][]string{
+				`\000.example.`: {"binary label"}, `a\.b.example.`: {"escaped dot"}, `\001.example.`: nil,
+			},
+		},
+		{
+			name: "duplicates allowed",
+			steps: []configStep{
+				{key: "k", value: "v"},
+				{key: "k", value: "v"},
+			},
+			want: map[string][]string{"k": {"v", "v"}},
+		},
+		{
+			name: "duplicates ignored",
+			ctx:  &TrieContext{Duplicates: IgnoreDuplicates},
+			steps: []configStep{
+				{key: "k", value: "v"},
+				{key: "k", value: "v"},
+				{key: "k", value: "w"},
+			},
+			want: map[string][]string{"k": {"v", "w"}},
+		},
+		{
+			name: "duplicates rejected",
+			ctx:  &TrieContext{Duplicates: RejectDuplicates},
+			steps: []configStep{
+				{key: "k", value: "v"},
+				{key: "k", value: "v", rejected: true},
+				{key: "k", value: "w"},
+			},
+			want: map[string][]string{"k": {"v", "w"}},
+		},
+		{
+			name:  "duplicate names rejected",
+			ctx:   &TrieContext{Duplicates: RejectDuplicates},
+			names: true,
+			steps: []configStep{
+				{key: "www.example.", value: "v"},
+				{key: "WWW.example.", value: "v", rejected: true},
+				{key: "www.example.", value: "w"},
+			},
+			want: map[string][]string{"www.example.": {"v", "w"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var tr Trie[*item]
+			if c.names {
+				tr = NewNameTrie[*item](c.ctx)
+			} else {
+				tr = NewTrie[*item](c.ctx)
+			}
+			for _, step := range c.steps {
+				// a new pointer every time, duplicates are found by value
+				err := tr.Put(step.key, &item{step.value})
+				if (err != nil) != step.rejected {
+					t.Fatalf("Put(%q, %q): got error %v, want rejected %v", step.key, step.value, err, step.rejected)
+				}
+			}
+			for key, want := range c.want {
+				data, _ := tr.Search(key)
+				var got []string
+				for _, d := range data {
+					got = append(got, d.name)
+				}
+				if strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Errorf("%q holds %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
@@ -1,82 +1,273 @@
 package trie
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
 
-type trieNode struct {
-	bit             byte
-	avaliableBitmap [16]byte // bitmap of 128 chars
-	data            []interface{}
-	children        []*trieNode
+/*
+trieNode is a node of a radix tree: the edge from its parent holds a
+whole run of characters (prefix) instead of a single one, so chains of
+nodes having a single child and no data are collapsed into one node.
+A node without data always has at least two children, except for the
+root.
+*/
+type trieNode[T any] struct {
+	// the characters between the parent and the node, empty for the root
+	prefix string
+	data   []T
+
+	/*
+	   The first character of the prefix of every child, sorted,
+	   kept apart from the children so that looking up a child
+	   only scans a few contiguous bytes.
+	*/
+	index    []byte
+	children []*trieNode[T] // in the order of index
+
+	/*
+	   The change, or batch of changes, that created the node.
+	   Only nodes created by the change in progress can be
+	   changed in place, the others may be seen by readers.
+	*/
+	gen uint64
 }
 
-func (tn *trieNode) put(data interface{}) {
-	tn.data = append(tn.data, data)
+// returns the length of the longest common prefix of a and b
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
 }
 
-func (tn *trieNode) append(char byte, data interface{}) error {
-	if char == 0 {
-		return fmt.Errorf("the given charecter is empty")
+// returns tn if it belongs to the generation gen, a copy belonging to it otherwise
+func (tn *trieNode[T]) mutable(gen uint64) *trieNode[T] {
+	if tn.gen == gen {
+		return tn
 	}
-	charVal := int(char)
-	if charVal > 128 {
-		return fmt.Errorf("invalid character for name server")
+	node := *tn
+	node.index = append([]byte(nil), tn.index...)
+	node.children = append([]*trieNode[T](nil), tn.children...)
+	node.gen = gen
+	return &node
+}
+
+/*
+find returns the position of the child whose prefix starts with char,
+or the position it should be inserted at together with false.
+*/
+func (tn *trieNode[T]) find(char byte) (int, bool) {
+	i := sort.Search(len(tn.index), func(i int) bool {
+		return tn.index[i] >= char
+	})
+	return i, i < len(tn.index) && tn.index[i] == char
+}
+
+func (tn *trieNode[T]) child(char byte) *trieNode[T] {
+	i, found := tn.find(char)
+	if !found {
+		return nil
 	}
+	return tn.children[i]
+}
 
-	if tn.exists(charVal) {
-		return fmt.Errorf("can't append - charecter already exists")
+// sets node as the child for the first character of its prefix
+func (tn *trieNode[T]) set(node *trieNode[T]) {
+	char := node.prefix[0]
+	i, found := tn.find(char)
+	if found {
+		tn.children[i] = node
+		return
 	}
+	tn.index = append(tn.index, 0)
+	copy(tn.index[i+1:], tn.index[i:])
+	tn.index[i] = char
+	tn.children = append(tn.children, nil)
+	copy(tn.children[i+1:], tn.children[i:])
+	tn.children[i] = node
+}
 
-	err := tn.setBitmap(charVal)
-	if err != nil {
-		return err
+// removes the child node of the given character
+func (tn *trieNode[T]) remove(char byte) {
+	i, found := tn.find(char)
+	if !found {
+		return
 	}
+	tn.index = append(tn.index[:i], tn.index[i+1:]...)
+	copy(tn.children[i:], tn.children[i+1:])
+	tn.children[len(tn.children)-1] = nil
+	tn.children = tn.children[:len(tn.children)-1]
+}
 
-	node := &trieNode{bit: char}
-	node.data = append(node.data, data)
-	tn.children = append(tn.children, node)
+/*
+compact returns the node that should take the place of tn, which isn't
+the root, in its parent: nil if it has no data and no children, its
+only child with the prefixes joined if it has no data. The joined node
+keeps the generation of the child, whose slices it shares.
+*/
+func (tn *trieNode[T]) compact() *trieNode[T] {
+	if len(tn.data) > 0 || len(tn.children) > 1 {
+		return tn
+	}
+	if len(tn.children) == 0 {
+		return nil
+	}
+	node := *tn.children[0]
+	node.prefix = tn.prefix + node.prefix
+	return &node
+}
 
-	return nil
+/*
+locate returns the node at which the key ends together with the key of
+that node. The key of the node is longer than the given one when the
+key ends inside the prefix of the node; false is returned if no key of
+the trie starts with the given one.
+*/
+func (tn *trieNode[T]) locate(key string) (*trieNode[T], string, bool) {
+	node, rest := tn, key
+	for rest != "" {
+		child := node.child(rest[0])
+		if child == nil {
+			return nil, "", false
+		}
+		common := commonPrefix(rest, child.prefix)
+		if common == len(rest) {
+			return child, key + child.prefix[common:], true
+		}
+		if common < len(child.prefix) {
+			return nil, "", false
+		}
+		node, rest = child, rest[common:]
+	}
+	return node, key, true
 }
 
-// if char exists, return true
-func (tn *trieNode) exists(charVal int) bool {
-	bytePos := charVal / 8
+/*
+with returns tn changed so that the values of the key, relative to tn,
+are the ones returned by fn, along with whether anything changed. fn
+gets the current values of the key and whether it exists, i.e. whether
+any key of the trie starts with it. Missing nodes are only created if
+create is set.
 
-	if bytePos < len(tn.avaliableBitmap) {
-		var maskByte byte = 1 << (charVal % 8)
+Nodes of the generation gen are changed in place, the other ones are
+copied so that the published versions of the trie stay untouched.
+*/
+func (tn *trieNode[T]) with(key string, create bool, gen uint64, fn func(old []T, exists bool) ([]T, error)) (*trieNode[T], bool, error) {
+	if key == "" {
+		data, err := fn(tn.data, true)
+		if err != nil {
+			return nil, false, err
+		}
+		node := tn.mutable(gen)
+		node.data = data
+		return node, true, nil
+	}
 
-		resultBit := tn.avaliableBitmap[bytePos] & maskByte
-		if resultBit == maskByte {
-			return true
+	child := tn.child(key[0])
+	var common int
+	if child != nil {
+		common = commonPrefix(key, child.prefix)
+		if common == len(child.prefix) {
+			newChild, changed, err := child.with(key[common:], create, gen, fn)
+			if err != nil || !changed {
+				return tn, false, err
+			}
+			node := tn.mutable(gen)
+			if newChild = newChild.compact(); newChild == nil {
+				node.remove(key[0])
+			} else {
+				node.set(newChild)
+			}
+			return node, true, nil
 		}
 	}
-	return false
-}
 
-func (tn *trieNode) setBitmap(charVal int) error {
-	if charVal == 0 {
-		return fmt.Errorf("can't use zero as character value")
+	// the key ends inside the prefix of the child or leaves it
+	exists := child != nil && common == len(key)
+	if !exists && !create {
+		return nil, false, fmt.Errorf("the given key doesn't exist")
+	}
+	data, err := fn(nil, exists)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) == 0 {
+		return tn, false, nil
 	}
-	bytePos := charVal / 8
 
-	if bytePos < len(tn.avaliableBitmap) {
-		var maskByte byte = 1 << (charVal % 8)
+	node := tn.mutable(gen)
+	if child == nil {
+		node.set(&trieNode[T]{prefix: key, data: data, gen: gen})
+		return node, true, nil
+	}
+	// split the prefix of the child where the key leaves it, the
+	// rest of the child keeps its generation as it shares its
+	// slices with the child
+	split := &trieNode[T]{prefix: key[:common], gen: gen}
+	rest := *child
+	rest.prefix = child.prefix[common:]
+	split.set(&rest)
+	if exists {
+		split.data = data
+	} else {
+		split.set(&trieNode[T]{prefix: key[common:], data: data, gen: gen})
+	}
+	node.set(split)
+	return node, true, nil
+}
 
-		tn.avaliableBitmap[bytePos] = tn.avaliableBitmap[bytePos] | maskByte
-		return nil
+// visits the nodes of the subtree holding data, key is the key of tn
+func (tn *trieNode[T]) walk(key []byte, fn func(key string, data []T) bool) bool {
+	if len(tn.data) > 0 && !fn(string(key), tn.data) {
+		return false
+	}
+	for _, child := range tn.children {
+		if !child.walk(append(key, child.prefix...), fn) {
+			return false
+		}
 	}
-	return fmt.Errorf("the given integer exceeds the character limit")
+	return true
 }
 
-// gives the next node based on the character, returns
-// the same node if not found with a false bool type
-func iterateNode(tn *trieNode, char byte) (*trieNode, int, bool) {
-	if tn.exists(int(char)) {
-		for i, childNode := range tn.children {
-			if childNode.bit == char {
-				return childNode, i, true
-			}
+/*
+walkRange visits the nodes of the subtree holding a key in [from, to)
+in order, skipping the subtrees that are entirely before from. Keys
+of a subtree start with the key of its root, so once the key of a node
+is not before to, neither are the keys after it.
+*/
+func (tn *trieNode[T]) walkRange(key []byte, from, to string, fn func(key string, data []T) bool) bool {
+	k := string(key)
+	if to != "" && k >= to {
+		return false
+	}
+	if len(tn.data) > 0 && k >= from && !fn(k, tn.data) {
+		return false
+	}
+	for _, child := range tn.children {
+		childKey := append(key, child.prefix...)
+		if ck := string(childKey); ck < from && !strings.HasPrefix(from, ck) {
+			continue
+		}
+		if !child.walkRange(childKey, from, to, fn) {
+			return false
 		}
 	}
-	return tn, -1, false
+	return true
+}
+
+// adds the nodes of the subtree and the memory they use to stats
+func (tn *trieNode[T]) account(stats *TrieStats) {
+	var value T
+	stats.Nodes++
+	stats.Edges += len(tn.children)
+	stats.Values += len(tn.data)
+	stats.Bytes += int(unsafe.Sizeof(*tn)) + len(tn.prefix) + cap(tn.index) +
+		cap(tn.children)*int(unsafe.Sizeof(tn)) + cap(tn.data)*int(unsafe.Sizeof(value))
+	for _, child := range tn.children {
+		child.account(stats)
+	}
 }
@@ -0,0 +1,529 @@
+package trie
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// every key of up to maxLength characters of the alphabet
+func allKeys(alphabet string, maxLength int) []string {
+	keys := []string{""}
+	last := []string{""}
+	for i := 0; i < maxLength; i++ {
+		var next []string
+		for _, key := range last {
+			for _, c := range alphabet {
+				next = append(next, key+string(c))
+			}
+		}
+		keys = append(keys, next...)
+		last = next
+	}
+	return keys
+}
+
+/*
+checkTrieNode checks the structure of the subtree of a byte trie: the
+index holds the first character of the prefix of every child in order,
+and a node other than the root without data has at least two children,
+otherwise it should have been pruned or merged with its child.
+*/
+func checkTrieNode[T any](t *testing.T, tn *trieNode[T], key string, root bool) {
+	t.Helper()
+	if len(tn.index) != len(tn.children) {
+		t.Fatalf("node %q: %d index entries for %d children", key, len(tn.index), len(tn.children))
+	}
+	if !root && tn.prefix == "" {
+		t.Fatalf("node %q: empty prefix", key)
+	}
+	if !root && len(tn.data) == 0 && len(tn.children) < 2 {
+		t.Fatalf("node %q: no data and %d children", key, len(tn.children))
+	}
+	for i, child := range tn.children {
+		if child.prefix == "" || tn.index[i] != child.prefix[0] {
+			t.Fatalf("node %q: index entry %q for child %q", key, tn.index[i], child.prefix)
+		}
+		if i > 0 && tn.index[i-1] >= tn.index[i] {
+			t.Fatalf("node %q: index %q not sorted", key, tn.index)
+		}
+		checkTrieNode(t, child, key+child.prefix, false)
+	}
+}
+
+// checks that a name trie has no empty branch and its children are sorted
+func checkLabelNode[T any](t *testing.T, ln *labelNode[T], name string, root bool) {
+	t.Helper()
+	if !root && len(ln.data) == 0 && len(ln.children) == 0 {
+		t.Fatalf("node %s: no data and no children", name)
+	}
+	for i, child := range ln.children {
+		if i > 0 && ln.children[i-1].label >= child.label {
+			t.Fatalf("node %s: children %q and %q not sorted", name, ln.children[i-1].label, child.label)
+		}
+		checkLabelNode(t, child, childName(name, child.label), false)
+	}
+}
+
+/*
+checkModel compares the trie with the model after a step: the values of
+every key of the universe, whether the key exists, the number of keys
+and the keys given by Walk in order.
+*/
+func checkModel(t *testing.T, step string, tr Trie[int], model map[string][]int, universe []string, canonical func(string) string, exists func(string) bool, less func(a, b string) bool, walkFrom string) {
+	t.Helper()
+	for _, key := range universe {
+		data, err := tr.Search(key)
+		want := model[canonical(key)]
+		if len(want) == 0 {
+			if len(data) != 0 {
+				t.Fatalf("%s: key %q holds %v, want nothing", step, key, data)
+			}
+			if (err == nil) != exists(key) {
+				t.Fatalf("%s: key %q got error %v, want exists %v", step, key, err, exists(key))
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(data, want) {
+			t.Fatalf("%s: key %q holds %v (%v), want %v", step, key, data, err, want)
+		}
+	}
+	if tr.Len() != len(model) || tr.IsEmpty() != (len(model) == 0) {
+		t.Fatalf("%s: Len %d, IsEmpty %v for %d keys", step, tr.Len(), tr.IsEmpty(), len(model))
+	}
+
+	var walked, want []string
+	tr.Walk(walkFrom, func(key string, _ []int) bool {
+		walked = append(walked, key)
+		return true
+	})
+	for key := range model {
+		want = append(want, key)
+	}
+	sort.Slice(want, func(i, j int) bool { return less(want[i], want[j]) })
+	if strings.Join(walked, ",") != strings.Join(want, ",") {
+		t.Fatalf("%s: Walk gave %q, want %q", step, walked, want)
+	}
+}
+
+/*
+runModel applies random Put, Delete, DeleteValues and Search calls on
+keys of the universe to the trie and to a map, and checks that both
+agree after every step.
+*/
+func runModel(t *testing.T, r *rand.Rand, tr Trie[int], universe []string, canonical func(string) string, check func(step string, model map[string][]int)) {
+	model := make(map[string][]int)
+	for i := 0; i < 300; i++ {
+		key := universe[r.Intn(len(universe))]
+		value := r.Intn(4)
+		var step string
+		switch op := r.Intn(10); {
+		case op < 5:
+			step = fmt.Sprintf("Put(%q, %d)", key, value)
+			if err := tr.Put(key, value); err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			model[canonical(key)] = append(model[canonical(key)], value)
+		case op < 7:
+			step = fmt.Sprintf("Delete(%q)", key)
+			removed, err := tr.Delete(key)
+			if want := model[canonical(key)]; (err == nil) != (len(want) > 0) || !reflect.DeepEqual(removed, want) {
+				t.Fatalf("%s: removed %v (%v), want %v", step, removed, err, want)
+			}
+			delete(model, canonical(key))
+		case op < 9:
+			step = fmt.Sprintf("DeleteValues(%q, %d)", key, value)
+			removed, err := tr.DeleteValues(key, func(v int) bool { return v == value })
+			old := model[canonical(key)]
+			if (err == nil) != (len(old) > 0) {
+				t.Fatalf("%s: got error %v for values %v", step, err, old)
+			}
+			var kept, want []int
+			for _, v := range old {
+				if v == value {
+					want = append(want, v)
+				} else {
+					kept = append(kept, v)
+				}
+			}
+			if !reflect.DeepEqual(removed, want) {
+				t.Fatalf("%s: removed %v, want %v", step, removed, want)
+			}
+			if len(kept) == 0 {
+				delete(model, canonical(key))
+			} else {
+				model[canonical(key)] = kept
+			}
+		default:
+			step = fmt.Sprintf("Search(%q)", key)
+		}
+		check(step, model)
+	}
+}
+
+func TestTrieModel(t *testing.T) {
+	universe := allKeys("abc", 4)
+	for seed := int64(1); seed <= 30; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		tr := NewTrie[int](nil)
+		same := func(key string) string { return key }
+		runModel(t, r, tr, universe, same, func(step string, model map[string][]int) {
+			// the empty key is the root, which always exists
+			exists := func(key string) bool {
+				if key == "" {
+					return true
+				}
+				for k := range model {
+					if strings.HasPrefix(k, key) {
+						return true
+					}
+				}
+				return false
+			}
+			checkModel(t, step, tr, model, universe, same, exists, func(a, b string) bool { return a < b }, "")
+			checkTrieNode(t, tr.(*trie[int]).current.Load().root, "", true)
+		})
+	}
+}
+
+func TestNameTrieModel(t *testing.T) {
+	var universe []string
+	for _, key := range allKeys("abc", 3) {
+		labels := strings.Split(key, "")
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		name := strings.Join(append(labels, "example."), ".")
+		// names are case insensitive
+		universe = append(universe, name, strings.ToUpper(name))
+	}
+	canonical := func(name string) string { return strings.ToLower(name) }
+	for seed := int64(1); seed <= 30; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		tr := NewNameTrie[int](nil)
+		runModel(t, r, tr, universe, canonical, func(step string, model map[string][]int) {
+			exists := func(name string) bool {
+				name = canonical(name)
+				for k := range model {
+					if k == name || strings.HasSuffix(k, "."+name) {
+						return true
+					}
+				}
+				return false
+			}
+			less := func(a, b string) bool { return CompareNames(a, b) < 0 }
+			checkModel(t, step, tr, model, universe, canonical, exists, less, ".")
+			checkLabelNode(t, tr.(*nameTrie[int]).current.Load().root, ".", true)
+		})
+	}
+}
+
+/*
+hammer runs writers putting and deleting keys and a writer changing the
+values of a set of keys in batches, one generation at a time, against
+readers. A batch failing on every fifth generation must leave no trace,
+and the values a reader sees with a single Walk must all belong to the
+same published generation.
+*/
+func hammer(t *testing.T, tr Trie[int], batchKeys []string, otherKey func(i int) string, walkBatch func(fn func(key string, data []int) bool), read func(i int)) {
+	const generations = 300
+	done := make(chan struct{})
+	errs := make(chan error, 16)
+	var writers, readers sync.WaitGroup
+
+	for _, key := range batchKeys {
+		if err := tr.Put(key, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for g := 1; g <= generations; g++ {
+			gen := g
+			tr.Batch(func(batch Trie[int]) error {
+				for _, key := range batchKeys {
+					err := batch.Modify(key, func([]int) ([]int, error) { return []int{gen}, nil })
+					if err != nil {
+						return err
+					}
+				}
+				if gen%5 == 0 {
+					return fmt.Errorf("generation %d dropped", gen)
+				}
+				return nil
+			})
+		}
+	}()
+	for w := 0; w < 2; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 2000; i++ {
+				key := otherKey(i%50 + w*50)
+				if err := tr.Put(key, i); err != nil {
+					errs <- err
+					return
+				}
+				if i%3 == 0 {
+					tr.Delete(key)
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				seen, count := -1, 0
+				walkBatch(func(key string, data []int) bool {
+					count++
+					if len(data) != 1 || seen >= 0 && data[0] != seen || data[0]%5 == 0 && data[0] != 0 {
+						errs <- fmt.Errorf("%s holds %v after a batch of generation %d", key, data, seen)
+						return false
+					}
+					seen = data[0]
+					return true
+				})
+				if count != len(batchKeys) {
+					errs <- fmt.Errorf("walk saw %d of the %d batch keys", count, len(batchKeys))
+				}
+				read(i)
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, key := range batchKeys {
+		if data, err := tr.Search(key); err != nil || len(data) != 1 || data[0] != generations-1 {
+			t.Fatalf("%s holds %v (%v) after the last batch, want [%d]", key, data, err, generations-1)
+		}
+	}
+	count := 0
+	tr.Walk("", func(string, []int) bool {
+		count++
+		return true
+	})
+	if count != tr.Len() {
+		t.Fatalf("Walk saw %d keys, Len is %d", count, tr.Len())
+	}
+}
+
+func TestTrieConcurrency(t *testing.T) {
+	tr := NewTrie[int](nil)
+	var batchKeys []string
+	for i := 0; i < 20; i++ {
+		batchKeys = append(batchKeys, fmt.Sprintf("batch/%02d", i))
+	}
+	hammer(t, tr, batchKeys,
+		func(i int) string { return fmt.Sprintf("other/%d", i) },
+		func(fn func(string, []int) bool) { tr.Walk("batch/", fn) },
+		func(i int) {
+			tr.Search(fmt.Sprintf("other/%d", i%100))
+			tr.Range("other/1", "other/5", func(string, []int) bool { return true })
+			tr.Stats()
+		})
+}
+
+func TestNameTrieConcurrency(t *testing.T) {
+	tr := NewNameTrie[int](nil)
+	var batchKeys []string
+	for i := 0; i < 20; i++ {
+		batchKeys = append(batchKeys, fmt.Sprintf("h%d.batch.example.", i))
+	}
+	hammer(t, tr, batchKeys,
+		func(i int) string { return fmt.Sprintf("h%d.z%d.other.example.", i, i%7) },
+		func(fn func(string, []int) bool) { tr.Walk("batch.example.", fn) },
+		func(i int) {
+			name := fmt.Sprintf("h%d.z%d.other.example.", i%100, i%7)
+			tr.Search(name)
+			tr.Predecessor(name)
+			tr.Successor(name)
+			tr.LongestMatch("x." + name)
+			tr.ClosestEncloser(name)
+		})
+}
+
+func TestBatchOutsideWriters(t *testing.T) {
+	tries := map[string]Trie[int]{"byte": NewTrie[int](nil), "name": NewNameTrie[int](nil)}
+	for kind, tr := range tries {
+		locked := make(chan struct{})
+		written := make(chan error, 1)
+		go func() {
+			<-locked
+			written <- tr.Put("outside.example.", 2)
+		}()
+
+		err := tr.Batch(func(batch Trie[int]) error {
+			close(locked)
+			if err := batch.Put("inside.example.", 1); err != nil {
+				return err
+			}
+			// a nested batch joins this one and is dropped with it
+			batch.Batch(func(nested Trie[int]) error {
+				return nested.Put("nested.example.", 3)
+			})
+			// the outside write waits for the batch to end
+			select {
+			case err := <-written:
+				t.Errorf("%s: a write outside the batch returned %v while it ran", kind, err)
+			default:
+			}
+			return fmt.Errorf("batch dropped")
+		})
+		if err == nil {
+			t.Fatalf("%s: the failing batch returned no error", kind)
+		}
+		if err = <-written; err != nil {
+			t.Fatalf("%s: the write outside the batch failed: %v", kind, err)
+		}
+
+		if data, err := tr.Search("outside.example."); err != nil || len(data) != 1 || data[0] != 2 {
+			t.Errorf("%s: the write outside the failed batch was lost, got %v (%v)", kind, data, err)
+		}
+		for _, key := range []string{"inside.example.", "nested.example."} {
+			if data, _ := tr.Search(key); len(data) != 0 {
+				t.Errorf("%s: %s holds %v after the batch failed", kind, key, data)
+			}
+		}
+		if tr.Len() != 1 {
+			t.Errorf("%s: got %d keys, want the outside one alone", kind, tr.Len())
+		}
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []string
+	}{
+		{".", nil},
+		{"", nil},
+		{"WWW.Example.COM.", []string{"com", "example", "www"}},
+		{"www.example.com", []string{"com", "example", "www"}},
+		{`a\.b.example.`, []string{"example", "a.b"}},
+		{`\065\\B.example.`, []string{"example", `a\b`}},
+		{`\200x.example.`, []string{"example", "\xc8x"}},
+	}
+	for _, test := range tests {
+		labels, err := splitName(test.name)
+		if err != nil || !reflect.DeepEqual(labels, test.labels) {
+			t.Errorf("%s: got %q (%v), want %q", test.name, labels, err, test.labels)
+		}
+	}
+	for _, name := range []string{"a..example.", ".example.", `a\256.example.`, `example\`, strings.Repeat("a", 64) + ".example."} {
+		if labels, err := splitName(name); err == nil {
+			t.Errorf("%s: got %q, want an error", name, labels)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	type counts struct{ keys, nodes, edges, values int }
+	check := func(step string, tr Trie[int], want counts) {
+		t.Helper()
+		stats := tr.Stats()
+		got := counts{stats.Keys, stats.Nodes, stats.Edges, stats.Values}
+		if got != want || stats.Bytes <= 0 {
+			t.Fatalf("%s: got %+v and %d bytes, want %+v", step, got, stats.Bytes, want)
+		}
+	}
+
+	// "" -> r -> {om -> {an -> {e, us}, ulus}, ubens}
+	tr := NewTrie[int](nil)
+	for i, key := range []string{"romane", "romanus", "romulus", "rubens", "romane"} {
+		tr.Put(key, i)
+	}
+	check("byte trie", tr, counts{4, 8, 7, 5})
+	before := tr.Stats().Bytes
+
+	// the paths left with a single child are compressed again
+	tr.Delete("romanus")
+	check("delete romanus", tr, counts{3, 6, 5, 4})
+	tr.Delete("romulus")
+	check("delete romulus", tr, counts{2, 4, 3, 3})
+	tr.Delete("rubens")
+	check("delete rubens", tr, counts{1, 2, 1, 2})
+	if after := tr.Stats().Bytes; after >= before {
+		t.Errorf("%d bytes after the deletes, %d before", after, before)
+	}
+	if data, err := tr.Search("romane"); err != nil || len(data) != 2 {
+		t.Fatalf("romane holds %v (%v) after the deletes", data, err)
+	}
+	tr.Delete("romane")
+	check("empty byte trie", tr, counts{0, 1, 0, 0})
+
+	// . -> example. -> {www, mail, b -> a}
+	nt := NewNameTrie[int](nil)
+	for i, name := range []string{"www.example.", "mail.example.", "a.b.example.", "MAIL.example."} {
+		nt.Put(name, i)
+	}
+	check("name trie", nt, counts{3, 6, 5, 4})
+	nt.Delete("a.b.example.")
+	check("delete a.b.example.", nt, counts{2, 4, 3, 3})
+	nt.DeleteValues("mail.example.", func(v int) bool { return v == 1 })
+	check("delete a value of mail.example.", nt, counts{2, 4, 3, 2})
+	nt.Delete("www.example.")
+	nt.Delete("mail.example.")
+	check("empty name trie", nt, counts{0, 1, 0, 0})
+}
+
+// the names of a reverse zone of a million addresses
+var reverseNames = func() []string {
+	names := make([]string, 1<<20)
+	for i := range names {
+		names[i] = fmt.Sprintf("%d.%d.%d.10.in-addr.arpa.", i&255, i>>8&255, i>>16)
+	}
+	return names
+}
+
+func BenchmarkLoad1MRecords(b *testing.B) {
+	names := reverseNames()
+	b.Run("name", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t := NewNameTrie[int](nil)
+			t.Batch(func(batch Trie[int]) error {
+				for j, name := range names {
+					batch.Put(name, j)
+				}
+				return nil
+			})
+			if i == b.N-1 {
+				b.ReportMetric(float64(t.Stats().Bytes)/float64(len(names)), "bytes/record")
+			}
+		}
+	})
+	b.Run("byte", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t := NewTrie[int](nil)
+			t.Batch(func(batch Trie[int]) error {
+				for j, name := range names {
+					batch.Put(name, j)
+				}
+				return nil
+			})
+			if i == b.N-1 {
+				b.ReportMetric(float64(t.Stats().Bytes)/float64(len(names)), "bytes/record")
+			}
+		}
+	})
+}
@@ -0,0 +1,27 @@
+package trie
+
+/*
+UntypedTrie is the interface tries had before they were generic, where
+values are stored as interface{} and type asserted by the callers. It
+is kept for compatibility, new code should use Trie[T] instead.
+*/
+type UntypedTrie interface {
+	Put(key string, data interface{}) error
+	Update(key string, data interface{}) error
+	Delete(key string) (interface{}, error)
+	Search(key string) ([]interface{}, error)
+	IsEmpty() bool
+}
+
+// untypedTrie adapts a Trie[interface{}] to the UntypedTrie interface
+type untypedTrie struct {
+	Trie[interface{}]
+}
+
+func (t untypedTrie) Delete(key string) (interface{}, error) {
+	return t.Trie.Delete(key)
+}
+
+func NewUntypedTrie(context *TrieContext) UntypedTrie {
+	return untypedTrie{NewTrie[interface{}](context)}
+}
@@ -0,0 +1,88 @@
+package trie
+
+import (
+	"fmt"
+	"testing"
+)
+
+// the keys of the Put and Search benchmarks, names of a synthetic zone
+var benchKeys = func() []string {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("host%d.rack%d.example.com.", i, i%100)
+	}
+	return keys
+}()
+
+func BenchmarkPut(b *testing.B) {
+	b.Run("generic", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t := NewTrie[int](nil)
+			for j, key := range benchKeys {
+				t.Put(key, j)
+			}
+		}
+	})
+	b.Run("untyped", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t := NewUntypedTrie(nil)
+			for j, key := range benchKeys {
+				t.Put(key, j)
+			}
+		}
+	})
+}
+
+func BenchmarkSearch(b *testing.B) {
+	b.Run("generic", func(b *testing.B) {
+		t := NewTrie[int](nil)
+		for j, key := range benchKeys {
+			t.Put(key, j)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if data, _ := t.Search(benchKeys[i%len(benchKeys)]); len(data) != 1 {
+				b.Fatal("key not found")
+			}
+		}
+	})
+	b.Run("untyped", func(b *testing.B) {
+		t := NewUntypedTrie(nil)
+		for j, key := range benchKeys {
+			t.Put(key, j)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if data, _ := t.Search(benchKeys[i%len(benchKeys)]); len(data) != 1 {
+				b.Fatal("key not found")
+			}
+		}
+	})
+}
+
+func TestUntypedTrie(t *testing.T) {
+	u := NewUntypedTrie(nil)
+	if !u.IsEmpty() {
+		t.Fatal("new trie isn't empty")
+	}
+	if err := u.Put("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Put("a", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Update("b", 3); err == nil {
+		t.Error("Update created a missing key")
+	}
+	data, err := u.Search("a")
+	if err != nil || len(data) != 2 || data[0] != 1 || data[1] != "two" {
+		t.Fatalf("got %v, %v, want [1 two]", data, err)
+	}
+	removed, err := u.Delete("a")
+	if values, ok := removed.([]interface{}); err != nil || !ok || len(values) != 2 {
+		t.Fatalf("Delete returned %v, %v, want the two values", removed, err)
+	}
+	if !u.IsEmpty() {
+		t.Error("trie isn't empty after deleting its only key")
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
+	"time"
 
+	"github.com/abhra303/qDNS/cache"
 	"github.com/abhra303/qDNS/config"
+	"github.com/abhra303/qDNS/dnssec"
 	"github.com/abhra303/qDNS/listener"
 	"github.com/abhra303/qDNS/resolver"
 	"github.com/abhra303/qDNS/zonefiles"
@@ -17,6 +22,13 @@ func main() {
 	var err error
 	arguments := os.Args
 
+	if len(arguments) >= 2 && arguments[1] == "signzone" {
+		if err = signZone(arguments[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	if len(arguments) >= 2 {
 		path = arguments[1]
 	}
@@ -37,10 +49,94 @@ func main() {
 		return
 	}
 
-	if !zonefiles.LoadZones() {
+	forwarderConf := config.ServerConfiguration.Forwarder
+	if len(forwarderConf.Upstreams) > 0 {
+		resolver.Forwarding, err = resolver.NewForwarder(forwarderConf.Upstreams, forwarderConf.Policy,
+			forwarderConf.Transport, forwarderConf.TlsServerName, forwarderConf.Timeout, forwarderConf.HealthCheckInterval)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		go resolver.Forwarding.CheckHealth(nil)
+	}
+
+	for _, zoneConf := range config.ServerConfiguration.ForwardZones {
+		forwarder, err := resolver.NewForwarder(zoneConf.Upstreams, zoneConf.Policy,
+			zoneConf.Transport, zoneConf.TlsServerName, zoneConf.Timeout, zoneConf.HealthCheckInterval)
+		if err == nil {
+			err = resolver.ForwardZones.Put(zoneConf.Name, forwarder)
+		}
+		if err != nil {
+			fmt.Printf("forward zone %s: %v\n", zoneConf.Name, err)
+			return
+		}
+		go forwarder.CheckHealth(nil)
+	}
+
+	recursionConf := config.ServerConfiguration.Recursion
+	if resolver.Forwarding == nil && recursionConf.RootHints != "" {
+		resolver.Recursion, err = resolver.NewRecursor(recursionConf.RootHints, recursionConf.Port, recursionConf.Timeout,
+			recursionConf.Retries, recursionConf.MaxReferrals, recursionConf.MaxDepth, recursionConf.QnameMinimisation)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	resolving := resolver.Forwarding != nil || resolver.Recursion != nil || !resolver.ForwardZones.IsEmpty()
+	if trustAnchors := config.ServerConfiguration.Dnssec.TrustAnchors; resolving && trustAnchors != "" {
+		resolver.Validation, err = resolver.NewValidator(trustAnchors)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	cacheConf := config.ServerConfiguration.Cache
+	if resolving && !cacheConf.Disabled {
+		resolver.Caching = cache.NewCache(cacheConf.Size, cacheConf.MaxTtl, cacheConf.MaxNegativeTtl,
+			cacheConf.ServeStale, cacheConf.Prefetch)
+		go func() {
+			for range time.Tick(time.Minute) {
+				stats := resolver.Caching.Stats()
+				log.Printf("cache: %d entries, %d hits, %d misses, %d evictions, %d stale hits, %d prefetches\n",
+					stats.Entries, stats.Hits, stats.Misses, stats.Evictions, stats.StaleHits, stats.Prefetches)
+			}
+		}()
+	}
+
+	// a forwarder or a recursive resolver doesn't need zones of its own
+	if !zonefiles.LoadZones() && !resolving {
 		fmt.Println("unable to load zones...")
 		return
 	}
+	for _, zoneConf := range config.ServerConfiguration.Zones {
+		if zoneConf.Dnssec.KskFile == "" {
+			continue
+		}
+		zones, err := zonefiles.Catalog.Search(zoneConf.ZoneName)
+		if err != nil || len(zones) == 0 {
+			continue
+		}
+		var nsec3 *zonefiles.Nsec3Params
+		if zoneConf.Dnssec.Nsec3.Enabled {
+			nsec3 = &zonefiles.Nsec3Params{Iterations: zoneConf.Dnssec.Nsec3.Iterations, OptOut: zoneConf.Dnssec.Nsec3.OptOut}
+			nsec3.Salt, err = hex.DecodeString(zoneConf.Dnssec.Nsec3.Salt)
+		}
+		var signer *dnssec.ZoneSigner
+		if err == nil {
+			signer, err = dnssec.NewZoneSigner(zones[0], zoneConf.Dnssec.KskFile, zoneConf.Dnssec.ZskFile,
+				zoneConf.Dnssec.SignatureValidity, nsec3)
+		}
+		if err == nil {
+			err = signer.Sign(time.Now())
+		}
+		if err != nil {
+			fmt.Printf("zone %s: %v\n", zoneConf.ZoneName, err)
+			return
+		}
+		go signer.KeepSigned()
+	}
 
 	fmt.Printf("starting server at port %v ...\n", port)
 
@@ -2,12 +2,94 @@ package resolver
 
 import (
 	"fmt"
+	"log"
 	"net"
 
+	"github.com/abhra303/qDNS/cache"
 	"github.com/abhra303/qDNS/dnsparser"
 	"github.com/abhra303/qDNS/zonefiles"
 )
 
+/*
+Caching keeps the answers of the upstream servers, or of the servers
+found by recursion, for as long as they are valid. It is nil if caching
+is disabled.
+*/
+var Caching cache.Cache
+
+/*
+resolveElsewhere answers a query for a name outside of our zones from
+the cache, or else through the forwarder of the name or the recursor. Popular
+answers are refreshed in the background shortly before they expire, and
+expired answers are served if the servers having the answer fail.
+*/
+func resolveElsewhere(query *dnsparser.DnsQuery) (*zonefiles.QueryResult, error) {
+	question := query.Question[0]
+	if Caching == nil {
+		return resolveUpstream(query)
+	}
+	if result, found := Caching.Get(question); found {
+		if Caching.NeedsPrefetch(question) {
+			go func() {
+				if _, err := resolveUpstream(query); err != nil {
+					log.Printf("prefetch of %s failed: %v\n", question.QName, err)
+				}
+			}()
+		}
+		return result, nil
+	}
+
+	result, err := resolveUpstream(query)
+	if err != nil || result.RCode == zonefiles.ServerFailure {
+		if stale, found := Caching.GetStale(question); found {
+			log.Printf("serving stale answer for %s\n", question.QName)
+			return stale, nil
+		}
+	}
+	return result, err
+}
+
+// resolves the query through the forwarder of the name or the recursor and caches the result
+func resolveUpstream(query *dnsparser.DnsQuery) (*zonefiles.QueryResult, error) {
+	var result *zonefiles.QueryResult
+	var err error
+	if forwarder := forwarderFor(query.Question[0].QName); forwarder != nil {
+		result, err = forwarder.Resolve(query)
+	} else {
+		result, err = Recursion.Resolve(query.Question[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if Validation != nil {
+		Validation.Validate(query.Question[0], result)
+	}
+	// bogus answers are only given to the clients asking not to check them
+	if Caching != nil && !result.Bogus {
+		Caching.Put(query.Question[0], result)
+	}
+	return result, nil
+}
+
+/*
+withoutDnssec returns the records, leaving out the DNSSEC ones unless
+they are of the type asked for, for the clients that didn't set the DO
+bit (RFC 4035, section 3.2.1).
+*/
+func withoutDnssec(records []*zonefiles.ResourceRecord, qtype int) []*zonefiles.ResourceRecord {
+	kept := make([]*zonefiles.ResourceRecord, 0, len(records))
+	for _, rrPtr := range records {
+		switch rType := (*rrPtr).GetRType(); rType {
+		case zonefiles.RRSIG, zonefiles.NSEC, zonefiles.NSEC3:
+			if int(rType) != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rrPtr)
+	}
+	return kept
+}
+
 func ResolveDNSRequest(inputBytes []byte, length int, conn *net.UDPConn, clientAddr *net.UDPAddr) {
 	query, err := dnsparser.ParseDnsQuery(inputBytes, length)
 	if err != nil {
@@ -15,7 +97,7 @@ func ResolveDNSRequest(inputBytes []byte, length int, conn *net.UDPConn, clientA
 		return
 	}
 
-	if !query.Header.QR {
+	if query.Header.QR {
 		err = fmt.Errorf("corrupted header: message received as a response")
 		fmt.Print(err)
 		return
@@ -34,9 +116,30 @@ func ResolveDNSRequest(inputBytes []byte, length int, conn *net.UDPConn, clientA
 	rrQuery := zonefiles.QueryDomain{QdCount: query.Header.Qdcount, Questions: query.Question}
 
 	rrResults, err := zonefiles.SearchResourceRecords(&rrQuery)
-	if err != nil {
+	if err != nil && (forwarderFor(query.Question[0].QName) != nil || Recursion != nil) && query.Header.RD {
+		// we are not an authority for the name, ask the ones that are
+		rrResults, err = resolveElsewhere(query)
+		if err != nil {
+			fmt.Print(err)
+			rrResults = &zonefiles.QueryResult{RCode: zonefiles.ServerFailure}
+		}
+	} else if err != nil {
+		// we are not an authority for the name, let the client know
+		// instead of leaving it waiting for an answer
 		fmt.Print(err)
-		return
+		rrResults = &zonefiles.QueryResult{RCode: zonefiles.Refused}
+	}
+	if rrResults.Bogus && !query.Header.CD {
+		rrResults = &zonefiles.QueryResult{RCode: zonefiles.ServerFailure}
+	}
+	dnssecOk := query.Opt != nil && query.Opt.DO
+	if !dnssecOk {
+		answers := withoutDnssec(rrResults.Answers, query.Question[0].Qtype)
+		authority := withoutDnssec(rrResults.Authority, query.Question[0].Qtype)
+		additional := withoutDnssec(rrResults.Additional, query.Question[0].Qtype)
+		rrResults = &zonefiles.QueryResult{Authoritative: rrResults.Authoritative, Authenticated: rrResults.Authenticated,
+			RCode: rrResults.RCode, Ancount: uint(len(answers)), Nscount: uint(len(authority)), Arcount: uint(len(additional)),
+			Answers: answers, Authority: authority, Additional: additional}
 	}
 
 	response := dnsparser.DnsMessage{}
@@ -45,12 +148,21 @@ func ResolveDNSRequest(inputBytes []byte, length int, conn *net.UDPConn, clientA
 	response.Header.Arcount = rrResults.Arcount
 	response.Header.Nscount = rrResults.Nscount
 	response.Header.Rcode = rrResults.RCode
+	// clients that don't understand the AD bit leave it unset (RFC 6840, section 5.7)
+	response.Header.AD = rrResults.Authenticated && (dnssecOk || query.Header.AD)
 	response.Header.Z = 0
-	response.Header.RA = true
+	response.Header.AA = rrResults.Authoritative
+	response.Header.TC = false
+	response.Header.RA = Forwarding != nil || Recursion != nil || !ForwardZones.IsEmpty()
 	response.Header.QR = true
 	response.Answer = rrResults.Answers
 	response.Authority = rrResults.Authority
 	response.Additional = rrResults.Additional
+	response.Question = &query.Question
+	response.SizeLimit = query.PayloadSize()
+	if query.Opt != nil {
+		response.Opt = &dnsparser.EdnsOpt{UDPSize: dnsparser.EdnsBufferSize, DO: query.Opt.DO}
+	}
 
 	rawMessage, err := dnsparser.SerializeMessage(&response)
 	if err != nil {
@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abhra303/qDNS/cache"
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+/*
+send sends a query with the header for the records of the name through
+ResolveDNSRequest, as the listener does, and returns the response.
+*/
+func send(t *testing.T, header dnsparser.MessageHeader, name string, rType zonefiles.RType) *dnsparser.DnsMessage {
+	t.Helper()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	header.ID, header.Qdcount = randomId(), 1
+	question := []*zonefiles.QueryQuestion{{QName: name, Qtype: int(rType), Qclass: int(zonefiles.IN)}}
+	query, err := dnsparser.SerializeMessage(&dnsparser.DnsMessage{Header: &header, Question: &question})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ResolveDNSRequest(query, len(query), server, client.LocalAddr().(*net.UDPAddr))
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 0xFFFF)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := dnsparser.ParseDnsMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// sends a recursive query for the A records of the name
+func ask(t *testing.T, name string) *dnsparser.DnsMessage {
+	t.Helper()
+	return send(t, dnsparser.MessageHeader{RD: true}, name, zonefiles.A)
+}
+
+// a fake upstream answering every query for an A record with the address and TTL
+func answeringFor(ip string, ttl uint) func(*zonefiles.QueryQuestion, bool) reply {
+	return func(question *zonefiles.QueryQuestion, _ bool) reply {
+		record := aRecord(question.QName, ip)
+		record.(*zonefiles.ARecord).TTL = ttl
+		return reply{answer: []zonefiles.ResourceRecord{record}}
+	}
+}
+
+// forwards the queries of the zone to the server until the test ends
+func forwardZone(t *testing.T, zone string, server *fakeServer) {
+	t.Helper()
+	f, err := NewForwarder([]string{server.address}, "", "", "", 200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ForwardZones.Put(zone, f)
+	t.Cleanup(func() { ForwardZones.Delete(zone) })
+}
+
+// returns the address and TTL of the only answer of the response
+func answerOf(t *testing.T, response *dnsparser.DnsMessage) (string, uint) {
+	t.Helper()
+	if response.Header.Rcode != zonefiles.NoError || len(response.Answer) != 1 {
+		t.Fatalf("got rcode %d and %d answers, want one answer", response.Header.Rcode, len(response.Answer))
+	}
+	return (*response.Answer[0]).GetValue(), (*response.Answer[0]).GetTtl()
+}
+
+func TestServeStaleAndPrefetch(t *testing.T) {
+	Caching = cache.NewCache(100, 0, 0, time.Second, true)
+	t.Cleanup(func() { Caching = nil })
+
+	t.Run("stale", func(t *testing.T) {
+		t.Parallel()
+		upstream := newFakeServer(t, "127.0.0.1:0", answeringFor("192.0.2.1", 1))
+		forwardZone(t, "stale.test.", upstream)
+
+		if ip, _ := answerOf(t, ask(t, "www.stale.test.")); ip != "192.0.2.1" {
+			t.Fatalf("got %s, want the answer of the upstream", ip)
+		}
+		upstream.stop()
+
+		// fresh, then expired but within the stale window, then past it
+		if ip, ttl := answerOf(t, ask(t, "www.stale.test.")); ip != "192.0.2.1" || ttl > 1 {
+			t.Errorf("got %s with TTL %d from the cache, want 192.0.2.1", ip, ttl)
+		}
+		time.Sleep(1300 * time.Millisecond)
+		if ip, ttl := answerOf(t, ask(t, "www.stale.test.")); ip != "192.0.2.1" || ttl != cache.StaleTtl {
+			t.Errorf("got %s with TTL %d once expired, want 192.0.2.1 with TTL %d", ip, ttl, cache.StaleTtl)
+		}
+		if response := ask(t, "other.stale.test."); response.Header.Rcode != zonefiles.ServerFailure {
+			t.Errorf("got rcode %d for a name never cached, want SERVFAIL", response.Header.Rcode)
+		}
+		time.Sleep(time.Second)
+		if response := ask(t, "www.stale.test."); response.Header.Rcode != zonefiles.ServerFailure || len(response.Answer) != 0 {
+			t.Errorf("got rcode %d and %d answers past the stale window, want SERVFAIL", response.Header.Rcode, len(response.Answer))
+		}
+		if len(upstream.received()) != 1 {
+			t.Errorf("the upstream got %q, want only the first query", upstream.received())
+		}
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		t.Parallel()
+		upstream := newFakeServer(t, "127.0.0.1:0", answeringFor("192.0.2.2", 2))
+		forwardZone(t, "prefetch.test.", upstream)
+
+		// popular answers are refreshed in the last tenth of their TTL
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			answerOf(t, ask(t, "www.prefetch.test."))
+		}
+		if n := len(upstream.received()); n != 1 {
+			t.Fatalf("the upstream got %d queries, want 1", n)
+		}
+		time.Sleep(time.Until(start.Add(1850 * time.Millisecond)))
+		if _, ttl := answerOf(t, ask(t, "www.prefetch.test.")); ttl != 1 {
+			t.Errorf("got TTL %d before the prefetch, want 1", ttl)
+		}
+		eventually(t, "the answer is prefetched", func() bool { return len(upstream.received()) == 2 })
+		eventually(t, "the prefetched answer is cached", func() bool {
+			_, ttl := answerOf(t, ask(t, "www.prefetch.test."))
+			return ttl == 2
+		})
+		if n := len(upstream.received()); n != 2 {
+			t.Errorf("the upstream got %d queries, want 2", n)
+		}
+	})
+}
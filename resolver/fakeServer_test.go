@@ -0,0 +1,192 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+// the answer of a fake server to a query
+type reply struct {
+	rcode                         int
+	answer, authority, additional []zonefiles.ResourceRecord
+
+	// only the header and the question are sent over UDP, with the TC bit
+	truncated bool
+}
+
+/*
+fakeServer answers the queries it gets over UDP and TCP on a loopback
+address with the reply of its handler, and records them. It answers
+authoritatively, unless the reply is a referral.
+*/
+type fakeServer struct {
+	address string
+	udp     net.PacketConn
+	tcp     net.Listener
+	handler func(question *zonefiles.QueryQuestion, tcp bool) reply
+
+	// the queries are recorded and dropped while set
+	silent atomic.Bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+/*
+newFakeServer starts a fake server on the address, a free port being
+chosen if it is 0, and stops it when the test ends.
+*/
+func newFakeServer(t *testing.T, address string, handler func(question *zonefiles.QueryQuestion, tcp bool) reply) *fakeServer {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Fatal(err)
+	}
+	s := &fakeServer{address: udp.LocalAddr().String(), udp: udp, tcp: tcp, handler: handler}
+	t.Cleanup(s.stop)
+
+	go func() {
+		buf := make([]byte, 0xFFFF)
+		for {
+			n, client, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := s.answer(t, buf[:n], false); response != nil {
+				udp.WriteTo(response, client)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				if response := s.answer(t, query, true); response != nil {
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// returns the response to a raw query, nil if it is dropped
+func (s *fakeServer) answer(t *testing.T, query []byte, tcp bool) []byte {
+	message, err := dnsparser.ParseDnsMessage(query)
+	if err != nil || message.Question == nil || len(*message.Question) != 1 {
+		t.Errorf("%s: bad query: %v", s.address, err)
+		return nil
+	}
+	question := (*message.Question)[0]
+	transport := "udp"
+	if tcp {
+		transport = "tcp"
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, fmt.Sprintf("%s %s %d", transport, question.QName, question.Qtype))
+	s.mu.Unlock()
+	if s.silent.Load() {
+		return nil
+	}
+
+	r := s.handler(question, tcp)
+	header := *message.Header
+	header.QR = true
+	header.AA = len(r.authority) == 0 || r.authority[0].GetRType() != zonefiles.NS || len(r.answer) > 0
+	header.Rcode = r.rcode
+	response, err := dnsparser.SerializeMessage(&dnsparser.DnsMessage{
+		Header:     &header,
+		Question:   message.Question,
+		Answer:     recordPointers(r.answer),
+		Authority:  recordPointers(r.authority),
+		Additional: recordPointers(r.additional),
+		Opt:        message.Opt,
+		SizeLimit:  0xFFFF,
+	})
+	if err != nil {
+		t.Errorf("%s: %v", s.address, err)
+		return nil
+	}
+	if r.truncated && !tcp {
+		response, _ = dnsparser.TruncateMessage(response)
+	}
+	return response
+}
+
+// returns the queries received so far, as "transport name type"
+func (s *fakeServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// stops answering, queries being refused from then on
+func (s *fakeServer) stop() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func recordPointers(records []zonefiles.ResourceRecord) []*zonefiles.ResourceRecord {
+	pointers := make([]*zonefiles.ResourceRecord, len(records))
+	for i := range records {
+		pointers[i] = &records[i]
+	}
+	return pointers
+}
+
+func aRecord(name string, ip string) zonefiles.ResourceRecord {
+	record := &zonefiles.ARecord{}
+	record.Name, record.Type, record.Class, record.TTL, record.Value = name, zonefiles.A, zonefiles.IN, 300, ip
+	return record
+}
+
+func nsRecord(name string, host string) zonefiles.ResourceRecord {
+	record := &zonefiles.NSRecord{}
+	record.Name, record.Type, record.Class, record.TTL, record.Value = name, zonefiles.NS, zonefiles.IN, 300, host
+	return record
+}
+
+func cnameRecord(name string, target string) zonefiles.ResourceRecord {
+	record := &zonefiles.CnameRecord{}
+	record.Name, record.Type, record.Class, record.TTL, record.Value = name, zonefiles.Cname, zonefiles.IN, 300, target
+	return record
+}
+
+func soaRecord(zone string) zonefiles.ResourceRecord {
+	return zonefiles.NewSoaRecord(zone, zonefiles.IN, 60,
+		zonefiles.Soa{MName: "ns." + zone, RName: "hostmaster." + zone, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 60})
+}
+
+// returns the records as "name TYPE value" strings
+func recordStrings(records []*zonefiles.ResourceRecord) []string {
+	var strs []string
+	for _, rr := range records {
+		strs = append(strs, fmt.Sprintf("%s %s %s", (*rr).GetName(), (*rr).GetRType(), (*rr).GetValue()))
+	}
+	return strs
+}
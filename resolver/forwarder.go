@@ -0,0 +1,389 @@
+package resolver
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/ds/trie"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+// the policies choosing the upstream server of a query
+const (
+	RoundRobin = "round-robin"
+	Fastest    = "fastest"
+)
+
+// the transports queries are forwarded over
+const (
+	// UDP, retrying over TCP if the answer is truncated
+	Udp = "udp"
+	Tcp = "tcp"
+
+	// DNS over TLS (RFC 7858)
+	Tls = "tls"
+)
+
+const (
+	defaultForwardTimeout      = 2 * time.Second
+	defaultHealthCheckInterval = 30 * time.Second
+
+	// the consecutive failures after which an upstream server is down
+	maxUpstreamFailures = 3
+
+	// the largest DNS message, the size of a TCP message being 16 bits
+	maxMessageSize = 0xFFFF
+)
+
+/*
+Forwarding sends the queries for names outside of our zones to upstream
+servers. It is nil if no upstream server is configured, in which case
+such queries are resolved by recursion, or refused.
+*/
+var Forwarding *Forwarder
+
+/*
+ForwardZones holds the forwarders of the domains whose queries go to
+servers of their own. A query goes to the forwarder of the most
+specific domain enclosing its name, or to Forwarding if there is none.
+*/
+var ForwardZones trie.NameTrie[*Forwarder] = trie.NewNameTrie[*Forwarder](nil)
+
+// returns the forwarder for the queries of the given name, nil if there is none
+func forwarderFor(name string) *Forwarder {
+	if _, forwarders, err := ForwardZones.LongestMatch(name); err == nil && len(forwarders) > 0 {
+		return forwarders[0]
+	}
+	return Forwarding
+}
+
+type upstream struct {
+	address string // host:port
+
+	// the queries that failed in a row, maxUpstreamFailures once down
+	failures atomic.Int32
+
+	// the smoothed response time in nanoseconds, 0 before the first answer
+	rtt atomic.Int64
+}
+
+func (u *upstream) healthy() bool {
+	return u.failures.Load() < maxUpstreamFailures
+}
+
+func (u *upstream) succeeded(rtt time.Duration) {
+	u.failures.Store(0)
+	// new samples weigh 1/8, as for the SRTT of TCP (RFC 6298)
+	old := u.rtt.Load()
+	if old == 0 {
+		u.rtt.Store(int64(rtt))
+	} else {
+		u.rtt.Store(old + (int64(rtt)-old)/8)
+	}
+}
+
+func (u *upstream) failed() {
+	u.failures.Add(1)
+}
+
+/*
+Forwarder relays queries to a list of upstream servers. A query is
+sent over UDP and again over TCP if the answer is truncated, or only
+over TCP or TLS. When a server doesn't answer, the next one is tried;
+servers failing
+maxUpstreamFailures times in a row, or failing a health check, are
+only tried once all the healthy ones failed, until they answer again.
+*/
+type Forwarder struct {
+	upstreams []*upstream
+	policy    string
+	transport string
+	timeout   time.Duration
+
+	// the configuration of the TLS connections, nil unless transport is Tls
+	tlsConfig *tls.Config
+
+	healthCheckInterval time.Duration
+
+	// the position of the next server to start with for RoundRobin
+	next atomic.Uint32
+}
+
+/*
+NewForwarder returns a forwarder to the given upstream servers, whose
+port defaults to 53, or 853 over TLS. The certificates of TLS servers
+must be valid for tlsServerName, or for the host of their address if it
+is empty. An empty policy or transport, or a zero timeout or health
+check interval, stands for its default value.
+*/
+func NewForwarder(addresses []string, policy string, transport string, tlsServerName string, timeout time.Duration, healthCheckInterval time.Duration) (*Forwarder, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("forwarder: no upstream server given")
+	}
+	if policy == "" {
+		policy = RoundRobin
+	}
+	if policy != RoundRobin && policy != Fastest {
+		return nil, fmt.Errorf("forwarder: unknown policy \"%s\"", policy)
+	}
+	if transport == "" {
+		transport = Udp
+	}
+	port := "53"
+	switch transport {
+	case Udp, Tcp:
+	case Tls:
+		port = "853"
+	default:
+		return nil, fmt.Errorf("forwarder: unknown transport \"%s\"", transport)
+	}
+	if timeout == 0 {
+		timeout = defaultForwardTimeout
+	}
+	if healthCheckInterval == 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+
+	f := &Forwarder{policy: policy, transport: transport, timeout: timeout, healthCheckInterval: healthCheckInterval}
+	for _, address := range addresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, port)
+		}
+		f.upstreams = append(f.upstreams, &upstream{address: address})
+	}
+	if transport == Tls {
+		f.tlsConfig = &tls.Config{ServerName: tlsServerName, MinVersion: tls.VersionTLS12}
+	}
+	return f, nil
+}
+
+// returns the upstream servers in the order they should be tried
+func (f *Forwarder) order() []*upstream {
+	n := len(f.upstreams)
+	start := 0
+	if f.policy == RoundRobin {
+		start = int((f.next.Add(1) - 1) % uint32(n))
+	}
+	ordered := make([]*upstream, 0, n)
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, f.upstreams[(start+i)%n])
+	}
+
+	if f.policy == Fastest {
+		// servers without answers yet come first so that they get measured
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].rtt.Load() < ordered[j].rtt.Load()
+		})
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].healthy() && !ordered[j].healthy()
+	})
+	return ordered
+}
+
+// returns a random message ID, so that answers are hard to forge
+func randomId() int {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return int(time.Now().UnixNano() & 0xFFFF)
+	}
+	return int(binary.BigEndian.Uint16(id[:]))
+}
+
+/*
+Resolve asks the upstream servers the question of the query and returns
+their answer.
+*/
+func (f *Forwarder) Resolve(query *dnsparser.DnsQuery) (*zonefiles.QueryResult, error) {
+	// the answers are validated here, the upstream servers must not drop the bogus ones
+	header := dnsparser.MessageHeader{ID: randomId(), RD: true, CD: query.Header.CD || Validation != nil, Qdcount: uint(len(query.Question))}
+	message := dnsparser.DnsMessage{Header: &header, Question: &query.Question, SizeLimit: dnsparser.EdnsBufferSize}
+	if query.Opt != nil || Validation != nil {
+		message.Opt = &dnsparser.EdnsOpt{UDPSize: dnsparser.EdnsBufferSize, DO: Validation != nil || query.Opt.DO}
+	}
+	rawQuery, err := dnsparser.SerializeMessage(&message)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := f.Forward(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := dnsparser.ParseDnsMessage(response)
+	if err != nil {
+		return nil, fmt.Errorf("forwarder: %v", err)
+	}
+	return &zonefiles.QueryResult{
+		RCode:      parsed.Header.Rcode,
+		Ancount:    uint(len(parsed.Answer)),
+		Nscount:    uint(len(parsed.Authority)),
+		Arcount:    uint(len(parsed.Additional)),
+		Answers:    parsed.Answer,
+		Authority:  parsed.Authority,
+		Additional: parsed.Additional,
+	}, nil
+}
+
+// Forward sends a raw query to the upstream servers until one of them answers
+func (f *Forwarder) Forward(query []byte) ([]byte, error) {
+	var err error
+	for _, u := range f.order() {
+		var response []byte
+		response, err = f.exchange(u, query)
+		if err == nil {
+			return response, nil
+		}
+		log.Printf("forwarder: %s: %v\n", u.address, err)
+	}
+	return nil, fmt.Errorf("forwarder: no upstream server answered, last error: %v", err)
+}
+
+func (f *Forwarder) exchange(u *upstream, query []byte) ([]byte, error) {
+	start := time.Now()
+	var response []byte
+	var err error
+	switch f.transport {
+	case Tcp:
+		response, err = exchangeTcp(u.address, query, f.timeout)
+	case Tls:
+		response, err = exchangeTls(u.address, query, f.timeout, f.tlsConfig)
+	default:
+		response, err = exchangeUdp(u.address, query, f.timeout)
+		if err == nil && response[2]&0x02 != 0 {
+			// the TC bit is set, the whole answer only fits over TCP
+			response, err = exchangeTcp(u.address, query, f.timeout)
+		}
+	}
+	if err != nil {
+		u.failed()
+		return nil, err
+	}
+	u.succeeded(time.Since(start))
+	return response, nil
+}
+
+func exchangeUdp(address string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if dnsparser.SameQuestion(query, buf[:n]) {
+			return buf[:n:n], nil
+		}
+		// not the answer to our query, keep waiting for it
+	}
+}
+
+// sends the query over TCP, where messages are prefixed by their length (RFC 1035, section 4.2.2)
+func exchangeTcp(address string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(conn, query, timeout)
+}
+
+/*
+sends the query over TLS, messages being framed as over TCP (RFC 7858).
+The server name defaults to the host of the address.
+*/
+func exchangeTls(address string, query []byte, timeout time.Duration, config *tls.Config) ([]byte, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(conn, query, timeout)
+}
+
+// exchanges length prefixed messages over a connected stream
+func exchangeStream(conn net.Conn, query []byte, timeout time.Duration) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	message := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	_, err := conn.Write(append(message, query...))
+	if err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if !dnsparser.SameQuestion(query, response) {
+		return nil, fmt.Errorf("the answer doesn't match the query")
+	}
+	return response, nil
+}
+
+/*
+CheckHealth asks every upstream server for the NS records of the root
+at every health check interval until stop is closed. A server that
+doesn't answer is marked down, one that answers is up again.
+*/
+func (f *Forwarder) CheckHealth(stop <-chan struct{}) {
+	ticker := time.NewTicker(f.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f.checkUpstreams()
+		}
+	}
+}
+
+func (f *Forwarder) checkUpstreams() {
+	question := []*zonefiles.QueryQuestion{{QName: ".", Qtype: int(zonefiles.NS), Qclass: int(zonefiles.IN)}}
+	for _, u := range f.upstreams {
+		header := dnsparser.MessageHeader{ID: randomId(), Qdcount: 1}
+		query, err := dnsparser.SerializeMessage(&dnsparser.DnsMessage{Header: &header, Question: &question})
+		if err != nil {
+			log.Printf("forwarder: %v\n", err)
+			return
+		}
+		go func(u *upstream) {
+			if _, err := f.exchange(u, query); err != nil {
+				if u.healthy() {
+					log.Printf("forwarder: %s is down: %v\n", u.address, err)
+				}
+				u.failures.Store(maxUpstreamFailures)
+			}
+		}(u)
+	}
+}
@@ -0,0 +1,310 @@
+package resolver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+// a recursive query for the A records of the name
+func queryFor(name string) *dnsparser.DnsQuery {
+	return &dnsparser.DnsQuery{
+		Header:   &dnsparser.MessageHeader{RD: true, Qdcount: 1},
+		Question: []*zonefiles.QueryQuestion{{QName: name, Qtype: int(zonefiles.A), Qclass: int(zonefiles.IN)}},
+	}
+}
+
+// a fake upstream answering every query for an A record with the address
+func answering(ip string) func(*zonefiles.QueryQuestion, bool) reply {
+	return func(question *zonefiles.QueryQuestion, _ bool) reply {
+		return reply{answer: []zonefiles.ResourceRecord{aRecord(question.QName, ip)}}
+	}
+}
+
+// waits up to a second for the condition to hold
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+func TestForwarderTruncation(t *testing.T) {
+	// 100 addresses don't fit in a UDP answer of 1232 octets
+	server := newFakeServer(t, "127.0.0.1:0", func(question *zonefiles.QueryQuestion, tcp bool) reply {
+		var answer []zonefiles.ResourceRecord
+		for i := 0; i < 100; i++ {
+			answer = append(answer, aRecord(question.QName, fmt.Sprintf("10.0.0.%d", i)))
+		}
+		return reply{answer: answer, truncated: true}
+	})
+
+	for _, c := range []struct {
+		transport string
+		want      []string
+	}{
+		{Udp, []string{"udp big.test. 1", "tcp big.test. 1"}},
+		{Tcp, []string{"tcp big.test. 1"}},
+	} {
+		before := len(server.received())
+		f, err := NewForwarder([]string{server.address}, "", c.transport, "", time.Second, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := f.Resolve(queryFor("big.test."))
+		if err != nil {
+			t.Fatalf("%s: %v", c.transport, err)
+		}
+		if len(result.Answers) != 100 {
+			t.Errorf("%s: got %d answers, want 100", c.transport, len(result.Answers))
+		}
+		if got := server.received()[before:]; strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s: the upstream got %q, want %q", c.transport, got, c.want)
+		}
+	}
+}
+
+func TestForwarderFailover(t *testing.T) {
+	down := newFakeServer(t, "127.0.0.1:0", answering("192.0.2.1"))
+	up := newFakeServer(t, "127.0.0.1:0", answering("192.0.2.2"))
+	down.silent.Store(true)
+	f, err := NewForwarder([]string{down.address, up.address}, RoundRobin, Udp, "", 50*time.Millisecond, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every other query starts with the silent server, until it failed too often
+	for i := 0; i < 2*maxUpstreamFailures; i++ {
+		result, err := f.Resolve(queryFor("www.test."))
+		if err != nil || len(result.Answers) != 1 || (*result.Answers[0]).GetValue() != "192.0.2.2" {
+			t.Fatalf("query %d: got %v (%v), want the answer of the healthy server", i, result, err)
+		}
+	}
+	if f.upstreams[0].healthy() || len(down.received()) != maxUpstreamFailures {
+		t.Fatalf("the silent server got %d queries and is healthy: %v", len(down.received()), f.upstreams[0].healthy())
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := f.Resolve(queryFor("www.test.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(down.received()); n != maxUpstreamFailures {
+		t.Errorf("the server down got %d queries, want %d", n, maxUpstreamFailures)
+	}
+
+	// the health checks find it up again, and the other one down
+	stop := make(chan struct{})
+	defer close(stop)
+	go f.CheckHealth(stop)
+	down.silent.Store(false)
+	eventually(t, "the server is up again", f.upstreams[0].healthy)
+	up.stop()
+	eventually(t, "the stopped server is down", func() bool { return !f.upstreams[1].healthy() })
+	result, err := f.Resolve(queryFor("www.test."))
+	if err != nil || (*result.Answers[0]).GetValue() != "192.0.2.1" {
+		t.Fatalf("got %v (%v), want the answer of the recovered server", result, err)
+	}
+	if got := down.received(); got[len(got)-1] != "udp www.test. 1" || !strings.Contains(strings.Join(got, ","), "udp . 2") {
+		t.Errorf("the recovered server got %q, want health checks and the query", got)
+	}
+
+	// all the servers are tried when none is healthy
+	down.stop()
+	if _, err := f.Resolve(queryFor("www.test.")); err == nil {
+		t.Error("got an answer with every server stopped")
+	}
+}
+
+func TestForwarderOrder(t *testing.T) {
+	addresses := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	cases := []struct {
+		name   string
+		policy string
+		rtts   []time.Duration
+		down   []bool
+		want   []string
+	}{
+		{
+			name:   "round-robin",
+			policy: RoundRobin,
+			want:   []string{"0 1 2", "1 2 0", "2 0 1", "0 1 2"},
+		},
+		{
+			name:   "round-robin skipping the server down",
+			policy: RoundRobin,
+			down:   []bool{false, true, false},
+			want:   []string{"0 2 1", "2 0 1", "2 0 1", "0 2 1"},
+		},
+		{
+			name:   "fastest, unmeasured servers first",
+			policy: Fastest,
+			rtts:   []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 0},
+			want:   []string{"2 1 0", "2 1 0"},
+		},
+		{
+			name:   "fastest down",
+			policy: Fastest,
+			rtts:   []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+			down:   []bool{false, true, false},
+			want:   []string{"2 0 1", "2 0 1"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := NewForwarder(addresses, c.policy, "", "", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			position := make(map[*upstream]int)
+			for i, u := range f.upstreams {
+				position[u] = i
+				if c.rtts != nil {
+					u.rtt.Store(int64(c.rtts[i]))
+				}
+				if c.down != nil && c.down[i] {
+					u.failures.Store(maxUpstreamFailures)
+				}
+			}
+			for _, want := range c.want {
+				var got []string
+				for _, u := range f.order() {
+					got = append(got, fmt.Sprint(position[u]))
+				}
+				if strings.Join(got, " ") != want {
+					t.Fatalf("got the order %q, want %q", strings.Join(got, " "), want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwarderFastest(t *testing.T) {
+	slow := newFakeServer(t, "127.0.0.1:0", func(question *zonefiles.QueryQuestion, tcp bool) reply {
+		time.Sleep(30 * time.Millisecond)
+		return answering("192.0.2.1")(question, tcp)
+	})
+	fast := newFakeServer(t, "127.0.0.1:0", answering("192.0.2.2"))
+	f, err := NewForwarder([]string{slow.address, fast.address}, Fastest, Udp, "", time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both get measured first, then the fastest gets all the queries
+	for i := 0; i < 6; i++ {
+		if _, err := f.Resolve(queryFor("www.test.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(slow.received()) != 1 || len(fast.received()) != 5 {
+		t.Errorf("the slow server got %d queries and the fast one %d, want 1 and 5", len(slow.received()), len(fast.received()))
+	}
+}
+
+func TestNewForwarder(t *testing.T) {
+	for _, c := range []struct {
+		transport string
+		address   string
+		want      string
+	}{
+		{Udp, "192.0.2.1", "192.0.2.1:53"},
+		{Tcp, "2001:db8::1", "[2001:db8::1]:53"},
+		{Tls, "192.0.2.1", "192.0.2.1:853"},
+		{Tls, "192.0.2.1:8853", "192.0.2.1:8853"},
+	} {
+		f, err := NewForwarder([]string{c.address}, "", c.transport, "", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.upstreams[0].address; got != c.want || f.policy != RoundRobin {
+			t.Errorf("%s over %s: got %s and policy %s, want %s and round-robin", c.address, c.transport, got, f.policy, c.want)
+		}
+	}
+	if _, err := NewForwarder([]string{"192.0.2.1"}, "random", "", "", 0, 0); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+	if _, err := NewForwarder([]string{"192.0.2.1"}, "", "quic", "", 0, 0); err == nil {
+		t.Error("accepted an unknown transport")
+	}
+	if _, err := NewForwarder(nil, "", "", "", 0, 0); err == nil {
+		t.Error("accepted no upstream server")
+	}
+}
+
+func TestForwardZones(t *testing.T) {
+	outer := newFakeServer(t, "127.0.0.1:0", answering("192.0.2.1"))
+	inner1 := newFakeServer(t, "127.0.0.1:0", answering("192.0.2.2"))
+	inner2 := newFakeServer(t, "127.0.0.1:0", answering("192.0.2.3"))
+	outerForwarder, err := NewForwarder([]string{outer.address}, "", Udp, "", 200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	innerForwarder, err := NewForwarder([]string{inner1.address, inner2.address}, RoundRobin, Tcp, "", 200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for zone, f := range map[string]*Forwarder{"example.test.": outerForwarder, "Sub.Example.Test": innerForwarder} {
+		if err := ForwardZones.Put(zone, f); err != nil {
+			t.Fatal(err)
+		}
+		zone := zone
+		t.Cleanup(func() { ForwardZones.Delete(zone) })
+	}
+
+	// the names no forward zone encloses are resolved from the root
+	port, roots := fakeAuthorities(t, map[string]handler{"127.0.0.20": answering("192.0.2.20")})
+	Recursion, err = NewRecursor(rootHints(t, "127.0.0.20"), port, 200*time.Millisecond, 1, 0, 0, MinimisationOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Recursion = nil })
+
+	for _, c := range []struct {
+		name string
+		want *Forwarder
+	}{
+		{"example.test.", outerForwarder},
+		{"www.example.test.", outerForwarder},
+		{"sub.example.test.", innerForwarder},
+		{"deep.www.SUB.example.test", innerForwarder},
+		{"notsub.example.test.", outerForwarder},
+		{"test.", nil},
+		{"example.org.", nil},
+	} {
+		if got := forwarderFor(c.name); got != c.want {
+			t.Errorf("%s: got forwarder %p, want %p", c.name, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		name, want string
+	}{
+		{"www.example.test.", "192.0.2.1"},
+		// the servers of the inner zone take turns, over TCP
+		{"a.sub.example.test.", "192.0.2.2"},
+		{"b.sub.example.test.", "192.0.2.3"},
+		{"www.example.org.", "192.0.2.20"},
+	} {
+		if ip, _ := answerOf(t, ask(t, c.name)); ip != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, ip, c.want)
+		}
+	}
+	for _, c := range []struct {
+		server *fakeServer
+		want   string
+	}{
+		{outer, "udp www.example.test. 1"},
+		{inner1, "tcp a.sub.example.test. 1"},
+		{inner2, "tcp b.sub.example.test. 1"},
+		{roots["127.0.0.20"], "udp www.example.org. 1"},
+	} {
+		if got := c.server.received(); strings.Join(got, ",") != c.want {
+			t.Errorf("%s got %q, want %q", c.server.address, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package resolver
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+const (
+	defaultRecursionTimeout = 2 * time.Second
+	defaultRetries          = 2
+	defaultMaxReferrals     = 16
+	defaultMaxDepth         = 4
+
+	// the longest chain of aliases followed to answer a query
+	maxCnameChain = 8
+
+	/*
+	   The most queries sent to answer one query, lookups of
+	   name servers included, so that a misconfigured or
+	   malicious delegation can't keep us busy.
+	*/
+	maxQueriesPerResolution = 64
+
+	/*
+	   The most queries for parts of a name sent to resolve it,
+	   the whole name is asked for once they are sent (RFC 9156,
+	   section 2.3).
+	*/
+	maxMinimiseCount = 10
+)
+
+// the modes of QNAME minimisation
+const (
+	MinimisationOff = "off"
+
+	// falls back to the whole name when a server fails for a part of it
+	MinimisationRelaxed = "relaxed"
+
+	// takes a name error for a part of the name as a name error for it
+	MinimisationStrict = "strict"
+)
+
+/*
+Recursion resolves the queries for names outside of our zones starting
+from the root servers. It is nil if recursion is not configured.
+*/
+var Recursion *Recursor
+
+/*
+Recursor is an iterative resolver. It asks the root servers first and
+follows their referrals down to the servers of the zone of the name,
+looking up the addresses of name servers given without glue. Records
+are only accepted from the servers of a zone for names in that zone
+(the bailiwick of the servers), so that a server can't make us believe
+anything about names it isn't responsible for.
+*/
+type Recursor struct {
+	roots        []string // host:port of the root servers
+	port         string
+	timeout      time.Duration
+	retries      int
+	maxReferrals int
+	maxDepth     int
+	minimisation string
+}
+
+/*
+NewRecursor returns a recursor starting from the root servers of the
+given root hints file. A zero port, timeout, number of retries, or
+limit stands for its default value, and an empty minimisation mode for
+MinimisationRelaxed.
+*/
+func NewRecursor(rootHints string, port int, timeout time.Duration, retries int, maxReferrals int, maxDepth int, minimisation string) (*Recursor, error) {
+	if port == 0 {
+		port = 53
+	}
+	if timeout == 0 {
+		timeout = defaultRecursionTimeout
+	}
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	if maxReferrals == 0 {
+		maxReferrals = defaultMaxReferrals
+	}
+	if maxDepth == 0 {
+		maxDepth = defaultMaxDepth
+	}
+	if minimisation == "" {
+		minimisation = MinimisationRelaxed
+	}
+	if minimisation != MinimisationOff && minimisation != MinimisationRelaxed && minimisation != MinimisationStrict {
+		return nil, fmt.Errorf("recursion: unknown QNAME minimisation mode \"%s\"", minimisation)
+	}
+
+	r := &Recursor{port: strconv.Itoa(port), timeout: timeout, retries: retries, maxReferrals: maxReferrals,
+		maxDepth: maxDepth, minimisation: minimisation}
+	var err error
+	r.roots, err = r.loadRootHints(rootHints)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+loadRootHints reads the addresses of the root servers from a file in the
+format of named.root: the NS records of the root and the A and AAAA
+records of the servers they name, with fully qualified names.
+*/
+func (r *Recursor) loadRootHints(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("recursion: %v", err)
+	}
+	defer file.Close()
+
+	var servers []string
+	addresses := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(line)
+		// the type comes after the owner and the optional TTL and class
+		for i := 1; i < len(fields)-1; i++ {
+			switch strings.ToUpper(fields[i]) {
+			case "NS":
+				if fqdn(fields[0]) == "." {
+					servers = append(servers, fqdn(fields[i+1]))
+				}
+			case "A", "AAAA":
+				if net.ParseIP(fields[i+1]) == nil {
+					return nil, fmt.Errorf("recursion: invalid address %s in %s", fields[i+1], path)
+				}
+				name := fqdn(fields[0])
+				addresses[name] = append(addresses[name], fields[i+1])
+			default:
+				continue
+			}
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("recursion: %v", err)
+	}
+
+	var roots []string
+	for _, server := range servers {
+		for _, address := range addresses[server] {
+			roots = append(roots, net.JoinHostPort(address, r.port))
+		}
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("recursion: no root server address in %s", path)
+	}
+	return roots, nil
+}
+
+// returns the lower case, fully qualified form of the name
+func fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// returns true if name is zone or below it
+func isSubdomain(name, zone string) bool {
+	name, zone = fqdn(name), fqdn(zone)
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// the state of the resolution of one query
+type resolution struct {
+	*Recursor
+	queries int
+}
+
+/*
+Resolve answers the question by asking the name servers responsible
+for its name, following aliases. The result holds the answer, or the
+SOA record of the zone proving the name or the records don't exist.
+*/
+func (r *Recursor) Resolve(question *zonefiles.QueryQuestion) (*zonefiles.QueryResult, error) {
+	res := &resolution{Recursor: r}
+	return res.resolve(question.QName, question.Qtype, question.Qclass, 0)
+}
+
+func (res *resolution) resolve(name string, qtype int, qclass int, depth int) (*zonefiles.QueryResult, error) {
+	if depth > res.maxDepth {
+		return nil, fmt.Errorf("recursion: lookups of name servers nested too deeply for %s", name)
+	}
+
+	result := &zonefiles.QueryResult{}
+	name = fqdn(name)
+	aliases := 0
+resolving:
+	for {
+		response, zone, err := res.iterate(name, qtype, qclass, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		// follow the aliases the servers of the zone answered for
+		followed := false
+		for {
+			records, cname := answersFor(response.Answer, name, qtype)
+			if len(records) > 0 {
+				result.Answers = append(result.Answers, records...)
+				result.Answers = append(result.Answers, signaturesFor(response.Answer, name, zonefiles.RType(qtype))...)
+				// the proof that a wildcard answered for the name
+				result.Authority = append(result.Authority, denialOf(response.Authority)...)
+				break resolving
+			}
+			if cname == nil {
+				break
+			}
+			result.Answers = append(result.Answers, cname)
+			result.Answers = append(result.Answers, signaturesFor(response.Answer, name, zonefiles.Cname)...)
+			name = fqdn((*cname).GetValue())
+			followed = true
+			if aliases++; aliases > maxCnameChain {
+				return nil, fmt.Errorf("recursion: too many aliases for %s", name)
+			}
+			if !isSubdomain(name, zone) {
+				// the alias points outside of the zone, ask its servers
+				continue resolving
+			}
+		}
+
+		soas := soasFor(response.Authority, name)
+		if followed && len(soas) == 0 {
+			// the servers answered with the alias alone, without
+			// saying whether its target exists: ask for it
+			continue resolving
+		}
+
+		// the name or its records don't exist, the SOA record of the
+		// zone says for how long
+		result.RCode = response.Header.Rcode
+		for _, rrPtr := range soas {
+			result.Authority = append(result.Authority, rrPtr)
+			result.Authority = append(result.Authority, signaturesFor(response.Authority, (*rrPtr).GetName(), zonefiles.SOA)...)
+		}
+		result.Authority = append(result.Authority, denialOf(response.Authority)...)
+		break
+	}
+	result.Ancount = uint(len(result.Answers))
+	result.Nscount = uint(len(result.Authority))
+	return result, nil
+}
+
+// returns the records of the name having the type, or else its alias
+func answersFor(answers []*zonefiles.ResourceRecord, name string, qtype int) ([]*zonefiles.ResourceRecord, *zonefiles.ResourceRecord) {
+	var records []*zonefiles.ResourceRecord
+	var cname *zonefiles.ResourceRecord
+	for _, rrPtr := range answers {
+		rr := *rrPtr
+		if fqdn(rr.GetName()) != name {
+			continue
+		}
+		if int(rr.GetRType()) == qtype {
+			records = append(records, rrPtr)
+		} else if rr.GetRType() == zonefiles.Cname && cname == nil {
+			cname = rrPtr
+		}
+	}
+	return records, cname
+}
+
+// returns the SOA records of the authority section for a zone the name is in
+func soasFor(authority []*zonefiles.ResourceRecord, name string) []*zonefiles.ResourceRecord {
+	var soas []*zonefiles.ResourceRecord
+	for _, rrPtr := range authority {
+		if (*rrPtr).GetRType() == zonefiles.SOA && isSubdomain(name, (*rrPtr).GetName()) {
+			soas = append(soas, rrPtr)
+		}
+	}
+	return soas
+}
+
+// returns the signatures of the records of the name having the type
+func signaturesFor(records []*zonefiles.ResourceRecord, name string, rType zonefiles.RType) []*zonefiles.ResourceRecord {
+	var sigs []*zonefiles.ResourceRecord
+	for _, rrPtr := range records {
+		if sig, ok := (*rrPtr).(*zonefiles.RrsigRecord); ok && sig.TypeCovered == rType && fqdn(sig.GetName()) == fqdn(name) {
+			sigs = append(sigs, rrPtr)
+		}
+	}
+	return sigs
+}
+
+// returns the NSEC and NSEC3 records of the authority section, with their signatures
+func denialOf(authority []*zonefiles.ResourceRecord) []*zonefiles.ResourceRecord {
+	var records []*zonefiles.ResourceRecord
+	for _, rrPtr := range authority {
+		switch rr := (*rrPtr).(type) {
+		case *zonefiles.NsecRecord, *zonefiles.Nsec3Record:
+			records = append(records, rrPtr)
+		case *zonefiles.RrsigRecord:
+			if rr.TypeCovered == zonefiles.NSEC || rr.TypeCovered == zonefiles.NSEC3 {
+				records = append(records, rrPtr)
+			}
+		}
+	}
+	return records
+}
+
+/*
+iterate follows the referrals from the root servers down to the servers
+having the answer for the name, and returns their response along with
+the zone they serve. The records of the response outside of the zone
+are dropped.
+
+With QNAME minimisation (RFC 9156), the servers of a zone are only asked
+for the A records of the name having one label more than the part of the
+name known to exist, until they refer us to the servers of that name or
+the whole name is reached. In relaxed mode, servers failing or denying
+the existence of such a name are asked for the whole name instead, as
+some servers don't answer properly for empty non-terminals.
+*/
+func (res *resolution) iterate(name string, qtype int, qclass int, depth int) (*dnsparser.DnsMessage, string, error) {
+	zone, servers := ".", res.roots
+	known := zone
+	minimising := res.minimisation != MinimisationOff
+	steps := 0
+	for referrals := 0; referrals <= res.maxReferrals; {
+		qname, qt := name, qtype
+		if minimising && steps < maxMinimiseCount {
+			if qname = childName(name, known); qname != name {
+				qt = int(zonefiles.A)
+			}
+		}
+
+		response, err := res.query(servers, qname, qt, qclass)
+		if err != nil && (qname == name || res.minimisation == MinimisationStrict) {
+			return nil, "", err
+		}
+		if err != nil || (qname != name && response.Header.Rcode == zonefiles.NameError && res.minimisation == MinimisationRelaxed) {
+			log.Printf("recursion: asking the servers of %s for %s instead of %s\n", zone, name, qname)
+			minimising = false
+			continue
+		}
+		if qname != name {
+			steps++
+		}
+		response.Answer = inBailiwick(response.Answer, zone)
+		response.Authority = inBailiwick(response.Authority, zone)
+		response.Additional = inBailiwick(response.Additional, zone)
+		if response.Header.Rcode == zonefiles.NameError || (qname == name && len(response.Answer) > 0) {
+			// in strict mode, nothing exists below a part of the
+			// name that doesn't exist (RFC 8020)
+			return response, zone, nil
+		}
+
+		cut, nameServers := referral(response, zone, qname)
+		if cut == "" && qname != name {
+			// the servers of the zone also serve qname, go one label further
+			known = qname
+			continue
+		}
+		if cut == "" && !response.Header.AA {
+			// neither an answer nor a referral, the servers are lame
+			return nil, "", fmt.Errorf("recursion: the servers of %s don't know %s", zone, name)
+		}
+		if cut == "" {
+			// no data for the name
+			return response, zone, nil
+		}
+		servers = glue(response, nameServers, res.port)
+		if len(servers) == 0 {
+			servers = res.lookupServers(nameServers, depth)
+		}
+		if len(servers) == 0 {
+			return nil, "", fmt.Errorf("recursion: no address for the name servers of %s", cut)
+		}
+		zone, known = cut, cut
+		referrals++
+	}
+	return nil, "", fmt.Errorf("recursion: too many referrals for %s", name)
+}
+
+// returns the ancestor of the name having one label more than zone
+func childName(name, zone string) string {
+	name, zone = fqdn(name), fqdn(zone)
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	zoneLabels := 0
+	if zone != "." {
+		zoneLabels = strings.Count(zone, ".")
+	}
+	if zoneLabels+1 >= len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-zoneLabels-1:], ".") + "."
+}
+
+// keeps the records whose owner is in the zone
+func inBailiwick(records []*zonefiles.ResourceRecord, zone string) []*zonefiles.ResourceRecord {
+	var kept []*zonefiles.ResourceRecord
+	for _, rrPtr := range records {
+		if isSubdomain((*rrPtr).GetName(), zone) {
+			kept = append(kept, rrPtr)
+		}
+	}
+	return kept
+}
+
+/*
+referral returns the zone cut the response delegates the name to and
+the names of its servers. The cut must be below the zone of the servers
+that sent the response and at or above the name, otherwise the response
+is not a referral and "" is returned.
+*/
+func referral(response *dnsparser.DnsMessage, zone string, name string) (string, []string) {
+	var cut string
+	var nameServers []string
+	for _, rrPtr := range response.Authority {
+		rr := *rrPtr
+		if rr.GetRType() != zonefiles.NS {
+			continue
+		}
+		owner := fqdn(rr.GetName())
+		if owner == fqdn(zone) || !isSubdomain(name, owner) || (cut != "" && owner != cut) {
+			continue
+		}
+		cut = owner
+		nameServers = append(nameServers, fqdn(rr.GetValue()))
+	}
+	return cut, nameServers
+}
+
+// returns the addresses the response gives for the name servers
+func glue(response *dnsparser.DnsMessage, nameServers []string, port string) []string {
+	var addresses []string
+	for _, rrPtr := range response.Additional {
+		rr := *rrPtr
+		if rr.GetRType() != zonefiles.A && rr.GetRType() != zonefiles.Aaaa {
+			continue
+		}
+		for _, ns := range nameServers {
+			if fqdn(rr.GetName()) == ns {
+				addresses = append(addresses, net.JoinHostPort(rr.GetValue(), port))
+				break
+			}
+		}
+	}
+	return addresses
+}
+
+// resolves the addresses of the name servers, stopping at the first one having any
+func (res *resolution) lookupServers(nameServers []string, depth int) []string {
+	for _, ns := range nameServers {
+		result, err := res.resolve(ns, int(zonefiles.A), int(zonefiles.IN), depth+1)
+		if err != nil {
+			log.Printf("%v\n", err)
+			continue
+		}
+		var addresses []string
+		for _, rrPtr := range result.Answers {
+			if (*rrPtr).GetRType() == zonefiles.A {
+				addresses = append(addresses, net.JoinHostPort((*rrPtr).GetValue(), res.port))
+			}
+		}
+		if len(addresses) > 0 {
+			return addresses
+		}
+	}
+	return nil
+}
+
+/*
+query asks the servers the question in turn until one of them answers
+with a usable response, going over the list retries times. Servers
+failing or refusing the query are skipped.
+*/
+func (res *resolution) query(servers []string, name string, qtype int, qclass int) (*dnsparser.DnsMessage, error) {
+	question := []*zonefiles.QueryQuestion{{QName: name, Qtype: qtype, Qclass: qclass}}
+	var lastErr error
+	for attempt := 0; attempt < res.retries; attempt++ {
+		for _, server := range servers {
+			if res.queries >= maxQueriesPerResolution {
+				return nil, fmt.Errorf("recursion: too many queries to resolve %s", name)
+			}
+			res.queries++
+
+			header := dnsparser.MessageHeader{ID: randomId(), Qdcount: 1}
+			message := dnsparser.DnsMessage{Header: &header, Question: &question, SizeLimit: dnsparser.EdnsBufferSize,
+				Opt: &dnsparser.EdnsOpt{UDPSize: dnsparser.EdnsBufferSize, DO: Validation != nil}}
+			rawQuery, err := dnsparser.SerializeMessage(&message)
+			if err != nil {
+				return nil, err
+			}
+
+			response, err := exchangeUdp(server, rawQuery, res.timeout)
+			if err == nil && response[2]&0x02 != 0 {
+				response, err = exchangeTcp(server, rawQuery, res.timeout)
+			}
+			if err != nil {
+				lastErr = fmt.Errorf("%s: %v", server, err)
+				continue
+			}
+			parsed, err := dnsparser.ParseDnsMessage(response)
+			if err != nil {
+				lastErr = fmt.Errorf("%s: %v", server, err)
+				continue
+			}
+			if rcode := parsed.Header.Rcode; rcode != zonefiles.NoError && rcode != zonefiles.NameError {
+				lastErr = fmt.Errorf("%s: answered with rcode %d", server, rcode)
+				continue
+			}
+			return parsed, nil
+		}
+	}
+	return nil, fmt.Errorf("recursion: no server answered for %s, last error: %v", name, lastErr)
+}
@@ -0,0 +1,397 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+type handler = func(question *zonefiles.QueryQuestion, tcp bool) reply
+
+/*
+fakeAuthorities starts a fake server on every loopback address of the
+map, all on the same port, and returns the port along with the servers.
+*/
+func fakeAuthorities(t *testing.T, handlers map[string]handler) (int, map[string]*fakeServer) {
+	t.Helper()
+	var ips []string
+	for ip := range handlers {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	servers := make(map[string]*fakeServer)
+	port := "0"
+	for _, ip := range ips {
+		servers[ip] = newFakeServer(t, net.JoinHostPort(ip, port), handlers[ip])
+		_, port, _ = net.SplitHostPort(servers[ip].address)
+	}
+	p, _ := strconv.Atoi(port)
+	return p, servers
+}
+
+// writes a root hints file naming a root server at each address
+func rootHints(t *testing.T, ips ...string) string {
+	t.Helper()
+	var hints strings.Builder
+	for i, ip := range ips {
+		fmt.Fprintf(&hints, ".\t3600000\tNS\t%c.ROOT-SERVERS.TEST.\n", 'A'+i)
+		fmt.Fprintf(&hints, "%c.ROOT-SERVERS.TEST.\t3600000\tA\t%s\n", 'A'+i, ip)
+	}
+	path := filepath.Join(t.TempDir(), "root.hints")
+	if err := os.WriteFile(path, []byte(hints.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func referralTo(zone string, nameServer string, glue ...zonefiles.ResourceRecord) reply {
+	return reply{authority: []zonefiles.ResourceRecord{nsRecord(zone, nameServer)}, additional: glue}
+}
+
+func nameError(zone string) reply {
+	return reply{rcode: zonefiles.NameError, authority: []zonefiles.ResourceRecord{soaRecord(zone)}}
+}
+
+/*
+the servers of the test. zone and of the zones below it:
+
+  - the root gives glue for the servers of test. and deep., not for the
+    one of other., which is in test.
+  - the servers of test. delegate shop.test. to a server in other.,
+    giving an address for it they aren't authoritative for
+  - the server of shop.test. answers with a record of test.
+  - every zone below deep. is delegated by its parent
+*/
+func delegations() map[string]handler {
+	answer := func(name string, records map[string]reply, zone string) reply {
+		if r, found := records[name]; found {
+			return r
+		}
+		return nameError(zone)
+	}
+	handlers := map[string]handler{
+		"127.0.0.2": func(q *zonefiles.QueryQuestion, _ bool) reply {
+			switch name := strings.ToLower(q.QName); {
+			case isSubdomain(name, "test."):
+				return referralTo("test.", "ns1.test.", aRecord("ns1.test.", "127.0.0.3"))
+			case isSubdomain(name, "other."):
+				return referralTo("other.", "ns.glueless.test.")
+			case isSubdomain(name, "deep."):
+				return referralTo("deep.", "ns.deep.", aRecord("ns.deep.", "127.0.0.10"))
+			}
+			return nameError(".")
+		},
+		"127.0.0.3": func(q *zonefiles.QueryQuestion, _ bool) reply {
+			name := strings.ToLower(q.QName)
+			if isSubdomain(name, "shop.test.") {
+				return referralTo("shop.test.", "ns.shop.other.", aRecord("ns.shop.other.", "127.0.0.66"))
+			}
+			return answer(name, map[string]reply{
+				"www.test.":         {answer: []zonefiles.ResourceRecord{aRecord("www.test.", "192.0.2.1")}},
+				"ns.glueless.test.": {answer: []zonefiles.ResourceRecord{aRecord("ns.glueless.test.", "127.0.0.4")}},
+				// the alias alone, without the records of its target
+				"cname-only.test.": {answer: []zonefiles.ResourceRecord{cnameRecord("cname-only.test.", "www.test.")}},
+				"dangling.test.": {rcode: zonefiles.NameError,
+					answer:    []zonefiles.ResourceRecord{cnameRecord("dangling.test.", "nowhere.test.")},
+					authority: []zonefiles.ResourceRecord{soaRecord("test.")}},
+			}, "test.")
+		},
+		"127.0.0.4": func(q *zonefiles.QueryQuestion, _ bool) reply {
+			return answer(strings.ToLower(q.QName), map[string]reply{
+				"ns.shop.other.": {answer: []zonefiles.ResourceRecord{aRecord("ns.shop.other.", "127.0.0.5")}},
+			}, "other.")
+		},
+		"127.0.0.5": func(q *zonefiles.QueryQuestion, _ bool) reply {
+			return answer(strings.ToLower(q.QName), map[string]reply{
+				"www.shop.test.": {answer: []zonefiles.ResourceRecord{aRecord("www.shop.test.", "192.0.2.5")}},
+				"alias.shop.test.": {answer: []zonefiles.ResourceRecord{
+					cnameRecord("alias.shop.test.", "www.test."), aRecord("www.test.", "6.6.6.6")}},
+			}, "shop.test.")
+		},
+		// the address given out of bailiwick
+		"127.0.0.66": func(q *zonefiles.QueryQuestion, _ bool) reply {
+			return reply{answer: []zonefiles.ResourceRecord{aRecord(q.QName, "6.6.6.6")}}
+		},
+	}
+
+	// 127.0.0.10 serves deep., 127.0.0.11 l4.deep. and so on
+	zone := "deep."
+	for i := 10; i < 14; i++ {
+		child := fmt.Sprintf("l%d.%s", 14-i, zone)
+		ns, next := "ns."+child, fmt.Sprintf("127.0.0.%d", i+1)
+		handlers[fmt.Sprintf("127.0.0.%d", i)] = func(q *zonefiles.QueryQuestion, _ bool) reply {
+			return referralTo(child, ns, aRecord(ns, next))
+		}
+		zone = child
+	}
+	handlers["127.0.0.14"] = func(q *zonefiles.QueryQuestion, _ bool) reply {
+		return reply{answer: []zonefiles.ResourceRecord{aRecord(q.QName, "192.0.2.14")}}
+	}
+	return handlers
+}
+
+func TestRecursion(t *testing.T) {
+	port, servers := fakeAuthorities(t, delegations())
+	hints := rootHints(t, "127.0.0.2")
+	deep := "www.l1.l2.l3.l4.deep."
+
+	cases := []struct {
+		name         string
+		qname        string
+		maxReferrals int
+		maxDepth     int
+
+		// the answers, nil if the resolution fails
+		want []string
+	}{
+		{
+			name:  "glue",
+			qname: "www.test.",
+			want:  []string{"www.test. A 192.0.2.1"},
+		},
+		{
+			name:  "glueless delegation, out-of-bailiwick glue ignored",
+			qname: "www.shop.test.",
+			want:  []string{"www.shop.test. A 192.0.2.5"},
+		},
+		{
+			name:  "out-of-bailiwick answer ignored",
+			qname: "alias.shop.test.",
+			want:  []string{"alias.shop.test. CNAME www.test.", "www.test. A 192.0.2.1"},
+		},
+		{
+			name:  "in-zone alias answered without its target",
+			qname: "cname-only.test.",
+			want:  []string{"cname-only.test. CNAME www.test.", "www.test. A 192.0.2.1"},
+		},
+		{
+			name:     "nested lookups of name servers within the limit",
+			qname:    "www.shop.test.",
+			maxDepth: 2,
+			want:     []string{"www.shop.test. A 192.0.2.5"},
+		},
+		{
+			name:     "nested lookups of name servers over the limit",
+			qname:    "www.shop.test.",
+			maxDepth: 1,
+		},
+		{
+			name:         "referrals within the limit",
+			qname:        deep,
+			maxReferrals: 5,
+			want:         []string{deep + " A 192.0.2.14"},
+		},
+		{
+			name:         "referrals over the limit",
+			qname:        deep,
+			maxReferrals: 4,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := NewRecursor(hints, port, 200*time.Millisecond, 1, c.maxReferrals, c.maxDepth, MinimisationOff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := r.Resolve(&zonefiles.QueryQuestion{QName: c.qname, Qtype: int(zonefiles.A), Qclass: int(zonefiles.IN)})
+			if c.want == nil {
+				if err == nil {
+					t.Fatalf("got %q, want an error", recordStrings(result.Answers))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recordStrings(result.Answers); strings.Join(got, ",") != strings.Join(c.want, ",") {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+	if got := servers["127.0.0.66"].received(); len(got) != 0 {
+		t.Errorf("the address given out of bailiwick got %q", got)
+	}
+}
+
+func TestNameError(t *testing.T) {
+	port, _ := fakeAuthorities(t, delegations())
+	r, err := NewRecursor(rootHints(t, "127.0.0.2"), port, 200*time.Millisecond, 1, 0, 0, MinimisationOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := r.Resolve(&zonefiles.QueryQuestion{QName: "nowhere.test.", Qtype: int(zonefiles.A), Qclass: int(zonefiles.IN)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recordStrings(result.Authority); result.RCode != zonefiles.NameError || len(got) != 1 || !strings.HasPrefix(got[0], "test. SOA") {
+		t.Errorf("got rcode %d and %q, want a name error with the SOA record of test.", result.RCode, got)
+	}
+
+	// an in-zone alias to a name that doesn't exist, proven by the SOA record
+	result, err = r.Resolve(&zonefiles.QueryQuestion{QName: "dangling.test.", Qtype: int(zonefiles.A), Qclass: int(zonefiles.IN)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, authority := recordStrings(result.Answers), recordStrings(result.Authority)
+	if result.RCode != zonefiles.NameError || len(answers) != 1 || len(authority) != 1 || !strings.HasPrefix(authority[0], "test. SOA") {
+		t.Errorf("got rcode %d, %q and %q, want a name error with the alias and the SOA record of test.", result.RCode, answers, authority)
+	}
+}
+
+func TestRootHints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "named.root")
+	os.WriteFile(path, []byte(`; comment
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000 IN   A     170.247.170.2
+C.ROOT-SERVERS.NET.      3600000      A     192.33.4.12
+`), 0644)
+	r, err := NewRecursor(path, 0, 0, 0, 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"198.41.0.4:53", "[2001:503:ba3e::2:30]:53", "170.247.170.2:53"}
+	if strings.Join(r.roots, ",") != strings.Join(want, ",") || r.minimisation != MinimisationRelaxed {
+		t.Errorf("got the roots %q and minimisation %s, want %q and relaxed", r.roots, r.minimisation, want)
+	}
+	if _, err := NewRecursor(path, 0, 0, 0, 0, 0, "aggressive"); err == nil {
+		t.Error("accepted an unknown minimisation mode")
+	}
+}
+
+/*
+the zones good., nx. and refused., whose servers answer for www.a.<zone>
+and respectively deny the data, the existence or refuse the queries of
+the empty non-terminal a.<zone>
+*/
+func minimisingDelegations() map[string]handler {
+	leaf := func(zone string, ip string, emptyNonTerminal reply) handler {
+		return func(q *zonefiles.QueryQuestion, _ bool) reply {
+			switch strings.ToLower(q.QName) {
+			case "www.a." + zone:
+				return reply{answer: []zonefiles.ResourceRecord{aRecord("www.a."+zone, ip)}}
+			case "a." + zone:
+				return emptyNonTerminal
+			}
+			return nameError(zone)
+		}
+	}
+	return map[string]handler{
+		"127.0.0.2": func(q *zonefiles.QueryQuestion, _ bool) reply {
+			for zone, ip := range map[string]string{"good.": "127.0.0.3", "nx.": "127.0.0.4", "refused.": "127.0.0.5"} {
+				if isSubdomain(q.QName, zone) {
+					return referralTo(zone, "ns."+zone, aRecord("ns."+zone, ip))
+				}
+			}
+			return nameError(".")
+		},
+		"127.0.0.3": leaf("good.", "127.0.0.3", reply{authority: []zonefiles.ResourceRecord{soaRecord("good.")}}),
+		"127.0.0.4": leaf("nx.", "127.0.0.4", nameError("nx.")),
+		"127.0.0.5": leaf("refused.", "127.0.0.5", reply{rcode: zonefiles.Refused}),
+	}
+}
+
+func TestMinimisation(t *testing.T) {
+	port, servers := fakeAuthorities(t, minimisingDelegations())
+	hints := rootHints(t, "127.0.0.2")
+
+	cases := []struct {
+		mode, zone string
+
+		// the queries of the root and of the servers of the zone
+		root, leaf []string
+
+		// the answer, or the rcode if there is none, and whether the resolution fails
+		want   string
+		rcode  int
+		failed bool
+	}{
+		{
+			mode: MinimisationOff, zone: "good.",
+			root: []string{"www.a.good. 1"}, leaf: []string{"www.a.good. 1"},
+			want: "127.0.0.3",
+		},
+		{
+			mode: MinimisationRelaxed, zone: "good.",
+			root: []string{"good. 1"}, leaf: []string{"a.good. 1", "www.a.good. 1"},
+			want: "127.0.0.3",
+		},
+		{
+			mode: MinimisationStrict, zone: "good.",
+			root: []string{"good. 1"}, leaf: []string{"a.good. 1", "www.a.good. 1"},
+			want: "127.0.0.3",
+		},
+		{
+			mode: MinimisationRelaxed, zone: "nx.",
+			root: []string{"nx. 1"}, leaf: []string{"a.nx. 1", "www.a.nx. 1"},
+			want: "127.0.0.4",
+		},
+		{
+			mode: MinimisationStrict, zone: "nx.",
+			root: []string{"nx. 1"}, leaf: []string{"a.nx. 1"},
+			rcode: zonefiles.NameError,
+		},
+		{
+			mode: MinimisationRelaxed, zone: "refused.",
+			root: []string{"refused. 1"}, leaf: []string{"a.refused. 1", "www.a.refused. 1"},
+			want: "127.0.0.5",
+		},
+		{
+			mode: MinimisationStrict, zone: "refused.",
+			root: []string{"refused. 1"}, leaf: []string{"a.refused. 1"},
+			failed: true,
+		},
+	}
+	leaves := map[string]*fakeServer{"good.": servers["127.0.0.3"], "nx.": servers["127.0.0.4"], "refused.": servers["127.0.0.5"]}
+	for _, c := range cases {
+		t.Run(c.mode+" "+c.zone, func(t *testing.T) {
+			root, leaf := servers["127.0.0.2"], leaves[c.zone]
+			rootBefore, leafBefore := len(root.received()), len(leaf.received())
+			r, err := NewRecursor(hints, port, 200*time.Millisecond, 1, 0, 0, c.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := r.Resolve(&zonefiles.QueryQuestion{QName: "www.a." + c.zone, Qtype: int(zonefiles.A), Qclass: int(zonefiles.IN)})
+
+			switch {
+			case c.failed:
+				if err == nil {
+					t.Errorf("got rcode %d and %q, want an error", result.RCode, recordStrings(result.Answers))
+				}
+			case err != nil:
+				t.Errorf("got the error %v", err)
+			case c.want != "":
+				if got := recordStrings(result.Answers); len(got) != 1 || !strings.HasSuffix(got[0], " A "+c.want) {
+					t.Errorf("got %q, want the address %s", got, c.want)
+				}
+			case result.RCode != c.rcode || len(result.Answers) != 0:
+				t.Errorf("got rcode %d and %q, want rcode %d", result.RCode, recordStrings(result.Answers), c.rcode)
+			}
+
+			for _, s := range []struct {
+				server *fakeServer
+				before int
+				want   []string
+			}{{root, rootBefore, c.root}, {leaf, leafBefore, c.leaf}} {
+				var got []string
+				for _, query := range s.server.received()[s.before:] {
+					got = append(got, strings.TrimPrefix(query, "udp "))
+				}
+				if strings.Join(got, ",") != strings.Join(s.want, ",") {
+					t.Errorf("%s got %q, want %q", s.server.address, got, s.want)
+				}
+			}
+		})
+	}
+}
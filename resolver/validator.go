@@ -0,0 +1,617 @@
+package resolver
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/dnssec"
+	"github.com/abhra303/qDNS/ds/trie"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+const (
+	// how long the keys of a zone are trusted at most, whatever their TTL
+	maxTrustTime = time.Hour
+
+	// how long a zone that failed validation stays bogus before it is checked again
+	bogusTrustTime = time.Minute
+
+	// the most zones whose keys are remembered, expired ones are dropped beyond
+	maxTrustedZones = 10000
+)
+
+// the security status of records (RFC 4035, section 4.3)
+type security int
+
+const (
+	// no trust anchor is above the name of the records
+	indeterminate security = iota
+
+	// the records are below a delegation proven to be unsigned
+	insecure
+
+	secure
+
+	// the records should be signed but their signatures can't be verified
+	bogus
+)
+
+/*
+Validation checks the DNSSEC signatures of the answers of the forwarders
+and of the recursion. It is nil if no trust anchor is configured.
+*/
+var Validation *Validator
+
+/*
+Validator validates answers by following the chain of trust from a
+trust anchor down to the keys that signed them (RFC 4035, section 5).
+The keys of a zone are trusted once its DNSKEY RRset is signed by one of
+its keys a DS record of the parent zone points to, the DS RRset being
+signed by the trusted keys of the parent zone. The zones below a
+delegation proven to have no DS records are unsigned: their answers are
+insecure, neither authenticated nor bogus.
+*/
+type Validator struct {
+	anchors trie.NameTrie[zonefiles.ResourceRecord]
+
+	// what the chain of trust says about the names looked up so far
+	lock   sync.Mutex
+	trusts map[string]*trust
+}
+
+// what the chain of trust says about a name
+type trust struct {
+	status security
+
+	// whether the name is a zone cut, the apex of a zone of its own
+	cut bool
+
+	// the zone keys of the zone, if it is secure
+	keys []*zonefiles.DnskeyRecord
+
+	expires time.Time
+}
+
+// returns the bogus trust of a name, logging why
+func bogusTrust(name string, err error) *trust {
+	log.Printf("dnssec: %s is bogus: %v\n", name, err)
+	return &trust{status: bogus, cut: true, expires: time.Now().Add(bogusTrustTime)}
+}
+
+/*
+NewValidator returns a validator trusting the DS and DNSKEY records of
+the given trust anchor file, and the zones below them.
+*/
+func NewValidator(trustAnchors string) (*Validator, error) {
+	anchors, err := zonefiles.LoadTrustAnchors(trustAnchors)
+	if err != nil {
+		return nil, fmt.Errorf("dnssec: %v", err)
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("dnssec: no trust anchor in %s", trustAnchors)
+	}
+	v := &Validator{anchors: trie.NewNameTrie[zonefiles.ResourceRecord](nil), trusts: make(map[string]*trust)}
+	for _, anchor := range anchors {
+		if err = v.anchors.Put(fqdn(anchor.GetName()), anchor); err != nil {
+			return nil, fmt.Errorf("dnssec: %v", err)
+		}
+	}
+	return v, nil
+}
+
+/*
+fetch asks the forwarder of the name or the recursor for its records of
+the given type along with their signatures. The response cache is
+bypassed, as the records are not validated yet.
+*/
+func fetch(name string, rType zonefiles.RType) (*zonefiles.QueryResult, error) {
+	question := &zonefiles.QueryQuestion{QName: name, Qtype: int(rType), Qclass: int(zonefiles.IN)}
+	if forwarder := forwarderFor(name); forwarder != nil {
+		query := dnsparser.DnsQuery{Header: &dnsparser.MessageHeader{RD: true, CD: true},
+			Opt: &dnsparser.EdnsOpt{DO: true}, Question: []*zonefiles.QueryQuestion{question}}
+		return forwarder.Resolve(&query)
+	}
+	if Recursion != nil {
+		return Recursion.Resolve(question)
+	}
+	return nil, fmt.Errorf("dnssec: no server to ask for the %v records of %s", rType, name)
+}
+
+// returns the records of the owner having the type, and the signatures covering them
+func rrsetOf(records []*zonefiles.ResourceRecord, owner string, rType zonefiles.RType) ([]zonefiles.ResourceRecord, []*zonefiles.RrsigRecord) {
+	var rrset []zonefiles.ResourceRecord
+	var sigs []*zonefiles.RrsigRecord
+	for _, rrPtr := range records {
+		rr := *rrPtr
+		if fqdn(rr.GetName()) != fqdn(owner) {
+			continue
+		}
+		if sig, ok := rr.(*zonefiles.RrsigRecord); ok && sig.TypeCovered == rType {
+			sigs = append(sigs, sig)
+		} else if rr.GetRType() == rType {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
+
+// an RRset of a section and its signatures
+type signedRRset struct {
+	records []zonefiles.ResourceRecord
+	sigs    []*zonefiles.RrsigRecord
+}
+
+// groups the records of a section into RRsets, in the order they appear
+func rrsetsOf(records []*zonefiles.ResourceRecord) []signedRRset {
+	var rrsets []signedRRset
+	seen := make(map[string]bool)
+	for _, rrPtr := range records {
+		rr := *rrPtr
+		if rr.GetRType() == zonefiles.RRSIG {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", fqdn(rr.GetName()), rr.GetRType())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		rrset, sigs := rrsetOf(records, rr.GetName(), rr.GetRType())
+		rrsets = append(rrsets, signedRRset{records: rrset, sigs: sigs})
+	}
+	return rrsets
+}
+
+// returns how long records can be trusted: for their lowest TTL, at most maxTrustTime
+func trustTime(records []zonefiles.ResourceRecord) time.Duration {
+	ttl := maxTrustTime
+	for _, rr := range records {
+		if d := time.Duration(rr.GetTtl()) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+/*
+verifyRRset checks that one of the signatures of the RRset, made by
+the zone, is valid now and verified by one of the keys.
+*/
+func verifyRRset(rrset []zonefiles.ResourceRecord, sigs []*zonefiles.RrsigRecord, zone string, keys []*zonefiles.DnskeyRecord) error {
+	owner, rType := rrset[0].GetName(), rrset[0].GetRType()
+	err := fmt.Errorf("no signature of the %v records of %s by %s", rType, owner, zone)
+	now := time.Now()
+	for _, sig := range sigs {
+		if fqdn(sig.SignerName) != fqdn(zone) || !isSubdomain(owner, zone) || sig.Labels > dnssec.CountLabels(owner) {
+			continue
+		}
+		if !dnssec.ValidAt(sig, now) {
+			err = fmt.Errorf("the signature of the %v records of %s is expired or not valid yet", rType, owner)
+			continue
+		}
+		for _, key := range keys {
+			if key.Algorithm != sig.Algorithm || dnssec.KeyTag(key) != sig.KeyTag {
+				continue
+			}
+			if err = dnssec.Verify(sig, key, rrset); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+/*
+cached returns what is known of the name, calling find if nothing is or
+if it expired.
+*/
+func (v *Validator) cached(name string, find func() (*trust, error)) (*trust, error) {
+	v.lock.Lock()
+	t, found := v.trusts[name]
+	v.lock.Unlock()
+	if found && time.Now().Before(t.expires) {
+		return t, nil
+	}
+
+	t, err := find()
+	if err != nil {
+		return nil, err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.trusts) >= maxTrustedZones {
+		now := time.Now()
+		for key, old := range v.trusts {
+			if !now.Before(old.expires) {
+				delete(v.trusts, key)
+			}
+		}
+	}
+	if len(v.trusts) < maxTrustedZones {
+		v.trusts[name] = t
+	}
+	return t, nil
+}
+
+/*
+zoneKeys returns the trust of the zone whose DNSKEY RRset must be signed
+by one of the keys the pointers, DS records or DNSKEY trust anchors,
+point to. The zone is insecure if none of them has an algorithm we
+support (RFC 4035, section 5.2).
+*/
+func (v *Validator) zoneKeys(zone string, pointers []zonefiles.ResourceRecord) (*trust, error) {
+	var supported []zonefiles.ResourceRecord
+	for _, pointer := range pointers {
+		switch p := pointer.(type) {
+		case *zonefiles.DsRecord:
+			if dnssec.SupportedAlgorithm(p.Algorithm) && dnssec.SupportedDigest(p.DigestType) {
+				supported = append(supported, p)
+			}
+		case *zonefiles.DnskeyRecord:
+			if dnssec.SupportedAlgorithm(p.Algorithm) {
+				supported = append(supported, p)
+			}
+		}
+	}
+	if len(supported) == 0 {
+		return &trust{status: insecure, cut: true, expires: time.Now().Add(trustTime(pointers))}, nil
+	}
+
+	result, err := fetch(zone, zonefiles.DNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	dnskeys, sigs := rrsetOf(result.Answers, zone, zonefiles.DNSKEY)
+	var entryKeys, zoneKeys []*zonefiles.DnskeyRecord
+	for _, rr := range dnskeys {
+		key := rr.(*zonefiles.DnskeyRecord)
+		if key.IsZoneKey() && key.Protocol == zonefiles.DnskeyProtocol {
+			zoneKeys = append(zoneKeys, key)
+		}
+		for _, pointer := range supported {
+			ds, isDs := pointer.(*zonefiles.DsRecord)
+			anchor, isKey := pointer.(*zonefiles.DnskeyRecord)
+			if (isDs && dnssec.MatchesDs(ds, key)) || (isKey && anchor.Flags == key.Flags &&
+				anchor.Algorithm == key.Algorithm && bytes.Equal(anchor.PublicKey, key.PublicKey)) {
+				entryKeys = append(entryKeys, key)
+				break
+			}
+		}
+	}
+	if len(entryKeys) == 0 {
+		return bogusTrust(zone, fmt.Errorf("no DNSKEY matches the DS records or trust anchors")), nil
+	}
+	if err = verifyRRset(dnskeys, sigs, zone, entryKeys); err != nil {
+		return bogusTrust(zone, err), nil
+	}
+	return &trust{status: secure, cut: true, keys: zoneKeys, expires: time.Now().Add(trustTime(dnskeys))}, nil
+}
+
+/*
+verifyDenial returns the NSEC and NSEC3 records of the section, made by
+the zone, once their signatures are verified with the keys of the zone.
+*/
+func verifyDenial(records []*zonefiles.ResourceRecord, zone string, keys []*zonefiles.DnskeyRecord) (*dnssec.Denial, error) {
+	denial := &dnssec.Denial{Zone: zone}
+	for _, rrset := range rrsetsOf(records) {
+		rType := rrset.records[0].GetRType()
+		if rType != zonefiles.NSEC && rType != zonefiles.NSEC3 {
+			continue
+		}
+		if err := verifyRRset(rrset.records, rrset.sigs, zone, keys); err != nil {
+			return nil, err
+		}
+		for _, rr := range rrset.records {
+			switch record := rr.(type) {
+			case *zonefiles.NsecRecord:
+				denial.Nsecs = append(denial.Nsecs, record)
+			case *zonefiles.Nsec3Record:
+				denial.Nsec3s = append(denial.Nsec3s, record)
+			}
+		}
+	}
+	return denial, nil
+}
+
+// reports whether hashing names for the NSEC3 records of the denial is too costly
+func tooManyIterations(denial *dnssec.Denial) bool {
+	return len(denial.Nsec3s) > 0 && denial.Nsec3s[0].Iterations > dnssec.MaxNsec3Iterations
+}
+
+/*
+delegation finds out, from the DS records of the name in the secure zone
+above it or the proof that it has none, whether the name is the apex of
+a secure zone and with which keys, the apex of an insecure zone, or not
+a zone cut at all.
+*/
+func (v *Validator) delegation(name string, zone string, keys []*zonefiles.DnskeyRecord) (*trust, error) {
+	result, err := fetch(name, zonefiles.DS)
+	if err != nil {
+		return nil, err
+	}
+	if result.RCode != zonefiles.NoError && result.RCode != zonefiles.NameError {
+		return nil, fmt.Errorf("dnssec: the DS records of %s can't be found, rcode %d", name, result.RCode)
+	}
+
+	dsSet, sigs := rrsetOf(result.Answers, name, zonefiles.DS)
+	if len(dsSet) > 0 {
+		if err = verifyRRset(dsSet, sigs, zone, keys); err != nil {
+			return bogusTrust(name, err), nil
+		}
+		return v.zoneKeys(name, dsSet)
+	}
+
+	expires := time.Now().Add(trustTime(recordsOf(result.Authority)))
+	denial, err := verifyDenial(result.Authority, zone, keys)
+	if err != nil {
+		return bogusTrust(name, err), nil
+	}
+	if tooManyIterations(denial) {
+		return &trust{status: insecure, cut: true, expires: expires}, nil
+	}
+	unsigned, proven := denial.InsecureDelegation(name)
+	if !proven {
+		return bogusTrust(name, fmt.Errorf("no proof that it has no DS records")), nil
+	}
+	if unsigned {
+		return &trust{status: insecure, cut: true, expires: expires}, nil
+	}
+	return &trust{status: secure, keys: keys, expires: expires}, nil
+}
+
+func recordsOf(records []*zonefiles.ResourceRecord) []zonefiles.ResourceRecord {
+	rrs := make([]zonefiles.ResourceRecord, 0, len(records))
+	for _, rrPtr := range records {
+		rrs = append(rrs, *rrPtr)
+	}
+	return rrs
+}
+
+/*
+chain follows the chain of trust from the closest trust anchor above the
+name down to the name. It returns the deepest zone at or above the name
+it reached, with its trusted keys if it is secure, or the reason it
+stopped: the zone is insecure or bogus. The trust is indeterminate if
+no trust anchor is above the name.
+*/
+func (v *Validator) chain(name string) (string, *trust, error) {
+	name = fqdn(name)
+	anchor, pointers, err := v.anchors.LongestMatch(name)
+	if err != nil {
+		return "", &trust{status: indeterminate}, nil
+	}
+	zone := fqdn(anchor)
+	zoneTrust, err := v.cached(zone, func() (*trust, error) { return v.zoneKeys(zone, pointers) })
+	if err != nil {
+		return "", nil, err
+	}
+
+	for current := zone; current != name && zoneTrust.status == secure; {
+		current = childName(name, current)
+		parent, keys := zone, zoneTrust.keys
+		next, err := v.cached(current, func() (*trust, error) { return v.delegation(current, parent, keys) })
+		if err != nil {
+			return "", nil, err
+		}
+		if next.cut {
+			zone, zoneTrust = current, next
+		}
+	}
+	return zone, zoneTrust, nil
+}
+
+/*
+verifySigned checks the signatures of an RRset, made by the zone of
+their signer which must be a secure zone above the records. Unsigned
+records are insecure if the chain of trust proves that their zone is
+unsigned, and bogus if it is signed. Returns the number of labels of
+the wildcard the records were synthesized from, 0 if they weren't.
+*/
+func (v *Validator) verifySigned(rrset signedRRset) (security, int, error) {
+	owner, rType := fqdn(rrset.records[0].GetName()), rrset.records[0].GetRType()
+	if len(rrset.sigs) == 0 {
+		// the DS records of a zone belong to its parent
+		zoneName := owner
+		if rType == zonefiles.DS {
+			zoneName = parentOf(owner)
+		}
+		_, zoneTrust, err := v.chain(zoneName)
+		if err != nil {
+			return bogus, 0, err
+		}
+		switch zoneTrust.status {
+		case secure:
+			return bogus, 0, fmt.Errorf("the %v records of %s are not signed", rType, owner)
+		case bogus:
+			return bogus, 0, fmt.Errorf("the chain of trust of %s is broken", zoneName)
+		}
+		return zoneTrust.status, 0, nil
+	}
+
+	err := fmt.Errorf("no valid signature of the %v records of %s", rType, owner)
+	tried := make(map[string]bool)
+	for _, sig := range rrset.sigs {
+		signer := fqdn(sig.SignerName)
+		if tried[signer] || !isSubdomain(owner, signer) || (rType == zonefiles.DS && signer == owner) {
+			continue
+		}
+		tried[signer] = true
+		zone, zoneTrust, chainErr := v.chain(signer)
+		if chainErr != nil {
+			return bogus, 0, chainErr
+		}
+		if zoneTrust.status == indeterminate || zoneTrust.status == insecure {
+			return zoneTrust.status, 0, nil
+		}
+		if zoneTrust.status == bogus || zone != signer {
+			err = fmt.Errorf("%s, the signer of the %v records of %s, is not a secure zone", signer, rType, owner)
+			continue
+		}
+		if err = verifyRRset(rrset.records, rrset.sigs, signer, zoneTrust.keys); err == nil {
+			labels := 0
+			if sig.Labels < dnssec.CountLabels(owner) {
+				labels = sig.Labels
+			}
+			return secure, labels, nil
+		}
+	}
+	return bogus, 0, err
+}
+
+// returns the name without its first label, "." for the root
+func parentOf(name string) string {
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '.' {
+			return name[i+1:]
+		}
+	}
+	return "."
+}
+
+/*
+verifyNegative checks that the authority section of the result proves
+that the name doesn't exist, or has no records of the type, with the
+NSEC or NSEC3 records of its zone signed along with the SOA record.
+*/
+func (v *Validator) verifyNegative(name string, rType zonefiles.RType, result *zonefiles.QueryResult) (security, error) {
+	var soa *signedRRset
+	for _, rrset := range rrsetsOf(result.Authority) {
+		if rrset.records[0].GetRType() == zonefiles.SOA && isSubdomain(name, rrset.records[0].GetName()) {
+			soa = &rrset
+			break
+		}
+	}
+	if soa == nil || len(soa.sigs) == 0 {
+		_, zoneTrust, err := v.chain(name)
+		if err != nil {
+			return bogus, err
+		}
+		switch zoneTrust.status {
+		case secure:
+			return bogus, fmt.Errorf("the negative answer for %s is not signed", name)
+		case bogus:
+			return bogus, fmt.Errorf("the chain of trust of %s is broken", name)
+		}
+		return zoneTrust.status, nil
+	}
+	status, _, err := v.verifySigned(*soa)
+	if status != secure {
+		return status, err
+	}
+
+	zone := fqdn(soa.records[0].GetName())
+	_, zoneTrust, err := v.chain(zone)
+	if err != nil {
+		return bogus, err
+	}
+	denial, err := verifyDenial(result.Authority, zone, zoneTrust.keys)
+	if err != nil {
+		return bogus, err
+	}
+	if tooManyIterations(denial) {
+		return insecure, nil
+	}
+	var proven, optOut bool
+	if result.RCode == zonefiles.NameError {
+		proven, optOut = denial.NameError(name)
+	} else {
+		proven, optOut = denial.NoData(name, rType)
+	}
+	if !proven {
+		return bogus, fmt.Errorf("no proof that the %v records of %s don't exist", rType, name)
+	}
+	if optOut {
+		return insecure, nil
+	}
+	return secure, nil
+}
+
+/*
+validate returns the security status of the result: secure if all of
+its RRsets and its proofs of non-existence are, bogus if any of them is.
+Results that aren't answers, such as server failures, and signatures,
+which aren't signed, are indeterminate.
+*/
+func (v *Validator) validate(question *zonefiles.QueryQuestion, result *zonefiles.QueryResult) (security, error) {
+	rType := zonefiles.RType(question.Qtype)
+	if (result.RCode != zonefiles.NoError && result.RCode != zonefiles.NameError) || rType == zonefiles.RRSIG {
+		return indeterminate, nil
+	}
+
+	status := secure
+	for _, rrset := range rrsetsOf(result.Answers) {
+		rrsetStatus, wildcardLabels, err := v.verifySigned(rrset)
+		if rrsetStatus == bogus {
+			return bogus, err
+		}
+		if rrsetStatus == secure && wildcardLabels > 0 {
+			// the name the records were synthesized for must not exist
+			owner := rrset.records[0].GetName()
+			zone := fqdn(rrset.sigs[0].SignerName)
+			_, zoneTrust, err := v.chain(zone)
+			if err != nil {
+				return bogus, err
+			}
+			denial, err := verifyDenial(result.Authority, zone, zoneTrust.keys)
+			if err != nil {
+				return bogus, err
+			}
+			proven, optOut := denial.WildcardAnswer(owner, wildcardLabels)
+			if !proven && !tooManyIterations(denial) {
+				return bogus, fmt.Errorf("no proof that %s doesn't exist for its wildcard answer", owner)
+			}
+			if optOut || !proven {
+				rrsetStatus = insecure
+			}
+		}
+		if rrsetStatus < status {
+			status = rrsetStatus
+		}
+	}
+
+	// the name the answer ends with, once its aliases are followed
+	name := fqdn(question.QName)
+	if rType != zonefiles.Cname {
+		for aliases := 0; aliases <= maxCnameChain; aliases++ {
+			cnames, _ := rrsetOf(result.Answers, name, zonefiles.Cname)
+			if len(cnames) == 0 {
+				break
+			}
+			name = fqdn(cnames[0].GetValue())
+		}
+	}
+	if records, _ := rrsetOf(result.Answers, name, rType); len(records) > 0 {
+		return status, nil
+	}
+
+	negativeStatus, err := v.verifyNegative(name, rType, result)
+	if negativeStatus == bogus {
+		return bogus, err
+	}
+	if negativeStatus < status {
+		status = negativeStatus
+	}
+	return status, nil
+}
+
+/*
+Validate checks the DNSSEC signatures of the records of the result
+answering the question. The result is marked Authenticated if they all
+lead to a trust anchor, and Bogus if any of them should be signed but
+isn't, or can't be verified. Results for names that are not below a
+trust anchor, or that are below an unsigned delegation, are left as
+they are.
+*/
+func (v *Validator) Validate(question *zonefiles.QueryQuestion, result *zonefiles.QueryResult) {
+	status, err := v.validate(question, result)
+	switch status {
+	case secure:
+		result.Authenticated = true
+	case bogus:
+		log.Printf("dnssec: bogus answer for %s: %v\n", question.QName, err)
+		result.Bogus = true
+	}
+}
@@ -0,0 +1,202 @@
+package resolver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abhra303/qDNS/dnsparser"
+	"github.com/abhra303/qDNS/dnssec"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+// writes a new private key in a PEM file, ECDSA P-256 or Ed25519
+func writeKey(t *testing.T, name string, useEcdsa bool) string {
+	t.Helper()
+	var private crypto.PrivateKey
+	var err error
+	if useEcdsa {
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name+".pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// parses the zone of the lines and signs it with the keys, the ZSK being optional
+func signedZone(t *testing.T, origin string, kskFile string, zskFile string, lines ...string) (*zonefiles.Zone, *dnssec.ZoneSigner) {
+	t.Helper()
+	zone := testZone(t, origin, lines...)
+	signer, err := dnssec.NewZoneSigner(zone, kskFile, zskFile, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signer.Sign(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return zone, signer
+}
+
+func testZone(t *testing.T, origin string, lines ...string) *zonefiles.Zone {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zone")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zone, err := zonefiles.ParseZonefile(origin, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+// the DS record of the key, with a SHA-256 digest
+func dsOf(t *testing.T, key *zonefiles.DnskeyRecord) string {
+	t.Helper()
+	digest, err := dnssec.Digest(key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &zonefiles.DsRecord{KeyTag: dnssec.KeyTag(key), Algorithm: key.Algorithm, DigestType: 2, Digest: digest}
+	return ds.GetValue()
+}
+
+// serializes the zone servers, each putting its zone alone in the Catalog while it answers
+var zoneServing sync.Mutex
+
+// answers from the zone alone, as the servers of one zone of a hierarchy do
+func zoneServer(zone *zonefiles.Zone) handler {
+	return func(q *zonefiles.QueryQuestion, _ bool) reply {
+		zoneServing.Lock()
+		defer zoneServing.Unlock()
+		zonefiles.Catalog.Put(zone.Origin, zone)
+		defer zonefiles.Catalog.Delete(zone.Origin)
+		result, err := zonefiles.SearchResourceRecord(q)
+		if err != nil {
+			return reply{rcode: zonefiles.Refused}
+		}
+		return reply{rcode: result.RCode, answer: recordsOf(result.Answers),
+			authority: recordsOf(result.Authority), additional: recordsOf(result.Additional)}
+	}
+}
+
+func TestValidation(t *testing.T) {
+	soa := func(zone string) string {
+		return fmt.Sprintf("@ IN SOA ns.%s hostmaster.%s 1 7200 3600 1209600 60", zone, zone)
+	}
+
+	good, goodSigner := signedZone(t, "good.test.", writeKey(t, "good-ksk", false), writeKey(t, "good-zsk", true),
+		"$TTL=300", soa("good.test."), "@ IN NS ns.good.test.", "ns IN A 127.0.0.4",
+		"www IN A 192.0.2.2", "tampered IN A 192.0.2.22")
+	bad, _ := signedZone(t, "bad.test.", writeKey(t, "bad-ksk", false), "",
+		"$TTL=300", soa("bad.test."), "@ IN NS ns.bad.test.", "ns IN A 127.0.0.5", "www IN A 192.0.2.3")
+	plain := testZone(t, "plain.test.",
+		"$TTL=300", soa("plain.test."), "@ IN NS ns.plain.test.", "ns IN A 127.0.0.6", "www IN A 192.0.2.4")
+
+	// the DS records of bad.test. point to a key it doesn't have
+	other, err := dnssec.LoadSigningKey(writeKey(t, "other", false), "bad.test.", dnssec.KskFlags, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, parentSigner := signedZone(t, "test.", writeKey(t, "test-ksk", false), writeKey(t, "test-zsk", false),
+		"$TTL=300", soa("test."), "@ IN NS ns.test.", "ns IN A 127.0.0.3", "www IN A 192.0.2.1",
+		"good IN NS ns.good.test.", "ns.good IN A 127.0.0.4", "good IN DS "+dsOf(t, goodSigner.Keys()[0]),
+		"bad IN NS ns.bad.test.", "ns.bad IN A 127.0.0.5", "bad IN DS "+dsOf(t, other.Dnskey),
+		"plain IN NS ns.plain.test.", "ns.plain IN A 127.0.0.6")
+
+	anchors := filepath.Join(t.TempDir(), "anchors")
+	if err = os.WriteFile(anchors, []byte("test. 300 IN DNSKEY "+parentSigner.Keys()[0].GetValue()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	goodServer := zoneServer(good)
+	port, _ := fakeAuthorities(t, map[string]handler{
+		// an unsigned root, test. being the trust anchor
+		"127.0.0.2": func(q *zonefiles.QueryQuestion, _ bool) reply {
+			if isSubdomain(q.QName, "test.") {
+				return referralTo("test.", "ns.test.", aRecord("ns.test.", "127.0.0.3"))
+			}
+			return nameError(".")
+		},
+		"127.0.0.3": zoneServer(parent),
+		"127.0.0.4": func(q *zonefiles.QueryQuestion, tcp bool) reply {
+			r := goodServer(q, tcp)
+			if strings.EqualFold(q.QName, "tampered.good.test.") {
+				for i, rr := range r.answer {
+					if sig, ok := rr.(*zonefiles.RrsigRecord); ok {
+						tampered := *sig
+						tampered.Signature = append([]byte(nil), sig.Signature...)
+						tampered.Signature[0] ^= 0xFF
+						r.answer[i] = &tampered
+					}
+				}
+			}
+			return r
+		},
+		"127.0.0.5": zoneServer(bad),
+		"127.0.0.6": zoneServer(plain),
+	})
+	if Recursion, err = NewRecursor(rootHints(t, "127.0.0.2"), port, 200*time.Millisecond, 1, 0, 0, MinimisationOff); err != nil {
+		t.Fatal(err)
+	}
+	if Validation, err = NewValidator(anchors); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Recursion, Validation = nil, nil })
+
+	cases := []struct {
+		name    string
+		rType   zonefiles.RType
+		cd      bool
+		rcode   int
+		answers int
+		ad      bool
+	}{
+		{name: "www.test.", rType: zonefiles.A, answers: 1, ad: true},
+		{name: "www.good.test.", rType: zonefiles.A, answers: 1, ad: true},
+		{name: "good.test.", rType: zonefiles.DNSKEY, answers: 2, ad: true},
+		{name: "nx.good.test.", rType: zonefiles.A, rcode: zonefiles.NameError, ad: true},
+		{name: "www.good.test.", rType: zonefiles.TXT, ad: true},
+		{name: "tampered.good.test.", rType: zonefiles.A, rcode: zonefiles.ServerFailure},
+		{name: "tampered.good.test.", rType: zonefiles.A, cd: true, answers: 1},
+		{name: "www.bad.test.", rType: zonefiles.A, rcode: zonefiles.ServerFailure},
+		{name: "www.bad.test.", rType: zonefiles.A, cd: true, answers: 1},
+		{name: "www.plain.test.", rType: zonefiles.A, answers: 1},
+		{name: "nx.plain.test.", rType: zonefiles.A, rcode: zonefiles.NameError},
+	}
+	for _, c := range cases {
+		response := send(t, dnsparser.MessageHeader{RD: true, AD: true, CD: c.cd}, c.name, c.rType)
+		answers := 0
+		for _, rr := range response.Answer {
+			if (*rr).GetRType() == c.rType {
+				answers++
+			}
+		}
+		if response.Header.Rcode != c.rcode || answers != c.answers || response.Header.AD != c.ad {
+			t.Errorf("%s %v (CD %v): got rcode %d, %d answers and AD %v, want rcode %d, %d answers and AD %v",
+				c.name, c.rType, c.cd, response.Header.Rcode, answers, response.Header.AD, c.rcode, c.answers, c.ad)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/abhra303/qDNS/dnssec"
+	"github.com/abhra303/qDNS/zonefiles"
+)
+
+/*
+signZone runs "qdns signzone", which signs a zone file offline so that
+it can be signed in CI and served as a static signed zone:
+
+	qdns signzone -origin example.com. -ksk ksk.pem [-zsk zsk.pem] [-o example.zone.signed]
+		[-inception 20240101000000] [-validity 336h] [-nsec3 [-salt ab12] [-iterations 0] [-optout]]
+		example.zone
+
+The zone file is read the way the files of the configured zones are,
+and written back with its DNSKEY, RRSIG and NSEC or NSEC3 records,
+replacing those it already had. Signing the same file with the same
+keys and inception time always gives the same output.
+*/
+func signZone(args []string) error {
+	flags := flag.NewFlagSet("signzone", flag.ContinueOnError)
+	origin := flags.String("origin", "", "the name of the zone")
+	kskFile := flags.String("ksk", "", "the PEM file of the key signing key")
+	zskFile := flags.String("zsk", "", "the PEM file of the zone signing key, the KSK signs every RRset if not given")
+	output := flags.String("o", "", "the signed zone file to write, the standard output if not given")
+	inceptionTime := flags.String("inception", "", "the inception of the signatures as YYYYMMDDHHmmSS in UTC or seconds since the epoch, now if not given")
+	validity := flags.Duration("validity", dnssec.DefaultSignatureValidity, "how long the signatures are valid")
+	nsec3 := flags.Bool("nsec3", false, "prove denial of existence with NSEC3 rather than NSEC records")
+	salt := flags.String("salt", "", "the NSEC3 salt in hexadecimal")
+	iterations := flags.Int("iterations", 0, "the additional NSEC3 hash iterations")
+	optOut := flags.Bool("optout", false, "leave the delegations to unsigned zones out of the NSEC3 chain")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *origin == "" || *kskFile == "" {
+		return fmt.Errorf("usage: qdns signzone -origin zone -ksk file [-zsk file] [-o file] [options] zonefile")
+	}
+
+	inception := time.Now()
+	if *inceptionTime != "" {
+		seconds, err := zonefiles.ParseSignatureTime(*inceptionTime)
+		if err != nil {
+			return fmt.Errorf("bad inception time %s", *inceptionTime)
+		}
+		inception = time.Unix(int64(seconds), 0)
+	}
+	var params *zonefiles.Nsec3Params
+	if *nsec3 {
+		params = &zonefiles.Nsec3Params{Iterations: *iterations, OptOut: *optOut}
+		var err error
+		if params.Salt, err = hex.DecodeString(*salt); err != nil {
+			return fmt.Errorf("bad NSEC3 salt %s: %v", *salt, err)
+		}
+	}
+
+	zone, err := zonefiles.ParseZonefile(*origin, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	signer, err := dnssec.NewZoneSigner(zone, *kskFile, *zskFile, *validity, params)
+	if err != nil {
+		return err
+	}
+	if err = signer.SignFrom(inception); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return zone.WriteZonefile(os.Stdout)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err = zone.WriteZonefile(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
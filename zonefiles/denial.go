@@ -0,0 +1,263 @@
+package zonefiles
+
+import "strings"
+
+/*
+The label of a name sorting after the owner names of every NSEC3 record
+of a zone, base32hex digits being at most "v".
+*/
+const afterLastHash = "w"
+
+/*
+denialOf returns how the zone proves that names and RRsets don't exist:
+with the NSEC3 chain whose parameters the NSEC3PARAM record of its apex
+tells, or with an NSEC chain if its apex owns an NSEC record. Unsigned
+zones have neither and give no proofs.
+*/
+func (z *Zone) denialOf() (*Nsec3paramRecord, bool) {
+	apex, _ := z.lookup(z.Origin)
+	nsec := false
+	for _, record := range apex {
+		switch record := record.(type) {
+		case *Nsec3paramRecord:
+			if record.HashAlgorithm == Nsec3Sha1 && record.Flags == 0 {
+				return record, false
+			}
+		case *NsecRecord:
+			nsec = true
+		}
+	}
+	return nil, nsec
+}
+
+/*
+proveNameError adds to the negative answer the proof that the name
+doesn't exist and that no wildcard can answer for it: the NSEC records
+covering the name and the wildcard of its closest encloser (RFC 4035,
+section 3.1.3.2), or the closest encloser proof of the name and the
+NSEC3 record covering the wildcard (RFC 5155, section 7.2.2).
+*/
+func (z *Zone) proveNameError(name string, result *QueryResult) {
+	param, nsec := z.denialOf()
+	if param != nil {
+		encloser, proof := z.closestEncloserProof(name, param)
+		addProof(result, proof)
+		addProof(result, z.nsec3Covering(wildcardAt(encloser), param))
+	} else if nsec {
+		addProof(result, z.nsecCovering(name))
+		addProof(result, z.nsecCovering(wildcardAt(canonicalName(z.closestEncloser(name)))))
+	}
+}
+
+/*
+proveNoData adds to the negative answer the proof that the name, which
+exists, has no RRset of the type asked: its NSEC or NSEC3 record, whose
+type bitmap lacks it (RFC 4035, section 3.1.3.1 and RFC 5155, section
+7.2.3). An empty non-terminal has no NSEC record, the one covering it
+is given instead. The delegations to unsigned zones left out of an
+opt-out NSEC3 chain get the closest encloser proof of their name
+instead (RFC 5155, section 7.2.4). The proof is the same for referrals
+to unsigned zones, which have no DS RRset.
+*/
+func (z *Zone) proveNoData(name string, result *QueryResult) {
+	param, nsec := z.denialOf()
+	if param != nil {
+		if match := z.nsec3Matching(name, param); match != nil {
+			addProof(result, match)
+			return
+		}
+		_, proof := z.closestEncloserProof(name, param)
+		addProof(result, proof)
+	} else if nsec {
+		if match := z.nsecAt(name); match != nil {
+			addProof(result, match)
+			return
+		}
+		addProof(result, z.nsecCovering(name))
+	}
+}
+
+/*
+proveWildcardAnswer adds to an answer synthesized from a wildcard the
+proof that the name asked doesn't exist, which validators need to
+accept it (RFC 4035, section 3.1.3.3 and RFC 5155, section 7.2.6).
+*/
+func (z *Zone) proveWildcardAnswer(name string, result *QueryResult) {
+	param, nsec := z.denialOf()
+	if param != nil {
+		encloser := canonicalName(z.closestEncloser(name))
+		addProof(result, z.nsec3Covering(nextCloser(canonicalName(name), encloser), param))
+	} else if nsec {
+		addProof(result, z.nsecCovering(name))
+	}
+}
+
+/*
+proveWildcardNoData adds to the negative answer the proof that the name
+doesn't exist and that the wildcard answering for it has no RRset of
+the type asked (RFC 4035, section 3.1.3.4 and RFC 5155, section 7.2.5).
+*/
+func (z *Zone) proveWildcardNoData(name string, result *QueryResult) {
+	param, nsec := z.denialOf()
+	if param != nil {
+		encloser, proof := z.closestEncloserProof(name, param)
+		addProof(result, proof)
+		addProof(result, z.nsec3Matching(wildcardAt(encloser), param))
+	} else if nsec {
+		addProof(result, z.nsecCovering(name))
+		addProof(result, z.nsecAt(wildcardAt(canonicalName(z.closestEncloser(name)))))
+	}
+}
+
+// returns the NSEC record of the name and its signatures, nil if it has none
+func (z *Zone) nsecAt(name string) []ResourceRecord {
+	records, _ := z.lookup(name)
+	return withSignatures(records, NSEC)
+}
+
+/*
+nsecCovering returns the NSEC record, and its signatures, of the name
+coming last before the given one in canonical order, whose next name
+comes after it. The glue below delegations has no NSEC records, they
+are skipped.
+*/
+func (z *Zone) nsecCovering(name string) []ResourceRecord {
+	for {
+		previous, records, found := z.trie.Predecessor(name)
+		if !found || !z.contains(previous) {
+			return nil
+		}
+		if nsec := withSignatures(records, NSEC); nsec != nil {
+			return nsec
+		}
+		name = previous
+	}
+}
+
+/*
+closestEncloserProof returns the closest encloser of the name, which
+doesn't exist, along with the NSEC3 records proving it: the one matching
+the encloser and the one covering the next closer name (RFC 5155,
+section 7.2.1). Names left out of an opt-out chain are not provable
+enclosers, the closest ancestor having an NSEC3 record is.
+*/
+func (z *Zone) closestEncloserProof(name string, param *Nsec3paramRecord) (string, []ResourceRecord) {
+	name, origin := canonicalName(name), canonicalName(z.Origin)
+	encloser := canonicalName(z.closestEncloser(name))
+	for {
+		if encloser != name {
+			if match := z.nsec3Matching(encloser, param); match != nil {
+				return encloser, append(match, z.nsec3Covering(nextCloser(name, encloser), param)...)
+			}
+		}
+		if encloser == origin || !z.contains(encloser) {
+			return encloser, nil
+		}
+		encloser = parentOf(encloser)
+	}
+}
+
+// returns the owner name of the NSEC3 record of the name
+func (z *Zone) hashedOwner(name string, param *Nsec3paramRecord) (string, bool) {
+	hash, err := Nsec3Hash(name, param.Iterations, param.Salt)
+	if err != nil {
+		return "", false
+	}
+	return Nsec3Owner(hash, z.Origin), true
+}
+
+// returns the NSEC3 record of the name and its signatures, nil if it has none
+func (z *Zone) nsec3Matching(name string, param *Nsec3paramRecord) []ResourceRecord {
+	owner, ok := z.hashedOwner(name, param)
+	if !ok || z.nsec3s == nil {
+		return nil
+	}
+	records, err := z.nsec3s.Search(owner)
+	if err != nil {
+		return nil
+	}
+	return withSignatures(records, NSEC3)
+}
+
+/*
+nsec3Covering returns the NSEC3 record, and its signatures, whose owner
+hash comes last before the hash of the name. A hash coming before the
+first one of the chain is covered by the last record, whose next hash
+wraps around to the first one.
+*/
+func (z *Zone) nsec3Covering(name string, param *Nsec3paramRecord) []ResourceRecord {
+	owner, ok := z.hashedOwner(name, param)
+	if !ok || z.nsec3s == nil {
+		return nil
+	}
+	previous, records, found := z.nsec3s.Predecessor(owner)
+	if !found || !z.contains(previous) {
+		previous, records, found = z.nsec3s.Predecessor(childOf(afterLastHash, canonicalName(z.Origin)))
+	}
+	if !found || !z.contains(previous) {
+		return nil
+	}
+	return withSignatures(records, NSEC3)
+}
+
+// returns the records of the type along with their signatures, nil if there are none
+func withSignatures(records []ResourceRecord, rType RType) []ResourceRecord {
+	rrset := recordsOfType(records, rType)
+	if len(rrset) == 0 {
+		return nil
+	}
+	return append(rrset, signaturesOf(records, rType, rrset[0].GetRClass())...)
+}
+
+/*
+addProof adds the records to the authority section of the result,
+leaving out those already there, as a record can be part of several
+proofs of an answer.
+*/
+func addProof(result *QueryResult, records []ResourceRecord) {
+	for _, record := range records {
+		added := false
+		for _, rr := range result.Authority {
+			if *rr == record {
+				added = true
+				break
+			}
+		}
+		if !added {
+			result.addAuthority(record)
+		}
+	}
+}
+
+/*
+nextCloser returns the ancestor of the name, or the name itself, having
+one label more than its closest encloser (RFC 5155, section 1.3).
+*/
+func nextCloser(name string, encloser string) string {
+	if name == encloser || !strings.HasSuffix(name, "."+encloser) && encloser != "." {
+		return name
+	}
+	labels := strings.Split(strings.TrimSuffix(strings.TrimSuffix(name, encloser), "."), ".")
+	return labels[len(labels)-1] + "." + strings.TrimPrefix(encloser, ".")
+}
+
+// returns the wildcard name whose closest encloser is the given name
+func wildcardAt(name string) string {
+	return childOf("*", name)
+}
+
+// returns the name made of the label followed by the parent name
+func childOf(label string, parent string) string {
+	if parent == "." {
+		return label + "."
+	}
+	return label + "." + parent
+}
+
+// returns the name one label above the given one, the root being its own parent
+func parentOf(name string) string {
+	if _, parent, found := strings.Cut(name, "."); found && parent != "" {
+		return parent
+	}
+	return "."
+}
@@ -0,0 +1,326 @@
+package zonefiles
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/abhra303/qDNS/ds/trie"
+)
+
+var denialZone = []string{
+	"$TTL=300",
+	"@ IN SOA ns1.example.test. admin.example.test. 1 7200 3600 1209600 60",
+	"@ IN NS ns1.example.test.",
+	"ns1 IN A 192.0.2.1",
+	"www IN A 192.0.2.2",
+	"host.ent IN A 192.0.2.3",
+	"*.wild IN A 192.0.2.4",
+	"secure IN NS ns.secure.example.test.",
+	"secure IN DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	"ns.secure IN A 192.0.2.5",
+	"insecure IN NS ns.insecure.example.test.",
+	"ns.insecure IN A 192.0.2.6",
+}
+
+// the types the denial records of the names of denialZone tell, empty non-terminals included
+var denialTypes = map[string][]RType{
+	"example.test.":          {SOA, NS},
+	"ns1.example.test.":      {A},
+	"www.example.test.":      {A},
+	"ent.example.test.":      nil,
+	"host.ent.example.test.": {A},
+	"wild.example.test.":     nil,
+	"*.wild.example.test.":   {A},
+	"secure.example.test.":   {NS, DS},
+	"insecure.example.test.": {NS},
+}
+
+func signedDenialZone(t *testing.T, nsec3 *Nsec3Params) *Zone {
+	t.Helper()
+	zone := parseTestZone(t, "example.test.", denialZone...)
+	if err := zone.Sign(nsec3, fakeSign); err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+func sameTypes(a, b []RType) bool {
+	for _, rType := range a {
+		if !HasType(b, rType) {
+			return false
+		}
+	}
+	for _, rType := range b {
+		if !HasType(a, rType) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNsecChain(t *testing.T) {
+	zone := signedDenialZone(t, nil)
+
+	// the names owning records, but the glue, in canonical order
+	var names []string
+	for name, types := range denialTypes {
+		if types != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return trie.CompareNames(names[i], names[j]) < 0 })
+
+	for i, name := range names {
+		nsecs := recordsAt(t, zone, name, NSEC)
+		if len(nsecs) != 1 {
+			t.Errorf("%s has NSEC records %v, want one", name, nsecs)
+			continue
+		}
+		nsec := nsecs[0].(*NsecRecord)
+		if next := names[(i+1)%len(names)]; nsec.NextName != next {
+			t.Errorf("the NSEC record of %s points to %s, want %s", name, nsec.NextName, next)
+		}
+		// an unsigned delegation has no signatures but its NSEC record's
+		if want := append(denialTypes[name], RRSIG, NSEC); !sameTypes(nsec.Types, want) {
+			t.Errorf("the NSEC record of %s has types %v, want %v", name, nsec.Types, want)
+		}
+	}
+	for _, name := range []string{"ent.example.test.", "ns.secure.example.test.", "ns.insecure.example.test."} {
+		if nsecs := recordsAt(t, zone, name, NSEC); len(nsecs) != 0 {
+			t.Errorf("%s has NSEC records %v, want none", name, nsecs)
+		}
+	}
+}
+
+func TestNsec3Chain(t *testing.T) {
+	for _, optOut := range []bool{false, true} {
+		params := &Nsec3Params{Iterations: 2, Salt: []byte{0xAB, 0xCD}, OptOut: optOut}
+		zone := signedDenialZone(t, params)
+
+		var hashes [][]byte
+		for name, types := range denialTypes {
+			hash, err := Nsec3Hash(name, params.Iterations, params.Salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, _ := zone.nsec3s.Search(Nsec3Owner(hash, zone.Origin))
+			nsec3s := recordsOfType(records, NSEC3)
+			if name == "insecure.example.test." && optOut {
+				if len(nsec3s) != 0 {
+					t.Errorf("opt-out: the unsigned delegation %s has NSEC3 records %v", name, nsec3s)
+				}
+				continue
+			}
+			if len(nsec3s) != 1 {
+				t.Errorf("opt-out %v: %s has NSEC3 records %v, want one", optOut, name, nsec3s)
+				continue
+			}
+			hashes = append(hashes, hash)
+
+			nsec3 := nsec3s[0].(*Nsec3Record)
+			want := types
+			switch {
+			case name == "example.test.":
+				want = append(want, RRSIG, NSEC3PARAM)
+			case types != nil && name != "insecure.example.test.":
+				want = append(want, RRSIG)
+			}
+			if !sameTypes(nsec3.Types, want) {
+				t.Errorf("opt-out %v: the NSEC3 record of %s has types %v, want %v", optOut, name, nsec3.Types, want)
+			}
+			if nsec3.IsOptOut() != optOut || nsec3.Iterations != params.Iterations || !bytes.Equal(nsec3.Salt, params.Salt) {
+				t.Errorf("opt-out %v: the NSEC3 record of %s is %s", optOut, name, nsec3.GetValue())
+			}
+			if len(signaturesOf(records, NSEC3, IN)) == 0 {
+				t.Errorf("opt-out %v: the NSEC3 record of %s is not signed", optOut, name)
+			}
+		}
+		if zone.nsec3s.Len() != len(hashes) {
+			t.Errorf("opt-out %v: got %d NSEC3 names, want %d", optOut, zone.nsec3s.Len(), len(hashes))
+		}
+
+		// each record points to the next hash in order, the last one to the first
+		sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+		for i, hash := range hashes {
+			records, _ := zone.nsec3s.Search(Nsec3Owner(hash, zone.Origin))
+			nsec3s := recordsOfType(records, NSEC3)
+			if len(nsec3s) == 0 {
+				continue
+			}
+			if next := hashes[(i+1)%len(hashes)]; !bytes.Equal(nsec3s[0].(*Nsec3Record).NextHashed, next) {
+				t.Errorf("opt-out %v: the NSEC3 record of %x points to %x, want %x", optOut, hash, nsec3s[0].(*Nsec3Record).NextHashed, next)
+			}
+		}
+	}
+}
+
+// tells if the denial records of the result match, or cover, the name
+func proves(result *QueryResult, name string, covering bool) bool {
+	for _, rr := range result.Authority {
+		switch record := (*rr).(type) {
+		case *NsecRecord:
+			owner, next := record.GetName(), record.NextName
+			if !covering {
+				if trie.CompareNames(owner, name) == 0 {
+					return true
+				}
+				continue
+			}
+			if trie.CompareNames(owner, next) < 0 {
+				if trie.CompareNames(owner, name) < 0 && trie.CompareNames(name, next) < 0 {
+					return true
+				}
+			} else if trie.CompareNames(owner, name) < 0 || trie.CompareNames(name, next) < 0 {
+				return true
+			}
+		case *Nsec3Record:
+			hash, _ := Nsec3Hash(name, record.Iterations, record.Salt)
+			owner, next := record.OwnerHash(), record.NextHashed
+			if !covering {
+				if bytes.Equal(owner, hash) {
+					return true
+				}
+				continue
+			}
+			if bytes.Compare(owner, next) < 0 {
+				if bytes.Compare(owner, hash) < 0 && bytes.Compare(hash, next) < 0 {
+					return true
+				}
+			} else if bytes.Compare(owner, hash) < 0 || bytes.Compare(hash, next) < 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tells if the denial records of the result covering the name have the opt-out flag
+func optedOut(result *QueryResult, name string) bool {
+	for _, rr := range result.Authority {
+		if record, ok := (*rr).(*Nsec3Record); ok && record.IsOptOut() {
+			hash, _ := Nsec3Hash(name, record.Iterations, record.Salt)
+			if !bytes.Equal(record.OwnerHash(), hash) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestDenialProofs(t *testing.T) {
+	type proof struct {
+		// the names the records of the proof own, and the names they cover
+		matched, covered []string
+	}
+	tests := []struct {
+		name  string
+		qname string
+		qtype RType
+		rcode int
+		nsec  proof
+		nsec3 proof
+		// the proof of the opt-out chain, when it differs
+		optOut *proof
+	}{
+		{"name error", "nope.example.test.", A, NameError,
+			proof{nil, []string{"nope.example.test.", "*.example.test."}},
+			proof{[]string{"example.test."}, []string{"nope.example.test.", "*.example.test."}}, nil},
+		{"name error below an empty non-terminal", "x.ent.example.test.", A, NameError,
+			proof{nil, []string{"x.ent.example.test.", "*.ent.example.test."}},
+			proof{[]string{"ent.example.test."}, []string{"x.ent.example.test.", "*.ent.example.test."}}, nil},
+		{"name error below a name", "x.y.www.example.test.", A, NameError,
+			proof{nil, []string{"x.y.www.example.test.", "*.www.example.test."}},
+			proof{[]string{"www.example.test."}, []string{"y.www.example.test.", "*.www.example.test."}}, nil},
+		{"no data", "www.example.test.", MX, NoError,
+			proof{[]string{"www.example.test."}, nil},
+			proof{[]string{"www.example.test."}, nil}, nil},
+		{"no data at an empty non-terminal", "ent.example.test.", A, NoError,
+			proof{nil, []string{"ent.example.test."}},
+			proof{[]string{"ent.example.test."}, nil}, nil},
+		{"wildcard answer", "a.wild.example.test.", A, NoError,
+			proof{nil, []string{"a.wild.example.test."}},
+			proof{nil, []string{"a.wild.example.test."}}, nil},
+		{"wildcard no data", "a.wild.example.test.", MX, NoError,
+			proof{[]string{"*.wild.example.test."}, []string{"a.wild.example.test."}},
+			proof{[]string{"wild.example.test.", "*.wild.example.test."}, []string{"a.wild.example.test."}}, nil},
+		{"referral to an unsigned zone", "host.insecure.example.test.", A, NoError,
+			proof{[]string{"insecure.example.test."}, nil},
+			proof{[]string{"insecure.example.test."}, nil},
+			&proof{[]string{"example.test."}, []string{"insecure.example.test."}}},
+		{"no DS at an unsigned delegation", "insecure.example.test.", DS, NoError,
+			proof{[]string{"insecure.example.test."}, nil},
+			proof{[]string{"insecure.example.test."}, nil},
+			&proof{[]string{"example.test."}, []string{"insecure.example.test."}}},
+	}
+
+	chains := []struct {
+		name   string
+		params *Nsec3Params
+	}{
+		{"NSEC", nil},
+		{"NSEC3", &Nsec3Params{Salt: []byte{0xAB}}},
+		{"NSEC3 opt-out", &Nsec3Params{Salt: []byte{0xAB}, OptOut: true}},
+	}
+	for _, chain := range chains {
+		zone := signedDenialZone(t, chain.params)
+		for _, test := range tests {
+			want := test.nsec
+			if chain.params != nil {
+				want = test.nsec3
+				if chain.params.OptOut && test.optOut != nil {
+					want = *test.optOut
+				}
+			}
+			result, err := zone.findResourceRecord(&QueryQuestion{QName: test.qname, Qtype: int(test.qtype), Qclass: int(IN)})
+			if err != nil {
+				t.Fatalf("%s: %s: %v", chain.name, test.name, err)
+			}
+			if result.RCode != test.rcode {
+				t.Errorf("%s: %s: got rcode %d, want %d", chain.name, test.name, result.RCode, test.rcode)
+			}
+			for _, name := range want.matched {
+				if !proves(result, name, false) {
+					t.Errorf("%s: %s: no record of %s in %v", chain.name, test.name, name, namesAndTypes(result.Authority))
+				}
+			}
+			for _, name := range want.covered {
+				if !proves(result, name, true) {
+					t.Errorf("%s: %s: no record covering %s in %v", chain.name, test.name, name, namesAndTypes(result.Authority))
+				}
+			}
+			if chain.params != nil && chain.params.OptOut && test.optOut != nil && !optedOut(result, test.qname) {
+				t.Errorf("%s: %s: the covering record has no opt-out flag", chain.name, test.name)
+			}
+
+			denials, sigs := 0, 0
+			for _, rr := range result.Authority {
+				switch record := (*rr).(type) {
+				case *NsecRecord, *Nsec3Record:
+					denials++
+				case *RrsigRecord:
+					if record.TypeCovered == NSEC || record.TypeCovered == NSEC3 {
+						sigs++
+					}
+				}
+			}
+			if denials == 0 || sigs != denials {
+				t.Errorf("%s: %s: got %d denial records and %d signatures of them", chain.name, test.name, denials, sigs)
+			}
+		}
+	}
+
+	// a signed delegation has DS records instead of a proof
+	zone := signedDenialZone(t, nil)
+	result, err := zone.findResourceRecord(&QueryQuestion{QName: "host.secure.example.test.", Qtype: int(A), Qclass: int(IN)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := false
+	for _, rr := range result.Authority {
+		ds = ds || (*rr).GetRType() == DS
+	}
+	if proves(result, "secure.example.test.", false) || !ds {
+		t.Errorf("got authority %v for a signed delegation, want its DS records and no NSEC record", namesAndTypes(result.Authority))
+	}
+}
@@ -0,0 +1,665 @@
+package zonefiles
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flags of DNSKEY records (RFC 4034, section 2.1.1)
+const (
+	// the key signs the records of its zone
+	DnskeyZoneKey = 0x0100
+
+	// the key is a key signing key, pointed to by the DS records of the parent
+	DnskeySep = 0x0001
+)
+
+// the only value of the protocol field of DNSKEY records
+const DnskeyProtocol = 3
+
+// flags of NSEC3 records (RFC 5155, section 3.1.2)
+const Nsec3OptOut = 0x01
+
+// the only hash algorithm of NSEC3 records (RFC 5155, section 11)
+const Nsec3Sha1 = 1
+
+// the hashed owner names of NSEC3 records use the base32 alphabet of RFC 4648, section 7
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type DnskeyRecord struct {
+	resourceRecord
+
+	Flags     int
+	Protocol  int
+	Algorithm int
+
+	// the public key, in the format of its algorithm
+	PublicKey []byte
+}
+
+func (d *DnskeyRecord) GetRClass() RClass {
+	return d.Class
+}
+
+func (d *DnskeyRecord) GetRType() RType {
+	return DNSKEY
+}
+
+func (d *DnskeyRecord) GetValue() string {
+	return fmt.Sprintf("%d %d %d %s", d.Flags, d.Protocol, d.Algorithm, base64.StdEncoding.EncodeToString(d.PublicKey))
+}
+
+func (d *DnskeyRecord) GetTtl() uint {
+	return d.TTL
+}
+
+// reports whether the key signs the records of its zone
+func (d *DnskeyRecord) IsZoneKey() bool {
+	return d.Flags&DnskeyZoneKey != 0
+}
+
+// reports whether the key is a key signing key
+func (d *DnskeyRecord) IsSep() bool {
+	return d.Flags&DnskeySep != 0
+}
+
+/*
+DsRecord identifies a DNSKEY of a child zone by a digest of it, and
+lives on the parent side of the zone cut (RFC 4034, section 5).
+*/
+type DsRecord struct {
+	resourceRecord
+
+	KeyTag     int
+	Algorithm  int
+	DigestType int
+	Digest     []byte
+}
+
+func (d *DsRecord) GetRClass() RClass {
+	return d.Class
+}
+
+func (d *DsRecord) GetRType() RType {
+	return DS
+}
+
+func (d *DsRecord) GetValue() string {
+	return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, strings.ToUpper(hex.EncodeToString(d.Digest)))
+}
+
+func (d *DsRecord) GetTtl() uint {
+	return d.TTL
+}
+
+type RrsigRecord struct {
+	resourceRecord
+
+	// the type of the records the signature covers
+	TypeCovered RType
+	Algorithm   int
+
+	/*
+	   The number of labels of the owner name of the signed
+	   records, the root and a leading "*" not included. Fewer
+	   labels than the owner has mean that the records were
+	   synthesized from a wildcard.
+	*/
+	Labels int
+
+	// the TTL of the records as they are in their zone
+	OriginalTtl uint
+
+	/*
+	   The validity period of the signature, in seconds since
+	   the epoch modulo 2^32 (RFC 4034, section 3.1.5).
+	*/
+	Expiration uint32
+	Inception  uint32
+
+	// the tag of the key, in the zone of SignerName, that made the signature
+	KeyTag     int
+	SignerName string
+	Signature  []byte
+}
+
+func (r *RrsigRecord) GetRClass() RClass {
+	return r.Class
+}
+
+func (r *RrsigRecord) GetRType() RType {
+	return RRSIG
+}
+
+func (r *RrsigRecord) GetValue() string {
+	return fmt.Sprintf("%v %d %d %d %s %s %d %s %s", r.TypeCovered, r.Algorithm, r.Labels, r.OriginalTtl,
+		formatSignatureTime(r.Expiration), formatSignatureTime(r.Inception), r.KeyTag, r.SignerName,
+		base64.StdEncoding.EncodeToString(r.Signature))
+}
+
+func (r *RrsigRecord) GetTtl() uint {
+	return r.TTL
+}
+
+/*
+NsecRecord proves that no name exists between its owner and NextName in
+the canonical order of the zone, and that its owner has no records of
+the types missing from Types (RFC 4034, section 4).
+*/
+type NsecRecord struct {
+	resourceRecord
+
+	NextName string
+	Types    []RType
+}
+
+func (n *NsecRecord) GetRClass() RClass {
+	return n.Class
+}
+
+func (n *NsecRecord) GetRType() RType {
+	return NSEC
+}
+
+func (n *NsecRecord) GetValue() string {
+	return strings.TrimSpace(n.NextName + " " + formatTypes(n.Types))
+}
+
+func (n *NsecRecord) GetTtl() uint {
+	return n.TTL
+}
+
+/*
+Nsec3Record is an NSEC record for the hashed names of a zone, so that
+the names of the zone can't be listed by walking the chain (RFC 5155).
+Its owner is the hash of a name, in base32, prepended to the zone.
+*/
+type Nsec3Record struct {
+	resourceRecord
+
+	HashAlgorithm int
+	Flags         int
+	Iterations    int
+	Salt          []byte
+
+	// the hash of the next name of the zone in hash order
+	NextHashed []byte
+	Types      []RType
+}
+
+func (n *Nsec3Record) GetRClass() RClass {
+	return n.Class
+}
+
+func (n *Nsec3Record) GetRType() RType {
+	return NSEC3
+}
+
+func (n *Nsec3Record) GetValue() string {
+	return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", n.HashAlgorithm, n.Flags, n.Iterations, formatSalt(n.Salt),
+		base32Hex.EncodeToString(n.NextHashed), formatTypes(n.Types)))
+}
+
+func (n *Nsec3Record) GetTtl() uint {
+	return n.TTL
+}
+
+// reports whether unsigned delegations may lie between the owner and the next name
+func (n *Nsec3Record) IsOptOut() bool {
+	return n.Flags&Nsec3OptOut != 0
+}
+
+// OwnerHash returns the hash the record stands for, from the first label of its owner
+func (n *Nsec3Record) OwnerHash() []byte {
+	label, _, _ := strings.Cut(n.GetName(), ".")
+	hash, err := base32Hex.DecodeString(strings.ToUpper(label))
+	if err != nil {
+		return nil
+	}
+	return hash
+}
+
+/*
+Nsec3paramRecord tells, at the apex of a zone, the parameters of the
+NSEC3 records its servers answer with (RFC 5155, section 4).
+*/
+type Nsec3paramRecord struct {
+	resourceRecord
+
+	HashAlgorithm int
+	Flags         int
+	Iterations    int
+	Salt          []byte
+}
+
+func (n *Nsec3paramRecord) GetRClass() RClass {
+	return n.Class
+}
+
+func (n *Nsec3paramRecord) GetRType() RType {
+	return NSEC3PARAM
+}
+
+func (n *Nsec3paramRecord) GetValue() string {
+	return fmt.Sprintf("%d %d %d %s", n.HashAlgorithm, n.Flags, n.Iterations, formatSalt(n.Salt))
+}
+
+func (n *Nsec3paramRecord) GetTtl() uint {
+	return n.TTL
+}
+
+/*
+Nsec3Hash returns the NSEC3 hash of the name: the SHA-1 of its canonical
+wire form followed by the salt, hashed again with the salt iterations
+more times (RFC 5155, section 5).
+*/
+func Nsec3Hash(name string, iterations int, salt []byte) ([]byte, error) {
+	name = canonicalName(name)
+	var wire []byte
+	if name != "." {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %s", name)
+			}
+			wire = append(append(wire, byte(len(label))), label...)
+		}
+	}
+	wire = append(wire, 0)
+
+	hash := sha1.Sum(append(wire, salt...))
+	for i := 0; i < iterations; i++ {
+		hash = sha1.Sum(append(hash[:], salt...))
+	}
+	return hash[:], nil
+}
+
+// Nsec3Owner returns the owner name of the NSEC3 record of the hash in the zone
+func Nsec3Owner(hash []byte, zone string) string {
+	owner := strings.ToLower(base32Hex.EncodeToString(hash))
+	if zone = canonicalName(zone); zone == "." {
+		return owner + "."
+	}
+	return owner + "." + zone
+}
+
+// HasType reports whether the type is in the types of an NSEC or NSEC3 record
+func HasType(types []RType, rType RType) bool {
+	for _, t := range types {
+		if t == rType {
+			return true
+		}
+	}
+	return false
+}
+
+func formatTypes(types []RType) string {
+	sorted := append([]RType(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	names := make([]string, len(sorted))
+	for i, t := range sorted {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " ")
+}
+
+// formats the salt of NSEC3 records in hexadecimal, "-" if there is none
+func formatSalt(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(salt))
+}
+
+// formats the time of a signature as YYYYMMDDHHmmSS in UTC (RFC 4034, section 3.2)
+func formatSignatureTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+// parses the fields following the type of a DS record
+func parseDsData(fields []string) (*DsRecord, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("invalid file: ds record must have key tag, algorithm, digest type and digest")
+	}
+	var values [3]int
+	for i, field := range fields[:3] {
+		value, err := strconv.Atoi(field)
+		if err != nil || value < 0 || (i == 0 && value > 0xFFFF) || (i > 0 && value > 0xFF) {
+			return nil, fmt.Errorf("invalid file: bad ds field \"%v\"", field)
+		}
+		values[i] = value
+	}
+	// the digest may be split in several fields
+	digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid file: bad ds digest: %v", err)
+	}
+	record := &DsRecord{resourceRecord: resourceRecord{Type: DS}, KeyTag: values[0], Algorithm: values[1], DigestType: values[2], Digest: digest}
+	record.Value = record.GetValue()
+	return record, nil
+}
+
+// parses the fields following the type of a DNSKEY record
+func parseDnskeyData(fields []string) (*DnskeyRecord, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("invalid file: dnskey record must have flags, protocol, algorithm and key")
+	}
+	var values [3]int
+	for i, field := range fields[:3] {
+		value, err := strconv.Atoi(field)
+		if err != nil || value < 0 || (i == 0 && value > 0xFFFF) || (i > 0 && value > 0xFF) {
+			return nil, fmt.Errorf("invalid file: bad dnskey field \"%v\"", field)
+		}
+		values[i] = value
+	}
+	if values[1] != DnskeyProtocol {
+		return nil, fmt.Errorf("invalid file: the dnskey protocol must be %d", DnskeyProtocol)
+	}
+	// the key may be split in several fields
+	key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid file: bad dnskey public key: %v", err)
+	}
+	record := &DnskeyRecord{resourceRecord: resourceRecord{Type: DNSKEY}, Flags: values[0], Protocol: values[1], Algorithm: values[2], PublicKey: key}
+	record.Value = record.GetValue()
+	return record, nil
+}
+
+func (zp *zonefileParser) parseDsFromFile(fields []string) error {
+	typePos := typePosition(fields, "DS")
+	record, err := parseDsData(fields[typePos+1:])
+	if err != nil {
+		return err
+	}
+	return zp.putDnssecRecord(fields, typePos, record, &record.resourceRecord)
+}
+
+func (zp *zonefileParser) parseDnskeyFromFile(fields []string) error {
+	typePos := typePosition(fields, "DNSKEY")
+	record, err := parseDnskeyData(fields[typePos+1:])
+	if err != nil {
+		return err
+	}
+	return zp.putDnssecRecord(fields, typePos, record, &record.resourceRecord)
+}
+
+/*
+ParseSignatureTime converts the time of a signature, as YYYYMMDDHHmmSS in
+UTC or as a number of seconds since the epoch, to the latter modulo
+2^32 (RFC 4034, section 3.2).
+*/
+func ParseSignatureTime(field string) (uint32, error) {
+	if len(field) == 14 {
+		t, err := time.Parse("20060102150405", field)
+		if err != nil {
+			return 0, fmt.Errorf("invalid file: bad signature time \"%v\"", field)
+		}
+		return uint32(t.Unix()), nil
+	}
+	seconds, err := strconv.ParseUint(field, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file: bad signature time \"%v\"", field)
+	}
+	return uint32(seconds), nil
+}
+
+// parses the salt of NSEC3 and NSEC3PARAM records, "-" standing for none
+func parseSalt(field string) ([]byte, error) {
+	if field == "-" {
+		return nil, nil
+	}
+	salt, err := hex.DecodeString(field)
+	if err != nil || len(salt) > 255 {
+		return nil, fmt.Errorf("invalid file: bad nsec3 salt \"%v\"", field)
+	}
+	return salt, nil
+}
+
+// parses the type bitmap of NSEC and NSEC3 records
+func parseTypes(fields []string) ([]RType, error) {
+	types := make([]RType, 0, len(fields))
+	for _, field := range fields {
+		rType, ok := ParseRType(field)
+		if !ok {
+			return nil, fmt.Errorf("invalid file: unknown type \"%v\"", field)
+		}
+		if !HasType(types, rType) {
+			types = append(types, rType)
+		}
+	}
+	return types, nil
+}
+
+// parses the numeric fields of a record that are at most max
+func parseNumbers(fields []string, max []int, rType string) ([]int, error) {
+	values := make([]int, len(max))
+	for i, field := range fields[:len(max)] {
+		value, err := strconv.Atoi(field)
+		if err != nil || value < 0 || value > max[i] {
+			return nil, fmt.Errorf("invalid file: bad %s field \"%v\"", rType, field)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// parses the fields following the type of an RRSIG record
+func parseRrsigData(fields []string) (*RrsigRecord, error) {
+	if len(fields) < 9 {
+		return nil, fmt.Errorf("invalid file: rrsig record must have type covered, algorithm, labels, " +
+			"original ttl, expiration, inception, key tag, signer name and signature")
+	}
+	covered, ok := ParseRType(fields[0])
+	if !ok {
+		return nil, fmt.Errorf("invalid file: unknown type covered \"%v\"", fields[0])
+	}
+	values, err := parseNumbers(fields[1:], []int{0xFF, 0xFF, 0x7FFFFFFF}, "rrsig")
+	if err != nil {
+		return nil, err
+	}
+	expiration, err := ParseSignatureTime(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	inception, err := ParseSignatureTime(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	keyTag, err := parseNumbers(fields[6:], []int{0xFFFF}, "rrsig")
+	if err != nil {
+		return nil, err
+	}
+	// the signature may be split in several fields
+	signature, err := base64.StdEncoding.DecodeString(strings.Join(fields[8:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid file: bad rrsig signature: %v", err)
+	}
+	record := &RrsigRecord{resourceRecord: resourceRecord{Type: RRSIG}, TypeCovered: covered, Algorithm: values[0],
+		Labels: values[1], OriginalTtl: uint(values[2]), Expiration: expiration, Inception: inception, KeyTag: keyTag[0],
+		SignerName: fields[7], Signature: signature}
+	record.Value = record.GetValue()
+	return record, nil
+}
+
+// parses the fields following the type of an NSEC record
+func parseNsecData(fields []string) (*NsecRecord, error) {
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("invalid file: nsec record must have a next domain name")
+	}
+	types, err := parseTypes(fields[1:])
+	if err != nil {
+		return nil, err
+	}
+	record := &NsecRecord{resourceRecord: resourceRecord{Type: NSEC}, NextName: fields[0], Types: types}
+	record.Value = record.GetValue()
+	return record, nil
+}
+
+// parses the fields following the type of an NSEC3 record
+func parseNsec3Data(fields []string) (*Nsec3Record, error) {
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("invalid file: nsec3 record must have hash algorithm, flags, iterations, salt and next hashed owner")
+	}
+	values, err := parseNumbers(fields, []int{0xFF, 0xFF, 0xFFFF}, "nsec3")
+	if err != nil {
+		return nil, err
+	}
+	salt, err := parseSalt(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	next, err := base32Hex.DecodeString(strings.ToUpper(fields[4]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid file: bad nsec3 next hashed owner \"%v\"", fields[4])
+	}
+	types, err := parseTypes(fields[5:])
+	if err != nil {
+		return nil, err
+	}
+	record := &Nsec3Record{resourceRecord: resourceRecord{Type: NSEC3}, HashAlgorithm: values[0], Flags: values[1],
+		Iterations: values[2], Salt: salt, NextHashed: next, Types: types}
+	record.Value = record.GetValue()
+	return record, nil
+}
+
+// parses the fields following the type of an NSEC3PARAM record
+func parseNsec3paramData(fields []string) (*Nsec3paramRecord, error) {
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid file: nsec3param record must have hash algorithm, flags, iterations and salt")
+	}
+	values, err := parseNumbers(fields, []int{0xFF, 0xFF, 0xFFFF}, "nsec3param")
+	if err != nil {
+		return nil, err
+	}
+	salt, err := parseSalt(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	record := &Nsec3paramRecord{resourceRecord: resourceRecord{Type: NSEC3PARAM}, HashAlgorithm: values[0], Flags: values[1],
+		Iterations: values[2], Salt: salt}
+	record.Value = record.GetValue()
+	return record, nil
+}
+
+func (zp *zonefileParser) parseRrsigFromFile(fields []string) error {
+	typePos := typePosition(fields, "RRSIG")
+	record, err := parseRrsigData(fields[typePos+1:])
+	if err != nil {
+		return err
+	}
+	return zp.putDnssecRecord(fields, typePos, record, &record.resourceRecord)
+}
+
+func (zp *zonefileParser) parseNsecFromFile(fields []string) error {
+	typePos := typePosition(fields, "NSEC")
+	record, err := parseNsecData(fields[typePos+1:])
+	if err != nil {
+		return err
+	}
+	return zp.putDnssecRecord(fields, typePos, record, &record.resourceRecord)
+}
+
+func (zp *zonefileParser) parseNsec3FromFile(fields []string) error {
+	typePos := typePosition(fields, "NSEC3")
+	record, err := parseNsec3Data(fields[typePos+1:])
+	if err != nil {
+		return err
+	}
+	return zp.putDnssecRecord(fields, typePos, record, &record.resourceRecord)
+}
+
+func (zp *zonefileParser) parseNsec3paramFromFile(fields []string) error {
+	typePos := typePosition(fields, "NSEC3PARAM")
+	record, err := parseNsec3paramData(fields[typePos+1:])
+	if err != nil {
+		return err
+	}
+	return zp.putDnssecRecord(fields, typePos, record, &record.resourceRecord)
+}
+
+// adds the record parsed from the fields to the zone, with the owner, class and TTL of the line
+func (zp *zonefileParser) putDnssecRecord(fields []string, typePos int, record ResourceRecord, rr *resourceRecord) error {
+	rr.TTL = uint(zp.ttl)
+	// the metadata parser expects a single value field after the type
+	err := zp.parseMetadataFromLine(append(fields[:typePos+1:typePos+1], fields[len(fields)-1]), rr)
+	if err != nil {
+		return err
+	}
+	rr.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), record)
+}
+
+/*
+LoadTrustAnchors reads the DS and DNSKEY records of a trust anchor file,
+the keys whose zones, and the zones below them, are trusted without
+proof. The file has the format of a master file whose records all have
+a fully qualified owner name, as the root anchors published by IANA
+(RFC 7958) once converted.
+*/
+func LoadTrustAnchors(path string) ([]ResourceRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var anchors []ResourceRecord
+	zp := zonefileParser{fscanner: bufio.NewScanner(file)}
+	for zp.fscanner.Scan() {
+		fields, err := splitFields(zp.fscanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		fields, err = zp.readContinuation(fields)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		owner := fields[0]
+		if !strings.HasSuffix(owner, ".") {
+			return nil, fmt.Errorf("invalid file: the trust anchor %s is not fully qualified", owner)
+		}
+		// the type comes after the owner and the optional TTL and class
+		typePos := 1
+		for typePos < len(fields) && !strings.EqualFold(fields[typePos], "DS") && !strings.EqualFold(fields[typePos], "DNSKEY") {
+			typePos++
+		}
+		if typePos == len(fields) {
+			return nil, fmt.Errorf("invalid file: trust anchors must be DS or DNSKEY records")
+		}
+
+		var anchor ResourceRecord
+		if strings.EqualFold(fields[typePos], "DS") {
+			var record *DsRecord
+			if record, err = parseDsData(fields[typePos+1:]); err == nil {
+				record.Name, record.Class = owner, IN
+				anchor = record
+			}
+		} else {
+			var record *DnskeyRecord
+			if record, err = parseDnskeyData(fields[typePos+1:]); err == nil {
+				record.Name, record.Class = owner, IN
+				anchor = record
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, anchor)
+	}
+	if err = zp.fscanner.Err(); err != nil {
+		return nil, err
+	}
+	return anchors, nil
+}
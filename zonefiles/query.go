@@ -37,7 +37,37 @@ type QueryDomain struct {
 	Questions []*QueryQuestion
 }
 
+// response codes (RCODE) of a query result
+const (
+	NoError        int = 0
+	FormatError    int = 1
+	ServerFailure  int = 2
+	NameError      int = 3
+	NotImplemented int = 4
+	Refused        int = 5
+)
+
 type QueryResult struct {
+	/*
+	   Whether the result was produced by an authority for
+	   the queried name; sets the AA bit of the response.
+	*/
+	Authoritative bool
+
+	/*
+	   Whether the records of the result were validated with
+	   DNSSEC up to a trust anchor; sets the AD bit of the
+	   response.
+	*/
+	Authenticated bool
+
+	/*
+	   Whether the records of the result failed DNSSEC
+	   validation. They are only given to the clients that
+	   disabled checking, the others get a server failure.
+	*/
+	Bogus bool
+
 	Ancount    uint
 	Arcount    uint
 	Nscount    uint
@@ -47,6 +77,21 @@ type QueryResult struct {
 	Additional []*ResourceRecord
 }
 
+func (r *QueryResult) addAnswer(rr ResourceRecord) {
+	r.Answers = append(r.Answers, &rr)
+	r.Ancount++
+}
+
+func (r *QueryResult) addAuthority(rr ResourceRecord) {
+	r.Authority = append(r.Authority, &rr)
+	r.Nscount++
+}
+
+func (r *QueryResult) addAdditional(rr ResourceRecord) {
+	r.Additional = append(r.Additional, &rr)
+	r.Arcount++
+}
+
 func SearchResourceRecord(query *QueryQuestion) (*QueryResult, error) {
 	zone, err := findZone(query)
 	if err != nil {
@@ -0,0 +1,323 @@
+package zonefiles
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type SrvRecord struct {
+	resourceRecord
+
+	/*
+	   The priority of the target host, lower values are
+	   tried first.
+	*/
+	Priority int
+
+	/*
+	   A relative weight for entries with the same priority,
+	   larger weights get a proportionately higher chance of
+	   being selected.
+	*/
+	Weight int
+
+	// the port on the target host of the service
+	Port int
+}
+
+func (s *SrvRecord) GetRClass() RClass {
+	return s.Class
+}
+
+func (s *SrvRecord) GetRType() RType {
+	return SRV
+}
+
+// returns the target host of the service
+func (s *SrvRecord) GetValue() string {
+	return s.Value
+}
+
+func (s *SrvRecord) GetTtl() uint {
+	return s.TTL
+}
+
+func (s *SrvRecord) GetPriority() int {
+	return s.Priority
+}
+
+func (s *SrvRecord) GetWeight() int {
+	return s.Weight
+}
+
+func (s *SrvRecord) GetPort() int {
+	return s.Port
+}
+
+// SvcParamKeys registered for the SVCB record (RFC 9460, section 14.3.2)
+const (
+	SvcParamMandatory     uint16 = 0
+	SvcParamAlpn          uint16 = 1
+	SvcParamNoDefaultAlpn uint16 = 2
+	SvcParamPort          uint16 = 3
+	SvcParamIpv4Hint      uint16 = 4
+	SvcParamEch           uint16 = 5
+	SvcParamIpv6Hint      uint16 = 6
+)
+
+var svcParamKeyNames = map[string]uint16{
+	"mandatory":       SvcParamMandatory,
+	"alpn":            SvcParamAlpn,
+	"no-default-alpn": SvcParamNoDefaultAlpn,
+	"port":            SvcParamPort,
+	"ipv4hint":        SvcParamIpv4Hint,
+	"ech":             SvcParamEch,
+	"ipv6hint":        SvcParamIpv6Hint,
+}
+
+type SvcParam struct {
+	Key uint16
+
+	// the value of the parameter in its wire format
+	Value []byte
+}
+
+type SvcbRecord struct {
+	resourceRecord
+
+	/*
+	   0 for AliasMode records, the priority of the
+	   alternative endpoint for ServiceMode records.
+	*/
+	Priority int
+
+	// the parameters of the endpoint, sorted by key
+	Params []SvcParam
+}
+
+func (s *SvcbRecord) GetRClass() RClass {
+	return s.Class
+}
+
+func (s *SvcbRecord) GetRType() RType {
+	return SVCB
+}
+
+// returns the TargetName of the record
+func (s *SvcbRecord) GetValue() string {
+	return s.Value
+}
+
+func (s *SvcbRecord) GetTtl() uint {
+	return s.TTL
+}
+
+func (s *SvcbRecord) GetPriority() int {
+	return s.Priority
+}
+
+/*
+returns the name holding the addresses of the endpoint; a TargetName
+of "." in ServiceMode stands for the owner name of the record itself
+*/
+func (s *SvcbRecord) GetTargetHost() string {
+	if s.Value == "." {
+		if s.Priority == 0 {
+			return ""
+		}
+		return s.Name
+	}
+	return s.Value
+}
+
+// returns the position of the given type in the fields of a record, types being case-insensitive
+func typePosition(fields []string, rType string) int {
+	for i, field := range fields {
+		if strings.EqualFold(field, rType) && !isOwnerField(fields, i) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+isOwnerField tells whether the field at the given position is the owner
+name of the record rather than its type, which is the case for an owner
+spelled like a type ("ns IN MX 10 mail") followed by the class, or by
+the type and the data of the record.
+*/
+func isOwnerField(fields []string, i int) bool {
+	if i != 0 || len(fields) < 2 {
+		return false
+	}
+	_, isType := ParseRType(fields[1])
+	return CheckClassValidity(fields[1]) != UnknownClass || isType && len(fields) > 2
+}
+
+func (zp *zonefileParser) parseSrvFromFile(fields []string) error {
+	srvRecord := SrvRecord{resourceRecord: resourceRecord{Type: SRV, TTL: uint(zp.ttl)}}
+
+	typePos := typePosition(fields, "SRV")
+	if len(fields)-typePos != 5 {
+		return fmt.Errorf("invalid file: srv record must have priority, weight, port and target")
+	}
+	// the metadata parser expects a single value field after the type
+	err := zp.parseMetadataFromLine(append(fields[:typePos+1:typePos+1], fields[len(fields)-1]), &srvRecord.resourceRecord)
+	if err != nil {
+		return err
+	}
+
+	var values [3]int
+	for i, field := range fields[typePos+1 : typePos+4] {
+		values[i], err = strconv.Atoi(field)
+		if err != nil || values[i] < 0 || values[i] > 0xFFFF {
+			return fmt.Errorf("invalid file: bad srv field \"%v\"", field)
+		}
+	}
+	target := fields[len(fields)-1]
+	if target != "." && !CheckDomainValidity(target) {
+		return fmt.Errorf("invalid file: the srv target is not valid")
+	}
+
+	srvRecord.Priority, srvRecord.Weight, srvRecord.Port = values[0], values[1], values[2]
+	srvRecord.Value = target
+	srvRecord.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), &srvRecord)
+}
+
+func (zp *zonefileParser) parseSvcbFromFile(fields []string) error {
+	svcbRecord := SvcbRecord{resourceRecord: resourceRecord{Type: SVCB, TTL: uint(zp.ttl)}}
+
+	typePos := typePosition(fields, "SVCB")
+	if len(fields)-typePos < 3 {
+		return fmt.Errorf("invalid file: svcb record must have priority and target")
+	}
+	err := zp.parseMetadataFromLine(fields[:typePos+2], &svcbRecord.resourceRecord)
+	if err != nil {
+		return err
+	}
+
+	svcbRecord.Priority, err = strconv.Atoi(fields[typePos+1])
+	if err != nil || svcbRecord.Priority < 0 || svcbRecord.Priority > 0xFFFF {
+		return fmt.Errorf("invalid file: bad svcb priority \"%v\"", fields[typePos+1])
+	}
+	target := fields[typePos+2]
+	if target != "." && !CheckDomainValidity(target) {
+		return fmt.Errorf("invalid file: the svcb target is not valid")
+	}
+	svcbRecord.Value = target
+
+	params := fields[typePos+3:]
+	if svcbRecord.Priority == 0 && len(params) > 0 {
+		return fmt.Errorf("invalid file: svcb records in alias mode can't have parameters")
+	}
+	seen := make(map[uint16]bool)
+	for _, field := range params {
+		param, err := parseSvcParam(field)
+		if err != nil {
+			return err
+		}
+		if seen[param.Key] {
+			return fmt.Errorf("invalid file: duplicate svcb parameter \"%v\"", field)
+		}
+		seen[param.Key] = true
+		svcbRecord.Params = append(svcbRecord.Params, param)
+	}
+	sort.Slice(svcbRecord.Params, func(i, j int) bool {
+		return svcbRecord.Params[i].Key < svcbRecord.Params[j].Key
+	})
+
+	svcbRecord.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), &svcbRecord)
+}
+
+// converts the name of a SvcParamKey ("alpn", "key65000", ...) to its number
+func parseSvcParamKey(name string) (uint16, error) {
+	if key, ok := svcParamKeyNames[name]; ok {
+		return key, nil
+	}
+	if strings.HasPrefix(name, "key") {
+		key, err := strconv.ParseUint(strings.TrimPrefix(name, "key"), 10, 16)
+		if err == nil {
+			return uint16(key), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid file: unknown svcb parameter \"%v\"", name)
+}
+
+/*
+parseSvcParam converts a "key=value" field of a SVCB record into the
+key and the wire format of the value (RFC 9460, section 7).
+*/
+func parseSvcParam(field string) (SvcParam, error) {
+	name, rawValue, hasValue := strings.Cut(field, "=")
+	key, err := parseSvcParamKey(name)
+	if err != nil {
+		return SvcParam{}, err
+	}
+	value, err := parseCharacterString(rawValue)
+	if err != nil {
+		return SvcParam{}, err
+	}
+	if !hasValue && key != SvcParamNoDefaultAlpn {
+		return SvcParam{}, fmt.Errorf("invalid file: svcb parameter \"%v\" needs a value", name)
+	}
+
+	param := SvcParam{Key: key}
+	switch key {
+	case SvcParamMandatory:
+		var keys []int
+		for _, keyName := range strings.Split(value, ",") {
+			k, err := parseSvcParamKey(keyName)
+			if err != nil {
+				return SvcParam{}, err
+			}
+			keys = append(keys, int(k))
+		}
+		sort.Ints(keys)
+		for _, k := range keys {
+			param.Value = binary.BigEndian.AppendUint16(param.Value, uint16(k))
+		}
+	case SvcParamAlpn:
+		for _, id := range strings.Split(value, ",") {
+			if len(id) == 0 || len(id) > MaxCharacterStringLength {
+				return SvcParam{}, fmt.Errorf("invalid file: bad alpn id in \"%v\"", field)
+			}
+			param.Value = append(param.Value, byte(len(id)))
+			param.Value = append(param.Value, id...)
+		}
+	case SvcParamNoDefaultAlpn:
+		if value != "" {
+			return SvcParam{}, fmt.Errorf("invalid file: no-default-alpn can't have a value")
+		}
+	case SvcParamPort:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return SvcParam{}, fmt.Errorf("invalid file: bad port in \"%v\"", field)
+		}
+		param.Value = binary.BigEndian.AppendUint16(param.Value, uint16(port))
+	case SvcParamIpv4Hint, SvcParamIpv6Hint:
+		for _, addr := range strings.Split(value, ",") {
+			if key == SvcParamIpv4Hint && CheckIPv4Validity(addr) {
+				param.Value = append(param.Value, net.ParseIP(addr).To4()...)
+			} else if key == SvcParamIpv6Hint && CheckIPv6Validity(addr) {
+				param.Value = append(param.Value, net.ParseIP(addr).To16()...)
+			} else {
+				return SvcParam{}, fmt.Errorf("invalid file: bad address hint in \"%v\"", field)
+			}
+		}
+	case SvcParamEch:
+		param.Value, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return SvcParam{}, fmt.Errorf("invalid file: bad ech config in \"%v\"", field)
+		}
+	default:
+		param.Value = []byte(value)
+	}
+	return param, nil
+}
@@ -0,0 +1,316 @@
+package zonefiles
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Nsec3Params are the parameters of the NSEC3 chain of a zone (RFC 5155,
+section 10). Zones signed without them have an NSEC chain.
+*/
+type Nsec3Params struct {
+	// the additional times names are hashed, 0 is recommended (RFC 9276)
+	Iterations int
+	Salt       []byte
+
+	/*
+	   Leaves the delegations to unsigned zones out of the chain,
+	   so that it doesn't grow with them (RFC 5155, section 6).
+	*/
+	OptOut bool
+}
+
+// a name of the zone being signed
+type signedName struct {
+	name string
+
+	// the records of the name, without its old signatures and denial records
+	records []ResourceRecord
+
+	// the NSEC or NSEC3PARAM records added to the name, and the signatures of all of them
+	added []ResourceRecord
+
+	delegation bool
+
+	// below a delegation, its records belong to the child zone
+	glue bool
+}
+
+/*
+Sign builds the NSEC chain of the zone, or its NSEC3 chain if nsec3 is
+given, signs the RRsets the zone is authoritative for with sign, which
+returns the RRSIG records of an RRset, and replaces the chain and the
+signatures the zone had with the new ones. Both are replaced in a
+single batch, dropped as a whole if a change fails, so that readers see
+either the old chain and signatures or the new ones, but for the moment
+between the publication of the NSEC3 records and of the other records
+(see batch). The NS records of the delegations and the names below
+them, whose records (glue) belong to the child zones, are not signed;
+the DS records of the delegations are (RFC 4035, section 2.2).
+*/
+func (z *Zone) Sign(nsec3 *Nsec3Params, sign func(rrset []ResourceRecord) ([]*RrsigRecord, error)) error {
+	origin := canonicalName(z.Origin)
+	var names []*signedName
+	var cut string
+	z.Walk(func(name string, records []ResourceRecord) bool {
+		current := &signedName{name: canonicalName(name)}
+		for _, record := range records {
+			switch record.GetRType() {
+			case RRSIG, NSEC, NSEC3PARAM:
+			default:
+				current.records = append(current.records, record)
+			}
+		}
+		if len(current.records) == 0 {
+			return true
+		}
+		// the names below a delegation come right after it in canonical order
+		if cut != "" && strings.HasSuffix(current.name, "."+cut) {
+			current.glue = true
+		} else {
+			cut = ""
+			if current.name != origin && len(recordsOfType(current.records, NS)) > 0 {
+				cut, current.delegation = current.name, true
+			}
+		}
+		names = append(names, current)
+		return true
+	})
+	if len(names) == 0 || names[0].name != origin {
+		return fmt.Errorf("zone %s has no records at its apex", z.Origin)
+	}
+
+	var nsec3s []*Nsec3Record
+	var err error
+	if nsec3 == nil {
+		z.chainNsec(names)
+	} else if nsec3s, err = z.chainNsec3(names, nsec3); err != nil {
+		return err
+	}
+
+	// sign the RRsets of the zone and the NSEC3 records
+	signRRsets := func(records []ResourceRecord, delegation bool) ([]ResourceRecord, error) {
+		var signatures []ResourceRecord
+		for _, rrset := range rrsetsOf(records) {
+			if delegation && rrset[0].GetRType() != DS && rrset[0].GetRType() != NSEC {
+				continue
+			}
+			sigs, err := sign(rrset)
+			if err != nil {
+				return nil, err
+			}
+			for _, sig := range sigs {
+				signatures = append(signatures, sig)
+			}
+		}
+		return signatures, nil
+	}
+	for _, current := range names {
+		if current.glue {
+			continue
+		}
+		sigs, err := signRRsets(append(current.records, current.added...), current.delegation)
+		if err != nil {
+			return err
+		}
+		current.added = append(current.added, sigs...)
+	}
+	hashed := make(map[string][]ResourceRecord, len(nsec3s))
+	for _, record := range nsec3s {
+		sigs, err := signRRsets([]ResourceRecord{record}, false)
+		if err != nil {
+			return err
+		}
+		hashed[record.GetName()] = append([]ResourceRecord{record}, sigs...)
+	}
+
+	return z.batch(func(zd zoneData) error {
+		var old []string
+		zd.nsec3s.Walk(z.Origin, func(name string, _ []ResourceRecord) bool {
+			old = append(old, name)
+			return true
+		})
+		for _, name := range old {
+			if _, err := zd.nsec3s.Delete(name); err != nil {
+				return err
+			}
+		}
+		for name, records := range hashed {
+			for _, record := range records {
+				if err := zd.nsec3s.Put(name, record); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, current := range names {
+			added := current.added
+			err := zd.records.Modify(current.name, func(records []ResourceRecord) ([]ResourceRecord, error) {
+				var kept []ResourceRecord
+				for _, record := range records {
+					switch record.GetRType() {
+					case RRSIG, NSEC, NSEC3PARAM:
+					default:
+						kept = append(kept, record)
+					}
+				}
+				if len(kept) == 0 {
+					// the name was deleted meanwhile
+					return nil, nil
+				}
+				return append(kept, added...), nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+chainNsec adds an NSEC record to every name the zone is authoritative
+for, delegations included, pointing to the next one in canonical order,
+the last one pointing back to the apex (RFC 4034, section 4.1.1). Empty
+non-terminals own no records, they get no NSEC record.
+*/
+func (z *Zone) chainNsec(names []*signedName) {
+	var chain []*signedName
+	for _, current := range names {
+		if !current.glue {
+			chain = append(chain, current)
+		}
+	}
+	ttl := z.negativeSoa().GetTtl()
+	for i, current := range chain {
+		next := chain[(i+1)%len(chain)]
+		nsec := &NsecRecord{NextName: next.name, Types: append(typesOf(current.records), RRSIG, NSEC)}
+		nsec.Name, nsec.Type, nsec.Class, nsec.TTL = current.name, NSEC, current.records[0].GetRClass(), ttl
+		nsec.Value = nsec.GetValue()
+		current.added = append(current.added, nsec)
+	}
+}
+
+/*
+chainNsec3 returns the NSEC3 records of the hashes of the names the zone
+is authoritative for and of the empty non-terminals above them, each
+pointing to the next hash in order (RFC 5155, section 7.1), and adds
+the NSEC3PARAM record telling their parameters to the apex. With
+opt-out, the delegations without DS records are left out of the chain.
+*/
+func (z *Zone) chainNsec3(names []*signedName, params *Nsec3Params) ([]*Nsec3Record, error) {
+	origin := canonicalName(z.Origin)
+	ttl := z.negativeSoa().GetTtl()
+	class := names[0].records[0].GetRClass()
+
+	param := &Nsec3paramRecord{HashAlgorithm: Nsec3Sha1, Iterations: params.Iterations, Salt: params.Salt}
+	param.Name, param.Type, param.Class, param.TTL = origin, NSEC3PARAM, class, ttl
+	param.Value = param.GetValue()
+	names[0].added = append(names[0].added, param)
+
+	exists := make(map[string]bool, len(names))
+	for _, current := range names {
+		exists[current.name] = true
+	}
+	included := make(map[string][]RType)
+	for _, current := range names {
+		if current.glue {
+			continue
+		}
+		types := typesOf(current.records)
+		unsigned := current.delegation && !HasType(types, DS)
+		if unsigned && params.OptOut {
+			continue
+		}
+		if !unsigned {
+			types = append(types, RRSIG)
+		}
+		if current.name == origin {
+			types = append(types, NSEC3PARAM)
+		}
+		included[current.name] = types
+		for ancestor := parentOf(current.name); z.contains(ancestor) && !exists[ancestor]; ancestor = parentOf(ancestor) {
+			if _, found := included[ancestor]; !found {
+				included[ancestor] = nil
+			}
+		}
+	}
+
+	type hashedName struct {
+		hash  []byte
+		types []RType
+	}
+	hashes := make([]hashedName, 0, len(included))
+	for name, types := range included {
+		hash, err := Nsec3Hash(name, params.Iterations, params.Salt)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hashedName{hash, types})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i].hash, hashes[j].hash) < 0 })
+
+	flags := 0
+	if params.OptOut {
+		flags = Nsec3OptOut
+	}
+	records := make([]*Nsec3Record, 0, len(hashes))
+	for i, current := range hashes {
+		next := hashes[(i+1)%len(hashes)]
+		if i > 0 && bytes.Equal(current.hash, hashes[i-1].hash) {
+			return nil, fmt.Errorf("zone %s: two names have the same NSEC3 hash, change the salt", z.Origin)
+		}
+		record := &Nsec3Record{HashAlgorithm: Nsec3Sha1, Flags: flags, Iterations: params.Iterations, Salt: params.Salt,
+			NextHashed: next.hash, Types: current.types}
+		record.Name, record.Type, record.Class, record.TTL = Nsec3Owner(current.hash, origin), NSEC3, class, ttl
+		record.Value = record.GetValue()
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// returns the types of the records, once each
+func typesOf(records []ResourceRecord) []RType {
+	var types []RType
+	for _, record := range records {
+		if !HasType(types, record.GetRType()) {
+			types = append(types, record.GetRType())
+		}
+	}
+	return types
+}
+
+// returns the records of the type
+func recordsOfType(records []ResourceRecord, rType RType) []ResourceRecord {
+	var matching []ResourceRecord
+	for _, record := range records {
+		if record.GetRType() == rType {
+			matching = append(matching, record)
+		}
+	}
+	return matching
+}
+
+// groups the records of a name by type and class, in the order the types first appear
+func rrsetsOf(records []ResourceRecord) [][]ResourceRecord {
+	type rrsetKey struct {
+		rType RType
+		class RClass
+	}
+	positions := make(map[rrsetKey]int)
+	var rrsets [][]ResourceRecord
+	for _, record := range records {
+		key := rrsetKey{record.GetRType(), record.GetRClass()}
+		position, found := positions[key]
+		if !found {
+			position = len(rrsets)
+			positions[key] = position
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[position] = append(rrsets[position], record)
+	}
+	return rrsets
+}
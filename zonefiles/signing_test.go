@@ -0,0 +1,164 @@
+package zonefiles
+
+import (
+	"fmt"
+	"testing"
+)
+
+var signingZone = []string{
+	"$TTL=300",
+	"@ IN SOA ns1.example.test. admin.example.test. 1 7200 3600 1209600 60",
+	"@ IN NS ns1.example.test.",
+	"ns1 IN A 192.0.2.1",
+	"www IN A 192.0.2.2",
+	"secure IN NS ns.secure.example.test.",
+	"secure IN DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	"ns.secure IN A 192.0.2.3",
+	"insecure IN NS ns.insecure.example.test.",
+	"ns.insecure IN A 192.0.2.4",
+}
+
+// signs an RRset with a signature telling its type, without cryptography
+func fakeSign(rrset []ResourceRecord) ([]*RrsigRecord, error) {
+	sig := &RrsigRecord{TypeCovered: rrset[0].GetRType(), OriginalTtl: rrset[0].GetTtl(), SignerName: "example.test."}
+	sig.Name, sig.Type, sig.Class, sig.TTL = rrset[0].GetName(), RRSIG, rrset[0].GetRClass(), rrset[0].GetTtl()
+	sig.Value = sig.GetValue()
+	return []*RrsigRecord{sig}, nil
+}
+
+// returns the types the RRSIG records of the name cover
+func signedTypes(t *testing.T, zone *Zone, name string) []RType {
+	t.Helper()
+	var types []RType
+	for _, record := range recordsAt(t, zone, name, RRSIG) {
+		types = append(types, record.(*RrsigRecord).TypeCovered)
+	}
+	return types
+}
+
+// counts the records of the type in the zone, NSEC3 records included
+func countRecords(zone *Zone, rType RType) int {
+	count := 0
+	each := func(_ string, records []ResourceRecord) bool {
+		count += len(recordsOfType(records, rType))
+		return true
+	}
+	zone.trie.Walk(zone.Origin, each)
+	zone.nsec3s.Walk(zone.Origin, each)
+	return count
+}
+
+func TestSignDelegations(t *testing.T) {
+	for _, nsec3 := range []*Nsec3Params{nil, {Salt: []byte{0xAB}}} {
+		zone := parseTestZone(t, "example.test.", signingZone...)
+		if err := zone.Sign(nsec3, fakeSign); err != nil {
+			t.Fatal(err)
+		}
+		denial := NSEC
+		if nsec3 != nil {
+			denial = NSEC3
+		}
+
+		tests := []struct {
+			name   string
+			signed []RType
+		}{
+			{"example.test.", []RType{SOA, NS}},
+			{"www.example.test.", []RType{A}},
+			// the NS records of a delegation belong to the child, its DS records to the parent
+			{"secure.example.test.", []RType{DS}},
+			{"insecure.example.test.", nil},
+			// glue
+			{"ns.secure.example.test.", nil},
+			{"ns.insecure.example.test.", nil},
+		}
+		for _, test := range tests {
+			got := signedTypes(t, zone, test.name)
+			for _, rType := range test.signed {
+				if !HasType(got, rType) {
+					t.Errorf("%v: %s has signatures of %v, want one of %v", denial, test.name, got, rType)
+				}
+			}
+			for _, rType := range []RType{NS, A} {
+				if HasType(got, rType) && !HasType(test.signed, rType) {
+					t.Errorf("%v: %s has a signature of its %v records", denial, test.name, rType)
+				}
+			}
+		}
+		if nsec3 == nil {
+			for _, name := range []string{"ns.secure.example.test.", "ns.insecure.example.test."} {
+				if nsecs := recordsAt(t, zone, name, NSEC); len(nsecs) != 0 {
+					t.Errorf("glue at %s has NSEC records %v", name, nsecs)
+				}
+			}
+		}
+	}
+}
+
+func TestSignNsec3param(t *testing.T) {
+	zone := parseTestZone(t, "example.test.", signingZone...)
+	if err := zone.Sign(&Nsec3Params{Iterations: 1, Salt: []byte{0xAB, 0xCD}}, fakeSign); err != nil {
+		t.Fatal(err)
+	}
+	params := recordsAt(t, zone, "example.test.", NSEC3PARAM)
+	if len(params) != 1 || countRecords(zone, NSEC3PARAM) != 1 {
+		t.Fatalf("got %v at the apex and %d NSEC3PARAM records in the zone, want a single one at the apex",
+			params, countRecords(zone, NSEC3PARAM))
+	}
+	if param := params[0].(*Nsec3paramRecord); param.Iterations != 1 || fmt.Sprintf("%x", param.Salt) != "abcd" {
+		t.Errorf("got NSEC3PARAM %s, want 1 iteration and salt abcd", param.GetValue())
+	}
+	if !HasType(signedTypes(t, zone, "example.test."), NSEC3PARAM) {
+		t.Error("the NSEC3PARAM record is not signed")
+	}
+
+	// signing again with an NSEC chain drops the NSEC3 chain
+	if err := zone.Sign(nil, fakeSign); err != nil {
+		t.Fatal(err)
+	}
+	if n, nsec3s := countRecords(zone, NSEC3PARAM), zone.nsec3s.Len(); n != 0 || nsec3s != 0 {
+		t.Errorf("got %d NSEC3PARAM records and %d NSEC3 names after signing with NSEC", n, nsec3s)
+	}
+}
+
+func TestSignAgain(t *testing.T) {
+	for _, nsec3 := range []*Nsec3Params{nil, {Salt: []byte{0xAB}}} {
+		zone := parseTestZone(t, "example.test.", signingZone...)
+		if err := zone.Sign(nsec3, fakeSign); err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[RType]int)
+		for _, rType := range []RType{RRSIG, NSEC, NSEC3, NSEC3PARAM} {
+			counts[rType] = countRecords(zone, rType)
+		}
+		if counts[RRSIG] == 0 {
+			t.Fatal("the zone has no signatures")
+		}
+
+		// the new signatures and chain replace the old ones
+		if err := zone.Sign(nsec3, fakeSign); err != nil {
+			t.Fatal(err)
+		}
+		for rType, want := range counts {
+			if got := countRecords(zone, rType); got != want {
+				t.Errorf("got %d %v records after signing again, want %d", got, rType, want)
+			}
+		}
+
+		// a failed signing leaves the zone as it was
+		err := zone.Sign(nsec3, func(rrset []ResourceRecord) ([]*RrsigRecord, error) {
+			if rrset[0].GetRType() == A {
+				return nil, fmt.Errorf("no key")
+			}
+			return fakeSign(rrset)
+		})
+		if err == nil {
+			t.Fatal("signing succeeded without a key")
+		}
+		for rType, want := range counts {
+			if got := countRecords(zone, rType); got != want {
+				t.Errorf("got %d %v records after a failed signing, want %d", got, rType, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package zonefiles
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+A snapshot holds the data of a zone in a compact binary form that loads
+much faster than the zone files it was made from. It is laid out as
+
+	magic     "qDNSsnap"
+	version   uint16
+	zone      origin, TTL and SOA
+	sources   the path, size and modification time of every zone file
+	records   count, then every record in canonical order
+	checksum  CRC-32 (IEEE) of everything before it
+
+Integers are big endian and strings are prefixed by their uint16
+length. A snapshot is only used if its checksum is right, its version
+is snapshotVersion and its zone files haven't changed since it was
+written; the zone files are parsed otherwise.
+*/
+const (
+	snapshotMagic   = "qDNSsnap"
+	snapshotVersion = 1
+)
+
+// identifies the content of a zone file without reading it
+type snapshotSource struct {
+	Path    string
+	Size    int64
+	ModTime int64 // in nanoseconds since the epoch
+}
+
+func statSources(files []string) ([]snapshotSource, error) {
+	sources := make([]snapshotSource, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, snapshotSource{Path: file, Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+	}
+	return sources, nil
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (sw *snapshotWriter) uint16(v uint16) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.BigEndian, v)
+	}
+}
+
+func (sw *snapshotWriter) uint32(v uint32) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.BigEndian, v)
+	}
+}
+
+func (sw *snapshotWriter) uint64(v uint64) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.BigEndian, v)
+	}
+}
+
+func (sw *snapshotWriter) bytes(b []byte) {
+	if len(b) > 0xFFFF {
+		sw.err = fmt.Errorf("snapshot: %d octets are too long for a field", len(b))
+	}
+	sw.uint16(uint16(len(b)))
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) string(s string) {
+	sw.bytes([]byte(s))
+}
+
+func (sw *snapshotWriter) soa(soa Soa) {
+	sw.uint16(uint16(soa.Class))
+	sw.string(soa.MName)
+	sw.string(soa.RName)
+	for _, v := range []int{soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum} {
+		sw.uint32(uint32(v))
+	}
+}
+
+func (sw *snapshotWriter) types(types []RType) {
+	sw.uint16(uint16(len(types)))
+	for _, t := range types {
+		sw.uint16(uint16(t))
+	}
+}
+
+func (sw *snapshotWriter) record(rr ResourceRecord) {
+	sw.string(rr.GetName())
+	sw.uint16(uint16(rr.GetRType()))
+	sw.uint16(uint16(rr.GetRClass()))
+	sw.uint32(uint32(rr.GetTtl()))
+	sw.string(rr.GetValue())
+
+	switch record := rr.(type) {
+	case *ARecord, *AaaaRecord, *NSRecord, *CnameRecord:
+	case *MxRecord:
+		sw.uint16(uint16(record.Preference))
+	case *TxtRecord:
+		sw.uint16(uint16(len(record.Strings)))
+		for _, str := range record.Strings {
+			sw.string(str)
+		}
+	case *SoaRecord:
+		sw.soa(record.Soa)
+	case *SrvRecord:
+		sw.uint16(uint16(record.Priority))
+		sw.uint16(uint16(record.Weight))
+		sw.uint16(uint16(record.Port))
+	case *SvcbRecord:
+		sw.uint16(uint16(record.Priority))
+		sw.uint16(uint16(len(record.Params)))
+		for _, param := range record.Params {
+			sw.uint16(param.Key)
+			sw.bytes(param.Value)
+		}
+	case *DsRecord:
+		sw.uint16(uint16(record.KeyTag))
+		sw.uint16(uint16(record.Algorithm))
+		sw.uint16(uint16(record.DigestType))
+		sw.bytes(record.Digest)
+	case *DnskeyRecord:
+		sw.uint16(uint16(record.Flags))
+		sw.uint16(uint16(record.Protocol))
+		sw.uint16(uint16(record.Algorithm))
+		sw.bytes(record.PublicKey)
+	case *RrsigRecord:
+		sw.uint16(uint16(record.TypeCovered))
+		sw.uint16(uint16(record.Algorithm))
+		sw.uint16(uint16(record.Labels))
+		sw.uint32(uint32(record.OriginalTtl))
+		sw.uint32(record.Expiration)
+		sw.uint32(record.Inception)
+		sw.uint16(uint16(record.KeyTag))
+		sw.string(record.SignerName)
+		sw.bytes(record.Signature)
+	case *NsecRecord:
+		sw.string(record.NextName)
+		sw.types(record.Types)
+	case *Nsec3Record:
+		sw.uint16(uint16(record.HashAlgorithm))
+		sw.uint16(uint16(record.Flags))
+		sw.uint16(uint16(record.Iterations))
+		sw.bytes(record.Salt)
+		sw.bytes(record.NextHashed)
+		sw.types(record.Types)
+	case *Nsec3paramRecord:
+		sw.uint16(uint16(record.HashAlgorithm))
+		sw.uint16(uint16(record.Flags))
+		sw.uint16(uint16(record.Iterations))
+		sw.bytes(record.Salt)
+	default:
+		sw.err = fmt.Errorf("snapshot: can't store records of type %d", rr.GetRType())
+	}
+}
+
+/*
+writeSnapshot saves the data of the zone to a snapshot at path. The
+sources must be taken before the zone files are parsed, so that a file
+changing in the meantime makes the snapshot stale. The snapshot is
+written to a temporary file first and renamed, so a crash never leaves
+a partial snapshot.
+*/
+func (z *Zone) writeSnapshot(path string, sources []snapshotSource) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	checksum := crc32.NewIEEE()
+	sw := &snapshotWriter{w: bufio.NewWriter(io.MultiWriter(tmp, checksum))}
+	_, sw.err = sw.w.WriteString(snapshotMagic)
+	sw.uint16(snapshotVersion)
+	sw.string(z.Origin)
+	sw.uint32(uint32(z.TTL))
+	sw.soa(z.SOA)
+	sw.uint16(uint16(len(sources)))
+	for _, source := range sources {
+		sw.string(source.Path)
+		sw.uint64(uint64(source.Size))
+		sw.uint64(uint64(source.ModTime))
+	}
+
+	var records []ResourceRecord
+	z.Walk(func(name string, rrs []ResourceRecord) bool {
+		records = append(records, rrs...)
+		return true
+	})
+	// the NSEC3 records are put back apart by putIn when loading
+	z.nsec3s.Walk(z.Origin, func(name string, rrs []ResourceRecord) bool {
+		records = append(records, rrs...)
+		return true
+	})
+	sw.uint32(uint32(len(records)))
+	for _, rr := range records {
+		sw.record(rr)
+	}
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+
+	// the checksum covers everything before it
+	if err = binary.Write(tmp, binary.BigEndian, checksum.Sum32()); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type snapshotReader struct {
+	buf []byte
+	err error
+}
+
+func (sr *snapshotReader) next(n int) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	if len(sr.buf) < n {
+		sr.err = fmt.Errorf("snapshot: unexpected end of data")
+		return nil
+	}
+	b := sr.buf[:n]
+	sr.buf = sr.buf[n:]
+	return b
+}
+
+func (sr *snapshotReader) uint16() uint16 {
+	if b := sr.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (sr *snapshotReader) uint32() uint32 {
+	if b := sr.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (sr *snapshotReader) uint64() uint64 {
+	if b := sr.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (sr *snapshotReader) bytes() []byte {
+	n := sr.uint16()
+	return append([]byte(nil), sr.next(int(n))...)
+}
+
+func (sr *snapshotReader) string() string {
+	return string(sr.next(int(sr.uint16())))
+}
+
+func (sr *snapshotReader) soa() Soa {
+	soa := Soa{Class: RClass(sr.uint16()), MName: sr.string(), RName: sr.string()}
+	soa.Serial = int(sr.uint32())
+	soa.Refresh = int(sr.uint32())
+	soa.Retry = int(sr.uint32())
+	soa.Expire = int(sr.uint32())
+	soa.Minimum = int(sr.uint32())
+	return soa
+}
+
+func (sr *snapshotReader) types() []RType {
+	var types []RType
+	for i := sr.uint16(); i > 0 && sr.err == nil; i-- {
+		types = append(types, RType(sr.uint16()))
+	}
+	return types
+}
+
+func (sr *snapshotReader) record() ResourceRecord {
+	rr := resourceRecord{Name: sr.string()}
+	rr.Type = RType(sr.uint16())
+	rr.Class = RClass(sr.uint16())
+	rr.TTL = uint(sr.uint32())
+	rr.Value = sr.string()
+
+	switch rr.Type {
+	case A:
+		return &ARecord{resourceRecord: rr}
+	case Aaaa:
+		return &AaaaRecord{resourceRecord: rr}
+	case NS:
+		return &NSRecord{resourceRecord: rr}
+	case Cname:
+		return &CnameRecord{resourceRecord: rr}
+	case MX:
+		return &MxRecord{resourceRecord: rr, Preference: int(sr.uint16())}
+	case TXT:
+		record := &TxtRecord{resourceRecord: rr}
+		for i := sr.uint16(); i > 0; i-- {
+			record.Strings = append(record.Strings, sr.string())
+		}
+		return record
+	case SOA:
+		return &SoaRecord{resourceRecord: rr, Soa: sr.soa()}
+	case SRV:
+		record := &SrvRecord{resourceRecord: rr}
+		record.Priority = int(sr.uint16())
+		record.Weight = int(sr.uint16())
+		record.Port = int(sr.uint16())
+		return record
+	case SVCB:
+		record := &SvcbRecord{resourceRecord: rr, Priority: int(sr.uint16())}
+		for i := sr.uint16(); i > 0; i-- {
+			record.Params = append(record.Params, SvcParam{Key: sr.uint16(), Value: sr.bytes()})
+		}
+		return record
+	case DS:
+		record := &DsRecord{resourceRecord: rr}
+		record.KeyTag = int(sr.uint16())
+		record.Algorithm = int(sr.uint16())
+		record.DigestType = int(sr.uint16())
+		record.Digest = sr.bytes()
+		return record
+	case DNSKEY:
+		record := &DnskeyRecord{resourceRecord: rr}
+		record.Flags = int(sr.uint16())
+		record.Protocol = int(sr.uint16())
+		record.Algorithm = int(sr.uint16())
+		record.PublicKey = sr.bytes()
+		return record
+	case RRSIG:
+		record := &RrsigRecord{resourceRecord: rr}
+		record.TypeCovered = RType(sr.uint16())
+		record.Algorithm = int(sr.uint16())
+		record.Labels = int(sr.uint16())
+		record.OriginalTtl = uint(sr.uint32())
+		record.Expiration = sr.uint32()
+		record.Inception = sr.uint32()
+		record.KeyTag = int(sr.uint16())
+		record.SignerName = sr.string()
+		record.Signature = sr.bytes()
+		return record
+	case NSEC:
+		return &NsecRecord{resourceRecord: rr, NextName: sr.string(), Types: sr.types()}
+	case NSEC3:
+		record := &Nsec3Record{resourceRecord: rr}
+		record.HashAlgorithm = int(sr.uint16())
+		record.Flags = int(sr.uint16())
+		record.Iterations = int(sr.uint16())
+		record.Salt = sr.bytes()
+		record.NextHashed = sr.bytes()
+		record.Types = sr.types()
+		return record
+	case NSEC3PARAM:
+		record := &Nsec3paramRecord{resourceRecord: rr}
+		record.HashAlgorithm = int(sr.uint16())
+		record.Flags = int(sr.uint16())
+		record.Iterations = int(sr.uint16())
+		record.Salt = sr.bytes()
+		return record
+	}
+	if sr.err == nil {
+		sr.err = fmt.Errorf("snapshot: unknown record type %d", rr.Type)
+	}
+	return nil
+}
+
+/*
+loadSnapshot loads the zone from the snapshot at path if it is valid
+and was made from the current content of the given zone files. The
+zone is left untouched if an error is returned.
+*/
+func (z *Zone) loadSnapshot(path string, files []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("snapshot: %s is not a snapshot", path)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("snapshot: bad checksum in %s", path)
+	}
+
+	sr := &snapshotReader{buf: body[len(snapshotMagic):]}
+	if version := sr.uint16(); version != snapshotVersion {
+		return fmt.Errorf("snapshot: unsupported version %d", version)
+	}
+	if origin := sr.string(); canonicalName(origin) != canonicalName(z.Origin) {
+		return fmt.Errorf("snapshot: %s holds zone %s instead of %s", path, origin, z.Origin)
+	}
+	ttl := int(sr.uint32())
+	soa := sr.soa()
+
+	sources, err := statSources(files)
+	if err != nil {
+		return err
+	}
+	if n := int(sr.uint16()); n != len(sources) {
+		return fmt.Errorf("snapshot: %s is stale, it was made from %d files", path, n)
+	}
+	for _, source := range sources {
+		if sr.string() != source.Path || int64(sr.uint64()) != source.Size || int64(sr.uint64()) != source.ModTime {
+			return fmt.Errorf("snapshot: %s is stale, %s has changed", path, source.Path)
+		}
+	}
+
+	count := sr.uint32()
+	records := make([]ResourceRecord, 0, count)
+	for i := uint32(0); i < count && sr.err == nil; i++ {
+		records = append(records, sr.record())
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+	if len(sr.buf) != 0 {
+		return fmt.Errorf("snapshot: trailing data in %s", path)
+	}
+
+	err = z.batch(func(zd zoneData) error {
+		for _, rr := range records {
+			if err := z.putIn(zd, rr.GetName(), rr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	z.setTtl(ttl)
+	z.setSoa(soa)
+	return nil
+}
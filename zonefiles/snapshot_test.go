@@ -0,0 +1,174 @@
+package zonefiles
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var snapshotZone = []string{
+	"$TTL=300",
+	"@ IN SOA ns1.example.com. admin.example.com. 7 7200 3600 1209600 60",
+	"@ IN NS ns1.example.com.",
+	"@ IN MX 10 mail.example.com.",
+	"@ IN NSEC3PARAM 1 0 0 -",
+	"ns1 IN A 192.0.2.1",
+	"mail IN AAAA 2001:db8::25",
+	`txt IN TXT "one" "two"`,
+	"_sip._tcp IN SRV 10 5 5060 ns1.example.com.",
+	"www IN CNAME ns1.example.com.",
+	"0p9mhaveqvm6t7vbl5lop2u3t2rp3tom IN NSEC3 1 0 0 - 2t7b4g4vsa5smi47k61mv5bv1a22bojr NS SOA MX RRSIG NSEC3PARAM",
+	"2t7b4g4vsa5smi47k61mv5bv1a22bojr IN NSEC3 1 0 0 - 0p9mhaveqvm6t7vbl5lop2u3t2rp3tom A RRSIG",
+}
+
+// writes the zone file and returns its path and the path of its snapshot
+func writeSnapshotZone(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "zone")
+	if err := os.WriteFile(path, []byte(strings.Join(snapshotZone, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, filepath.Join(dir, "zone.snap")
+}
+
+// returns the zone in the master file format, NSEC3 records included
+func zoneText(t *testing.T, zone *Zone) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := zone.WriteZonefile(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// rewrites the snapshot with fn and fixes its checksum unless broken is set
+func editSnapshot(t *testing.T, path string, broken bool, fn func(data []byte)) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(data)
+	if !broken {
+		body := data[:len(data)-4]
+		binary.BigEndian.PutUint32(data[len(data)-4:], crc32.ChecksumIEEE(body))
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	file, snapshot := writeSnapshotZone(t)
+	parsed := newZone("example.com.")
+	parsed.load([]string{file}, snapshot)
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Fatalf("no snapshot written: %v", err)
+	}
+
+	loaded := newZone("example.com.")
+	if err := loaded.loadSnapshot(snapshot, []string{file}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := zoneText(t, parsed), zoneText(t, loaded); got != want {
+		t.Errorf("got zone\n%s\nfrom the snapshot, want\n%s", got, want)
+	}
+	if loaded.TTL != parsed.TTL || loaded.SOA != parsed.SOA {
+		t.Errorf("got TTL %d and SOA %+v, want %d and %+v", loaded.TTL, loaded.SOA, parsed.TTL, parsed.SOA)
+	}
+	if loaded.nsec3s.Len() != 2 || loaded.trie.Len() != parsed.trie.Len() {
+		t.Errorf("got %d names and %d NSEC3 names, want %d and 2", loaded.trie.Len(), loaded.nsec3s.Len(), parsed.trie.Len())
+	}
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, file, snapshot string)
+	}{
+		{"bad checksum", func(t *testing.T, file, snapshot string) {
+			editSnapshot(t, snapshot, true, func(data []byte) { data[len(data)/2] ^= 0xFF })
+		}},
+		{"unsupported version", func(t *testing.T, file, snapshot string) {
+			editSnapshot(t, snapshot, false, func(data []byte) {
+				binary.BigEndian.PutUint16(data[len(snapshotMagic):], snapshotVersion+1)
+			})
+		}},
+		{"not a snapshot", func(t *testing.T, file, snapshot string) {
+			editSnapshot(t, snapshot, false, func(data []byte) { copy(data, "notsnap!") })
+		}},
+		{"zone file size changed", func(t *testing.T, file, snapshot string) {
+			f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err = f.WriteString("extra IN A 192.0.2.9\n"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"zone file modification time changed", func(t *testing.T, file, snapshot string) {
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(file, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		file, snapshot := writeSnapshotZone(t)
+		newZone("example.com.").load([]string{file}, snapshot)
+		test.change(t, file, snapshot)
+
+		zone := newZone("example.com.")
+		if err := zone.loadSnapshot(snapshot, []string{file}); err == nil {
+			t.Errorf("%s: the snapshot loaded", test.name)
+			continue
+		}
+		if !zone.IsEmpty() || !zone.nsec3s.IsEmpty() {
+			t.Errorf("%s: a snapshot that failed to load changed the zone", test.name)
+		}
+
+		// load parses the zone files instead and writes a new snapshot
+		zone.load([]string{file}, snapshot)
+		if records := recordsAt(t, zone, "ns1.example.com.", A); len(records) != 1 || zone.nsec3s.Len() != 2 {
+			t.Errorf("%s: got %v and %d NSEC3 names after parsing the files", test.name, records, zone.nsec3s.Len())
+		}
+		if err := newZone("example.com.").loadSnapshot(snapshot, []string{file}); err != nil {
+			t.Errorf("%s: the new snapshot doesn't load: %v", test.name, err)
+		}
+	}
+}
+
+func TestSnapshotFailedLoad(t *testing.T) {
+	file, snapshot := writeSnapshotZone(t)
+	zone := newZone("example.com.")
+	zone.load([]string{file}, "")
+
+	// a record that can't be put back, after the NSEC3 records in the snapshot
+	outside := &ARecord{resourceRecord: resourceRecord{Name: "www.example.org.", Type: A, Class: IN, TTL: 300, Value: "192.0.2.8"}}
+	if err := zone.nsec3s.Put("zzz.example.com.", outside); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := statSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = zone.writeSnapshot(snapshot, sources); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newZone("example.com.")
+	if err = loaded.loadSnapshot(snapshot, []string{file}); err == nil {
+		t.Fatal("a snapshot holding a record out of the zone loaded")
+	}
+	if !loaded.IsEmpty() || !loaded.nsec3s.IsEmpty() {
+		t.Errorf("got %d names and %d NSEC3 names from a snapshot that failed to load, want none",
+			loaded.trie.Len(), loaded.nsec3s.Len())
+	}
+}
@@ -0,0 +1,151 @@
+package zonefiles
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+WriteZonefile writes the records of the zone as a master file that
+ParseZonefile reads back: the names in canonical order, then the NSEC3
+records in the order of their hashes, every record fully qualified, the
+RRsets of a name by type with their signatures right after them, and a
+$TTL directive before every record whose TTL differs from the previous
+one. The same zone is always written the same way.
+*/
+func (z *Zone) WriteZonefile(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	ttl := -1
+	var err error
+	write := func(name string, records []ResourceRecord) bool {
+		for _, rrset := range sortedRRsets(records) {
+			for _, record := range rrset {
+				var line string
+				if line, err = masterFileLine(record); err != nil {
+					return false
+				}
+				if int(record.GetTtl()) != ttl {
+					ttl = int(record.GetTtl())
+					fmt.Fprintf(bw, "$TTL=%d\n", ttl)
+				}
+				bw.WriteString(line)
+			}
+		}
+		return true
+	}
+	z.Walk(write)
+	if err == nil && z.nsec3s != nil {
+		z.nsec3s.Walk(z.Origin, write)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+/*
+sortedRRsets groups the records of a name by type, in increasing type
+order, each RRset followed by the signatures covering it.
+*/
+func sortedRRsets(records []ResourceRecord) [][]ResourceRecord {
+	var rrsets [][]ResourceRecord
+	for _, rrset := range rrsetsOf(records) {
+		if rrset[0].GetRType() != RRSIG {
+			rrset = append(rrset, signaturesOf(records, rrset[0].GetRType(), rrset[0].GetRClass())...)
+			rrsets = append(rrsets, rrset)
+		}
+	}
+	sort.SliceStable(rrsets, func(i, j int) bool { return rrsets[i][0].GetRType() < rrsets[j][0].GetRType() })
+	return rrsets
+}
+
+// returns the record as a line of a master file
+func masterFileLine(rr ResourceRecord) (string, error) {
+	var class string
+	switch rr.GetRClass() {
+	case IN:
+		class = "IN"
+	case CS:
+		class = "CS"
+	case HS:
+		class = "HS"
+	default:
+		return "", fmt.Errorf("can't write %s records of class %d", rr.GetName(), rr.GetRClass())
+	}
+
+	var data string
+	switch record := rr.(type) {
+	case *ARecord, *AaaaRecord, *NSRecord, *CnameRecord, *TxtRecord, *SoaRecord,
+		*DsRecord, *DnskeyRecord, *RrsigRecord, *NsecRecord, *Nsec3Record, *Nsec3paramRecord:
+		data = record.GetValue()
+	case *MxRecord:
+		data = fmt.Sprintf("%d %s", record.Preference, record.GetValue())
+	case *SrvRecord:
+		data = fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, record.GetValue())
+	case *SvcbRecord:
+		fields := []string{strconv.Itoa(record.Priority), record.GetValue()}
+		for _, param := range record.Params {
+			fields = append(fields, formatSvcParam(param))
+		}
+		data = strings.Join(fields, " ")
+	default:
+		return "", fmt.Errorf("can't write %s records of type %v", rr.GetName(), rr.GetRType())
+	}
+	return fmt.Sprintf("%s %s %v %s\n", rr.GetName(), class, rr.GetRType(), data), nil
+}
+
+// returns the name of a SvcParamKey, the reverse of parseSvcParamKey
+func svcParamKeyName(key uint16) string {
+	for name, k := range svcParamKeyNames {
+		if k == key {
+			return name
+		}
+	}
+	return fmt.Sprintf("key%d", key)
+}
+
+// formats a parameter of a SVCB record the way parseSvcParam reads it
+func formatSvcParam(param SvcParam) string {
+	name := svcParamKeyName(param.Key)
+	var values []string
+	switch param.Key {
+	case SvcParamMandatory:
+		for i := 0; i+1 < len(param.Value); i += 2 {
+			values = append(values, svcParamKeyName(binary.BigEndian.Uint16(param.Value[i:])))
+		}
+	case SvcParamAlpn:
+		for i := 0; i < len(param.Value); i += 1 + int(param.Value[i]) {
+			end := i + 1 + int(param.Value[i])
+			if end > len(param.Value) {
+				break
+			}
+			values = append(values, string(param.Value[i+1:end]))
+		}
+	case SvcParamNoDefaultAlpn:
+		return name
+	case SvcParamPort:
+		if len(param.Value) == 2 {
+			values = append(values, strconv.Itoa(int(binary.BigEndian.Uint16(param.Value))))
+		}
+	case SvcParamIpv4Hint, SvcParamIpv6Hint:
+		size := net.IPv4len
+		if param.Key == SvcParamIpv6Hint {
+			size = net.IPv6len
+		}
+		for i := 0; i+size <= len(param.Value); i += size {
+			values = append(values, net.IP(param.Value[i:i+size]).String())
+		}
+	case SvcParamEch:
+		values = append(values, base64.StdEncoding.EncodeToString(param.Value))
+	default:
+		values = append(values, string(param.Value))
+	}
+	return name + "=" + FormatCharacterStrings([]string{strings.Join(values, ",")})
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/abhra303/qDNS/config"
 	"github.com/abhra303/qDNS/ds/trie"
@@ -18,27 +19,85 @@ import (
 type RType uint16
 type RClass uint16
 
+// type and class values are the ones assigned by IANA so that they
+// can be compared with the QTYPE/QCLASS of a query and written on the
+// wire as they are.
 const (
-	UnknownType RType = iota
-	SOA
-	NS
-	A
-	Aaaa
-	MX
-	TXT
-	Cname
+	UnknownType RType = 0
+	A           RType = 1
+	NS          RType = 2
+	Cname       RType = 5
+	SOA         RType = 6
+	MX          RType = 15
+	TXT         RType = 16
+	Aaaa        RType = 28
+	SRV         RType = 33
+	DS          RType = 43
+	RRSIG       RType = 46
+	NSEC        RType = 47
+	DNSKEY      RType = 48
+	NSEC3       RType = 50
+	NSEC3PARAM  RType = 51
+	SVCB        RType = 64
 )
 
+var typeNames = map[RType]string{
+	A:          "A",
+	NS:         "NS",
+	Cname:      "CNAME",
+	SOA:        "SOA",
+	MX:         "MX",
+	TXT:        "TXT",
+	Aaaa:       "AAAA",
+	SRV:        "SRV",
+	DS:         "DS",
+	RRSIG:      "RRSIG",
+	NSEC:       "NSEC",
+	DNSKEY:     "DNSKEY",
+	NSEC3:      "NSEC3",
+	NSEC3PARAM: "NSEC3PARAM",
+	SVCB:       "SVCB",
+}
+
+// String returns the mnemonic of the type, or TYPEnnn if it has none (RFC 3597, section 5)
+func (t RType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// ParseRType converts a type mnemonic or its TYPEnnn form back to the type
+func ParseRType(name string) (RType, bool) {
+	name = strings.ToUpper(name)
+	for t, typeName := range typeNames {
+		if typeName == name {
+			return t, true
+		}
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		t, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16)
+		if err == nil {
+			return RType(t), true
+		}
+	}
+	return UnknownType, false
+}
+
 const (
-	UnknownClass RClass = iota
-	IN
-	CS
-	HS
+	UnknownClass RClass = 0
+	IN           RClass = 1
+	CS           RClass = 2
+	HS           RClass = 4
 )
 
-var Catalog trie.Trie
+// the longest <character-string> that fits in its one octet length
+const MaxCharacterStringLength = 255
+
+var Catalog trie.NameTrie[*Zone] = trie.NewNameTrie[*Zone](&trie.TrieContext{KeyLimit: 255})
 
 type ResourceRecord interface {
+	GetName() string
 	GetRType() RType
 	GetRClass() RClass
 	GetValue() string
@@ -47,6 +106,12 @@ type ResourceRecord interface {
 
 type resourceRecord struct {
 
+	/*
+	   The fully qualified domain name of the node to which
+	   this resource record pertains.
+	*/
+	Name string
+
 	/*
 	   Two octets containing one of the RR type codes.  This
 	   field specifies the meaning of the data in the RDATA
@@ -76,6 +141,10 @@ type resourceRecord struct {
 	Value string
 }
 
+func (r *resourceRecord) GetName() string {
+	return r.Name
+}
+
 /*
 Though these records have similar data, we
 
@@ -145,6 +214,14 @@ func (n *NSRecord) GetTtl() uint {
 
 type TxtRecord struct {
 	resourceRecord
+
+	/*
+	   The unescaped <character-string>s of the record in the
+	   order they appeared in the zone file. A string may be
+	   longer than 255 octets; it gets split into several
+	   <character-string>s when written on the wire.
+	*/
+	Strings []string
 }
 
 func (t *TxtRecord) GetRClass() RClass {
@@ -163,6 +240,26 @@ func (t *TxtRecord) GetTtl() uint {
 	return t.TTL
 }
 
+// returns the strings of the record as they should be put on the
+// wire, each of them at most MaxCharacterStringLength octets long
+func (t *TxtRecord) GetCharacterStrings() []string {
+	var chunks []string
+	for _, str := range t.Strings {
+		if len(str) == 0 {
+			chunks = append(chunks, str)
+			continue
+		}
+		for len(str) > MaxCharacterStringLength {
+			chunks = append(chunks, str[:MaxCharacterStringLength])
+			str = str[MaxCharacterStringLength:]
+		}
+		if len(str) > 0 {
+			chunks = append(chunks, str)
+		}
+	}
+	return chunks
+}
+
 type CnameRecord struct {
 	resourceRecord
 }
@@ -219,34 +316,437 @@ type Soa struct {
 	Minimum int
 }
 
+/*
+SoaRecord is the SOA resource record of a zone. It is kept in the zone
+trie at the apex so that SOA queries are answered like any other query
+and is also used in the authority section of negative answers.
+*/
+type SoaRecord struct {
+	resourceRecord
+	Soa
+}
+
+// NewSoaRecord returns the SOA record of the zone whose apex is name
+func NewSoaRecord(name string, class RClass, ttl uint, soa Soa) *SoaRecord {
+	soa.Class = class
+	record := &SoaRecord{
+		resourceRecord: resourceRecord{Name: name, Type: SOA, Class: class, TTL: ttl},
+		Soa:            soa,
+	}
+	record.Value = record.GetValue()
+	return record
+}
+
+func (s *SoaRecord) GetRClass() RClass {
+	return s.resourceRecord.Class
+}
+
+func (s *SoaRecord) GetRType() RType {
+	return SOA
+}
+
+func (s *SoaRecord) GetValue() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", s.MName, s.RName, s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+}
+
+func (s *SoaRecord) GetTtl() uint {
+	return s.TTL
+}
+
+/*
+UnknownRecord holds a record of a type we have no structure for, such
+as the ones received from other servers, with its RDATA left as it is
+on the wire (RFC 3597). Its RDATA must not contain compressed names.
+*/
+type UnknownRecord struct {
+	resourceRecord
+	Data []byte
+}
+
+func (u *UnknownRecord) GetRClass() RClass {
+	return u.Class
+}
+
+func (u *UnknownRecord) GetRType() RType {
+	return u.Type
+}
+
+// returns the RDATA in the generic format of RFC 3597, section 5
+func (u *UnknownRecord) GetValue() string {
+	return fmt.Sprintf("\\# %d %x", len(u.Data), u.Data)
+}
+
+func (u *UnknownRecord) GetTtl() uint {
+	return u.TTL
+}
+
+/*
+WithTtl returns a copy of the record with the given TTL, the record
+itself being left untouched as it may be shared.
+*/
+func WithTtl(rr ResourceRecord, ttl uint) ResourceRecord {
+	switch record := rr.(type) {
+	case *ARecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *AaaaRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *NSRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *TxtRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *CnameRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *MxRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *SoaRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *SrvRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *SvcbRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *DnskeyRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *DsRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *RrsigRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *NsecRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *Nsec3Record:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *Nsec3paramRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	case *UnknownRecord:
+		c := *record
+		c.TTL = ttl
+		return &c
+	}
+	return rr
+}
+
 type Zone struct {
-	trie     trie.Trie
+	trie trie.NameTrie[ResourceRecord]
+
+	/*
+	   The NSEC3 records of the zone and their signatures, kept
+	   apart as their hashed owner names don't exist in the zone
+	   (RFC 5155, section 7.2.8).
+	*/
+	nsec3s trie.NameTrie[ResourceRecord]
+
 	ZoneName string
 	TTL      int
 	SOA      Soa
 	Origin   string
 	flags    int32
+
+	// guards TTL and SOA while the files of the zone are parsed
+	loading sync.Mutex
 }
 
-func (z *Zone) Put(key string, data interface{}) error {
-	return z.trie.Put(key, data)
+func (z *Zone) setTtl(ttl int) {
+	z.loading.Lock()
+	defer z.loading.Unlock()
+	z.TTL = ttl
 }
 
-// TODO: implement update and delete methods
-func (z *Zone) Update(key string, data interface{}) error {
-	return nil
+func (z *Zone) setSoa(soa Soa) {
+	z.loading.Lock()
+	defer z.loading.Unlock()
+	z.SOA = soa
 }
 
-func (z *Zone) Delete(key string) (interface{}, error) {
-	return nil, nil
+// returns true if the given name is the apex of the zone or below it
+func (z *Zone) contains(name string) bool {
+	name = canonicalName(name)
+	origin := canonicalName(z.Origin)
+	return name == origin || strings.HasSuffix(name, "."+origin)
 }
 
-func (z *Zone) Search(key string) ([]interface{}, error) {
-	if !strings.HasSuffix(key, z.Origin) {
-		return nil, fmt.Errorf("key doesn't match with the zone origin prefix")
+/*
+zoneData is where the records of a zone are written: the tries of the
+zone, or the views of them given to a batch.
+*/
+type zoneData struct {
+	records trie.Trie[ResourceRecord]
+	nsec3s  trie.Trie[ResourceRecord]
+}
+
+func (z *Zone) Put(key string, data ResourceRecord) error {
+	return z.putIn(zoneData{records: z.trie, nsec3s: z.nsec3s}, key, data)
+}
+
+// puts the record in the records of the zone, or in its NSEC3 records if it is one of them
+func (z *Zone) putIn(zd zoneData, key string, data ResourceRecord) error {
+	if !z.contains(key) {
+		return fmt.Errorf("name %s is not in zone %s", key, z.Origin)
+	}
+	if isHashed(data) {
+		return zd.nsec3s.Put(key, data)
+	}
+	return zd.records.Put(key, data)
+}
+
+/*
+batch calls fn with views of the records and the NSEC3 records of the
+zone, and publishes the changes made to both when it returns, or drops
+them all if it returns an error. The NSEC3 records are published first,
+so readers finding an NSEC3PARAM record also find its chain; a reader
+may still see the new NSEC3 records along with the old records for the
+time between the two publications.
+*/
+func (z *Zone) batch(fn func(zd zoneData) error) error {
+	return z.trie.Batch(func(records trie.Trie[ResourceRecord]) error {
+		return z.nsec3s.Batch(func(nsec3s trie.Trie[ResourceRecord]) error {
+			return fn(zoneData{records: records, nsec3s: nsec3s})
+		})
+	})
+}
+
+// reports whether the record is an NSEC3 record or the signature of one
+func isHashed(rr ResourceRecord) bool {
+	if sig, ok := rr.(*RrsigRecord); ok {
+		return sig.TypeCovered == NSEC3
+	}
+	return rr.GetRType() == NSEC3
+}
+
+/*
+Update replaces the records of the name having the type and class of
+the given record (its RRset) with the record.
+*/
+func (z *Zone) Update(key string, data ResourceRecord) error {
+	if !z.contains(key) {
+		return fmt.Errorf("name %s is not in zone %s", key, z.Origin)
+	}
+	// a single change, so that readers see either the old RRset or the new one
+	return z.trie.Modify(key, func(records []ResourceRecord) ([]ResourceRecord, error) {
+		if len(records) == 0 {
+			return nil, fmt.Errorf("the given key doesn't exist")
+		}
+		var updated []ResourceRecord
+		for _, rr := range records {
+			if rr.GetRType() != data.GetRType() || rr.GetRClass() != data.GetRClass() {
+				updated = append(updated, rr)
+			}
+		}
+		return append(updated, data), nil
+	})
+}
+
+// Delete removes the name with all of its records
+func (z *Zone) Delete(key string) ([]ResourceRecord, error) {
+	if !z.contains(key) {
+		return nil, fmt.Errorf("name %s is not in zone %s", key, z.Origin)
+	}
+	return z.trie.Delete(key)
+}
+
+/*
+DeleteRecord removes the records of the name having the type, class
+and value of the given record. The name goes away with its last record.
+*/
+func (z *Zone) DeleteRecord(key string, data ResourceRecord) ([]ResourceRecord, error) {
+	if !z.contains(key) {
+		return nil, fmt.Errorf("name %s is not in zone %s", key, z.Origin)
+	}
+	removed, err := z.trie.DeleteValues(key, func(rr ResourceRecord) bool {
+		return rr.GetRType() == data.GetRType() && rr.GetRClass() == data.GetRClass() &&
+			rr.GetValue() == data.GetValue()
+	})
+	if err == nil && len(removed) == 0 {
+		err = fmt.Errorf("no such record owned by %s", key)
+	}
+	return removed, err
+}
+
+// Walk calls fn for every name of the zone owning records, in canonical order
+func (z *Zone) Walk(fn func(name string, records []ResourceRecord) bool) error {
+	return z.trie.Walk(z.Origin, fn)
+}
+
+func (z *Zone) Search(key string) ([]ResourceRecord, error) {
+	if !z.contains(key) {
+		return nil, fmt.Errorf("name %s is not in zone %s", key, z.Origin)
+	}
+	return z.trie.Search(key)
+}
+
+/*
+lookup returns the records owned by the given name of the zone. A name
+exists if it owns records or if it is an empty non-terminal, i.e. some
+name below it owns records (RFC 8020).
+*/
+func (z *Zone) lookup(name string) ([]ResourceRecord, bool) {
+	if !z.contains(name) {
+		return nil, false
+	}
+	records, err := z.trie.Search(name)
+	if err != nil {
+		// the apex exists even if the zone is empty
+		return nil, canonicalName(name) == canonicalName(z.Origin)
+	}
+	return records, true
+}
+
+// returns the lower case, fully qualified form of the name
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+/*
+closestEncloser returns the longest existing ancestor of the given name
+of the zone (RFC 4592, section 3.3.1). Empty non-terminals exist, so
+they can be closest enclosers too.
+*/
+func (z *Zone) closestEncloser(name string) string {
+	encloser, err := z.trie.ClosestEncloser(name)
+	if err != nil || !z.contains(encloser) {
+		return z.Origin
+	}
+	return encloser
+}
+
+/*
+wildcardRecords synthesizes the records of a name that doesn't exist
+from the wildcard at its closest encloser, if there is one. The owner
+of the synthesized records is the given name. A wildcard that is an
+empty non-terminal still exists but has no records to synthesize.
+*/
+func (z *Zone) wildcardRecords(name string) ([]ResourceRecord, bool) {
+	source, exists := z.lookup("*." + z.closestEncloser(name))
+	if !exists {
+		return nil, false
+	}
+
+	records := make([]ResourceRecord, 0, len(source))
+	for _, record := range source {
+		records = append(records, withOwner(record, name))
+	}
+	return records, true
+}
+
+// returns a copy of the record owned by the given name
+func withOwner(rr ResourceRecord, name string) ResourceRecord {
+	switch record := rr.(type) {
+	case *ARecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *AaaaRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *NSRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *CnameRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *MxRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *TxtRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *SoaRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *SrvRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *SvcbRecord:
+		r := *record
+		r.Name = name
+		return &r
+	case *RrsigRecord:
+		// its Labels field still tells the wildcard it was made for
+		r := *record
+		r.Name = name
+		return &r
+	}
+	return rr
+}
+
+// returns the signatures among the records covering the RRset of the type and class
+func signaturesOf(records []ResourceRecord, rType RType, class RClass) []ResourceRecord {
+	var sigs []ResourceRecord
+	for _, record := range records {
+		if sig, ok := record.(*RrsigRecord); ok && sig.TypeCovered == rType && sig.GetRClass() == class {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+/*
+addNegativeSoa adds the SOA record of a negative answer to the result,
+along with its signatures if the zone is signed. The signatures get the
+TTL of the SOA record.
+*/
+func (z *Zone) addNegativeSoa(result *QueryResult) {
+	soa := z.negativeSoa()
+	result.addAuthority(soa)
+	apex, _ := z.lookup(z.Origin)
+	for _, sig := range signaturesOf(apex, SOA, soa.GetRClass()) {
+		result.addAuthority(WithTtl(sig, soa.GetTtl()))
+	}
+}
+
+/*
+negativeSoa returns the SOA record to put in the authority section of
+a negative answer. Its TTL is the smaller of the SOA TTL and the SOA
+MINIMUM field as required by RFC 2308, section 3.
+*/
+func (z *Zone) negativeSoa() *SoaRecord {
+	ttl := uint(z.TTL)
+	if z.SOA.Minimum >= 0 && uint(z.SOA.Minimum) < ttl {
+		ttl = uint(z.SOA.Minimum)
+	}
+	return &SoaRecord{
+		resourceRecord: resourceRecord{Name: z.Origin, Type: SOA, Class: z.SOA.Class, TTL: ttl},
+		Soa:            z.SOA,
 	}
-	k := strings.TrimSuffix(key, "."+z.Origin)
-	return z.trie.Search(k)
 }
 
 func (z *Zone) IsEmpty() bool {
@@ -257,6 +757,21 @@ type zonefileParser struct {
 	zone          *Zone
 	fscanner      *bufio.Scanner
 	currentDomain string
+
+	/*
+	   The $ORIGIN and $TTL in effect for the file, kept apart
+	   from the zone as the files of a zone are parsed in
+	   parallel.
+	*/
+	origin string
+	ttl    int
+
+	// where the records are put, the tries of the zone or the views of a batch loading them
+	data zoneData
+}
+
+func (zp *zonefileParser) put(key string, data ResourceRecord) error {
+	return zp.zone.putIn(zp.data, key, data)
 }
 
 var domainRegexp = regexp.MustCompile(`^(?i)[a-z0-9-]+(\.[a-z0-9-]+)+\.?$`)
@@ -267,7 +782,7 @@ func CheckDomainValidity(str string) bool {
 
 func CheckIPv4Validity(str string) bool {
 	if ip := net.ParseIP(str); ip != nil {
-		return strings.Count(str, ".") == 4 && strings.Count(str, ":") == 0
+		return strings.Count(str, ".") == 3 && strings.Count(str, ":") == 0
 	}
 	return false
 }
@@ -280,7 +795,7 @@ func CheckIPv6Validity(str string) bool {
 }
 
 func CheckClassValidity(str string) RClass {
-	switch str {
+	switch strings.ToUpper(str) {
 	case "IN":
 		return IN
 	case "CS":
@@ -311,13 +826,13 @@ func (zp *zonefileParser) parseZoneDirectives(line string) error {
 			if !strings.HasSuffix(value, ".") {
 				value += "."
 			}
-			zp.zone.Origin = value
+			zp.origin = value
 		case "TTL":
 			i, err := strconv.Atoi(value)
 			if err != nil {
 				return err
 			}
-			zp.zone.TTL = i
+			zp.ttl = i
 		default:
 			return fmt.Errorf("invalid file: unknown directive \"%v\"", line)
 		}
@@ -327,6 +842,177 @@ func (zp *zonefileParser) parseZoneDirectives(line string) error {
 	return nil
 }
 
+/*
+splitFields breaks a line of a master file into its fields. Fields are
+separated by whitespace, a quoted string is kept as a single field
+(together with its quotes) and an unescaped ";" outside of quotes
+starts a comment. Escape sequences are left untouched so that they can
+be interpreted by the parser of the record.
+*/
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, inQuotes := false, false
+
+	for i := 0; i < len(line); i++ {
+		char := line[i]
+		switch {
+		case char == '\\':
+			if i+1 == len(line) {
+				return nil, fmt.Errorf("invalid file: dangling escape in \"%v\"", line)
+			}
+			field.WriteByte(char)
+			field.WriteByte(line[i+1])
+			inField = true
+			i++
+		case char == '"':
+			field.WriteByte(char)
+			inField = true
+			inQuotes = !inQuotes
+		case inQuotes:
+			field.WriteByte(char)
+		case char == ';':
+			i = len(line)
+		case char == ' ' || char == '\t' || char == '\r':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(char)
+			inField = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("invalid file: unterminated quoted string in \"%v\"", line)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+/*
+readContinuation joins records that are spread over several lines
+using parentheses. The parentheses themselves are dropped from the
+returned fields.
+*/
+func (zp *zonefileParser) readContinuation(fields []string) ([]string, error) {
+	var joined []string
+	open := false
+
+	for {
+		for _, field := range fields {
+			switch field {
+			case "(":
+				if open {
+					return nil, fmt.Errorf("invalid file: nested parentheses")
+				}
+				open = true
+			case ")":
+				if !open {
+					return nil, fmt.Errorf("invalid file: unbalanced parentheses")
+				}
+				open = false
+			default:
+				joined = append(joined, field)
+			}
+		}
+		if !open {
+			return joined, nil
+		}
+		if !zp.fscanner.Scan() {
+			return nil, fmt.Errorf("invalid file: missing closing parenthesis")
+		}
+		var err error
+		fields, err = splitFields(zp.fscanner.Text())
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+parseCharacterString converts a <character-string> as found in a
+master file into its raw octets. The string may be quoted; "\X"
+stands for the character X and "\DDD" for the octet with the decimal
+value DDD (RFC 1035, section 5.1).
+*/
+func parseCharacterString(field string) (string, error) {
+	if strings.HasPrefix(field, "\"") {
+		if len(field) < 2 || !strings.HasSuffix(field, "\"") {
+			return "", fmt.Errorf("invalid file: malformed quoted string %v", field)
+		}
+		field = field[1 : len(field)-1]
+	}
+
+	var str strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' {
+			str.WriteByte(field[i])
+			continue
+		}
+		i++
+		if i == len(field) {
+			return "", fmt.Errorf("invalid file: dangling escape in %v", field)
+		}
+		if field[i] < '0' || field[i] > '9' {
+			str.WriteByte(field[i])
+			continue
+		}
+		if i+3 > len(field) {
+			return "", fmt.Errorf("invalid file: short decimal escape in %v", field)
+		}
+		octet, err := strconv.Atoi(field[i : i+3])
+		if err != nil || octet > 255 {
+			return "", fmt.Errorf("invalid file: bad decimal escape in %v", field)
+		}
+		str.WriteByte(byte(octet))
+		i += 2
+	}
+	return str.String(), nil
+}
+
+// FormatCharacterStrings formats the given strings back to their master file representation
+func FormatCharacterStrings(strs []string) string {
+	quoted := make([]string, len(strs))
+	for i, str := range strs {
+		var b strings.Builder
+		b.WriteByte('"')
+		for j := 0; j < len(str); j++ {
+			char := str[j]
+			switch {
+			case char == '"' || char == '\\':
+				b.WriteByte('\\')
+				b.WriteByte(char)
+			case char < ' ' || char > '~':
+				fmt.Fprintf(&b, "\\%03d", char)
+			default:
+				b.WriteByte(char)
+			}
+		}
+		b.WriteByte('"')
+		quoted[i] = b.String()
+	}
+	return strings.Join(quoted, " ")
+}
+
+// returns the fully qualified owner name of the record being parsed
+func (zp *zonefileParser) ownerName() string {
+	domain := zp.currentDomain
+	if domain == "" || domain == zp.origin {
+		return zp.origin
+	}
+	if strings.HasSuffix(domain, ".") {
+		if strings.HasSuffix(domain, "."+zp.origin) {
+			return domain
+		}
+		return domain + zp.origin
+	}
+	return domain + "." + zp.origin
+}
+
 func (zp *zonefileParser) parseMetadataFromLine(fields []string, resoresourceRecord *resourceRecord) error {
 	fieldNumbers := len(fields)
 	var class RClass = IN
@@ -344,10 +1030,10 @@ func (zp *zonefileParser) parseMetadataFromLine(fields []string, resoresourceRec
 			}
 		} else {
 			currentDomain := fields[0]
-			if strings.HasSuffix(fields[0], zp.zone.Origin) {
-				currentDomain = strings.TrimSuffix(fields[0], zp.zone.Origin)
+			if strings.HasSuffix(fields[0], zp.origin) {
+				currentDomain = strings.TrimSuffix(fields[0], zp.origin)
 			} else if strings.HasSuffix(fields[0], ".") {
-				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.zone.Origin)
+				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.origin)
 			}
 			zp.currentDomain = currentDomain
 		}
@@ -356,10 +1042,10 @@ func (zp *zonefileParser) parseMetadataFromLine(fields []string, resoresourceRec
 			zp.currentDomain = ""
 		} else {
 			currentDomain := fields[0]
-			if strings.HasSuffix(fields[0], zp.zone.Origin) {
-				currentDomain = strings.TrimSuffix(fields[0], zp.zone.Origin)
+			if strings.HasSuffix(fields[0], zp.origin) {
+				currentDomain = strings.TrimSuffix(fields[0], zp.origin)
 			} else if strings.HasSuffix(fields[0], ".") {
-				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.zone.Origin)
+				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.origin)
 			}
 			zp.currentDomain = currentDomain
 		}
@@ -373,82 +1059,96 @@ func (zp *zonefileParser) parseMetadataFromLine(fields []string, resoresourceRec
 	return nil
 }
 
+/*
+parseTtlAndClass reads the fields between the owner and the type of a
+record, an optional TTL and an optional class in either order (RFC 1035,
+section 5.1). The TTL is -1 when the record has none and the class IN.
+*/
+func parseTtlAndClass(fields []string) (int, RClass, error) {
+	ttl, class := -1, UnknownClass
+	for _, field := range fields {
+		if c := CheckClassValidity(field); c != UnknownClass && class == UnknownClass {
+			class = c
+		} else if i, err := strconv.Atoi(field); err == nil && i >= 0 && ttl < 0 {
+			ttl = i
+		} else {
+			return 0, UnknownClass, fmt.Errorf("unknown class or ttl field %s", field)
+		}
+	}
+	if class == UnknownClass {
+		class = IN
+	}
+	return ttl, class, nil
+}
+
 func (zp *zonefileParser) parseSoaFromFile(fields []string) error {
-	if len(fields) < 5 {
-		return fmt.Errorf("invalid file: soa have fewer fields")
+	// the first field is the owner, even when it is spelled like the type
+	typePos := 1
+	for typePos < len(fields) && !strings.EqualFold(fields[typePos], "SOA") {
+		typePos++
+	}
+	if typePos < 1 || len(fields)-typePos != 8 {
+		return fmt.Errorf("invalid file: soa has wrong number of fields")
 	}
 	if fields[0] == "@" {
-		zp.currentDomain = zp.zone.Origin
+		zp.currentDomain = ""
 	} else if !CheckDomainValidity(fields[0]) {
 		return fmt.Errorf("invalid file: soa has invalid domain name")
 	} else {
 		zp.currentDomain = fields[0]
 	}
-	class := CheckClassValidity(fields[1])
-	if class == UnknownClass {
-		return fmt.Errorf("invalid file: unknown class field in soa")
+	if zp.ownerName() != zp.origin {
+		return fmt.Errorf("invalid file: soa owner %s is not the zone apex", fields[0])
+	}
+	ttl, class, err := parseTtlAndClass(fields[1:typePos])
+	if err != nil {
+		return fmt.Errorf("invalid file: %v in soa", err)
+	}
+	if ttl < 0 {
+		ttl = zp.ttl
 	}
-	zp.zone.SOA.Class = class
+	var soa Soa
+	soa.Class = class
 
-	if !CheckDomainValidity(fields[3]) {
+	if !CheckDomainValidity(fields[typePos+1]) {
 		return fmt.Errorf("invalid file: the soa domain is not correct")
 	}
-	zp.zone.SOA.MName = fields[3]
-	if !CheckDomainValidity(fields[4]) {
+	soa.MName = fields[typePos+1]
+	if !CheckDomainValidity(fields[typePos+2]) {
 		return fmt.Errorf("invalid file: the soa mail is not correct")
 	}
-	zp.zone.SOA.RName = fields[4]
-	if fields[5] == "(" {
-		var valOpts []int
-		for zp.fscanner.Scan() {
-			if len(valOpts) > 5 {
-				return fmt.Errorf("invalid file: unkwnown arguments in soa")
-			}
-			line := zp.fscanner.Text()
-			line = strings.TrimLeft(line, ";")
-			line = strings.TrimSpace(line)
-			if strings.HasSuffix(line, ")") {
-				if line == ")" {
-					break
-				}
-				line = strings.TrimSuffix(line, ")")
-				i, err := strconv.Atoi(line)
-				if err != nil {
-					return err
-				}
-				valOpts = append(valOpts, i)
-				break
-			}
-			i, err := strconv.Atoi(line)
-			if err != nil {
-				return err
-			}
-			valOpts = append(valOpts, i)
-		}
-		if len(valOpts) >= 1 {
-			zp.zone.SOA.Serial = valOpts[0]
-		}
-		if len(valOpts) >= 2 {
-			zp.zone.SOA.Refresh = valOpts[1]
-		}
-		if len(valOpts) >= 3 {
-			zp.zone.SOA.Retry = valOpts[2]
-		}
-		if len(valOpts) >= 4 {
-			zp.zone.SOA.Expire = valOpts[3]
-		}
-		if len(valOpts) >= 5 {
-			zp.zone.SOA.Minimum = valOpts[4]
+	soa.RName = fields[typePos+2]
+
+	var valOpts [5]int
+	for i, field := range fields[typePos+3:] {
+		val, err := strconv.Atoi(field)
+		if err != nil {
+			return err
 		}
+		valOpts[i] = val
 	}
-	return nil
+	soa.Serial = valOpts[0]
+	soa.Refresh = valOpts[1]
+	soa.Retry = valOpts[2]
+	soa.Expire = valOpts[3]
+	soa.Minimum = valOpts[4]
+
+	soaRecord := SoaRecord{
+		resourceRecord: resourceRecord{Name: zp.origin, Type: SOA, Class: class, TTL: uint(ttl)},
+		Soa:            soa,
+	}
+	zp.zone.setSoa(soa)
+	// the TTL of the zone is the one of its SOA record, files may change $TTL for other records
+	zp.zone.setTtl(ttl)
+	soaRecord.Value = soaRecord.GetValue()
+	return zp.put(zp.origin, &soaRecord)
 }
 
 func (zp *zonefileParser) parseNsFromFile(fields []string) error {
 	var err error
 	var value string
 	fieldNumbers := len(fields)
-	nsRecord := NSRecord{resourceRecord: resourceRecord{Type: NS, TTL: uint(zp.zone.TTL)}}
+	nsRecord := NSRecord{resourceRecord: resourceRecord{Type: NS, TTL: uint(zp.ttl)}}
 
 	err = zp.parseMetadataFromLine(fields, &nsRecord.resourceRecord)
 	if err != nil {
@@ -459,15 +1159,15 @@ func (zp *zonefileParser) parseNsFromFile(fields []string) error {
 	}
 	value = fields[fieldNumbers-1]
 	nsRecord.Value = value
-	zp.zone.Put(zp.currentDomain, nsRecord)
-	return nil
+	nsRecord.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), &nsRecord)
 }
 
 func (zp *zonefileParser) parseAFromFile(fields []string) error {
 	fieldNumbers := len(fields)
 	var err error
 	var value string
-	aRecord := ARecord{resourceRecord: resourceRecord{Type: A}}
+	aRecord := ARecord{resourceRecord: resourceRecord{Type: A, TTL: uint(zp.ttl)}}
 
 	err = zp.parseMetadataFromLine(fields, &aRecord.resourceRecord)
 	if err != nil {
@@ -478,15 +1178,15 @@ func (zp *zonefileParser) parseAFromFile(fields []string) error {
 	}
 	value = fields[fieldNumbers-1]
 	aRecord.Value = value
-	zp.zone.Put(zp.currentDomain, aRecord)
-	return nil
+	aRecord.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), &aRecord)
 }
 
 func (zp *zonefileParser) parseAaaaFromFile(fields []string) error {
 	fieldNumbers := len(fields)
 	var err error
 	var value string
-	aaaaRecord := AaaaRecord{resourceRecord: resourceRecord{Type: Aaaa}}
+	aaaaRecord := AaaaRecord{resourceRecord: resourceRecord{Type: Aaaa, TTL: uint(zp.ttl)}}
 
 	err = zp.parseMetadataFromLine(fields, &aaaaRecord.resourceRecord)
 	if err != nil {
@@ -497,8 +1197,8 @@ func (zp *zonefileParser) parseAaaaFromFile(fields []string) error {
 	}
 	value = fields[fieldNumbers-1]
 	aaaaRecord.Value = value
-	zp.zone.Put(zp.currentDomain, aaaaRecord)
-	return nil
+	aaaaRecord.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), &aaaaRecord)
 }
 
 func (zp *zonefileParser) parseMxFromFile(fields []string) error {
@@ -521,10 +1221,10 @@ func (zp *zonefileParser) parseMxFromFile(fields []string) error {
 			preference = i
 		} else {
 			currentDomain := fields[0]
-			if strings.HasSuffix(fields[0], zp.zone.Origin) {
-				currentDomain = strings.TrimSuffix(fields[0], zp.zone.Origin)
+			if strings.HasSuffix(fields[0], zp.origin) {
+				currentDomain = strings.TrimSuffix(fields[0], zp.origin)
 			} else if strings.HasSuffix(fields[0], ".") {
-				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.zone.Origin)
+				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.origin)
 			}
 			zp.currentDomain = currentDomain
 		}
@@ -534,10 +1234,10 @@ func (zp *zonefileParser) parseMxFromFile(fields []string) error {
 				zp.currentDomain = ""
 			} else {
 				currentDomain := fields[0]
-				if strings.HasSuffix(fields[0], zp.zone.Origin) {
-					currentDomain = strings.TrimSuffix(fields[0], zp.zone.Origin)
+				if strings.HasSuffix(fields[0], zp.origin) {
+					currentDomain = strings.TrimSuffix(fields[0], zp.origin)
 				} else if strings.HasSuffix(fields[0], ".") {
-					return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.zone.Origin)
+					return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.origin)
 				}
 				zp.currentDomain = currentDomain
 			}
@@ -555,10 +1255,10 @@ func (zp *zonefileParser) parseMxFromFile(fields []string) error {
 				}
 			} else {
 				currentDomain := fields[0]
-				if strings.HasSuffix(fields[0], zp.zone.Origin) {
-					currentDomain = strings.TrimSuffix(fields[0], zp.zone.Origin)
+				if strings.HasSuffix(fields[0], zp.origin) {
+					currentDomain = strings.TrimSuffix(fields[0], zp.origin)
 				} else if strings.HasSuffix(fields[0], ".") {
-					return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.zone.Origin)
+					return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.origin)
 				}
 				zp.currentDomain = currentDomain
 			}
@@ -568,10 +1268,10 @@ func (zp *zonefileParser) parseMxFromFile(fields []string) error {
 			zp.currentDomain = ""
 		} else {
 			currentDomain := fields[0]
-			if strings.HasSuffix(fields[0], zp.zone.Origin) {
-				currentDomain = strings.TrimSuffix(fields[0], zp.zone.Origin)
+			if strings.HasSuffix(fields[0], zp.origin) {
+				currentDomain = strings.TrimSuffix(fields[0], zp.origin)
 			} else if strings.HasSuffix(fields[0], ".") {
-				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.zone.Origin)
+				return fmt.Errorf("parse error: can't have a non zone domain %s in zone %s", fields[0], zp.origin)
 			}
 			zp.currentDomain = currentDomain
 		}
@@ -590,31 +1290,41 @@ func (zp *zonefileParser) parseMxFromFile(fields []string) error {
 	}
 	value := fields[fieldNumbers-1]
 
-	mxRecord := MxRecord{resourceRecord: resourceRecord{Type: MX, Class: class, Value: value}, Preference: preference}
-	zp.zone.Put(zp.currentDomain, mxRecord)
-	return nil
+	mxRecord := MxRecord{resourceRecord: resourceRecord{Name: zp.ownerName(), Type: MX, Class: class, TTL: uint(zp.ttl), Value: value}, Preference: preference}
+	return zp.put(zp.ownerName(), &mxRecord)
 }
 
 func (zp *zonefileParser) parseTxtFromFile(fields []string) error {
 	var err error
-	var value string
-	txtRecord := TxtRecord{resourceRecord: resourceRecord{Type: TXT}}
+	txtRecord := TxtRecord{resourceRecord: resourceRecord{Type: TXT, TTL: uint(zp.ttl)}}
+
+	typePos := typePosition(fields, "TXT")
+	if typePos < 0 || typePos == len(fields)-1 {
+		return fmt.Errorf("invalid file: txt record has no data")
+	}
 
-	err = zp.parseMetadataFromLine(fields, &txtRecord.resourceRecord)
+	// the metadata parser expects a single value field after the type
+	err = zp.parseMetadataFromLine(append(fields[:typePos+1:typePos+1], fields[len(fields)-1]), &txtRecord.resourceRecord)
 	if err != nil {
 		return err
 	}
-	value = fields[len(fields)-1]
-	txtRecord.Value = value
-	zp.zone.Put(zp.currentDomain, txtRecord)
-	return nil
+	for _, field := range fields[typePos+1:] {
+		str, err := parseCharacterString(field)
+		if err != nil {
+			return err
+		}
+		txtRecord.Strings = append(txtRecord.Strings, str)
+	}
+	txtRecord.Value = FormatCharacterStrings(txtRecord.Strings)
+	txtRecord.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), &txtRecord)
 }
 
 func (zp *zonefileParser) parseCnameFromFile(fields []string) error {
 	var err error
 	var value string
 	fieldNumbers := len(fields)
-	cnameRecord := CnameRecord{resourceRecord: resourceRecord{Type: Cname}}
+	cnameRecord := CnameRecord{resourceRecord: resourceRecord{Type: Cname, TTL: uint(zp.ttl)}}
 
 	err = zp.parseMetadataFromLine(fields, &cnameRecord.resourceRecord)
 	if err != nil {
@@ -625,26 +1335,15 @@ func (zp *zonefileParser) parseCnameFromFile(fields []string) error {
 	}
 	value = fields[fieldNumbers-1]
 	cnameRecord.Value = value
-	zp.zone.Put(zp.currentDomain, cnameRecord)
-	return nil
+	cnameRecord.Name = zp.ownerName()
+	return zp.put(zp.ownerName(), &cnameRecord)
 }
 
 func (zp *zonefileParser) getRrType(fields []string) RType {
 	for i := 0; i < len(fields)-1; i++ {
-		if fields[i] == "A" {
-			return A
-		} else if fields[i] == "AAAA" {
-			return Aaaa
-		} else if fields[i] == "NS" {
-			return NS
-		} else if fields[i] == "MX" {
-			return MX
-		} else if fields[i] == "TXT" {
-			return TXT
-		} else if fields[i] == "CNAME" {
-			return Cname
-		} else if fields[i] == "SOA" {
-			return SOA
+		rType, ok := ParseRType(fields[i])
+		if _, supported := typeNames[rType]; ok && supported && !isOwnerField(fields, i) {
+			return rType
 		}
 	}
 	return UnknownType
@@ -670,8 +1369,14 @@ func (zp *zonefileParser) parseFile() error {
 			continue
 		}
 
-		line = strings.Split(line, ";")[0]
-		fields := strings.Fields(line)
+		fields, err := splitFields(line)
+		if err != nil {
+			return err
+		}
+		fields, err = zp.readContinuation(fields)
+		if err != nil {
+			return err
+		}
 		fieldNumbers := len(fields)
 		if fieldNumbers == 0 {
 			continue
@@ -694,6 +1399,22 @@ func (zp *zonefileParser) parseFile() error {
 			err = zp.parseTxtFromFile(fields)
 		case Cname:
 			err = zp.parseCnameFromFile(fields)
+		case SRV:
+			err = zp.parseSrvFromFile(fields)
+		case SVCB:
+			err = zp.parseSvcbFromFile(fields)
+		case DS:
+			err = zp.parseDsFromFile(fields)
+		case DNSKEY:
+			err = zp.parseDnskeyFromFile(fields)
+		case RRSIG:
+			err = zp.parseRrsigFromFile(fields)
+		case NSEC:
+			err = zp.parseNsecFromFile(fields)
+		case NSEC3:
+			err = zp.parseNsec3FromFile(fields)
+		case NSEC3PARAM:
+			err = zp.parseNsec3paramFromFile(fields)
 		case UnknownType:
 			return fmt.Errorf("unable to parse resource type")
 		}
@@ -707,29 +1428,262 @@ func (zp *zonefileParser) parseFile() error {
 	return nil
 }
 
+// the longest chain of aliases followed for a single query
+const maxCnameChain = 8
+
+/*
+findResourceRecord answers the query from the data of the zone. Names
+that don't exist get an NXDOMAIN answer and names without records of
+the requested type a NODATA one; both carry the SOA of the zone in the
+authority section (RFC 2308).
+
+Names at or below a delegation point (a name other than the apex owning
+NS records) get a referral: the NS records of the cut in the authority
+section, the addresses of the name servers that are in the zone (glue)
+in the additional section and no AA bit, as the data below the cut
+belongs to the child zone.
+
+When the name is an alias, the CNAME is added to the answer and its
+target is looked up in this zone or in any other zone of the Catalog,
+until a name without alias is found, the target leaves our zones, a
+loop is detected or the chain gets longer than maxCnameChain. The
+answer holds the whole chain in order and its RCODE is the one of the
+last name looked up (RFC 6604).
+*/
 func (z *Zone) findResourceRecord(query *QueryQuestion) (*QueryResult, error) {
-	// code to search for resource record
-	rData, err := z.Search(query.QName)
-	if err != nil {
-		return nil, err
+	if !z.contains(query.QName) {
+		return nil, fmt.Errorf("name %s is not in zone %s", query.QName, z.Origin)
+	}
+	result := &QueryResult{Authoritative: true}
+
+	zone, name := z, query.QName
+	visited := map[string]bool{strings.ToLower(name): true}
+	for {
+		if zone.referral(name, query, result) {
+			// the AA bit is about the query name, the part of the
+			// chain that led to the referral is still authoritative
+			result.Authoritative = name != query.QName
+			return result, nil
+		}
+		target, isAlias := zone.answerName(name, query, result)
+		if !isAlias {
+			addTargetAddresses(result)
+			return result, nil
+		}
+
+		target = canonicalName(target)
+		if visited[target] {
+			log.Printf("cname loop detected at %s while resolving %s\n", target, query.QName)
+			return result, nil
+		}
+		if len(visited) > maxCnameChain {
+			log.Printf("cname chain of %s is longer than %d\n", query.QName, maxCnameChain)
+			return result, nil
+		}
+		visited[target] = true
+
+		if !zone.contains(target) {
+			var err error
+			zone, err = findZone(&QueryQuestion{QName: target})
+			if err != nil {
+				// the target is out of our authority, the client
+				// has to resolve it by itself
+				return result, nil
+			}
+		}
+		name = target
 	}
-	result := &QueryResult{}
+}
 
-	for _, data := range rData {
-		tData := data.(ResourceRecord)
-		if tData.GetRType() == RType(query.Qtype) && tData.GetRClass() == RClass(query.Qclass) {
-			result.Answers = append(result.Answers, &tData)
-			result.Ancount++
-		} else {
-			result.Nscount++
-			result.Authority = append(result.Authority, &tData)
+/*
+addTargetAddresses puts the A and AAAA records of the hosts the answers
+point to (NS, MX, SRV and SVCB targets) in the additional section,
+sparing the client a round trip. Only the addresses of hosts inside one
+of our zones are added, we have no trustworthy data for other names.
+*/
+func addTargetAddresses(result *QueryResult) {
+	added := make(map[string]bool)
+	for _, rr := range result.Additional {
+		added[canonicalName((*rr).GetName())] = true
+	}
+
+	for _, rr := range result.Answers {
+		var target string
+		switch record := (*rr).(type) {
+		case *NSRecord, *MxRecord, *SrvRecord:
+			target = record.GetValue()
+		case *SvcbRecord:
+			target = record.GetTargetHost()
+		}
+		if target == "" || target == "." {
+			continue
+		}
+		target = canonicalName(target)
+		if added[target] {
+			continue
+		}
+		added[target] = true
+
+		zone, err := findZone(&QueryQuestion{QName: target})
+		if err != nil {
+			continue
+		}
+		records, _ := zone.lookup(target)
+		for _, record := range records {
+			if record.GetRType() == A || record.GetRType() == Aaaa {
+				result.addAdditional(record)
+			}
+		}
+	}
+}
+
+/*
+referral adds a referral to the result if the name is at or below a
+zone cut. DS records live on the parent side of the cut, so they are
+answered from this zone when the name is the cut itself.
+*/
+func (z *Zone) referral(name string, query *QueryQuestion, result *QueryResult) bool {
+	cut, nsRecords, isCut := z.findZoneCut(name, RClass(query.Qclass))
+	if !isCut || (cut == canonicalName(name) && RType(query.Qtype) == DS) {
+		return false
+	}
+
+	result.RCode = NoError
+	for _, ns := range nsRecords {
+		result.addAuthority(ns)
+	}
+	// the DS records of a signed delegation and their signatures (RFC 4035, section 3.1.4)
+	cutRecords, _ := z.lookup(cut)
+	for _, record := range cutRecords {
+		if record.GetRType() == DS && record.GetRClass() == RClass(query.Qclass) {
+			result.addAuthority(record)
+		}
+	}
+	sigs := signaturesOf(cutRecords, DS, RClass(query.Qclass))
+	for _, sig := range sigs {
+		result.addAuthority(sig)
+	}
+	if len(sigs) == 0 {
+		// the proof that the child zone is unsigned
+		z.proveNoData(cut, result)
+	}
+	for _, ns := range nsRecords {
+		target := canonicalName(ns.GetValue())
+		if !z.contains(target) {
+			// out of zone name servers don't need glue
+			continue
+		}
+		records, _ := z.lookup(target)
+		for _, record := range records {
+			if record.GetRType() == A || record.GetRType() == Aaaa {
+				result.addAdditional(record)
+			}
+		}
+	}
+	return true
+}
+
+/*
+findZoneCut looks for the topmost delegation point at or above the
+given name, i.e. the closest name to the apex owning NS records, and
+returns it together with its NS records.
+*/
+func (z *Zone) findZoneCut(name string, class RClass) (string, []ResourceRecord, bool) {
+	name, origin := canonicalName(name), canonicalName(z.Origin)
+	if name == origin || !z.contains(name) {
+		return "", nil, false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."+origin), ".")
+	cut := origin
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut = labels[i] + "." + cut
+		records, exists := z.lookup(cut)
+		if !exists {
+			// nothing exists below a name that doesn't exist
+			return "", nil, false
 		}
 
+		var nsRecords []ResourceRecord
+		for _, record := range records {
+			if record.GetRType() == NS && record.GetRClass() == class {
+				nsRecords = append(nsRecords, record)
+			}
+		}
+		if len(nsRecords) > 0 {
+			return cut, nsRecords, true
+		}
+	}
+	return "", nil, false
+}
+
+/*
+answerName adds the records of name matching the query to the result,
+or the negative answer if there aren't any. If the name is an alias,
+its CNAME record is added instead and the target is returned with true.
+*/
+func (z *Zone) answerName(name string, query *QueryQuestion, result *QueryResult) (string, bool) {
+	result.RCode = NoError
+	records, exists := z.lookup(name)
+	wildcard := false
+	if !exists {
+		records, exists = z.wildcardRecords(name)
+		wildcard = exists
+	}
+	if !exists {
+		result.RCode = NameError
+		z.addNegativeSoa(result)
+		z.proveNameError(name, result)
+		return "", false
+	}
+
+	var cname ResourceRecord
+	var found bool
+	for _, record := range records {
+		if record.GetRClass() != RClass(query.Qclass) {
+			continue
+		}
+		if record.GetRType() == RType(query.Qtype) {
+			result.addAnswer(record)
+			found = true
+		} else if record.GetRType() == Cname {
+			cname = record
+		}
+	}
+	if found {
+		for _, sig := range signaturesOf(records, RType(query.Qtype), RClass(query.Qclass)) {
+			result.addAnswer(sig)
+		}
+		if wildcard {
+			z.proveWildcardAnswer(name, result)
+		}
+		return "", false
 	}
-	return result, nil
+	if cname != nil {
+		result.addAnswer(cname)
+		for _, sig := range signaturesOf(records, Cname, RClass(query.Qclass)) {
+			result.addAnswer(sig)
+		}
+		if wildcard {
+			z.proveWildcardAnswer(name, result)
+		}
+		return cname.GetValue(), true
+	}
+	z.addNegativeSoa(result)
+	if wildcard {
+		z.proveWildcardNoData(name, result)
+	} else {
+		z.proveNoData(name, result)
+	}
+	return "", false
 }
 
-func (z *Zone) loadFromFiles(files []string) {
+/*
+loadFromFiles parses the zone files in parallel, putting their records
+in zd, and reports whether all of them parsed.
+*/
+func (z *Zone) loadFromFiles(files []string, zd zoneData) bool {
+	var failed atomic.Bool
 	wg := new(sync.WaitGroup)
 	wg.Add(len(files))
 	for _, file := range files {
@@ -738,57 +1692,131 @@ func (z *Zone) loadFromFiles(files []string) {
 			f, err := os.Open(file)
 			if err != nil {
 				log.Printf("%s: %v\n", file, err)
+				failed.Store(true)
 				return
 			}
 			defer f.Close()
 
 			fscanner := bufio.NewScanner(f)
-			zfParser := zonefileParser{zone: z, fscanner: fscanner}
+			zfParser := zonefileParser{zone: z, fscanner: fscanner, origin: z.Origin, ttl: z.TTL, data: zd}
 
 			err = zfParser.parseFile()
 			if err != nil {
 				log.Printf("%s: parse error: %v\n", file, err)
+				failed.Store(true)
 				return
 			}
 		})(file)
 	}
 	wg.Wait()
+	return !failed.Load()
+}
+
+// returns an empty zone of the origin
+func newZone(origin string) *Zone {
+	zone := &Zone{ZoneName: origin, Origin: origin}
+	// an RRset can't hold the same record twice (RFC 2181, section 5)
+	zone.trie = trie.NewNameTrie[ResourceRecord](&trie.TrieContext{Duplicates: trie.IgnoreDuplicates})
+	zone.nsec3s = trie.NewNameTrie[ResourceRecord](&trie.TrieContext{Duplicates: trie.IgnoreDuplicates})
+	if !strings.HasSuffix(zone.Origin, ".") {
+		zone.Origin += "."
+	}
+	return zone
+}
+
+/*
+ParseZonefile reads the zone of the origin from a master file, the way
+the files of the configured zones are read, without adding it to the
+Catalog.
+*/
+func ParseZonefile(origin string, path string) (*Zone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zone := newZone(origin)
+	zp := zonefileParser{zone: zone, fscanner: bufio.NewScanner(file), origin: zone.Origin, data: zoneData{records: zone.trie, nsec3s: zone.nsec3s}}
+	if err = zp.parseFile(); err != nil {
+		return nil, fmt.Errorf("%s: parse error: %v", path, err)
+	}
+	if zone.IsEmpty() {
+		return nil, fmt.Errorf("%s: no records for zone %s", path, zone.Origin)
+	}
+	return zone, nil
 }
 
 func LoadZones() bool {
 	wg := new(sync.WaitGroup)
 	wg.Add(len(config.ServerConfiguration.Zones))
 	for _, zoneConf := range config.ServerConfiguration.Zones {
-		go (func(zoneName string, zoneFileLocation []string) {
-			var zone *Zone
+		go (func(zoneName string, zoneFileLocation []string, snapshotPath string) {
+			zone := newZone(zoneName)
 			defer wg.Done()
 			log.Printf("%v\n", zoneName)
-			zone.trie = trie.NewTrie(&trie.TrieContext{})
-			zone.ZoneName = zoneName
-			zone.loadFromFiles(zoneFileLocation)
+			zone.load(zoneFileLocation, snapshotPath)
 			if zone.IsEmpty() {
 				log.Println(fmt.Errorf("zone loading failed: either zone %s has empty files or files have parse errors", zone.ZoneName))
 				return
 			}
-			Catalog.Put(zone.ZoneName, zone)
-		})(zoneConf.ZoneName, zoneConf.ZonefileLocation)
+			stats := zone.trie.Stats()
+			log.Printf("%s: loaded %d names in %d nodes, about %d KiB\n", zone.ZoneName, stats.Keys, stats.Nodes, stats.Bytes/1024)
+			Catalog.Put(zone.Origin, zone)
+		})(zoneConf.ZoneName, zoneConf.ZonefileLocation, zoneConf.SnapshotPath)
 	}
 	wg.Wait()
 	return !Catalog.IsEmpty()
 }
 
+/*
+load fills the zone from its snapshot if there is an up to date one,
+from its zone files otherwise, in which case a new snapshot is written.
+*/
+func (z *Zone) load(files []string, snapshotPath string) {
+	if snapshotPath == "" {
+		z.batch(func(zd zoneData) error {
+			z.loadFromFiles(files, zd)
+			return nil
+		})
+		return
+	}
+
+	err := z.loadSnapshot(snapshotPath, files)
+	if err == nil {
+		log.Printf("%s: loaded from snapshot %s\n", z.ZoneName, snapshotPath)
+		return
+	}
+	log.Printf("%s: %v, parsing the zone files\n", z.ZoneName, err)
+
+	// a snapshot of a zone with broken files would hide the errors
+	sources, err := statSources(files)
+	parsed := true
+	z.batch(func(zd zoneData) error {
+		parsed = z.loadFromFiles(files, zd)
+		return nil
+	})
+	if err != nil || !parsed || z.IsEmpty() {
+		return
+	}
+	if err = z.writeSnapshot(snapshotPath, sources); err != nil {
+		log.Printf("%s: can't write snapshot: %v\n", z.ZoneName, err)
+	}
+}
+
+/*
+findZone returns the most specific zone of the Catalog enclosing the
+queried name, so a zone configured for sub.example.com. is preferred
+over example.com. for names below it.
+*/
 func findZone(question *QueryQuestion) (*Zone, error) {
 	if Catalog.IsEmpty() {
 		return nil, fmt.Errorf("failed to load zones")
 	}
 
-	// TODO: fix the searching of available zones
-	z, err := Catalog.Search(question.QName)
+	_, z, err := Catalog.LongestMatch(question.QName)
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		return nil, fmt.Errorf("no zone found for %s", question.QName)
 	}
-	zone := z[0]
-
-	return zone.(*Zone), nil
+	return z[0], nil
 }
@@ -0,0 +1,505 @@
+package zonefiles
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parses the lines as the zone file of the origin
+func parseTestZone(t *testing.T, origin string, lines ...string) *Zone {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zone")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zone, err := ParseZonefile(origin, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+// returns the records of the type the zone has at the name
+func recordsAt(t *testing.T, zone *Zone, name string, rType RType) []ResourceRecord {
+	t.Helper()
+	records, _ := zone.lookup(name)
+	return recordsOfType(records, rType)
+}
+
+func TestParseTxt(t *testing.T) {
+	long := strings.Repeat("k", 300)
+	tests := []struct {
+		line    string
+		strings []string
+	}{
+		{`spf IN TXT "v=spf1 include:_spf.example.com -all"`, []string{"v=spf1 include:_spf.example.com -all"}},
+		{`quotes IN TXT "say \"hi\" \\ bye"`, []string{`say "hi" \ bye`}},
+		{`multi IN TXT "first string" second "" "third"`, []string{"first string", "second", "", "third"}},
+		{`decimal IN TXT "\065\066;C"`, []string{"AB;C"}},
+		{`comment IN TXT "a;b" ; not part of the record`, []string{"a;b"}},
+		{`lower in txt "case"`, []string{"case"}},
+		{`txt IN TXT "owner spelled like the type"`, []string{"owner spelled like the type"}},
+		{`long IN TXT "` + long + `"`, []string{long}},
+		{`split IN TXT ( "one"
+		"two" )`, []string{"one", "two"}},
+	}
+	for _, test := range tests {
+		zone := parseTestZone(t, "example.com.",
+			"$TTL=300",
+			"@ IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60",
+			test.line)
+		owner := strings.Fields(test.line)[0] + ".example.com."
+		records := recordsAt(t, zone, owner, TXT)
+		if len(records) != 1 {
+			t.Errorf("%s: got %d TXT records, want 1", test.line, len(records))
+			continue
+		}
+		txt := records[0].(*TxtRecord)
+		if strings.Join(txt.Strings, "|") != strings.Join(test.strings, "|") || len(txt.Strings) != len(test.strings) {
+			t.Errorf("%s: got strings %q, want %q", test.line, txt.Strings, test.strings)
+		}
+		if txt.GetName() != owner {
+			t.Errorf("%s: got owner %s, want %s", test.line, txt.GetName(), owner)
+		}
+	}
+}
+
+func TestParseTxtErrors(t *testing.T) {
+	for _, line := range []string{
+		`open IN TXT "unterminated`,
+		`empty IN TXT`,
+		`escape IN TXT "\25"`,
+		`octet IN TXT "\256"`,
+	} {
+		path := filepath.Join(t.TempDir(), "zone")
+		data := "@ IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60\n" + line + "\n"
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseZonefile("example.com.", path); err == nil {
+			t.Errorf("%s: parsed without error", line)
+		}
+	}
+}
+
+func TestParseSoaTtlAndClass(t *testing.T) {
+	tests := []struct {
+		line  string
+		ttl   uint
+		class RClass
+	}{
+		{"@ SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60", 300, IN},
+		{"@ IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60", 300, IN},
+		{"@ 3600 SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60", 3600, IN},
+		{"@ 3600 IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60", 3600, IN},
+		{"example.com. CS 86400 soa ns1.example.com. admin.example.com. 1 7200 3600 1209600 60", 86400, CS},
+	}
+	for _, test := range tests {
+		zone := parseTestZone(t, "example.com.", "$TTL=300", test.line)
+		records := recordsAt(t, zone, "example.com.", SOA)
+		if len(records) != 1 {
+			t.Errorf("%s: got %d SOA records, want 1", test.line, len(records))
+			continue
+		}
+		if ttl := records[0].GetTtl(); ttl != test.ttl || zone.TTL != int(test.ttl) {
+			t.Errorf("%s: got TTL %d and zone TTL %d, want %d", test.line, ttl, zone.TTL, test.ttl)
+		}
+		if class := records[0].GetRClass(); class != test.class {
+			t.Errorf("%s: got class %d, want %d", test.line, class, test.class)
+		}
+	}
+
+	for _, line := range []string{
+		"@ IN IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60",
+		"@ 60 60 SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60",
+		"@ XX SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60",
+	} {
+		path := filepath.Join(t.TempDir(), "zone")
+		if err := os.WriteFile(path, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseZonefile("example.com.", path); err == nil {
+			t.Errorf("%s: parsed without error", line)
+		}
+	}
+}
+
+func TestTxtCharacterStrings(t *testing.T) {
+	txt := &TxtRecord{Strings: []string{strings.Repeat("a", 600), "", "short", strings.Repeat("b", 255)}}
+	var lengths []int
+	for _, str := range txt.GetCharacterStrings() {
+		lengths = append(lengths, len(str))
+	}
+	want := []int{255, 255, 90, 0, 5, 255}
+	if len(lengths) != len(want) {
+		t.Fatalf("got chunks of %v octets, want %v", lengths, want)
+	}
+	for i := range want {
+		if lengths[i] != want[i] {
+			t.Fatalf("got chunks of %v octets, want %v", lengths, want)
+		}
+	}
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	type fixture struct {
+		origin string
+		lines  []string
+	}
+	lowMinimum := fixture{"example.com.", []string{
+		"$TTL=3600",
+		"@ IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60",
+		"@ IN NS ns1.example.com.",
+		"ns1 IN A 192.0.2.1",
+		"www IN A 192.0.2.2",
+		"a.b.deep IN A 192.0.2.3",
+	}}
+	highMinimum := fixture{"example.org.", []string{
+		"$TTL=30",
+		"@ IN SOA ns1.example.org. admin.example.org. 1 7200 3600 1209600 300",
+		"@ IN NS ns1.example.org.",
+		"www IN A 192.0.2.4",
+	}}
+	tests := []struct {
+		name    string
+		zone    fixture
+		qname   string
+		qtype   int
+		rcode   int
+		answers int
+		soaTtl  uint
+	}{
+		{"positive answer", lowMinimum, "www.example.com.", 1, NoError, 1, 0},
+		{"nodata", lowMinimum, "www.example.com.", 28, NoError, 0, 60},
+		{"nodata at the apex", lowMinimum, "example.com.", 15, NoError, 0, 60},
+		{"nodata at an empty non-terminal", lowMinimum, "b.deep.example.com.", 1, NoError, 0, 60},
+		{"nxdomain", lowMinimum, "missing.example.com.", 1, NameError, 0, 60},
+		{"nxdomain below an existing name", lowMinimum, "x.www.example.com.", 1, NameError, 0, 60},
+		{"nxdomain of any type", lowMinimum, "missing.example.com.", 255, NameError, 0, 60},
+		{"soa ttl below the minimum", highMinimum, "missing.example.org.", 1, NameError, 0, 30},
+		{"nodata with soa ttl below the minimum", highMinimum, "www.example.org.", 16, NoError, 0, 30},
+	}
+	for _, test := range tests {
+		origin := test.zone.origin
+		zone := parseTestZone(t, origin, test.zone.lines...)
+		result, err := zone.findResourceRecord(&QueryQuestion{QName: test.qname, Qtype: test.qtype, Qclass: 1})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if result.RCode != test.rcode || len(result.Answers) != test.answers || !result.Authoritative {
+			t.Errorf("%s: got rcode %d with %d answers and AA %v, want rcode %d with %d answers and AA",
+				test.name, result.RCode, len(result.Answers), result.Authoritative, test.rcode, test.answers)
+		}
+		if test.answers > 0 {
+			if len(result.Authority) != 0 {
+				t.Errorf("%s: positive answer has %d authority records", test.name, len(result.Authority))
+			}
+			continue
+		}
+		if len(result.Authority) != 1 || (*result.Authority[0]).GetRType() != SOA {
+			t.Errorf("%s: got %d authority records, want the SOA alone", test.name, len(result.Authority))
+			continue
+		}
+		soa := *result.Authority[0]
+		if soa.GetName() != origin || soa.GetTtl() != test.soaTtl {
+			t.Errorf("%s: got SOA of %s with TTL %d, want %s with TTL %d", test.name, soa.GetName(), soa.GetTtl(), origin, test.soaTtl)
+		}
+	}
+}
+
+// adds the zones to the Catalog for the duration of the test
+func useCatalog(t *testing.T, zones ...*Zone) {
+	t.Helper()
+	for _, zone := range zones {
+		if err := Catalog.Put(zone.Origin, zone); err != nil {
+			t.Fatal(err)
+		}
+		origin := zone.Origin
+		t.Cleanup(func() { Catalog.Delete(origin) })
+	}
+}
+
+// returns the owner names and types of the records as "name TYPE" strings
+func namesAndTypes(records []*ResourceRecord) []string {
+	var names []string
+	for _, rr := range records {
+		names = append(names, (*rr).GetName()+" "+(*rr).GetRType().String())
+	}
+	return names
+}
+
+func TestCnameChains(t *testing.T) {
+	lines := []string{
+		"$TTL=300",
+		"@ IN SOA ns1.chain.test. admin.chain.test. 1 7200 3600 1209600 60",
+		"@ IN NS ns1.chain.test.",
+		"ns1 IN A 192.0.2.1",
+		"www IN A 192.0.2.2",
+		"one IN CNAME two.chain.test.",
+		"two IN CNAME www.chain.test.",
+		"dangling IN CNAME missing.chain.test.",
+		"away IN CNAME www.other.test.",
+		"away-missing IN CNAME missing.other.test.",
+		"outside IN CNAME www.outside.org.",
+		"loop1 IN CNAME loop2.chain.test.",
+		"loop2 IN CNAME loop1.chain.test.",
+	}
+	// c0 -> c1 -> ... -> c11 -> www, longer than maxCnameChain
+	for i := 0; i < 12; i++ {
+		lines = append(lines, fmt.Sprintf("c%d IN CNAME c%d.chain.test.", i, i+1))
+	}
+	lines = append(lines, "c12 IN CNAME www.chain.test.")
+	chain := parseTestZone(t, "chain.test.", lines...)
+	other := parseTestZone(t, "other.test.",
+		"$TTL=300",
+		"@ IN SOA ns1.other.test. admin.other.test. 1 7200 3600 1209600 60",
+		"@ IN NS ns1.other.test.",
+		"www IN A 192.0.2.3")
+	useCatalog(t, chain, other)
+
+	var longChain []string
+	for i := 0; i <= maxCnameChain; i++ {
+		longChain = append(longChain, fmt.Sprintf("c%d.chain.test. CNAME", i))
+	}
+	tests := []struct {
+		name      string
+		qname     string
+		rcode     int
+		answers   []string
+		authority []string
+	}{
+		{"in-zone chain", "one.chain.test.", NoError,
+			[]string{"one.chain.test. CNAME", "two.chain.test. CNAME", "www.chain.test. A"}, nil},
+		{"in-zone chain to a missing name", "dangling.chain.test.", NameError,
+			[]string{"dangling.chain.test. CNAME"}, []string{"chain.test. SOA"}},
+		{"chain into another zone", "away.chain.test.", NoError,
+			[]string{"away.chain.test. CNAME", "www.other.test. A"}, nil},
+		{"chain to a missing name of another zone", "away-missing.chain.test.", NameError,
+			[]string{"away-missing.chain.test. CNAME"}, []string{"other.test. SOA"}},
+		{"chain out of our zones", "outside.chain.test.", NoError,
+			[]string{"outside.chain.test. CNAME"}, nil},
+		{"loop", "loop1.chain.test.", NoError,
+			[]string{"loop1.chain.test. CNAME", "loop2.chain.test. CNAME"}, nil},
+		{"chain longer than the limit", "c0.chain.test.", NoError, longChain, nil},
+	}
+	for _, test := range tests {
+		result, err := SearchResourceRecord(&QueryQuestion{QName: test.qname, Qtype: int(A), Qclass: 1})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if result.RCode != test.rcode {
+			t.Errorf("%s: got rcode %d, want %d", test.name, result.RCode, test.rcode)
+		}
+		if got := namesAndTypes(result.Answers); strings.Join(got, ", ") != strings.Join(test.answers, ", ") {
+			t.Errorf("%s: got answers %v, want %v", test.name, got, test.answers)
+		}
+		if got := namesAndTypes(result.Authority); strings.Join(got, ", ") != strings.Join(test.authority, ", ") {
+			t.Errorf("%s: got authority %v, want %v", test.name, got, test.authority)
+		}
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	zone := parseTestZone(t, "wild.test.",
+		"$TTL=300",
+		"@ IN SOA ns1.wild.test. admin.wild.test. 1 7200 3600 1209600 60",
+		"@ IN NS ns1.wild.test.",
+		"ns1 IN A 192.0.2.1",
+		"www IN A 192.0.2.2",
+		"*.any IN A 192.0.2.10",
+		"*.any IN TXT \"synthesized\"",
+		"host.any IN A 192.0.2.11",
+		"leaf.ent.any IN A 192.0.2.12",
+		"*.alias IN CNAME www.wild.test.")
+	useCatalog(t, zone)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     RType
+		rcode     int
+		answers   []string
+		authority []string
+	}{
+		{"synthesized answer", "foo.any.wild.test.", A, NoError,
+			[]string{"foo.any.wild.test. A"}, nil},
+		{"synthesized answer below the closest encloser", "a.b.any.wild.test.", TXT, NoError,
+			[]string{"a.b.any.wild.test. TXT"}, nil},
+		{"wildcard nodata", "foo.any.wild.test.", Aaaa, NoError,
+			nil, []string{"wild.test. SOA"}},
+		{"existing name shadows the wildcard", "host.any.wild.test.", TXT, NoError,
+			nil, []string{"wild.test. SOA"}},
+		{"empty non-terminal shadows the wildcard", "ent.any.wild.test.", A, NoError,
+			nil, []string{"wild.test. SOA"}},
+		{"empty non-terminal blocks the wildcard", "foo.ent.any.wild.test.", A, NameError,
+			nil, []string{"wild.test. SOA"}},
+		{"wildcard cname", "foo.alias.wild.test.", A, NoError,
+			[]string{"foo.alias.wild.test. CNAME", "www.wild.test. A"}, nil},
+		{"no wildcard", "foo.wild.test.", A, NameError,
+			nil, []string{"wild.test. SOA"}},
+	}
+	for _, test := range tests {
+		result, err := SearchResourceRecord(&QueryQuestion{QName: test.qname, Qtype: int(test.qtype), Qclass: 1})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if result.RCode != test.rcode {
+			t.Errorf("%s: got rcode %d, want %d", test.name, result.RCode, test.rcode)
+		}
+		if got := namesAndTypes(result.Answers); strings.Join(got, ", ") != strings.Join(test.answers, ", ") {
+			t.Errorf("%s: got answers %v, want %v", test.name, got, test.answers)
+		}
+		if got := namesAndTypes(result.Authority); strings.Join(got, ", ") != strings.Join(test.authority, ", ") {
+			t.Errorf("%s: got authority %v, want %v", test.name, got, test.authority)
+		}
+	}
+
+	// the source of synthesis isn't changed by the answers built from it
+	if records := recordsAt(t, zone, "*.any.wild.test.", A); len(records) != 1 || records[0].GetName() != "*.any.wild.test." {
+		t.Errorf("got wildcard records %v, want the A record of *.any.wild.test.", records)
+	}
+}
+
+func TestTargetAddresses(t *testing.T) {
+	add := parseTestZone(t, "add.test.",
+		"$TTL=300",
+		"@ IN SOA ns1.add.test. admin.add.test. 1 7200 3600 1209600 60",
+		"@ IN NS ns1.add.test.",
+		"@ IN NS ns.outside.org.",
+		"@ IN MX 10 mail.add.test.",
+		"@ IN MX 20 mx.example.com.",
+		"@ IN MX 30 mx.outside.org.",
+		"_sip._tcp IN SRV 10 5 5060 sip.add.test.",
+		"_svc IN SVCB 1 web.add.test. alpn=h2",
+		"alias IN SVCB 0 web.example.com.",
+		"ns1 IN A 198.51.100.1",
+		"mail IN A 198.51.100.2",
+		"mail IN AAAA 2001:db8::2",
+		"mail IN TXT \"not an address\"",
+		"sip IN AAAA 2001:db8::5",
+		"web IN A 198.51.100.3")
+	example := parseTestZone(t, "example.com.",
+		"$TTL=300",
+		"@ IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60",
+		"@ IN NS ns1.example.com.",
+		"mx IN A 192.0.2.25",
+		"web IN AAAA 2001:db8::80")
+	useCatalog(t, add, example)
+
+	tests := []struct {
+		qname      string
+		qtype      int
+		additional []string
+	}{
+		{"add.test.", 2, []string{"ns1.add.test. A"}},
+		{"add.test.", 15, []string{"mail.add.test. A", "mail.add.test. AAAA", "mx.example.com. A"}},
+		{"_sip._tcp.add.test.", 33, []string{"sip.add.test. AAAA"}},
+		{"_svc.add.test.", 64, []string{"web.add.test. A"}},
+		{"alias.add.test.", 64, []string{"web.example.com. AAAA"}},
+		{"mail.add.test.", 1, nil},
+	}
+	for _, test := range tests {
+		result, err := SearchResourceRecord(&QueryQuestion{QName: test.qname, Qtype: test.qtype, Qclass: 1})
+		if err != nil {
+			t.Errorf("%s %d: %v", test.qname, test.qtype, err)
+			continue
+		}
+		got := namesAndTypes(result.Additional)
+		if strings.Join(got, ", ") != strings.Join(test.additional, ", ") || result.Arcount != uint(len(got)) {
+			t.Errorf("%s %d: got additional %v (count %d), want %v", test.qname, test.qtype, got, result.Arcount, test.additional)
+		}
+	}
+}
+
+func TestFindZoneNested(t *testing.T) {
+	parent := parseTestZone(t, "example.com.",
+		"$TTL=300",
+		"@ IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 60",
+		"@ IN NS ns1.example.com.",
+		"ns1 IN A 192.0.2.1",
+		"www IN A 192.0.2.2",
+		"sub IN NS ns1.sub.example.com.",
+		"ns1.sub IN A 192.0.2.53",
+		"xsub IN A 192.0.2.3")
+	child := parseTestZone(t, "sub.example.com.",
+		"$TTL=300",
+		"@ IN SOA ns1.sub.example.com. admin.example.com. 7 7200 3600 1209600 60",
+		"@ IN NS ns1.sub.example.com.",
+		"ns1 IN A 192.0.2.53",
+		"www IN A 192.0.2.80")
+	useCatalog(t, parent, child)
+
+	tests := []struct {
+		qname string
+		zone  *Zone
+	}{
+		{"example.com.", parent},
+		{"www.example.com.", parent},
+		{"missing.example.com.", parent},
+		{"xsub.example.com.", parent},
+		{"sub.example.com.", child},
+		{"SUB.Example.COM.", child},
+		{"www.sub.example.com.", child},
+		{"a.b.c.sub.example.com.", child},
+	}
+	for _, test := range tests {
+		zone, err := findZone(&QueryQuestion{QName: test.qname})
+		if err != nil {
+			t.Errorf("%s: %v", test.qname, err)
+		} else if zone != test.zone {
+			t.Errorf("%s: got zone %s, want %s", test.qname, zone.Origin, test.zone.Origin)
+		}
+	}
+	for _, qname := range []string{"com.", "example.org.", "ample.com.", "."} {
+		if zone, err := findZone(&QueryQuestion{QName: qname}); err == nil {
+			t.Errorf("%s: got zone %s, want none", qname, zone.Origin)
+		}
+	}
+
+	answers := []struct {
+		qname  string
+		qtype  int
+		rcode  int
+		answer string
+	}{
+		// the child apex is answered by the child, not referred by the parent
+		{"sub.example.com.", 6, NoError, "sub.example.com. SOA"},
+		{"www.sub.example.com.", 1, NoError, "www.sub.example.com. A"},
+		{"missing.sub.example.com.", 1, NameError, ""},
+		// names just above the cut stay in the parent
+		{"xsub.example.com.", 1, NoError, "xsub.example.com. A"},
+		{"example.com.", 6, NoError, "example.com. SOA"},
+	}
+	for _, test := range answers {
+		result, err := SearchResourceRecord(&QueryQuestion{QName: test.qname, Qtype: test.qtype, Qclass: 1})
+		if err != nil {
+			t.Errorf("%s %d: %v", test.qname, test.qtype, err)
+			continue
+		}
+		got := strings.Join(namesAndTypes(result.Answers), ", ")
+		if result.RCode != test.rcode || got != test.answer || !result.Authoritative {
+			t.Errorf("%s %d: got rcode %d, answers %q and AA %v, want rcode %d, answers %q and AA",
+				test.qname, test.qtype, result.RCode, got, result.Authoritative, test.rcode, test.answer)
+		}
+		if test.rcode == NameError && (len(result.Authority) == 0 || (*result.Authority[0]).GetName() != "sub.example.com.") {
+			t.Errorf("%s %d: negative answer doesn't carry the SOA of the child", test.qname, test.qtype)
+		}
+	}
+
+	// without the child zone, the parent refers to it
+	Catalog.Delete(child.Origin)
+	result, err := SearchResourceRecord(&QueryQuestion{QName: "www.sub.example.com.", Qtype: 1, Qclass: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Authoritative || len(result.Answers) != 0 || strings.Join(namesAndTypes(result.Authority), ", ") != "sub.example.com. NS" {
+		t.Errorf("got AA %v, answers %v and authority %v, want a referral to sub.example.com.",
+			result.Authoritative, namesAndTypes(result.Answers), namesAndTypes(result.Authority))
+	}
+}